@@ -0,0 +1,176 @@
+// Adaptive connection limit per server instead of a fixed "--maxconns" for all servers: The limit
+// follows AIMD (additive increase, multiplicative decrease) based on the latency of the server
+// relative to its latency without load and on overload signals like 503 responses, so that fast and
+// slow servers of a heterogeneous cluster each get the concurrency that they can handle.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdaptiveConnsInitial is the initial connection limit of each server (at most "--maxconns")
+const AdaptiveConnsInitial = 10
+
+// AdaptiveConnsLatencyTolerance is the factor over the latency without load from which a response
+// counts as sign of overload
+const AdaptiveConnsLatencyTolerance = 2.0
+
+// AdaptiveConnsBackoff is the factor by which the limit gets lowered on overload
+const AdaptiveConnsBackoff = 0.9
+
+// AdaptiveConnsLatencyWindow is the duration of the windows for the min latency. The latency without
+// load is the min of the current and the previous window, so that it follows lasting changes of the
+// server, e.g. after a hardware upgrade.
+const AdaptiveConnsLatencyWindow = 30 * time.Second
+
+// AdaptiveConnLimit adjusts the limit of the connection limiter of a server. The latency of a
+// response is the time from the request being fully sent until the response headers were received,
+// so that the transfer of large bodies doesn't count as slowness of the server.
+type AdaptiveConnLimit struct {
+	mutex            sync.Mutex
+	limiter          *PriorityLimiter
+	serverStr        string
+	limit            float64       // fractional, so that the additive increase is spread over responses
+	maxLimit         float64       // "--maxconns"
+	minLatency       time.Duration // min of the previous window; 0 if no sample
+	windowMinLatency time.Duration // min of the current window; 0 if no sample
+	windowStart      time.Time
+	lastDecrease     time.Time
+}
+
+func NewAdaptiveConnLimit(limiter *PriorityLimiter, serverStr string, maxLimit int) *AdaptiveConnLimit {
+	return &AdaptiveConnLimit{
+		limiter:     limiter,
+		serverStr:   serverStr,
+		limit:       float64(limiter.Limit()),
+		maxLimit:    float64(maxLimit),
+		windowStart: time.Now(),
+	}
+}
+
+// noLoadLatencyUnlocked returns the estimated latency of the server without load, which is the min
+// latency of the current and the previous window; caller must hold the mutex
+func (adaptiveLimit *AdaptiveConnLimit) noLoadLatencyUnlocked() time.Duration {
+	if adaptiveLimit.minLatency == 0 ||
+		(adaptiveLimit.windowMinLatency != 0 && adaptiveLimit.windowMinLatency < adaptiveLimit.minLatency) {
+		return adaptiveLimit.windowMinLatency
+	}
+
+	return adaptiveLimit.minLatency
+}
+
+// observe adjusts the limit after a request that was sent to the server at forwardTime. latency is
+// the time until the response headers were received. isOverload is true for failed requests and
+// responses through which the server signals overload.
+func (adaptiveLimit *AdaptiveConnLimit) observe(now time.Time, forwardTime time.Time,
+	latency time.Duration, isOverload bool) {
+	adaptiveLimit.mutex.Lock()
+	defer adaptiveLimit.mutex.Unlock()
+
+	if now.Sub(adaptiveLimit.windowStart) >= AdaptiveConnsLatencyWindow {
+		adaptiveLimit.minLatency = adaptiveLimit.windowMinLatency
+		adaptiveLimit.windowMinLatency = 0
+		adaptiveLimit.windowStart = now
+	}
+
+	if !isOverload && (adaptiveLimit.windowMinLatency == 0 || latency < adaptiveLimit.windowMinLatency) {
+		adaptiveLimit.windowMinLatency = latency
+	}
+
+	var noLoadLatency = adaptiveLimit.noLoadLatencyUnlocked()
+
+	if isOverload || float64(latency) > float64(noLoadLatency)*AdaptiveConnsLatencyTolerance {
+		// requests that were sent before the last decrease don't reflect the lowered limit yet, so
+		// that a burst of slow responses only lowers the limit once
+		if !forwardTime.After(adaptiveLimit.lastDecrease) {
+			return
+		}
+
+		adaptiveLimit.lastDecrease = now
+		adaptiveLimit.limit *= AdaptiveConnsBackoff
+
+		if adaptiveLimit.limit < 1 {
+			adaptiveLimit.limit = 1
+		}
+	} else {
+		// a limit that is not used can't be confirmed by the latency
+		if numActive, _ := adaptiveLimit.limiter.Usage(); float64(2*numActive) < adaptiveLimit.limit {
+			return
+		}
+
+		// +1 per "limit" responses, i.e. about +1 per round trip with all slots in use
+		adaptiveLimit.limit += 1 / adaptiveLimit.limit
+
+		if adaptiveLimit.limit > adaptiveLimit.maxLimit {
+			adaptiveLimit.limit = adaptiveLimit.maxLimit
+		}
+	}
+
+	if newLimit := int(adaptiveLimit.limit); newLimit != adaptiveLimit.limiter.Limit() {
+		adaptiveLimit.limiter.SetLimit(newLimit)
+
+		if config.beVerbose {
+			fmt.Printf("Adaptive connection limit changed. Server: %s; Limit: %d; Latency: %v; "+
+				"No-load latency: %v; Overload: %v\n", adaptiveLimit.serverStr, newLimit, latency,
+				noLoadLatency, isOverload)
+		}
+	}
+}
+
+// adaptiveConnsSample are the times of a request toward a server for the latency of the response
+type adaptiveConnsSample struct {
+	wroteRequestTime int64     // atomic; unix time in ns when the request was fully sent; 0 before
+	forwardTime      time.Time // when the request got forwarded after waiting for a connection slot
+}
+
+type adaptiveConnsSampleKey struct{}
+
+// WithAdaptiveConnsSample returns the request with a context that records the times for the
+// adaptive connection limit of the server
+func WithAdaptiveConnsSample(r *http.Request) *http.Request {
+	var sample = &adaptiveConnsSample{forwardTime: time.Now()}
+
+	ctx := httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			atomic.StoreInt64(&sample.wroteRequestTime, time.Now().UnixNano())
+		},
+	})
+
+	return r.WithContext(context.WithValue(ctx, adaptiveConnsSampleKey{}, sample))
+}
+
+// ObserveAdaptiveConns adjusts the adaptive connection limit of the server after the response
+// headers of a request from WithAdaptiveConnsSample() were received or the request failed
+func (backend *Backend) ObserveAdaptiveConns(ctx context.Context, isOverload bool) {
+	if backend.adaptiveConns == nil {
+		return
+	}
+
+	sample, hasSample := ctx.Value(adaptiveConnsSampleKey{}).(*adaptiveConnsSample)
+	if !hasSample {
+		return
+	}
+
+	var now = time.Now()
+	var latencyStart = sample.forwardTime
+
+	// the server may reply before the request body was sent completely
+	if wroteRequestTime := atomic.LoadInt64(&sample.wroteRequestTime); wroteRequestTime != 0 {
+		latencyStart = time.Unix(0, wroteRequestTime)
+	}
+
+	backend.adaptiveConns.observe(now, sample.forwardTime, now.Sub(latencyStart), isOverload)
+}
+
+// IsOverloadStatus returns true if the response status of a server signals overload, e.g. "503 Slow
+// Down" of S3
+func IsOverloadStatus(statusCode int) bool {
+	return statusCode == http.StatusServiceUnavailable || statusCode == http.StatusTooManyRequests
+}
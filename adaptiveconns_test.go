@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestAdaptiveLimit returns an adaptive limit with the given initial and max limit, whose slots
+// are all in use
+func newTestAdaptiveLimit(t *testing.T, initialLimit int, maxLimit int) *AdaptiveConnLimit {
+	limiter := NewPriorityLimiter(initialLimit)
+
+	for i := 0; i < initialLimit; i++ {
+		if err := limiter.Acquire(context.Background(), PriorityNormal); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return NewAdaptiveConnLimit(limiter, "test", maxLimit)
+}
+
+func TestAdaptiveConnLimitIncrease(t *testing.T) {
+	adaptiveLimit := newTestAdaptiveLimit(t, 10, 12)
+	now := time.Now()
+
+	// +1/10, +1/10.1, ...
+	for i := 0; i < 11; i++ {
+		adaptiveLimit.observe(now, now, 10*time.Millisecond, false)
+	}
+
+	if got := adaptiveLimit.limiter.Limit(); got != 11 {
+		t.Errorf("limit after 11 responses = %d; want 11", got)
+	}
+
+	for i := 0; i < 100; i++ {
+		adaptiveLimit.observe(now, now, 10*time.Millisecond, false)
+	}
+
+	if got := adaptiveLimit.limiter.Limit(); got != 12 {
+		t.Errorf("limit after 111 responses = %d; want max 12", got)
+	}
+}
+
+func TestAdaptiveConnLimitUnusedNoIncrease(t *testing.T) {
+	adaptiveLimit := NewAdaptiveConnLimit(NewPriorityLimiter(10), "test", 100)
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		adaptiveLimit.observe(now, now, 10*time.Millisecond, false)
+	}
+
+	if got := adaptiveLimit.limiter.Limit(); got != 10 {
+		t.Errorf("limit without active requests = %d; want unchanged 10", got)
+	}
+}
+
+func TestAdaptiveConnLimitDecrease(t *testing.T) {
+	adaptiveLimit := newTestAdaptiveLimit(t, 10, 100)
+	start := time.Now()
+
+	adaptiveLimit.observe(start, start, 10*time.Millisecond, false) // no-load latency
+
+	// slow response, then a slow response of a request that was sent before the decrease
+	adaptiveLimit.observe(start.Add(time.Second), start.Add(time.Millisecond), 50*time.Millisecond, false)
+	adaptiveLimit.observe(start.Add(2*time.Second), start.Add(time.Millisecond), 50*time.Millisecond, false)
+
+	if got := adaptiveLimit.limiter.Limit(); got != 9 {
+		t.Errorf("limit after slow responses = %d; want 9", got)
+	}
+
+	// failed requests sent after the last decrease, down to the min limit
+	for i := 3; i < 100; i++ {
+		forwardTime := start.Add(time.Duration(i) * time.Second)
+		adaptiveLimit.observe(forwardTime.Add(time.Millisecond), forwardTime, time.Millisecond, true)
+	}
+
+	if got := adaptiveLimit.limiter.Limit(); got != 1 {
+		t.Errorf("limit after failed requests = %d; want min 1", got)
+	}
+}
+
+func TestAdaptiveConnLimitLatencyWindow(t *testing.T) {
+	adaptiveLimit := newTestAdaptiveLimit(t, 10, 100)
+	start := time.Now()
+
+	adaptiveLimit.observe(start, start, 10*time.Millisecond, false)
+
+	// the server got permanently slower, so the old min latency expires after two windows
+	for i := 1; i <= 3; i++ {
+		now := start.Add(time.Duration(i) * AdaptiveConnsLatencyWindow)
+		adaptiveLimit.observe(now, start, 30*time.Millisecond, true)
+	}
+
+	adaptiveLimit.mutex.Lock()
+	noLoadLatency := adaptiveLimit.noLoadLatencyUnlocked()
+	adaptiveLimit.mutex.Unlock()
+
+	if noLoadLatency != 0 {
+		t.Errorf("no-load latency of failed requests only = %v; want 0", noLoadLatency)
+	}
+
+	now := start.Add(4 * AdaptiveConnsLatencyWindow)
+	adaptiveLimit.observe(now, now, 30*time.Millisecond, false)
+
+	adaptiveLimit.mutex.Lock()
+	noLoadLatency = adaptiveLimit.noLoadLatencyUnlocked()
+	adaptiveLimit.mutex.Unlock()
+
+	if noLoadLatency != 30*time.Millisecond {
+		t.Errorf("no-load latency = %v; want 30ms", noLoadLatency)
+	}
+}
+
+func TestPriorityLimiterSetLimit(t *testing.T) {
+	limiter := NewPriorityLimiter(1)
+
+	if err := limiter.Acquire(context.Background(), PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	acquiredChan := make(chan struct{}, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			if err := limiter.Acquire(context.Background(), PriorityNormal); err == nil {
+				acquiredChan <- struct{}{}
+			}
+		}()
+	}
+
+	for limiter.NumWaiting() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	limiter.SetLimit(2) // hands a slot to a waiter
+
+	<-acquiredChan
+
+	limiter.SetLimit(1)
+	limiter.Release() // above the lowered limit, so no handover
+
+	if numActive, _ := limiter.Usage(); numActive != 1 || limiter.NumWaiting() != 1 {
+		t.Errorf("after release above limit: active = %d, waiting = %d; want 1, 1", numActive,
+			limiter.NumWaiting())
+	}
+
+	limiter.Release() // at the limit, so handover
+
+	<-acquiredChan
+
+	if numActive, _ := limiter.Usage(); numActive != 1 || limiter.NumWaiting() != 0 {
+		t.Errorf("after release at limit: active = %d, waiting = %d; want 1, 0", numActive,
+			limiter.NumWaiting())
+	}
+}
@@ -0,0 +1,96 @@
+// Read-your-writes affinity: after a write of a key, reads of the same key get pinned to the server
+// that handled the write for "--affinity", to avoid stale reads from eventually consistent replicas
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Keys for "--affinitykey"
+const (
+	AffinityKeyPath   = "path"   // reads of the written path
+	AffinityKeyClient = "client" // all reads of the client IP that wrote
+)
+
+type affinityEntry struct {
+	backendIdx uint32
+	expiry     time.Time
+}
+
+var affinityState = struct {
+	mutex   sync.Mutex
+	entries map[string]affinityEntry // key is path or client IP
+}{entries: make(map[string]affinityEntry)}
+
+// isWriteMethod returns true for methods that modify the requested resource
+func isWriteMethod(method string) bool {
+	return method == http.MethodPut || method == http.MethodPost || method == http.MethodPatch ||
+		method == http.MethodDelete
+}
+
+// affinityKey returns the key of the request for affinity according to config.affinityKey
+func affinityKey(r *http.Request) string {
+	if config.affinityKey == AffinityKeyClient {
+		return ClientIP(r)
+	}
+
+	return r.URL.Path
+}
+
+// affinityMiddleware pins reads to the server of a preceding write of the same key and records the
+// server of writes
+func affinityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var state = GetRequestState(r)
+		var key = affinityKey(r)
+
+		if isWriteMethod(r.Method) {
+			next.ServeHTTP(w, r)
+
+			// the window starts when the write completed on the server
+			affinityState.mutex.Lock()
+			affinityState.entries[key] = affinityEntry{
+				backendIdx: state.backendIdx,
+				expiry:     time.Now().Add(config.affinityWindow),
+			}
+			affinityState.mutex.Unlock()
+
+			return
+		}
+
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			affinityState.mutex.Lock()
+			entry, exists := affinityState.entries[key]
+			affinityState.mutex.Unlock()
+
+			// an ejected server would fail the read, so rather risk a stale read from another server
+			if exists && time.Now().Before(entry.expiry) &&
+				!proxyState.backends[entry.backendIdx].IsEjected() &&
+				!proxyState.backends[entry.backendIdx].IsRemoved() {
+				state.SetBackend(entry.backendIdx)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// PurgeAffinityEntries periodically removes expired affinity entries
+func PurgeAffinityEntries() {
+	for range time.Tick(config.affinityWindow) {
+		var now = time.Now()
+
+		affinityState.mutex.Lock()
+
+		for key, entry := range affinityState.entries {
+			if now.After(entry.expiry) {
+				delete(affinityState.entries, key)
+			}
+		}
+
+		affinityState.mutex.Unlock()
+	}
+}
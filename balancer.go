@@ -0,0 +1,350 @@
+// Pluggable strategies to balance requests among servers. Custom strategies get registered through
+// RegisterBalancerStrategy, typically from an init() function in a separate source file, and get
+// selected through "--balancer".
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BalancerServer is a candidate server of a balancer
+type BalancerServer struct {
+	BackendIdx uint32 // index in proxyState.backends
+	Weight     uint32 // 0 means that the server should only be picked if all others fail
+}
+
+// BalancerStrategy picks the server for requests among a set of servers, e.g. all servers or the
+// servers of a pool. Each set of servers has its own instance. Implementations must be safe for
+// concurrent use.
+type BalancerStrategy interface {
+	// Update sets the candidate servers with their current weights. It gets called before the first
+	// Pick and whenever weights change, e.g. through DNS updates or ejections. The slice is owned by
+	// the strategy after the call. It is empty if no server is available.
+	Update(servers []BalancerServer)
+
+	// Pick returns the index of the server for the request. Returns false if no server is available.
+	// In TLS passthrough mode, the request only has Host (the SNI hostname) and RemoteAddr.
+	Pick(r *http.Request) (backendIdx uint32, ok bool)
+
+	// Completed gets called when a request that was picked by this strategy is done with the server,
+	// i.e. the response was sent to the client or the request failed. duration is the time from
+	// forwarding the request to the server until then. Not called for requests that were routed to
+	// a different server after the pick (e.g. through sharding or a routing script) or that were
+	// answered by the proxy (e.g. from the cache).
+	Completed(backendIdx uint32, duration time.Duration)
+
+	// Failed gets called for a failed request that was picked by this strategy, before Completed
+	Failed(backendIdx uint32, class ErrorClass)
+}
+
+// DefaultBalancerName is the strategy of "--balancer" by default
+const DefaultBalancerName = "roundrobin"
+
+// balancerStrategies are the constructors of the registered strategies, mapped by name
+var balancerStrategies = map[string]func() BalancerStrategy{
+	DefaultBalancerName: func() BalancerStrategy { return &roundRobinBalancer{} },
+	"random":            func() BalancerStrategy { return &randomBalancer{} },
+	"leastconns":        func() BalancerStrategy { return &leastConnsBalancer{} },
+	"fastest":           func() BalancerStrategy { return &fastestBalancer{} },
+}
+
+// RegisterBalancerStrategy adds a strategy for "--balancer". Must be called before ParseArguments,
+// typically from an init() function.
+func RegisterBalancerStrategy(name string, newStrategy func() BalancerStrategy) {
+	balancerStrategies[name] = newStrategy
+}
+
+// BalancerNames returns the names of the registered strategies in alphabetical order
+func BalancerNames() []string {
+	var names []string
+
+	for name := range balancerStrategies {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// NewBalancerStrategy returns a new instance of the registered strategy with the given name
+func NewBalancerStrategy(name string) BalancerStrategy {
+	return balancerStrategies[name]()
+}
+
+// NotifyBalancerFailure notifies the balancer that picked the server of the request with the given
+// context about a failure of the request to this server. No-op if the request was sent to a different
+// server than the picked one, e.g. for quorum reads.
+func NotifyBalancerFailure(ctx context.Context, backend *Backend, class ErrorClass) {
+	state, isProxied := ctx.Value(requestStateKey{}).(*RequestState)
+
+	if isProxied && state.balancer != nil && state.backend == backend {
+		state.balancer.Failed(state.backendIdx, class)
+	}
+}
+
+// roundRobinBalancer is the smooth weighted round-robin strategy, which interleaves servers instead
+// of sending consecutive requests to the same server. The position is a 64-bit counter, which
+// doesn't wrap around in practice (at 10M requests/s it takes 58,000 years), so the round-robin
+// order has no jump like a modulo of a 32-bit counter with a slot count that is no power of 2. The
+// position continues across updates, so that frequent updates don't favor the first slots.
+type roundRobinBalancer struct {
+	position uint64       // atomic; first for alignment on 32-bit archs; number of picks
+	slots    atomic.Value // []uint32 of backend indices, each occurring in proportion to its weight
+}
+
+func (balancer *roundRobinBalancer) Update(servers []BalancerServer) {
+	balancer.slots.Store(computeScheduleSlots(servers))
+}
+
+func (balancer *roundRobinBalancer) Pick(r *http.Request) (uint32, bool) {
+	slots := balancer.slots.Load().([]uint32)
+	if len(slots) == 0 {
+		return 0, false
+	}
+
+	position := atomic.AddUint64(&balancer.position, 1) - 1
+
+	return slots[position%uint64(len(slots))], true
+}
+
+func (balancer *roundRobinBalancer) Completed(backendIdx uint32, duration time.Duration) {}
+
+func (balancer *roundRobinBalancer) Failed(backendIdx uint32, class ErrorClass) {}
+
+// computeScheduleSlots returns the slots of the smooth weighted round-robin schedule of the given
+// servers. Weights get scaled down if their sum exceeds MaxScheduleLen.
+func computeScheduleSlots(servers []BalancerServer) []uint32 {
+	var weights = make([]uint64, len(servers))
+	var totalWeight uint64
+
+	for i, server := range servers {
+		weights[i] = uint64(server.Weight)
+		totalWeight += weights[i]
+	}
+
+	if totalWeight > MaxScheduleLen {
+		var scaledTotalWeight uint64
+
+		for i := range weights {
+			if weights[i] == 0 {
+				continue
+			}
+
+			weights[i] = weights[i] * MaxScheduleLen / totalWeight
+			if weights[i] == 0 {
+				weights[i] = 1 // keep servers with small weight in the schedule
+			}
+
+			scaledTotalWeight += weights[i]
+		}
+
+		totalWeight = scaledTotalWeight
+	}
+
+	var slots = make([]uint32, 0, totalWeight)
+	var currentWeights = make([]int64, len(weights))
+
+	for uint64(len(slots)) < totalWeight {
+		var selectedIdx = -1
+
+		for i := range weights {
+			if weights[i] == 0 {
+				continue
+			}
+
+			currentWeights[i] += int64(weights[i])
+
+			if selectedIdx < 0 || currentWeights[i] > currentWeights[selectedIdx] {
+				selectedIdx = i
+			}
+		}
+
+		currentWeights[selectedIdx] -= int64(totalWeight)
+		slots = append(slots, servers[selectedIdx].BackendIdx)
+	}
+
+	return slots
+}
+
+// randomBalancer picks servers randomly with a probability in proportion to their weight
+type randomBalancer struct {
+	slots atomic.Value // []uint32; same as roundRobinBalancer
+}
+
+func (balancer *randomBalancer) Update(servers []BalancerServer) {
+	balancer.slots.Store(computeScheduleSlots(servers))
+}
+
+func (balancer *randomBalancer) Pick(r *http.Request) (uint32, bool) {
+	slots := balancer.slots.Load().([]uint32)
+	if len(slots) == 0 {
+		return 0, false
+	}
+
+	return slots[rand.Intn(len(slots))], true
+}
+
+func (balancer *randomBalancer) Completed(backendIdx uint32, duration time.Duration) {}
+
+func (balancer *randomBalancer) Failed(backendIdx uint32, class ErrorClass) {}
+
+// leastConnsBalancer picks the server with the fewest requests in flight relative to its weight.
+// Ties get broken round-robin, so that idle servers share the load.
+type leastConnsBalancer struct {
+	position uint64       // atomic; first for alignment on 32-bit archs
+	servers  atomic.Value // []BalancerServer with weight > 0
+}
+
+func (balancer *leastConnsBalancer) Update(servers []BalancerServer) {
+	balancer.servers.Store(weightedServers(servers))
+}
+
+func (balancer *leastConnsBalancer) Pick(r *http.Request) (uint32, bool) {
+	servers := balancer.servers.Load().([]BalancerServer)
+	if len(servers) == 0 {
+		return 0, false
+	}
+
+	var startIdx = int(atomic.AddUint64(&balancer.position, 1) % uint64(len(servers)))
+	var selected = servers[startIdx]
+	var selectedInFlight = atomic.LoadInt64(&proxyState.backends[selected.BackendIdx].numInFlight)
+
+	for i := 1; i < len(servers); i++ {
+		server := servers[(startIdx+i)%len(servers)]
+		inFlight := atomic.LoadInt64(&proxyState.backends[server.BackendIdx].numInFlight)
+
+		// inFlight / weight < selectedInFlight / selected.weight
+		if inFlight*int64(selected.Weight) < selectedInFlight*int64(server.Weight) {
+			selected, selectedInFlight = server, inFlight
+		}
+	}
+
+	return selected.BackendIdx, true
+}
+
+func (balancer *leastConnsBalancer) Completed(backendIdx uint32, duration time.Duration) {}
+
+func (balancer *leastConnsBalancer) Failed(backendIdx uint32, class ErrorClass) {}
+
+// weightedServers returns the servers with weight > 0
+func weightedServers(servers []BalancerServer) []BalancerServer {
+	var weighted = make([]BalancerServer, 0, len(servers))
+
+	for _, server := range servers {
+		if server.Weight != 0 {
+			weighted = append(weighted, server)
+		}
+	}
+
+	return weighted
+}
+
+// FastestLatencyDecay is the weight of the latest request in the moving average of response times
+// of the "fastest" strategy
+const FastestLatencyDecay = 0.1
+
+// FastestFailurePenalty is the response time that a failed request counts as for the "fastest"
+// strategy, so that failing servers get avoided
+const FastestFailurePenalty = 10 * time.Second
+
+// FastestMinLatency is added to the moving average of response times of the "fastest" strategy, so
+// that the requests in flight still count for servers with very low response times
+const FastestMinLatency = time.Millisecond
+
+// fastestBalancer picks the server with the lowest moving average of response times, multiplied by
+// the requests in flight to prefer idle servers. Servers without completed requests count as fast as
+// the fastest server, so that each server gets probed without getting flooded.
+type fastestBalancer struct {
+	mutex     sync.Mutex
+	servers   []BalancerServer   // weight > 0
+	latencies map[uint32]float64 // moving average in seconds by backend index
+	numPicks  uint64
+}
+
+func (balancer *fastestBalancer) Update(servers []BalancerServer) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+
+	balancer.servers = weightedServers(servers)
+
+	if balancer.latencies == nil {
+		balancer.latencies = make(map[uint32]float64)
+	}
+}
+
+func (balancer *fastestBalancer) Pick(r *http.Request) (uint32, bool) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+
+	if len(balancer.servers) == 0 {
+		return 0, false
+	}
+
+	balancer.numPicks++
+
+	var minLatency = -1.0
+
+	for _, server := range balancer.servers {
+		if latency, exists := balancer.latencies[server.BackendIdx]; exists &&
+			(minLatency < 0 || latency < minLatency) {
+			minLatency = latency
+		}
+	}
+
+	if minLatency < 0 {
+		minLatency = 0 // no server has completed requests yet
+	}
+
+	var selectedIdx = -1
+	var selectedCost float64
+	var startIdx = int(balancer.numPicks % uint64(len(balancer.servers)))
+
+	for i := range balancer.servers {
+		server := balancer.servers[(startIdx+i)%len(balancer.servers)]
+		inFlight := atomic.LoadInt64(&proxyState.backends[server.BackendIdx].numInFlight)
+
+		latency, exists := balancer.latencies[server.BackendIdx]
+		if !exists {
+			latency = minLatency
+		}
+
+		cost := (latency + FastestMinLatency.Seconds()) * float64(inFlight+1) / float64(server.Weight)
+
+		if selectedIdx < 0 || cost < selectedCost {
+			selectedIdx, selectedCost = (startIdx+i)%len(balancer.servers), cost
+		}
+	}
+
+	return balancer.servers[selectedIdx].BackendIdx, true
+}
+
+func (balancer *fastestBalancer) Completed(backendIdx uint32, duration time.Duration) {
+	balancer.observe(backendIdx, duration)
+}
+
+func (balancer *fastestBalancer) Failed(backendIdx uint32, class ErrorClass) {
+	if class != ErrorClassCanceled {
+		balancer.observe(backendIdx, FastestFailurePenalty)
+	}
+}
+
+func (balancer *fastestBalancer) observe(backendIdx uint32, duration time.Duration) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+
+	latency, exists := balancer.latencies[backendIdx]
+	if !exists {
+		balancer.latencies[backendIdx] = duration.Seconds()
+		return
+	}
+
+	balancer.latencies[backendIdx] = latency + FastestLatencyDecay*(duration.Seconds()-latency)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// benchSizes are the body size classes of the benchmarks, from small objects where the overhead
+// per request dominates to large objects where the copy throughput dominates
+var benchSizes = []int{0, 4 * 1024, 64 * 1024, 1024 * 1024, 16 * 1024 * 1024}
+
+// benchMode is a proxy configuration to compare against the default configuration
+type benchMode struct {
+	name     string
+	isDirect bool // requests go directly to the server to measure the overhead of the proxy
+	config   Config
+	noFlush  bool // responses get flushed when the buffer is full instead of after each write
+}
+
+var benchModes = []benchMode{
+	{name: "direct", isDirect: true},
+	{name: "default", config: Config{poolBufSize: 128 * 1024}},
+	{name: "nopool", config: Config{}},
+	{name: "noflush", config: Config{poolBufSize: 128 * 1024}, noFlush: true},
+	{name: "limits", config: Config{poolBufSize: 128 * 1024, numConnsPerServer: 4,
+		maxClientConns: 1024}},
+}
+
+// benchServer is a server that sends a response body of the size given as path ("/SIZE") and
+// discards request bodies
+func benchServer(b *testing.B) *httptest.Server {
+	var body = bytes.Repeat([]byte("x"), benchSizes[len(benchSizes)-1])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+
+		if r.Method != http.MethodGet {
+			return
+		}
+
+		size, err := strconv.Atoi(r.URL.Path[1:])
+		if err != nil || size > len(body) {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(body[:size])
+	}))
+
+	b.Cleanup(server.Close)
+
+	return server
+}
+
+// benchURL returns the URL for requests of the given mode, which is the proxy in front of the
+// server unless it's the direct mode
+func benchURL(b *testing.B, mode benchMode, server *httptest.Server) string {
+	if mode.isDirect {
+		return server.URL
+	}
+
+	proxy := startTestProxy(b, mode.config, server.URL)
+
+	if mode.noFlush {
+		proxyState.backends[0].proxy.FlushInterval = 0
+	}
+
+	return proxy.URL
+}
+
+// runBenchRequests sends parallel requests with the given method and body size class until b.N
+// requests completed
+func runBenchRequests(b *testing.B, method string, url string, size int) {
+	client := newTestClient(b)
+	body := bytes.Repeat([]byte("x"), size)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			var req *http.Request
+			var err error
+
+			if method == http.MethodGet {
+				req, err = http.NewRequest(method, url+"/"+strconv.Itoa(size), nil)
+			} else {
+				req, err = http.NewRequest(method, url+"/obj", bytes.NewReader(body))
+			}
+
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				b.Errorf("%s = %d; want 200", method, resp.StatusCode)
+				return
+			}
+		}
+	})
+}
+
+func formatBenchSize(size int) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%dMiB", size/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%dKiB", size/1024)
+	}
+
+	return fmt.Sprintf("%dB", size)
+}
+
+func benchmarkMethod(b *testing.B, method string) {
+	for _, mode := range benchModes {
+		b.Run(mode.name, func(b *testing.B) {
+			server := benchServer(b)
+			url := benchURL(b, mode, server)
+
+			for _, size := range benchSizes {
+				b.Run(formatBenchSize(size), func(b *testing.B) {
+					runBenchRequests(b, method, url, size)
+				})
+			}
+		})
+	}
+}
+
+// BenchmarkProxyGet measures downloads through the proxy per response size class
+func BenchmarkProxyGet(b *testing.B) {
+	benchmarkMethod(b, http.MethodGet)
+}
+
+// BenchmarkProxyPut measures uploads through the proxy per request size class
+func BenchmarkProxyPut(b *testing.B) {
+	benchmarkMethod(b, http.MethodPut)
+}
@@ -0,0 +1,126 @@
+// Transformation of request and response bodies through external filter processes, which read the
+// original body from stdin and write the transformed body to stdout
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// filterReader streams a body through a filter process
+type filterReader struct {
+	stdout    io.ReadCloser
+	cmd       *exec.Cmd
+	body      io.ReadCloser // original body, stdin of the filter process
+	isEOF     bool
+	closeOnce sync.Once
+}
+
+// NewBodyFilter starts the filter command for the given body. env contains additional
+// "NAME=VALUE" environment variables for the filter process (e.g. request method and path).
+func NewBodyFilter(body io.ReadCloser, filterCmd string, env []string) (io.ReadCloser, error) {
+	cmd := exec.Command("/bin/sh", "-c", filterCmd)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = body
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := StartChildProcess(cmd); err != nil {
+		return nil, err
+	}
+
+	return &filterReader{stdout: stdout, cmd: cmd, body: body}, nil
+}
+
+func (reader *filterReader) Read(buf []byte) (int, error) {
+	numRead, err := reader.stdout.Read(buf)
+
+	if err == io.EOF && !reader.isEOF {
+		reader.isEOF = true
+
+		// a failed filter must not look like a complete body to the receiver
+		if waitErr := WaitChildProcess(reader.cmd); waitErr != nil {
+			return numRead, fmt.Errorf("Body filter failed: %w", waitErr)
+		}
+	}
+
+	return numRead, err
+}
+
+// Close stops the filter process if the body was not read completely, e.g. because the client
+// disconnected
+func (reader *filterReader) Close() error {
+	reader.closeOnce.Do(func() {
+		if !reader.isEOF {
+			reader.cmd.Process.Kill()
+			WaitChildProcess(reader.cmd)
+		}
+
+		reader.body.Close()
+	})
+
+	return nil
+}
+
+// FilterRequestBody passes the request body through config.requestFilterCmd. The length of the
+// filtered body is unknown, so it gets sent chunked to the server.
+func FilterRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+
+	filteredBody, err := NewBodyFilter(r.Body, config.requestFilterCmd, []string{
+		"PROXPERFECT_METHOD=" + r.Method,
+		"PROXPERFECT_PATH=" + r.URL.Path,
+		"PROXPERFECT_QUERY=" + r.URL.RawQuery,
+		"PROXPERFECT_CONTENT_TYPE=" + r.Header.Get("Content-Type"),
+	})
+	if err != nil {
+		HTTPError(w, r, http.StatusInternalServerError, "Starting request body filter failed: "+err.Error())
+		return false
+	}
+
+	r.Body = filteredBody
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+	r.Header.Del("Content-MD5") // no longer matches the body
+
+	return true
+}
+
+// FilterResponseBody passes the server response body through config.responseFilterCmd
+func FilterResponseBody(resp *http.Response) error {
+	if resp.Request.Method == http.MethodHead || !statusAllowsBody(resp.StatusCode) ||
+		resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+
+	filteredBody, err := NewBodyFilter(resp.Body, config.responseFilterCmd, []string{
+		"PROXPERFECT_METHOD=" + resp.Request.Method,
+		"PROXPERFECT_PATH=" + resp.Request.URL.Path,
+		"PROXPERFECT_QUERY=" + resp.Request.URL.RawQuery,
+		"PROXPERFECT_STATUS=" + strconv.Itoa(resp.StatusCode),
+		"PROXPERFECT_CONTENT_TYPE=" + resp.Header.Get("Content-Type"),
+	})
+	if err != nil {
+		return errors.New("Starting response body filter failed: " + err.Error())
+	}
+
+	resp.Body = filteredBody
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Content-MD5") // no longer matches the body
+
+	return nil
+}
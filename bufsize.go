@@ -0,0 +1,58 @@
+// Admin interface endpoint to change the size of pooled proxy buffers at runtime, so that throughput
+// vs memory usage can be tuned during a live run
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// bufSizeMutex serializes changes, so that all servers end up with the same buffer size
+var bufSizeMutex sync.Mutex
+
+// BufSizeHandler is the admin interface handler to query (GET) or change (POST with query parameter
+// "size") the buffer size of all servers. Size 0 disables buffer pooling.
+func BufSizeHandler(w http.ResponseWriter, r *http.Request) {
+	bufSizeMutex.Lock()
+	defer bufSizeMutex.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		bufSize, err := strconv.Atoi(r.URL.Query().Get("size"))
+		if err != nil || bufSize < 0 {
+			http.Error(w, "Invalid buffer size: \""+r.URL.Query().Get("size")+"\"", http.StatusBadRequest)
+			return
+		}
+
+		for _, backend := range proxyState.backends {
+			backend.proxy.BufferPool.(*proxyBufferPool).SetBufSize(bufSize)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// reply with current state
+	var bufPoolState struct {
+		BufSize      int    `json:"bufSize"`
+		NumAllocated uint32 `json:"numAllocated"` // since last change of buffer size
+	}
+
+	for _, backend := range proxyState.backends {
+		generation := backend.proxy.BufferPool.(*proxyBufferPool).generation.Load().(*bufferPoolGeneration)
+
+		bufPoolState.BufSize = generation.bufSize
+		bufPoolState.NumAllocated += atomic.LoadUint32(&generation.bufAllocNum)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(bufPoolState)
+}
@@ -0,0 +1,679 @@
+// In-memory cache of GET responses with LRU eviction. Responses get cached for the time of their
+// "Cache-Control" header (s-maxage or max-age), unless a route of "--cacheroutes" forces a TTL or
+// bypasses the cache for matching paths, e.g. for static content of servers without cache headers.
+// Expired responses can still get served while a background request refreshes them
+// (stale-while-revalidate) and when the servers fail or are unavailable (stale-if-error).
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheHeader is the response header that tells clients whether the response came from the cache
+const CacheHeader = "X-ProxPerfect-Cache"
+
+// Values of CacheHeader
+const (
+	CacheStatusHit    = "HIT"
+	CacheStatusMiss   = "MISS"
+	CacheStatusBypass = "BYPASS"
+	CacheStatusStale  = "STALE"
+)
+
+// CacheRefreshTimeout is the max time of a background request to refresh a stale response
+const CacheRefreshTimeout = time.Minute
+
+// cacheRefreshKey is the context key of background requests that refresh cached responses. The value
+// is the *Tenant of the request that the background request was made for; nil without "--apikeys".
+type cacheRefreshKey struct{}
+
+// Freshness of cached responses
+const (
+	cacheFresh           = iota
+	cacheStaleRevalidate // expired, but can be served while getting refreshed
+	cacheStaleIfError    // expired, but can be served if the server fails
+)
+
+// CacheEntryShare is the max share of "--cachesize" of a single response, so that a large response
+// doesn't evict many small ones
+const CacheEntryShare = 8
+
+// CacheRouteBypass is the TTL value of a route that bypasses the cache
+const CacheRouteBypass = "bypass"
+
+// CacheRoute overrides the caching of responses for matching paths
+type CacheRoute struct {
+	pathPattern string        // a trailing "*" matches any suffix
+	ttl         time.Duration // forced TTL, regardless of response headers; 0 for bypass
+	isBypass    bool          // neither serve nor store responses
+}
+
+// ParseCacheRoutes parses a comma-separated list of routes in the format "PATH_PATTERN=TTL|bypass",
+// e.g. "/static/*=1h,/static/live/*=bypass"
+func ParseCacheRoutes(routesStr string) ([]CacheRoute, error) {
+	var routes []CacheRoute
+
+	for _, routeStr := range strings.Split(routesStr, ",") {
+		pathPattern, ttlStr, hasTTL := strings.Cut(routeStr, "=")
+
+		if !hasTTL || pathPattern == "" {
+			return nil, fmt.Errorf("Invalid cache route: %s", routeStr)
+		}
+
+		if ttlStr == CacheRouteBypass {
+			routes = append(routes, CacheRoute{pathPattern: pathPattern, isBypass: true})
+			continue
+		}
+
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("Invalid TTL of cache route: %s", routeStr)
+		}
+
+		routes = append(routes, CacheRoute{pathPattern: pathPattern, ttl: ttl})
+	}
+
+	return routes, nil
+}
+
+// MatchCacheRoute returns the first cache route that matches the path, or nil if no route matches
+func MatchCacheRoute(path string) *CacheRoute {
+	for i := range config.cacheRoutes {
+		if MatchPathPattern(config.cacheRoutes[i].pathPattern, path) {
+			return &config.cacheRoutes[i]
+		}
+	}
+
+	return nil
+}
+
+type cacheEntry struct {
+	key        string
+	statusCode int
+	header     http.Header
+	body       []byte
+	trailer    http.Header // nil if response has no trailers
+	size       int64       // approximate memory usage
+	storedTime time.Time
+	expiry     time.Time
+
+	staleRevalidateEnd time.Time // end of stale-while-revalidate; equals expiry if disabled
+	staleIfErrorEnd    time.Time // end of stale-if-error; equals expiry if disabled
+	isRefreshing       bool      // background refresh in progress; protected by responseCache.mutex
+}
+
+// usableEnd returns the time after which the entry can't be served anymore
+func (entry *cacheEntry) usableEnd() time.Time {
+	if entry.staleIfErrorEnd.After(entry.staleRevalidateEnd) {
+		return entry.staleIfErrorEnd
+	}
+
+	return entry.staleRevalidateEnd
+}
+
+var responseCache = struct {
+	numHits      uint64 // atomic; first for alignment on 32-bit archs
+	numMisses    uint64 // atomic
+	numBypasses  uint64 // atomic
+	numEvictions uint64 // atomic; entries removed to make room, not counting expired entries
+	numStaleHits uint64 // atomic; stale responses served while getting refreshed
+	numStaleErrs uint64 // atomic; stale responses served because the server failed
+	numRefreshes uint64 // atomic; background requests to refresh stale responses
+	mutex        sync.Mutex
+	entries      map[string]*list.Element // value is *cacheEntry
+	lru          *list.List               // most recently used first
+	size         int64                    // sum of entry sizes
+}{entries: make(map[string]*list.Element), lru: list.New()}
+
+// CacheStats are the stats of the response cache
+type CacheStats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Bypasses   uint64 `json:"bypasses"`
+	Evictions  uint64 `json:"evictions"`
+	StaleHits  uint64 `json:"staleHits"`   // stale responses served while getting refreshed
+	StaleErrs  uint64 `json:"staleErrors"` // stale responses served because the server failed
+	Refreshes  uint64 `json:"refreshes"`
+	NumEntries int    `json:"entries"`
+	Size       int64  `json:"size"` // bytes
+}
+
+func GetCacheStats() CacheStats {
+	responseCache.mutex.Lock()
+	defer responseCache.mutex.Unlock()
+
+	return CacheStats{
+		Hits:       atomic.LoadUint64(&responseCache.numHits),
+		Misses:     atomic.LoadUint64(&responseCache.numMisses),
+		Bypasses:   atomic.LoadUint64(&responseCache.numBypasses),
+		Evictions:  atomic.LoadUint64(&responseCache.numEvictions),
+		StaleHits:  atomic.LoadUint64(&responseCache.numStaleHits),
+		StaleErrs:  atomic.LoadUint64(&responseCache.numStaleErrs),
+		Refreshes:  atomic.LoadUint64(&responseCache.numRefreshes),
+		NumEntries: len(responseCache.entries),
+		Size:       responseCache.size,
+	}
+}
+
+// CacheKey returns the key of the cached response for the request. Responses of different tenants
+// and content encodings must not get mixed up.
+func CacheKey(r *http.Request) string {
+	return tenantCacheKey(r, RequestTenantName(r))
+}
+
+// tenantCacheKey returns the key of the cached response for the request of the given tenant, e.g. for
+// requests of the admin interface on behalf of a tenant
+func tenantCacheKey(r *http.Request, tenantName string) string {
+	var key = r.Host + r.URL.RequestURI() + "\x00" + r.Header.Get("Accept-Encoding")
+
+	if proxyState.tenants != nil {
+		key = tenantName + "\x00" + key
+	}
+
+	return key
+}
+
+// isCacheableRequest returns true if the request can be served from the cache. Conditional and
+// range requests go to the server, because their responses depend on more than the URL.
+func isCacheableRequest(r *http.Request, route *CacheRoute) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	for _, headerName := range []string{"Range", "If-Match", "If-None-Match", "If-Modified-Since",
+		"If-Unmodified-Since", "If-Range"} {
+		if r.Header.Get(headerName) != "" {
+			return false
+		}
+	}
+
+	if route != nil {
+		return true // forced TTL
+	}
+
+	requestDirectives := ParseCacheControl(r.Header)
+	if _, noCache := requestDirectives["no-cache"]; noCache {
+		return false
+	}
+
+	if _, noStore := requestDirectives["no-store"]; noStore {
+		return false
+	}
+
+	return true
+}
+
+// ParseCacheControl returns the directives of the "Cache-Control" header, mapped to their value
+// (empty for directives without value)
+func ParseCacheControl(header http.Header) map[string]string {
+	var directives = make(map[string]string)
+
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, directiveValue, _ := strings.Cut(strings.TrimSpace(directive), "=")
+
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(directiveValue, "\"")
+			}
+		}
+	}
+
+	return directives
+}
+
+// ResponseCacheTTL returns the time to cache the given response to the request, or 0 if the
+// response must not be cached
+func ResponseCacheTTL(r *http.Request, statusCode int, header http.Header, route *CacheRoute) time.Duration {
+	if r.Method != http.MethodGet || statusCode != http.StatusOK {
+		return 0
+	}
+
+	if route != nil {
+		return route.ttl
+	}
+
+	directives := ParseCacheControl(header)
+
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, exists := directives[directive]; exists {
+			return 0
+		}
+	}
+
+	if header.Get("Set-Cookie") != "" {
+		return 0
+	}
+
+	if vary := header.Get("Vary"); vary != "" && !strings.EqualFold(strings.TrimSpace(vary), "Accept-Encoding") {
+		return 0 // key only contains Accept-Encoding
+	}
+
+	// responses to authorized requests are only for shared caches if explicitly allowed
+	_, isPublic := directives["public"]
+	sharedMaxAge, hasSharedMaxAge := directives["s-maxage"]
+
+	if r.Header.Get("Authorization") != "" && !isPublic && !hasSharedMaxAge {
+		return 0
+	}
+
+	var maxAgeStr = directives["max-age"]
+	if hasSharedMaxAge {
+		maxAgeStr = sharedMaxAge
+	}
+
+	maxAge, err := strconv.ParseInt(maxAgeStr, 10, 64)
+	if err != nil || maxAge <= 0 {
+		return 0
+	}
+
+	return time.Duration(maxAge) * time.Second
+}
+
+// ResponseStaleWindows returns the times to serve the response after its expiry while refreshing
+// it and if the server fails, from the "Cache-Control" directives of the response or else from
+// "--stalerevalidate" and "--staleiferror"
+func ResponseStaleWindows(header http.Header) (staleRevalidate time.Duration, staleIfError time.Duration) {
+	directives := ParseCacheControl(header)
+
+	staleRevalidate, staleIfError = config.staleRevalidate, config.staleIfError
+
+	if seconds, err := strconv.ParseInt(directives["stale-while-revalidate"], 10, 64); err == nil && seconds >= 0 {
+		staleRevalidate = time.Duration(seconds) * time.Second
+	}
+
+	if seconds, err := strconv.ParseInt(directives["stale-if-error"], 10, 64); err == nil && seconds >= 0 {
+		staleIfError = time.Duration(seconds) * time.Second
+	}
+
+	if _, mustRevalidate := directives["must-revalidate"]; mustRevalidate {
+		return 0, 0
+	}
+
+	return staleRevalidate, staleIfError
+}
+
+// LookupCache returns the cached response for the key and its freshness, or nil if there is none or
+// it can't be served anymore. If canRefresh is true, startRefresh is true for the first lookup of a
+// response in its stale-while-revalidate window, so that the caller starts the background refresh.
+func LookupCache(key string, canRefresh bool) (entry *cacheEntry, freshness int, startRefresh bool) {
+	responseCache.mutex.Lock()
+	defer responseCache.mutex.Unlock()
+
+	element, exists := responseCache.entries[key]
+	if !exists {
+		return nil, 0, false
+	}
+
+	entry = element.Value.(*cacheEntry)
+
+	var now = time.Now()
+
+	switch {
+	case !now.After(entry.expiry):
+		freshness = cacheFresh
+	case now.Before(entry.staleRevalidateEnd):
+		freshness = cacheStaleRevalidate
+
+		if canRefresh && !entry.isRefreshing {
+			entry.isRefreshing = true
+			startRefresh = true
+		}
+	case now.Before(entry.staleIfErrorEnd):
+		freshness = cacheStaleIfError
+	default:
+		removeCacheElement(element)
+		return nil, 0, false
+	}
+
+	responseCache.lru.MoveToFront(element)
+
+	return entry, freshness, startRefresh
+}
+
+// finishCacheRefresh allows a new background refresh of the response for the key, e.g. after the
+// refresh failed
+func finishCacheRefresh(key string) {
+	responseCache.mutex.Lock()
+	defer responseCache.mutex.Unlock()
+
+	if element, exists := responseCache.entries[key]; exists {
+		element.Value.(*cacheEntry).isRefreshing = false
+	}
+}
+
+// RefreshCache sends a copy of the request to a server to replace the cached response for the key.
+// The refresh is done when this returns, also if the copy got rejected before reaching the cache.
+func RefreshCache(r *http.Request, key string) {
+	defer finishCacheRefresh(key)
+
+	atomic.AddUint64(&responseCache.numRefreshes, 1)
+
+	FetchIntoCache(r, GetRequestState(r).tenant)
+}
+
+// FetchIntoCache sends a copy of the GET request through the handler of client requests, including
+// the selection of the server, without using a cached response, so that a cacheable response
+// replaces the cached response. The copy is made for the given tenant (nil without "--apikeys"),
+// because the API key of the request is no longer available after admission. Returns the status
+// code of the response.
+func FetchIntoCache(r *http.Request, tenant *Tenant) int {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), cacheRefreshKey{}, tenant),
+		CacheRefreshTimeout)
+	defer cancel()
+
+	fetchReq := r.Clone(ctx)
+	fetchReq.Method = http.MethodGet
+	fetchReq.Body = http.NoBody
+	fetchReq.ContentLength = 0
+
+	writer := &discardResponseWriter{header: make(http.Header), statusCode: http.StatusOK}
+
+	http.DefaultServeMux.ServeHTTP(writer, fetchReq)
+
+	return writer.statusCode
+}
+
+// isCacheRefresh returns true for background requests of RefreshCache
+func isCacheRefresh(r *http.Request) bool {
+	_, isRefresh := CacheRefreshTenant(r)
+	return isRefresh
+}
+
+// CacheRefreshTenant returns the tenant of a background request of FetchIntoCache and true, or false
+// for client requests
+func CacheRefreshTenant(r *http.Request) (*Tenant, bool) {
+	tenant, isRefresh := r.Context().Value(cacheRefreshKey{}).(*Tenant)
+	return tenant, isRefresh
+}
+
+// discardResponseWriter is the response writer of background requests
+type discardResponseWriter struct {
+	header        http.Header
+	statusCode    int
+	isHeaderWrite bool
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {
+	if !w.isHeaderWrite {
+		w.isHeaderWrite = true
+		w.statusCode = statusCode
+	}
+}
+
+// staleErrorWriter holds back error responses (5xx), so that a stale response can be served instead
+type staleErrorWriter struct {
+	http.ResponseWriter
+	isError       bool
+	isHeaderWrite bool
+}
+
+func (writer *staleErrorWriter) WriteHeader(statusCode int) {
+	if writer.isHeaderWrite {
+		return
+	}
+
+	writer.isHeaderWrite = true
+
+	if statusCode >= 500 {
+		writer.isError = true
+		return
+	}
+
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (writer *staleErrorWriter) Write(buf []byte) (int, error) {
+	if !writer.isHeaderWrite {
+		writer.WriteHeader(http.StatusOK)
+	}
+
+	if writer.isError {
+		return len(buf), nil
+	}
+
+	return writer.ResponseWriter.Write(buf)
+}
+
+func (writer *staleErrorWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok && !writer.isError {
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to access the wrapped writer
+func (writer *staleErrorWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// ServeStaleResponse serves the cached response for a request that can't be forwarded, because no
+// server is available. Stale responses get served within their stale-if-error window. Returns false
+// if there is no such response.
+func ServeStaleResponse(w http.ResponseWriter, r *http.Request) bool {
+	var route = MatchCacheRoute(r.URL.Path)
+
+	if (route != nil && route.isBypass) || !isCacheableRequest(r, route) || isCacheRefresh(r) {
+		return false
+	}
+
+	entry, freshness, _ := LookupCache(CacheKey(r), false)
+	if entry == nil {
+		return false
+	}
+
+	if freshness == cacheFresh {
+		atomic.AddUint64(&responseCache.numHits, 1)
+		ServeCachedResponse(w, r, entry, CacheStatusHit)
+	} else {
+		atomic.AddUint64(&responseCache.numStaleErrs, 1)
+		ServeCachedResponse(w, r, entry, CacheStatusStale)
+	}
+
+	return true
+}
+
+// StoreCache adds the response to the cache and evicts least recently used entries as needed
+func StoreCache(entry *cacheEntry) {
+	entry.size = int64(len(entry.key) + len(entry.body))
+
+	for _, header := range []http.Header{entry.header, entry.trailer} {
+		for headerName, values := range header {
+			entry.size += int64(len(headerName))
+
+			for _, value := range values {
+				entry.size += int64(len(value))
+			}
+		}
+	}
+
+	if entry.size > config.cacheSize/CacheEntryShare {
+		return
+	}
+
+	responseCache.mutex.Lock()
+	defer responseCache.mutex.Unlock()
+
+	if element, exists := responseCache.entries[entry.key]; exists {
+		removeCacheElement(element)
+	}
+
+	for responseCache.size+entry.size > config.cacheSize {
+		removeCacheElement(responseCache.lru.Back())
+		atomic.AddUint64(&responseCache.numEvictions, 1)
+	}
+
+	responseCache.entries[entry.key] = responseCache.lru.PushFront(entry)
+	responseCache.size += entry.size
+}
+
+// removeCacheElement removes an entry from the cache; responseCache.mutex must be held
+func removeCacheElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+
+	responseCache.lru.Remove(element)
+	delete(responseCache.entries, entry.key)
+	responseCache.size -= entry.size
+}
+
+// ServeCachedResponse writes the cached response to the client with the given CacheHeader status
+func ServeCachedResponse(w http.ResponseWriter, r *http.Request, entry *cacheEntry, cacheStatus string) {
+	for key := range w.Header() {
+		delete(w.Header(), key) // e.g. headers of a failed server response
+	}
+
+	for key, values := range entry.header {
+		w.Header()[key] = values
+	}
+
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.storedTime).Seconds())))
+	// trailers need a chunked response
+	if len(entry.trailer) == 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+	}
+
+	setCacheStatus(w, cacheStatus)
+	w.WriteHeader(entry.statusCode)
+
+	if r.Method != http.MethodHead {
+		w.Write(entry.body)
+
+		WriteResponseTrailers(w, entry.trailer)
+	}
+}
+
+// setCacheStatus sets CacheHeader of the response. (not using Header.Set(), because it would
+// canonicalize to "X-Proxperfect-...")
+func setCacheStatus(w http.ResponseWriter, status string) {
+	w.Header()[CacheHeader] = []string{status}
+}
+
+// PurgeExpiredCacheEntries periodically removes expired entries, so that they don't occupy memory
+// until they get evicted
+func PurgeExpiredCacheEntries() {
+	for range time.Tick(time.Minute) {
+		var now = time.Now()
+
+		responseCache.mutex.Lock()
+
+		for _, element := range responseCache.entries {
+			if now.After(element.Value.(*cacheEntry).usableEnd()) {
+				removeCacheElement(element)
+			}
+		}
+
+		responseCache.mutex.Unlock()
+	}
+}
+
+// cacheMiddleware serves GET and HEAD requests from the cache and stores cacheable responses
+func cacheMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route = MatchCacheRoute(r.URL.Path)
+
+		if (route != nil && route.isBypass) || !isCacheableRequest(r, route) {
+			atomic.AddUint64(&responseCache.numBypasses, 1)
+
+			setCacheStatus(w, CacheStatusBypass)
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		var key = CacheKey(r)
+		var staleEntry *cacheEntry // served if the server fails
+		var isRefresh = isCacheRefresh(r)
+
+		if !isRefresh {
+			entry, freshness, startRefresh := LookupCache(key, true)
+
+			switch {
+			case entry == nil:
+			case freshness == cacheFresh:
+				atomic.AddUint64(&responseCache.numHits, 1)
+				ServeCachedResponse(w, r, entry, CacheStatusHit)
+
+				return
+			case freshness == cacheStaleRevalidate:
+				if startRefresh {
+					go RefreshCache(r, key)
+				}
+
+				atomic.AddUint64(&responseCache.numStaleHits, 1)
+				ServeCachedResponse(w, r, entry, CacheStatusStale)
+
+				return
+			default:
+				staleEntry = entry
+			}
+		}
+
+		setCacheStatus(w, CacheStatusMiss)
+
+		var writer = w
+		var errorWriter *staleErrorWriter
+
+		if staleEntry != nil {
+			errorWriter = &staleErrorWriter{ResponseWriter: w}
+			writer = errorWriter
+		}
+
+		recorder := &responseRecorder{ResponseWriter: writer, statusCode: http.StatusOK,
+			maxBodySize: int(config.cacheSize / CacheEntryShare)}
+
+		next.ServeHTTP(recorder, r)
+
+		if errorWriter != nil && errorWriter.isError {
+			atomic.AddUint64(&responseCache.numStaleErrs, 1)
+			ServeCachedResponse(w, r, staleEntry, CacheStatusStale)
+
+			return
+		}
+
+		if !isRefresh {
+			atomic.AddUint64(&responseCache.numMisses, 1)
+		}
+
+		if recorder.isTruncated || !recorder.isHeaderWrite || r.Context().Err() != nil {
+			return
+		}
+
+		ttl := ResponseCacheTTL(r, recorder.statusCode, recorder.header, route)
+		if ttl == 0 {
+			return
+		}
+
+		delete(recorder.header, CacheHeader)
+
+		staleRevalidate, staleIfError := ResponseStaleWindows(recorder.header)
+
+		now := time.Now()
+
+		StoreCache(&cacheEntry{
+			key:                key,
+			statusCode:         recorder.statusCode,
+			header:             recorder.header,
+			body:               recorder.body.Bytes(),
+			trailer:            recorder.Trailer(),
+			storedTime:         now,
+			expiry:             now.Add(ttl),
+			staleRevalidateEnd: now.Add(ttl + staleRevalidate),
+			staleIfErrorEnd:    now.Add(ttl + staleIfError),
+		})
+	})
+}
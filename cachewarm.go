@@ -0,0 +1,198 @@
+// Admin interface endpoint to preload the response cache from a list of URLs, e.g. so that
+// benchmarks start from a defined cache state
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheWarmConcurrency is the number of concurrent requests of a cache warm-up
+const DefaultCacheWarmConcurrency = 4
+
+// MaxCacheWarmListSize is the max size of the URL list of a cache warm-up in bytes
+const MaxCacheWarmListSize = 16 * 1024 * 1024
+
+// CacheWarmResult is the result of a single URL of a cache warm-up
+type CacheWarmResult struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status"`
+	IsCached   bool   `json:"cached"`
+}
+
+// NewCacheWarmRequest returns the GET request for a line of the URL list of a cache warm-up, in the
+// form of a client request to the proxy. The line is either a full URL, of which the host becomes
+// the "Host" header, or a path with optional query for the given default host.
+func NewCacheWarmRequest(line string, defaultHost string, remoteAddr string) (*http.Request, error) {
+	lineURL, err := url.Parse(line)
+	if err != nil {
+		return nil, err
+	}
+
+	var host = lineURL.Host
+	if host == "" {
+		host = defaultHost
+	}
+
+	if host == "" {
+		return nil, fmt.Errorf("URL has no host and no \"host\" query parameter was given: %s", line)
+	}
+
+	requestURL := &url.URL{Path: lineURL.Path, RawPath: lineURL.RawPath, RawQuery: lineURL.RawQuery}
+
+	if requestURL.Path == "" {
+		requestURL.Path = "/"
+	}
+
+	return &http.Request{
+		Method:     http.MethodGet,
+		URL:        requestURL,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Host:       host,
+		RemoteAddr: remoteAddr,
+		RequestURI: requestURL.RequestURI(),
+	}, nil
+}
+
+// CacheWarmHandler is the admin interface handler to preload the cache (POST) with the URLs in the
+// request body, one per line. Each URL gets fetched through the normal selection of the server and
+// stored if the response is cacheable. Query parameters: "host" for the "Host" header of lines
+// without host, "encoding" for the "Accept-Encoding" header, "concurrency" for the number of
+// concurrent requests and "tenant" for the tenant whose cached responses get preloaded (required
+// with "--apikeys", because the URLs get fetched without API key).
+func CacheWarmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if config.cacheSize <= 0 {
+		http.Error(w, "Cache is disabled", http.StatusConflict)
+		return
+	}
+
+	var query = r.URL.Query()
+	var concurrency = DefaultCacheWarmConcurrency
+
+	if concurrencyParam := query.Get("concurrency"); concurrencyParam != "" {
+		var err error
+
+		concurrency, err = strconv.Atoi(concurrencyParam)
+		if err != nil || concurrency <= 0 {
+			http.Error(w, "Invalid concurrency: "+concurrencyParam, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var tenant *Tenant
+
+	if tenantName := query.Get("tenant"); proxyState.tenants != nil {
+		if tenant = TenantByName(tenantName); tenant == nil {
+			http.Error(w, "Missing or unknown tenant: \""+tenantName+"\" (\"tenant\" query parameter is "+
+				"required with \"--apikeys\")", http.StatusBadRequest)
+			return
+		}
+	} else if tenantName != "" {
+		http.Error(w, "Tenants are disabled (see \"--apikeys\")", http.StatusBadRequest)
+		return
+	}
+
+	var requests []*http.Request
+
+	scanner := bufio.NewScanner(io.LimitReader(r.Body, MaxCacheWarmListSize))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		warmReq, err := NewCacheWarmRequest(line, query.Get("host"), r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "Invalid URL list: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if encoding := query.Get("encoding"); encoding != "" {
+			warmReq.Header.Set("Accept-Encoding", encoding)
+		}
+
+		requests = append(requests, warmReq)
+	}
+
+	if err := scanner.Err(); err != nil {
+		http.Error(w, "Reading URL list failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("Cache warm-up through admin interface started. URLs: %d; Concurrency: %d\n", len(requests), concurrency)
+
+	var startTime = time.Now()
+	var results = make([]CacheWarmResult, len(requests))
+	var requestIdxs = make(chan int)
+	var waitGroup sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+
+			for requestIdx := range requestIdxs {
+				warmReq := requests[requestIdx]
+
+				results[requestIdx].URL = warmReq.Host + warmReq.RequestURI
+				results[requestIdx].StatusCode = FetchIntoCache(warmReq, tenant)
+
+				entry, _, _ := LookupCache(tenantCacheKey(warmReq, query.Get("tenant")), false)
+				results[requestIdx].IsCached = entry != nil && !entry.storedTime.Before(startTime)
+			}
+		}()
+	}
+
+	for i := range requests {
+		requestIdxs <- i
+	}
+
+	close(requestIdxs)
+	waitGroup.Wait()
+
+	var reply struct {
+		NumURLs    int               `json:"urls"`
+		NumCached  int               `json:"cached"`
+		DurationMs int64             `json:"durationMs"`
+		Results    []CacheWarmResult `json:"results"`
+	}
+
+	reply.NumURLs = len(requests)
+	reply.DurationMs = time.Since(startTime).Milliseconds()
+	reply.Results = results
+
+	for _, result := range results {
+		if result.IsCached {
+			reply.NumCached++
+		}
+	}
+
+	fmt.Printf("Cache warm-up through admin interface done. URLs: %d; Cached: %d; Duration: %dms\n", reply.NumURLs, reply.NumCached, reply.DurationMs)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(reply)
+}
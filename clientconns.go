@@ -0,0 +1,152 @@
+// Accounting and limit of client connections, including reuse of connections for requests
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RejectLingerTimeout is the max time to wait for a rejected client to close its connection after
+// the rejection response, so that the response doesn't get lost through a connection reset
+const RejectLingerTimeout = time.Second
+
+// rejectResponse is sent to plain HTTP clients that exceed the connection limit
+const rejectResponse = "HTTP/1.1 503 Service Unavailable\r\n" +
+	"Connection: close\r\n" +
+	"Retry-After: 1\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+// ClientConnStats are the stats of client connections
+type ClientConnStats struct {
+	NumTotalPlain  uint64  `json:"totalPlain"` // 64-bit atomics first for alignment on 32-bit archs
+	NumTotalTLS    uint64  `json:"totalTLS"`
+	NumRejected    uint64  `json:"rejected"`
+	NumReqsNew     uint64  `json:"requestsNewConn"`    // first request of a connection
+	NumReqsReused  uint64  `json:"requestsReusedConn"` // further requests of a connection (keep-alive, HTTP/2)
+	NumCurrent     int64   `json:"current"`
+	AvgReqsPerConn float64 `json:"avgRequestsPerConn"` // of connections with requests; computed
+}
+
+// clientConnRequestsKey is the context key of the number of requests (*uint64) of a client
+// connection
+type clientConnRequestsKey struct{}
+
+var clientConnStats ClientConnStats
+
+// GetClientConnStats returns a snapshot of each client connection counter
+func GetClientConnStats() ClientConnStats {
+	stats := ClientConnStats{
+		NumTotalPlain: atomic.LoadUint64(&clientConnStats.NumTotalPlain),
+		NumTotalTLS:   atomic.LoadUint64(&clientConnStats.NumTotalTLS),
+		NumRejected:   atomic.LoadUint64(&clientConnStats.NumRejected),
+		NumReqsNew:    atomic.LoadUint64(&clientConnStats.NumReqsNew),
+		NumReqsReused: atomic.LoadUint64(&clientConnStats.NumReqsReused),
+		NumCurrent:    atomic.LoadInt64(&clientConnStats.NumCurrent),
+	}
+
+	if stats.NumReqsNew > 0 {
+		stats.AvgReqsPerConn = float64(stats.NumReqsNew+stats.NumReqsReused) / float64(stats.NumReqsNew)
+	}
+
+	return stats
+}
+
+// ClientConnContext is the http.Server.ConnContext hook that adds the request counter of a client
+// connection to the context of its requests
+func ClientConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, clientConnRequestsKey{}, new(uint64))
+}
+
+// CountClientConnReuse wraps the handler for client requests to count whether requests arrived over
+// new or reused connections, so that connection churn can be told apart from keep-alive clients
+func CountClientConnReuse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if numConnReqs, ok := r.Context().Value(clientConnRequestsKey{}).(*uint64); ok {
+			if atomic.AddUint64(numConnReqs, 1) == 1 {
+				atomic.AddUint64(&clientConnStats.NumReqsNew, 1)
+			} else {
+				atomic.AddUint64(&clientConnStats.NumReqsReused, 1)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientConnListener counts accepted client connections and rejects connections beyond
+// config.maxClientConns
+type clientConnListener struct {
+	net.Listener
+	isTLS bool // connections get TLS on top of this listener
+}
+
+func (listener *clientConnListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		var numCurrent = atomic.AddInt64(&clientConnStats.NumCurrent, 1)
+
+		if config.maxClientConns > 0 && numCurrent > int64(config.maxClientConns) {
+			atomic.AddInt64(&clientConnStats.NumCurrent, -1)
+			atomic.AddUint64(&clientConnStats.NumRejected, 1)
+
+			go listener.reject(conn)
+
+			continue
+		}
+
+		if listener.isTLS {
+			atomic.AddUint64(&clientConnStats.NumTotalTLS, 1)
+		} else {
+			atomic.AddUint64(&clientConnStats.NumTotalPlain, 1)
+		}
+
+		return &clientConn{Conn: conn}, nil
+	}
+}
+
+// reject sends a 503 response to plain HTTP clients and closes the connection
+func (listener *clientConnListener) reject(conn net.Conn) {
+	defer conn.Close()
+
+	if config.beVerbose {
+		fmt.Printf("Rejected client connection. Client: %s; Limit: %d\n", conn.RemoteAddr(), config.maxClientConns)
+	}
+
+	if listener.isTLS {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(RejectLingerTimeout))
+	conn.Write([]byte(rejectResponse))
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+
+	io.Copy(io.Discard, conn)
+}
+
+// clientConn releases its slot of the connection limit on close, including hijacked connections
+type clientConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (conn *clientConn) Close() error {
+	conn.closeOnce.Do(func() {
+		atomic.AddInt64(&clientConnStats.NumCurrent, -1)
+	})
+
+	return conn.Conn.Close()
+}
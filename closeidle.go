@@ -0,0 +1,57 @@
+// Admin interface endpoint to close idle connections toward servers without a restart, e.g. after
+// changes of a load balancer or NAT in front of the servers left stale connections in the pool
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// CloseIdleHandler is the admin interface handler to close the idle connections (POST) of the server
+// with the given index or server string in query parameter "server", or of all servers. In-flight
+// requests keep their connections. With "--prewarm", new idle connections get established.
+func CloseIdleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var backends = proxyState.backends
+
+	if serverParam := r.URL.Query().Get("server"); serverParam != "" {
+		backendIdx, exists := FindBackend(serverParam)
+		if !exists {
+			http.Error(w, "Unknown server: "+serverParam, http.StatusBadRequest)
+			return
+		}
+
+		backends = backends[backendIdx : backendIdx+1]
+	}
+
+	var reply struct {
+		Servers        []string `json:"servers"`
+		PrewarmedConns []int    `json:"prewarmedConns,omitempty"` // by server; nil if pre-warming disabled
+	}
+
+	for _, backend := range backends {
+		backend.transport.CloseIdleConnections()
+
+		fmt.Printf("Closed idle connections through admin interface. Server: %s\n", backend.serverStr)
+
+		reply.Servers = append(reply.Servers, backend.serverStr)
+
+		if config.numPrewarmConns != 0 {
+			numConns, _ := ProbeServerConnections(backend, config.numPrewarmConns)
+
+			reply.PrewarmedConns = append(reply.PrewarmedConns, numConns)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(reply)
+}
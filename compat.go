@@ -0,0 +1,166 @@
+// Compatibility mode for HTTP/1.0 and other ancient clients, e.g. very old benchmark tools and
+// appliances: Requests without "Host" header get routed to a pool, and responses without length
+// get buffered to send them with "Content-Length", because HTTP/1.0 clients don't understand
+// chunked encoding and otherwise only get the end of the body through the connection close.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// MaxCompatBufferSize is the max size of a response body that gets buffered to determine its
+// length for a HTTP/1.0 client. Larger responses get sent as they arrive and end with the
+// connection close.
+const MaxCompatBufferSize = 16 * 1024 * 1024
+
+// CheckCompatPool returns an error if the pool for requests without "Host" header has no servers
+func CheckCompatPool() error {
+	if config.compatPool != "" && len(PoolBackends()[config.compatPool]) == 0 {
+		return fmt.Errorf("Compatibility pool has no servers: %s", config.compatPool)
+	}
+
+	return nil
+}
+
+// lengthBufferingWriter holds back the response until the handler returned, so that the response
+// gets sent with "Content-Length". If the response has a length or grows beyond
+// MaxCompatBufferSize, it gets passed through from then on.
+type lengthBufferingWriter struct {
+	http.ResponseWriter
+	statusCode    int
+	body          bytes.Buffer
+	isHeaderWrite bool
+	isPassThrough bool // response goes directly to the wrapped writer
+}
+
+func (writer *lengthBufferingWriter) WriteHeader(statusCode int) {
+	if writer.isHeaderWrite {
+		return
+	}
+
+	// informational responses are not for HTTP/1.0 clients, so the net/http server drops them
+	if statusCode < http.StatusOK {
+		writer.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	writer.isHeaderWrite = true
+	writer.statusCode = statusCode
+
+	if writer.Header().Get("Content-Length") != "" || !bodyAllowedForStatus(statusCode) ||
+		writer.Header().Get("Content-Type") == "text/event-stream" {
+		writer.passThrough()
+	}
+}
+
+func (writer *lengthBufferingWriter) Write(buf []byte) (int, error) {
+	if !writer.isHeaderWrite {
+		writer.WriteHeader(http.StatusOK)
+	}
+
+	if writer.isPassThrough {
+		return writer.ResponseWriter.Write(buf)
+	}
+
+	if writer.body.Len()+len(buf) > MaxCompatBufferSize {
+		if err := writer.passThrough(); err != nil {
+			return 0, err
+		}
+
+		return writer.ResponseWriter.Write(buf)
+	}
+
+	return writer.body.Write(buf)
+}
+
+// Flush only applies to passed through responses, because the reverse proxy flushes each write of
+// responses without length, which would defeat the buffering
+func (writer *lengthBufferingWriter) Flush() {
+	if !writer.isPassThrough {
+		return
+	}
+
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// passThrough sends the status and the buffered part of the body to the wrapped writer
+func (writer *lengthBufferingWriter) passThrough() error {
+	writer.isPassThrough = true
+
+	writer.ResponseWriter.WriteHeader(writer.statusCode)
+
+	_, err := writer.ResponseWriter.Write(writer.body.Bytes())
+	writer.body = bytes.Buffer{}
+
+	return err
+}
+
+// finish sends the buffered response with its length after the handler returned
+func (writer *lengthBufferingWriter) finish() {
+	if writer.isPassThrough {
+		return
+	}
+
+	if !writer.isHeaderWrite {
+		writer.WriteHeader(http.StatusOK)
+
+		if writer.isPassThrough {
+			return
+		}
+	}
+
+	// HTTP/1.0 has no trailers, but the whole body is known, so they can be sent as headers
+	trailer := SplitResponseTrailers(writer.Header())
+
+	writer.Header().Del("Trailer")
+
+	for key, values := range trailer {
+		writer.Header()[key] = values
+	}
+
+	writer.Header().Del("Transfer-Encoding")
+	writer.Header().Set("Content-Length", strconv.Itoa(writer.body.Len()))
+
+	writer.passThrough()
+}
+
+// Unwrap allows http.ResponseController to access the wrapped writer
+func (writer *lengthBufferingWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// bodyAllowedForStatus returns false for status codes that don't permit a response body
+func bodyAllowedForStatus(statusCode int) bool {
+	return statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
+
+// compatMiddleware routes requests without "Host" header to the compatibility pool and buffers
+// responses to HTTP/1.0 clients to send them with length
+func compatMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var state = GetRequestState(r)
+
+		if r.Host == "" && config.compatPool != "" {
+			if balancer, backendIdx, exists := SelectPoolBackend(config.compatPool, r); exists {
+				state.SetPickedBackend(balancer, backendIdx)
+			}
+		}
+
+		if r.ProtoAtLeast(1, 1) || r.Method == http.MethodHead || IsEventStreamRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		writer := &lengthBufferingWriter{ResponseWriter: w}
+
+		next.ServeHTTP(writer, r)
+
+		writer.finish()
+	})
+}
@@ -0,0 +1,176 @@
+// Connection-level event logging to debug connection churn and pool exhaustion
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var lastConnTraceID uint64 // atomic; for log messages
+
+// tracedConn wraps a client or server connection to log when it gets closed and why
+type tracedConn struct {
+	net.Conn
+	connID      uint64
+	description string // e.g. "Client: 1.2.3.4:5678"
+	errMutex    sync.Mutex
+	firstErr    error // first read or write error; nil if none
+	closeOnce   sync.Once
+	isReadAbort bool // read deadline in the past, used by http.Server to abort background reads
+}
+
+func NewTracedConn(conn net.Conn, description string) *tracedConn {
+	return &tracedConn{
+		Conn:        conn,
+		connID:      atomic.AddUint64(&lastConnTraceID, 1),
+		description: description,
+	}
+}
+
+func (conn *tracedConn) recordErr(err error) {
+	conn.errMutex.Lock()
+
+	if conn.firstErr == nil {
+		conn.firstErr = err
+	}
+
+	conn.errMutex.Unlock()
+}
+
+func (conn *tracedConn) Read(buf []byte) (int, error) {
+	numRead, err := conn.Conn.Read(buf)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && conn.isReadAborted() {
+			return numRead, err // not a reason for closing the connection
+		}
+
+		conn.recordErr(err)
+	}
+
+	return numRead, err
+}
+
+func (conn *tracedConn) SetReadDeadline(deadline time.Time) error {
+	conn.errMutex.Lock()
+	conn.isReadAbort = !deadline.IsZero() && deadline.Before(time.Now())
+	conn.errMutex.Unlock()
+
+	return conn.Conn.SetReadDeadline(deadline)
+}
+
+func (conn *tracedConn) isReadAborted() bool {
+	conn.errMutex.Lock()
+	defer conn.errMutex.Unlock()
+
+	return conn.isReadAbort
+}
+
+func (conn *tracedConn) Write(buf []byte) (int, error) {
+	numWritten, err := conn.Conn.Write(buf)
+	if err != nil {
+		conn.recordErr(err)
+	}
+
+	return numWritten, err
+}
+
+func (conn *tracedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.errMutex.Lock()
+		reason := "Closed by proxy"
+
+		if conn.firstErr != nil {
+			reason = conn.firstErr.Error()
+		}
+
+		conn.errMutex.Unlock()
+
+		fmt.Printf("[CONN #%d] Close. %s; Reason: %s\n", conn.connID, conn.description, reason)
+	})
+
+	return conn.Conn.Close()
+}
+
+// tracedListener wraps a listener to log accepted client connections
+type tracedListener struct {
+	net.Listener
+}
+
+func (listener *tracedListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tracedConn := NewTracedConn(conn, "Client: "+conn.RemoteAddr().String())
+
+	fmt.Printf("[CONN #%d] Accept. %s\n", tracedConn.connID, tracedConn.description)
+
+	return tracedConn, nil
+}
+
+// connTraceID returns the trace ID of a connection from the transport, which might be wrapped by
+// TLS. Returns 0 if the connection is not traced.
+func connTraceID(conn net.Conn) uint64 {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	if tracedConn, ok := conn.(*tracedConn); ok {
+		return tracedConn.connID
+	}
+
+	return 0
+}
+
+// NewClientTrace returns the httptrace hooks to log connection events of a request toward this
+// backend
+func (backend *Backend) NewClientTrace(currentRequestNum uint64) *httptrace.ClientTrace {
+	var logPrefix = fmt.Sprintf("[CONN %s REQUEST #%d]", backend.serverStr, currentRequestNum)
+
+	return &httptrace.ClientTrace{
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			fmt.Printf("%s DNS lookup done. Addresses: %v; Error: %v\n", logPrefix, info.Addrs, info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			fmt.Printf("%s Dial start. Address: %s\n", logPrefix, addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			fmt.Printf("%s Dial done. Address: %s; Error: %v\n", logPrefix, addr, err)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			fmt.Printf("%s TLS handshake done. Version: %s; Resumed: %v; Error: %v\n", logPrefix, tlsVersionName(state.Version), state.DidResume, err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			fmt.Printf("%s Got connection #%d. Reused: %v; Was idle: %v (%v); Local: %s\n", logPrefix, connTraceID(info.Conn), info.Reused, info.WasIdle, info.IdleTime, info.Conn.LocalAddr())
+		},
+		PutIdleConn: func(err error) {
+			if err != nil {
+				fmt.Printf("%s Connection not returned to idle pool. Reason: %v\n", logPrefix, err)
+			}
+		},
+	}
+}
+
+// tlsVersionNames are the names of TLS versions for log messages (tls.VersionName() requires Go 1.21)
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// tlsVersionName returns the name of the TLS version, e.g. "TLS 1.3", or its hex value if unknown
+func tlsVersionName(version uint16) string {
+	if name, exists := tlsVersionNames[version]; exists {
+		return name
+	}
+
+	return fmt.Sprintf("%#04x", version)
+}
@@ -0,0 +1,380 @@
+// Container mode for Kubernetes, Docker Compose and similar runtimes: Output gets logged to stdout
+// as JSON lines, the port comes from the "PORT" environment variable, SIGTERM shuts down gracefully,
+// zombie processes get reaped when running as PID 1 (where the kernel doesn't apply the default
+// actions of signals), and the admin interface with health endpoints is enabled by default.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ContainerAdminPort is the port of the admin interface in container mode if "--adminport" is not
+// given
+const ContainerAdminPort = 8081
+
+// ContainerDrainTimeout is the max time for in-flight requests to complete after SIGTERM, below
+// the default grace period of 30s of Kubernetes and Docker before SIGKILL
+const ContainerDrainTimeout = 25 * time.Second
+
+// ApplyContainerDefaults sets the listen port from the "PORT" environment variable and enables the
+// admin interface, unless the corresponding options were given explicitly
+func ApplyContainerDefaults() {
+	var isSet = make(map[string]bool)
+
+	flag.Visit(func(option *flag.Flag) {
+		isSet[option.Name] = true
+	})
+
+	if portStr := os.Getenv("PORT"); portStr != "" && !isSet["port"] {
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			fmt.Println("ERROR: Invalid port in PORT environment variable:", portStr)
+			os.Exit(1)
+		}
+
+		config.listenPort = port
+	}
+
+	if !isSet["adminport"] {
+		config.adminPort = ContainerAdminPort
+	}
+
+	if config.adminPort == config.listenPort {
+		fmt.Printf("ERROR: Admin interface port is the same as the port for client requests: %d\n",
+			config.listenPort)
+		os.Exit(1)
+	}
+}
+
+// jsonLogEntry is a line of output in container mode
+type jsonLogEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"` // "info", "warning" or "error"
+	Message string `json:"msg"`
+}
+
+// jsonLogState converts the lines of stdout to JSON lines. The original stdout gets replaced by a
+// pipe, so that all output of the proxy gets converted.
+var jsonLogState struct {
+	mutex      sync.Mutex // serializes writes of the pipe reader and the log package
+	encoder    *json.Encoder
+	stdout     *os.File // original stdout
+	pipeWriter *os.File
+	doneChan   chan struct{} // closed when the pipe reader is done
+}
+
+// jsonLogWriter converts output of the log package to JSON lines
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(buf []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(buf), "\n"), "\n") {
+		WriteJSONLogLine(line)
+	}
+
+	return len(buf), nil
+}
+
+// WriteJSONLogLine writes a line of output as JSON line to the original stdout. The level is taken
+// from the "ERROR:" or "WARNING:" prefix of the line.
+func WriteJSONLogLine(line string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+
+	var entry = jsonLogEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   "info",
+		Message: line,
+	}
+
+	switch {
+	case strings.HasPrefix(line, "ERROR:"):
+		entry.Level = "error"
+		entry.Message = strings.TrimSpace(strings.TrimPrefix(line, "ERROR:"))
+	case strings.HasPrefix(line, "WARNING:"):
+		entry.Level = "warning"
+		entry.Message = strings.TrimSpace(strings.TrimPrefix(line, "WARNING:"))
+	}
+
+	jsonLogState.mutex.Lock()
+	defer jsonLogState.mutex.Unlock()
+
+	jsonLogState.encoder.Encode(entry)
+}
+
+// StartJSONLog replaces stdout by a pipe, whose lines get written as JSON lines to the original
+// stdout
+func StartJSONLog() error {
+	pipeReader, pipeWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	jsonLogState.stdout = os.Stdout
+	jsonLogState.encoder = json.NewEncoder(os.Stdout)
+	jsonLogState.pipeWriter = pipeWriter
+	jsonLogState.doneChan = make(chan struct{})
+
+	os.Stdout = pipeWriter
+
+	log.SetFlags(0) // time is part of the JSON line
+	log.SetOutput(jsonLogWriter{})
+
+	go func() {
+		defer close(jsonLogState.doneChan)
+
+		reader := bufio.NewReader(pipeReader)
+
+		for {
+			line, err := reader.ReadString('\n') // no length limit for long lines
+			WriteJSONLogLine(line)
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopJSONLog restores the original stdout after the pending output got written, so that no
+// output gets lost on exit
+func StopJSONLog() {
+	if jsonLogState.pipeWriter == nil {
+		return
+	}
+
+	os.Stdout = jsonLogState.stdout
+
+	jsonLogState.pipeWriter.Close()
+	<-jsonLogState.doneChan
+}
+
+// childProcessState tracks the running child processes of the proxy (e.g. body filters, config
+// check of Reconfigure()), so that the zombie reaper doesn't take their exit status, which
+// exec.Cmd.Wait() needs, and so that signals can be forwarded to them
+var childProcessState = struct {
+	mutex     sync.Mutex
+	processes map[int]*os.Process // key is PID
+}{processes: make(map[int]*os.Process)}
+
+// StartChildProcess starts the command as tracked child process; to be followed by
+// WaitChildProcess()
+func StartChildProcess(cmd *exec.Cmd) error {
+	childProcessState.mutex.Lock()
+	defer childProcessState.mutex.Unlock()
+
+	// under lock, so that the reaper can't take the exit status of a child that exits immediately
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	childProcessState.processes[cmd.Process.Pid] = cmd.Process
+
+	return nil
+}
+
+// WaitChildProcess waits for the exit of a child process that was started by StartChildProcess()
+func WaitChildProcess(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+
+	childProcessState.mutex.Lock()
+	delete(childProcessState.processes, cmd.Process.Pid)
+	childProcessState.mutex.Unlock()
+
+	return err
+}
+
+// CombinedOutputOfChild runs the command like exec.Cmd.CombinedOutput() as tracked child process
+func CombinedOutputOfChild(cmd *exec.Cmd) ([]byte, error) {
+	var output bytes.Buffer
+
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := StartChildProcess(cmd); err != nil {
+		return nil, err
+	}
+
+	err := WaitChildProcess(cmd)
+
+	return output.Bytes(), err
+}
+
+// ForwardSignalToChildren sends the signal to all tracked child processes
+func ForwardSignalToChildren(forwardSignal os.Signal) {
+	childProcessState.mutex.Lock()
+	defer childProcessState.mutex.Unlock()
+
+	for _, process := range childProcessState.processes {
+		process.Signal(forwardSignal)
+	}
+}
+
+// ReapZombies waits for all exited child processes that are not tracked, e.g. processes of a
+// container that got orphaned and reparented to the proxy as PID 1
+func ReapZombies() {
+	childProcessState.mutex.Lock()
+	defer childProcessState.mutex.Unlock()
+
+	childPIDs, err := listChildPIDs()
+	if err != nil {
+		// without the list of children, zombies can only be reaped while no child is tracked
+		for len(childProcessState.processes) == 0 {
+			var status syscall.WaitStatus
+
+			if pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil); pid <= 0 || err != nil {
+				return
+			}
+		}
+
+		return
+	}
+
+	for _, pid := range childPIDs {
+		if _, isTracked := childProcessState.processes[pid]; isTracked {
+			continue
+		}
+
+		var status syscall.WaitStatus
+
+		syscall.Wait4(pid, &status, syscall.WNOHANG, nil) // no-op for children that still run
+	}
+}
+
+// listChildPIDs returns the PIDs of the child processes of all threads of the proxy from /proc
+func listChildPIDs() ([]int, error) {
+	childrenFiles, err := filepath.Glob("/proc/self/task/*/children")
+	if err != nil || len(childrenFiles) == 0 {
+		return nil, fmt.Errorf("List of child processes not available")
+	}
+
+	var childPIDs []int
+
+	for _, childrenFile := range childrenFiles {
+		content, err := os.ReadFile(childrenFile)
+		if err != nil {
+			continue // thread exited
+		}
+
+		for _, pidStr := range strings.Fields(string(content)) {
+			if pid, err := strconv.Atoi(pidStr); err == nil {
+				childPIDs = append(childPIDs, pid)
+			}
+		}
+	}
+
+	return childPIDs, nil
+}
+
+// IsShuttingDown returns true after the proxy received SIGTERM or SIGINT in container mode
+func IsShuttingDown() bool {
+	return atomic.LoadInt32(&proxyState.isShuttingDown) != 0
+}
+
+// HandleContainerSignals reaps zombies on SIGCHLD when running as PID 1 and shuts down gracefully
+// on SIGTERM or SIGINT: In-flight requests complete for up to ContainerDrainTimeout, new connections
+// get refused. The Go runtime would exit immediately on these signals, and not at all as PID 1.
+func HandleContainerSignals() {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
+
+	if os.Getpid() == 1 {
+		signal.Notify(signalChan, syscall.SIGCHLD)
+	}
+
+	for receivedSignal := range signalChan {
+		if receivedSignal == syscall.SIGCHLD {
+			ReapZombies()
+			continue
+		}
+
+		if !atomic.CompareAndSwapInt32(&proxyState.isShuttingDown, 0, 1) {
+			continue // already shutting down
+		}
+
+		go ShutDownContainer(receivedSignal)
+	}
+}
+
+// ShutDownContainer waits for in-flight requests to complete and exits
+func ShutDownContainer(receivedSignal os.Signal) {
+	fmt.Printf("Shutting down on signal. Signal: %v; Timeout: %v\n", receivedSignal,
+		ContainerDrainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ContainerDrainTimeout)
+	defer cancel()
+
+	var exitCode = 0
+
+	if proxyState.server != nil {
+		if err := proxyState.server.Shutdown(ctx); err != nil {
+			fmt.Println("WARNING: In-flight requests didn't complete before timeout:", err)
+			exitCode = 1
+		}
+	}
+
+	// child processes of requests that didn't complete (e.g. body filters) must not outlive the proxy
+	ForwardSignalToChildren(receivedSignal)
+
+	if config.printReport {
+		fmt.Println("=== Server report")
+		WriteServerReport(os.Stdout)
+	}
+
+	fmt.Println("Shutdown complete.")
+
+	StopJSONLog()
+
+	os.Exit(exitCode)
+}
+
+// LiveHandler is the admin handler for liveness checks, which succeeds while the proxy runs
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "OK")
+}
+
+// ReadyHandler is the admin handler for readiness checks, which fails with 503 while no server is
+// available or the proxy is shutting down, so that no new requests get routed to the proxy
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case IsShuttingDown():
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+	case GetScheduleStats().Servers == 0:
+		http.Error(w, NoServersMessage, http.StatusServiceUnavailable)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "OK")
+	}
+}
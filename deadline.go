@@ -0,0 +1,54 @@
+// Per-request deadlines from client headers, so that clients can bound their wait time through
+// the proxy
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcTimeoutUnits maps the unit suffixes of the "grpc-timeout" header to durations
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// ClientTimeout returns the timeout that the client requested through the "X-Request-Timeout"
+// header (seconds or duration like "1.5s") or the "grpc-timeout" header (e.g. "100m"). ok is false
+// if the request has no valid timeout header.
+func ClientTimeout(header http.Header) (timeout time.Duration, ok bool) {
+	if value := strings.TrimSpace(header.Get("X-Request-Timeout")); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			timeout = time.Duration(seconds * float64(time.Second))
+		} else if timeout, err = time.ParseDuration(value); err != nil {
+			return 0, false
+		}
+
+		return timeout, timeout > 0
+	}
+
+	if value := strings.TrimSpace(header.Get("Grpc-Timeout")); len(value) >= 2 && len(value) <= 9 {
+		unit, unitExists := grpcTimeoutUnits[value[len(value)-1]]
+		if !unitExists {
+			return 0, false
+		}
+
+		amount, err := strconv.ParseUint(value[:len(value)-1], 10, 32)
+		if err != nil {
+			return 0, false
+		}
+
+		timeout = time.Duration(amount) * unit
+
+		return timeout, timeout > 0
+	}
+
+	return 0, false
+}
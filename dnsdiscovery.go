@@ -0,0 +1,258 @@
+// Discovery of servers through DNS SRV records with weights and drain flags from SRV and TXT records
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SRVServerPrefix marks server strings that get expanded through a DNS SRV record, e.g.
+// "srv+http://_s3._tcp.cluster.local"
+const SRVServerPrefix = "srv+"
+
+// DNSLookupTimeout is the timeout for each DNS lookup of the SRV and TXT records
+const DNSLookupTimeout = 10 * time.Second
+
+// SRVTarget is a server from a SRV record with its weight from the SRV or TXT record
+type SRVTarget struct {
+	hostPort  string // without trailing dot of the host name
+	weight    uint32
+	isDrained bool
+}
+
+// dnsResolver returns the resolver for config.dnsServer
+func dnsResolver() *net.Resolver {
+	if config.dnsServer == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, config.dnsServer)
+		},
+	}
+}
+
+// LookupSRVTargets returns the servers of the given SRV record. TXT records of the same name with
+// the format "proxperfect HOST[:PORT] [weight=N] [drain]" override the weight of the SRV record.
+func LookupSRVTargets(srvName string) ([]SRVTarget, error) {
+	var resolver = dnsResolver()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DNSLookupTimeout)
+	defer cancel()
+
+	// a deleted record means that all of its servers were removed
+	_, srvRecords, err := resolver.LookupSRV(ctx, "", "", srvName)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+
+	var targets []SRVTarget
+
+	for _, srvRecord := range srvRecords {
+		targets = append(targets, SRVTarget{
+			hostPort: net.JoinHostPort(strings.TrimSuffix(srvRecord.Target, "."), strconv.Itoa(int(srvRecord.Port))),
+			weight:   uint32(srvRecord.Weight),
+		})
+	}
+
+	// stable order for consistent backend indices
+	sort.Slice(targets, func(i, j int) bool { return targets[i].hostPort < targets[j].hostPort })
+
+	txtRecords, err := resolver.LookupTXT(ctx, srvName)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+
+	for _, txtRecord := range txtRecords {
+		fields := strings.Fields(txtRecord)
+		if len(fields) < 2 || fields[0] != "proxperfect" {
+			continue
+		}
+
+		for i := range targets {
+			host, _, _ := net.SplitHostPort(targets[i].hostPort)
+
+			if fields[1] != targets[i].hostPort && fields[1] != host {
+				continue
+			}
+
+			for _, field := range fields[2:] {
+				if field == "drain" {
+					targets[i].isDrained = true
+				} else if strings.HasPrefix(field, "weight=") {
+					weight, err := strconv.ParseUint(strings.TrimPrefix(field, "weight="), 10, 16)
+					if err != nil {
+						return nil, fmt.Errorf("Invalid weight in TXT record: %s; Record: %s", srvName, txtRecord)
+					}
+
+					targets[i].weight = uint32(weight)
+				}
+			}
+		}
+	}
+
+	// SRV weight 0 only means "rarely" if other servers have higher weights
+	var hasWeights = false
+
+	for _, target := range targets {
+		hasWeights = hasWeights || (target.weight != 0 && !target.isDrained)
+	}
+
+	if !hasWeights {
+		for i := range targets {
+			targets[i].weight = DefaultWeight
+		}
+	}
+
+	return targets, nil
+}
+
+// ExpandSRVServer returns the server strings for the servers of the SRV record in the given server
+// string, e.g. "srv+http://_s3._tcp.cluster.local,dial=..." becomes "http://HOST:PORT,dial=..."
+func ExpandSRVServer(serverStr string) (srvName string, serverStrs []string, targets []SRVTarget, err error) {
+	serverURLStr, serverOptions, _ := strings.Cut(strings.TrimPrefix(serverStr, SRVServerPrefix), ",")
+
+	srvURL, err := url.Parse(serverURLStr)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	srvName = srvURL.Host
+
+	targets, err = LookupSRVTargets(srvName)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("SRV lookup failed: %s; Error: %w", srvName, err)
+	}
+
+	if len(targets) == 0 {
+		return "", nil, nil, fmt.Errorf("SRV record has no servers: %s", srvName)
+	}
+
+	for _, target := range targets {
+		targetURL := *srvURL
+		targetURL.Host = target.hostPort
+
+		targetServerStr := targetURL.String()
+		if serverOptions != "" {
+			targetServerStr += "," + serverOptions
+		}
+
+		serverStrs = append(serverStrs, targetServerStr)
+	}
+
+	return srvName, serverStrs, targets, nil
+}
+
+// HasSRVBackends returns true if any server was discovered through a SRV record
+func HasSRVBackends() bool {
+	for _, backend := range proxyState.backends {
+		if backend.srvName != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsRemoved returns true if the server is no longer in its SRV record
+func (backend *Backend) IsRemoved() bool {
+	return atomic.LoadUint32(&backend.isRemoved) != 0
+}
+
+// srvTargetWeight returns the effective schedule weight of a target
+func srvTargetWeight(target SRVTarget) uint32 {
+	if target.isDrained {
+		return 0
+	}
+
+	return target.weight
+}
+
+// RefreshDNSWeights periodically updates the weights and drain flags of servers from SRV records.
+// Servers that disappeared from their SRV record get removed from the schedule until they return.
+// New servers in a SRV record are ignored until restart.
+func RefreshDNSWeights() {
+	var ignoredTargets = make(map[string]bool) // key is SRV record name and target; to warn only once
+
+	for range time.Tick(config.dnsRefreshInterval) {
+		var srvBackends = make(map[string][]*Backend) // key is SRV record name
+
+		for _, backend := range proxyState.backends {
+			if backend.srvName != "" {
+				srvBackends[backend.srvName] = append(srvBackends[backend.srvName], backend)
+			}
+		}
+
+		var weights = make(map[*Backend]uint32)
+		var isRemovalChanged = false
+
+		for srvName, backends := range srvBackends {
+			targets, err := LookupSRVTargets(srvName)
+			if err != nil {
+				fmt.Printf("WARNING: SRV lookup failed, keeping previous weights: %s; Error: %v\n", srvName, err)
+				continue
+			}
+
+			var targetWeights = make(map[string]uint32)
+
+			for _, target := range targets {
+				targetWeights[target.hostPort] = srvTargetWeight(target)
+			}
+
+			for _, backend := range backends {
+				weight, exists := targetWeights[backend.targetURL.Host]
+				delete(targetWeights, backend.targetURL.Host)
+
+				if !exists {
+					if !backend.IsRemoved() {
+						fmt.Printf("WARNING: Server no longer in SRV record: %s; Server: %s\n", srvName, backend.serverStr)
+						atomic.StoreUint32(&backend.isRemoved, 1)
+						isRemovalChanged = true
+					}
+
+					continue // keep the weight for the return of the server
+				}
+
+				if backend.IsRemoved() {
+					fmt.Printf("Server returned to SRV record: %s; Server: %s\n", srvName, backend.serverStr)
+					atomic.StoreUint32(&backend.isRemoved, 0)
+					isRemovalChanged = true
+				}
+
+				if weight != backend.Weight() {
+					fmt.Printf("Server weight changed through DNS. Server: %s; Weight: %d -> %d\n", backend.serverStr, backend.Weight(), weight)
+					weights[backend] = weight
+				}
+			}
+
+			for hostPort := range targetWeights {
+				if ignoredTargets[srvName+" "+hostPort] {
+					continue
+				}
+
+				ignoredTargets[srvName+" "+hostPort] = true
+
+				fmt.Printf("WARNING: New server in SRV record is ignored until restart: %s; Server: %s\n", srvName, hostPort)
+			}
+		}
+
+		if len(weights) != 0 || isRemovalChanged {
+			SetBackendWeights(weights)
+		}
+	}
+}
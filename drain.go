@@ -0,0 +1,122 @@
+// Draining of specific clients: in-flight requests get finished, new requests get rejected
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const DefaultDrainMessage = "Client is being drained, no new requests accepted"
+
+type DrainState struct {
+	mutex   sync.RWMutex
+	clients map[string]string // key is canonical client IP, value is message for rejected requests
+	apiKeys map[string]string // key is API key, value is message for rejected requests
+}
+
+var drainState = DrainState{
+	clients: make(map[string]string),
+	apiKeys: make(map[string]string),
+}
+
+// RejectDrainedRequest replies with 503 and returns true if the client IP or API key of the request
+// is being drained
+func RejectDrainedRequest(w http.ResponseWriter, r *http.Request) bool {
+	drainState.mutex.RLock()
+
+	clientIP := ClientIP(r)
+	message, isDrained := drainState.clients[clientIP]
+
+	// e.g. from a header of "--realip" in another spelling than the canonical form
+	if !isDrained && len(drainState.clients) != 0 {
+		if ip := net.ParseIP(clientIP); ip != nil {
+			message, isDrained = drainState.clients[ip.String()]
+		}
+	}
+
+	if !isDrained && config.apiKeyHeader != "" {
+		message, isDrained = drainState.apiKeys[r.Header.Get(config.apiKeyHeader)]
+	}
+
+	drainState.mutex.RUnlock()
+
+	if isDrained {
+		HTTPMaintenanceError(w, r, http.StatusServiceUnavailable, message)
+	}
+
+	return isDrained
+}
+
+// DrainHandler is the admin interface endpoint to manage drained clients:
+// GET lists drained clients and API keys, POST starts draining and DELETE stops draining
+// of the client given by query parameter "client=IP" or "apikey=KEY". Query parameter "message"
+// optionally sets the message for rejected requests.
+func DrainHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.URL.Query().Get("client")
+	apiKey := r.URL.Query().Get("apikey")
+	message := r.URL.Query().Get("message")
+
+	if message == "" {
+		message = DefaultDrainMessage
+	}
+
+	if r.Method != http.MethodGet {
+		if (clientIP == "") == (apiKey == "") {
+			http.Error(w, "Exactly one of query parameters \"client\" or \"apikey\" required", http.StatusBadRequest)
+			return
+		}
+
+		if clientIP != "" {
+			ip := net.ParseIP(clientIP)
+			if ip == nil {
+				http.Error(w, "Invalid client IP: "+clientIP, http.StatusBadRequest)
+				return
+			}
+
+			clientIP = ip.String() // e.g. "::ffff:10.0.0.1" as "10.0.0.1"
+		}
+	}
+
+	drainState.mutex.Lock()
+	defer drainState.mutex.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if clientIP != "" {
+			drainState.clients[clientIP] = message
+		} else {
+			drainState.apiKeys[apiKey] = message
+		}
+	case http.MethodDelete:
+		delete(drainState.clients, clientIP)
+		delete(drainState.apiKeys, apiKey)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// reply with current state; API keys are secret, so only show tenant names
+	var drained struct {
+		Clients map[string]string `json:"clients"`
+		Tenants map[string]string `json:"tenants"`
+	}
+
+	drained.Clients = drainState.clients
+	drained.Tenants = make(map[string]string)
+
+	for apiKey, message := range drainState.apiKeys {
+		if tenant, exists := proxyState.tenants[apiKey]; exists {
+			drained.Tenants[tenant.name] = message
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(drained)
+}
@@ -0,0 +1,191 @@
+// Classification of errors of requests toward servers, to distinguish e.g. "server down" from
+// "network flaky" and "server too slow"
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+type ErrorClass int
+
+const (
+	ErrorClassDNS ErrorClass = iota
+	ErrorClassConnectRefused
+	ErrorClassConnectTimeout
+	ErrorClassConnect // other connection setup errors, e.g. "no route to host"
+	ErrorClassTLS
+	ErrorClassReset
+	ErrorClassHeaderTimeout
+	ErrorClassBodyTimeout
+	ErrorClassCanceled // client canceled the request, so not the fault of the server
+	ErrorClassOther
+
+	NumErrorClasses // not a class, only used for array sizes
+)
+
+var errorClassNames = [NumErrorClasses]string{
+	"dns",
+	"connectRefused",
+	"connectTimeout",
+	"connect",
+	"tls",
+	"reset",
+	"headerTimeout",
+	"bodyTimeout",
+	"canceled",
+	"other",
+}
+
+func (class ErrorClass) String() string {
+	return errorClassNames[class]
+}
+
+// ClassifyUpstreamError determines the error class of a failed request toward a server.
+// isBodyPhase is true for errors while reading the response body, false for errors until the
+// response headers were received.
+func ClassifyUpstreamError(err error, isBodyPhase bool) ErrorClass {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var recordHeaderErr tls.RecordHeaderError
+	var certInvalidErr x509.CertificateInvalidError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.As(err, &dnsErr):
+		return ErrorClassDNS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		if opErr.Timeout() {
+			return ErrorClassConnectTimeout
+		}
+
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return ErrorClassConnectRefused
+		}
+
+		return ErrorClassConnect
+	case errors.As(err, &recordHeaderErr), errors.As(err, &certInvalidErr),
+		errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr),
+		strings.Contains(err.Error(), "tls:"), strings.Contains(err.Error(), "TLS handshake"):
+		return ErrorClassTLS
+	case errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, context.DeadlineExceeded):
+		if isBodyPhase {
+			return ErrorClassBodyTimeout
+		}
+
+		return ErrorClassHeaderTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorClassReset
+	}
+
+	return ErrorClassOther
+}
+
+// CountError increments the counter of the given error class for this backend
+func (backend *Backend) CountError(class ErrorClass) {
+	atomic.AddUint64(&backend.errorCounts[class], 1)
+
+	if backend.health != nil {
+		backend.RecordFailure(class)
+	}
+}
+
+// ErrorCounts returns a copy of the error counters of this backend, mapped by class name
+func (backend *Backend) ErrorCounts() map[string]uint64 {
+	errorCounts := make(map[string]uint64)
+
+	for class := ErrorClass(0); class < NumErrorClasses; class++ {
+		errorCounts[class.String()] = atomic.LoadUint64(&backend.errorCounts[class])
+	}
+
+	return errorCounts
+}
+
+// ProxyErrorHandler is the httputil.ReverseProxy hook for requests that failed before the response
+// headers were received
+func (backend *Backend) ProxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	// client disconnect or the client's own deadline is not a server error
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		atomic.AddUint64(&proxyState.upstreamCancels, 1)
+
+		if config.beVerbose {
+			fmt.Printf("Request canceled by client. Server: %s; Request: %s %s; Reason: %v\n", backend.serverStr, r.Method, r.URL.String(), ctxErr)
+		}
+
+		w.WriteHeader(CanceledRequestStatus(ctxErr))
+		return
+	}
+
+	class := ClassifyUpstreamError(err, false)
+
+	backend.CountError(class)
+	NotifyBalancerFailure(r.Context(), backend, class)
+	backend.ObserveAdaptiveConns(r.Context(), true)
+
+	fmt.Printf("Proxy error. Server: %s; Class: %s; Request: %s %s; Error: %v\n", backend.serverStr, class, r.Method, r.URL.String(), err)
+
+	if !WriteErrorPage(w, r, http.StatusBadGateway, "Request to server failed: "+class.String(), false) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// CanceledRequestStatus returns the response status for a request that was canceled by the client
+// (the status only matters if the client canceled through a deadline and is still connected)
+func CanceledRequestStatus(ctxErr error) int {
+	if errors.Is(ctxErr, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusServiceUnavailable
+}
+
+// AbortCanceledRequest accounts a request that was canceled by the client while waiting for a
+// connection slot
+func AbortCanceledRequest(w http.ResponseWriter, r *http.Request, ctxErr error) {
+	atomic.AddUint64(&proxyState.queuedCancels, 1)
+
+	if config.beVerbose {
+		fmt.Printf("Request canceled by client while queued: %s %s (Client: %s); Reason: %v\n", r.Method, r.URL.String(), ClientIP(r), ctxErr)
+	}
+
+	w.WriteHeader(CanceledRequestStatus(ctxErr))
+}
+
+// errorClassifyingReader wraps a response body to classify errors while reading it
+type errorClassifyingReader struct {
+	io.ReadCloser
+	backend *Backend
+	ctx     context.Context // context of the request to the server
+}
+
+func (reader *errorClassifyingReader) Read(buf []byte) (int, error) {
+	numRead, err := reader.ReadCloser.Read(buf)
+
+	if err != nil && err != io.EOF {
+		if reader.ctx.Err() != nil {
+			atomic.AddUint64(&proxyState.upstreamCancels, 1)
+		} else {
+			class := ClassifyUpstreamError(err, true)
+
+			reader.backend.CountError(class)
+			NotifyBalancerFailure(reader.ctx, reader.backend, class)
+		}
+	}
+
+	return numRead, err
+}
@@ -0,0 +1,335 @@
+// Error and maintenance pages from user-provided Go templates instead of the plain-text messages,
+// e.g. for branded HTML pages or JSON errors for API clients. The templates get loaded from a
+// directory and can be reloaded at runtime through the admin interface.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
+	"time"
+)
+
+// ErrorTemplateDefault is the name of the template for all error responses without a more specific
+// template, e.g. "default.html"
+const ErrorTemplateDefault = "default"
+
+// ErrorTemplateMaintenance is the name of the template for responses to drained clients and for
+// requests while no server is available, e.g. "maintenance.html"
+const ErrorTemplateMaintenance = "maintenance"
+
+// errorTemplateContentTypes maps the file extensions of templates to the content type of the
+// response. Templates with extension ".html" get the context-aware escaping of html/template.
+var errorTemplateContentTypes = map[string]string{
+	".html": "text/html; charset=utf-8",
+	".json": "application/json",
+	".txt":  "text/plain; charset=utf-8",
+}
+
+// ErrorPageData are the variables of error page templates, e.g. "{{.Status}}" or "{{.Message}}"
+type ErrorPageData struct {
+	Status     int    // e.g. 503
+	StatusText string // e.g. "Service Unavailable"
+	Message    string // message of the plain-text response, e.g. the message of "/drain"
+	Method     string
+	Host       string
+	Path       string
+	RequestURI string
+	ClientIP   string
+	TraceID    string // from "traceparent" header; empty if none
+	Instance   string // "--instance" name
+	Time       time.Time
+}
+
+// errorTemplate is a loaded template file
+type errorTemplate struct {
+	fileName    string
+	contentType string
+	template    interface {
+		Execute(writer io.Writer, data interface{}) error
+	}
+}
+
+// errorTemplateSet are the templates of a load, by name (status code, status class like "5xx",
+// ErrorTemplateDefault or ErrorTemplateMaintenance) and extension
+type errorTemplateSet struct {
+	templates map[string]map[string]*errorTemplate
+	loadTime  time.Time
+}
+
+var errorTemplateState struct {
+	mutex sync.Mutex   // serializes loads
+	set   atomic.Value // *errorTemplateSet; unset if error templates disabled
+}
+
+// errorTemplateFuncs are available in all templates, e.g. "{{json .Message}}" for a quoted JSON
+// string
+var errorTemplateFuncs = map[string]interface{}{
+	"json": func(value interface{}) (string, error) {
+		jsonValue, err := json.Marshal(value)
+		return string(jsonValue), err
+	},
+}
+
+// isErrorTemplateName returns true for a status code, a status class (e.g. "5xx") or one of the
+// special names
+func isErrorTemplateName(name string) bool {
+	if name == ErrorTemplateDefault || name == ErrorTemplateMaintenance {
+		return true
+	}
+
+	if len(name) != 3 {
+		return false
+	}
+
+	if strings.HasSuffix(name, "xx") {
+		return name[0] >= '1' && name[0] <= '5'
+	}
+
+	code, err := strconv.Atoi(name)
+
+	return err == nil && code >= 100 && code <= 599
+}
+
+// LoadErrorTemplates loads all templates of config.errorTemplateDir in the format "NAME.EXT" and
+// replaces the current templates if all of them are valid
+func LoadErrorTemplates() error {
+	errorTemplateState.mutex.Lock()
+	defer errorTemplateState.mutex.Unlock()
+
+	dirEntries, err := os.ReadDir(config.errorTemplateDir)
+	if err != nil {
+		return err
+	}
+
+	var templateSet = &errorTemplateSet{
+		templates: make(map[string]map[string]*errorTemplate),
+		loadTime:  time.Now(),
+	}
+
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+
+		var extension = filepath.Ext(dirEntry.Name())
+		var name = strings.TrimSuffix(dirEntry.Name(), extension)
+
+		contentType, isKnownExtension := errorTemplateContentTypes[extension]
+		if !isKnownExtension || !isErrorTemplateName(name) {
+			return fmt.Errorf("Invalid error template file name: %s (Expected: "+
+				"STATUS|CLASS|%s|%s.html|json|txt, e.g. 503.html or 5xx.json)", dirEntry.Name(),
+				ErrorTemplateDefault, ErrorTemplateMaintenance)
+		}
+
+		errTemplate, err := parseErrorTemplate(filepath.Join(config.errorTemplateDir, dirEntry.Name()))
+		if err != nil {
+			return err
+		}
+
+		errTemplate.contentType = contentType
+
+		if templateSet.templates[name] == nil {
+			templateSet.templates[name] = make(map[string]*errorTemplate)
+		}
+
+		templateSet.templates[name][extension] = errTemplate
+	}
+
+	if len(templateSet.templates) == 0 {
+		return fmt.Errorf("No error templates found in directory: %s", config.errorTemplateDir)
+	}
+
+	errorTemplateState.set.Store(templateSet)
+
+	return nil
+}
+
+// parseErrorTemplate parses the template file and checks that it can be executed
+func parseErrorTemplate(path string) (*errorTemplate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var errTemplate = &errorTemplate{fileName: filepath.Base(path)}
+
+	if filepath.Ext(path) == ".html" {
+		errTemplate.template, err = htmltemplate.New(errTemplate.fileName).
+			Funcs(errorTemplateFuncs).Parse(string(content))
+	} else {
+		errTemplate.template, err = texttemplate.New(errTemplate.fileName).
+			Funcs(errorTemplateFuncs).Parse(string(content))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// e.g. references of unknown variables only fail on execution
+	var testData = ErrorPageData{Status: http.StatusServiceUnavailable,
+		StatusText: http.StatusText(http.StatusServiceUnavailable), Time: time.Now()}
+
+	if err := errTemplate.template.Execute(io.Discard, testData); err != nil {
+		return nil, err
+	}
+
+	return errTemplate, nil
+}
+
+// preferredErrorTemplateExtensions returns the template extensions in the order of preference
+// according to the "Accept" header of the request
+func preferredErrorTemplateExtensions(r *http.Request) []string {
+	accept := r.Header.Get("Accept")
+
+	switch {
+	case strings.Contains(accept, "json"):
+		return []string{".json", ".txt", ".html"}
+	case strings.Contains(accept, "html"):
+		return []string{".html", ".txt", ".json"}
+	}
+
+	return []string{".txt", ".html", ".json"}
+}
+
+// WriteErrorPage replies with the error page of the most specific template for the status code
+// (maintenance template if isMaintenance, status code, status class, default template). Returns
+// false if no template applies, so that the caller has to reply without template.
+func WriteErrorPage(w http.ResponseWriter, r *http.Request, code int, message string,
+	isMaintenance bool) bool {
+	templateSet, _ := errorTemplateState.set.Load().(*errorTemplateSet)
+	if templateSet == nil {
+		return false
+	}
+
+	var names = []string{strconv.Itoa(code), strconv.Itoa(code/100) + "xx", ErrorTemplateDefault}
+	if isMaintenance {
+		names = append([]string{ErrorTemplateMaintenance}, names...)
+	}
+
+	var errTemplate *errorTemplate
+
+	for _, name := range names {
+		for _, extension := range preferredErrorTemplateExtensions(r) {
+			if errTemplate = templateSet.templates[name][extension]; errTemplate != nil {
+				break
+			}
+		}
+
+		if errTemplate != nil {
+			break
+		}
+	}
+
+	if errTemplate == nil {
+		return false
+	}
+
+	var data = ErrorPageData{
+		Status:     code,
+		StatusText: http.StatusText(code),
+		Message:    message,
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		RequestURI: r.RequestURI,
+		ClientIP:   ClientIP(r),
+		TraceID:    TraceID(r.Header),
+		Instance:   config.instanceName,
+		Time:       time.Now(),
+	}
+
+	var page bytes.Buffer
+
+	if err := errTemplate.template.Execute(&page, data); err != nil {
+		if config.beVerbose {
+			fmt.Printf("Rendering error template failed. Template: %s; Error: %v\n",
+				errTemplate.fileName, err)
+		}
+
+		return false
+	}
+
+	w.Header().Set("Content-Type", errTemplate.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(code)
+	w.Write(page.Bytes())
+
+	return true
+}
+
+// HTTPMaintenanceError replies like HTTPError, but with the maintenance template if available,
+// e.g. for drained clients
+func HTTPMaintenanceError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	if config.beVerbose {
+		fmt.Printf("[ERROR %d]: %s %s (Client: %s): %s\n", code, r.Method, r.URL.String(), ClientIP(r), message)
+	}
+
+	if !WriteErrorPage(w, r, code, message, true) {
+		http.Error(w, message, code)
+	}
+}
+
+// ErrorTemplatesHandler is the admin handler to list the loaded error templates (GET) or to reload
+// them from the template directory (POST)
+func ErrorTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	if config.errorTemplateDir == "" {
+		http.Error(w, "Error templates disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := LoadErrorTemplates(); err != nil {
+			http.Error(w, "Loading error templates failed, keeping current templates: "+err.Error(),
+				http.StatusBadRequest)
+			return
+		}
+
+		fmt.Printf("Reloaded error templates through admin interface. Dir: %s\n",
+			config.errorTemplateDir)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// reply with current state
+	var templatesState struct {
+		Dir       string    `json:"dir"`
+		Templates []string  `json:"templates"` // file names
+		LoadTime  time.Time `json:"loadTime"`
+	}
+
+	templateSet := errorTemplateState.set.Load().(*errorTemplateSet)
+
+	templatesState.Dir = config.errorTemplateDir
+	templatesState.LoadTime = templateSet.loadTime
+
+	for _, extensionTemplates := range templateSet.templates {
+		for _, errTemplate := range extensionTemplates {
+			templatesState.Templates = append(templatesState.Templates, errTemplate.fileName)
+		}
+	}
+
+	sort.Strings(templatesState.Templates)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(templatesState)
+}
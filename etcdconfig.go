@@ -0,0 +1,251 @@
+// Shared configuration in etcd (through its v3 HTTP/JSON gateway), which gets watched for changes to
+// reconfigure a fleet of proxy instances centrally
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// EtcdRetryInterval is the wait time before the watch on etcd gets re-established after an error
+const EtcdRetryInterval = 5 * time.Second
+
+// ReconfigureDrainTimeout is the max time to wait for active requests to complete before restarting
+// with a changed configuration
+const ReconfigureDrainTimeout = 30 * time.Second
+
+// ParseConfigText returns the command line arguments of a configuration text. Each line contains an
+// option with optional value (e.g. "--maxconns 8") or a server. Empty lines and lines starting with
+// "#" are ignored. Options become single "--name=value" arguments and servers come after all
+// options, because flag parsing stops at the first argument that is not an option.
+func ParseConfigText(text string) []string {
+	var options, servers []string
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "-") {
+			servers = append(servers, line)
+			continue
+		}
+
+		// e.g. "--sse true" as "--sse=true", because bool options don't take a separate value
+		option, value, hasValue := strings.Cut(line, " ")
+
+		if hasValue && !strings.Contains(option, "=") {
+			line = option + "=" + strings.TrimSpace(value)
+		}
+
+		options = append(options, line)
+	}
+
+	return append(options, servers...)
+}
+
+// etcdKeyValue is a key-value pair in the JSON format of the etcd v3 gateway (int64 as string)
+type etcdKeyValue struct {
+	Key         []byte `json:"key"` // []byte for base64 decoding
+	Value       []byte `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+// etcdPost sends a request to the etcd v3 gateway
+func etcdPost(ctx context.Context, path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(config.etcdURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd request failed: %s; Status: %s", path, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// LoadEtcdConfig returns the configuration text from config.etcdKey and its revision
+func LoadEtcdConfig() (text string, revision string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+
+	resp, err := etcdPost(ctx, "/v3/kv/range", map[string][]byte{"key": []byte(config.etcdKey)})
+	if err != nil {
+		return "", "", err
+	}
+
+	defer resp.Body.Close()
+
+	var rangeResp struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&rangeResp); err != nil {
+		return "", "", fmt.Errorf("Invalid etcd response: %w", err)
+	}
+
+	if len(rangeResp.Kvs) == 0 {
+		return "", "", errors.New("Config key not found in etcd: " + config.etcdKey)
+	}
+
+	return string(rangeResp.Kvs[0].Value), rangeResp.Kvs[0].ModRevision, nil
+}
+
+// WatchEtcdConfig waits for changes of config.etcdKey after the given revision and restarts the
+// proxy with the changed configuration
+func WatchEtcdConfig(revision string) {
+	for {
+		changedText, changedRevision, err := waitEtcdConfigChange(revision)
+
+		// the revision of the last event, so that the next watch doesn't replay older changes
+		revision = changedRevision
+
+		if err != nil {
+			fmt.Println("WARNING: Watching config in etcd failed:", err)
+			time.Sleep(EtcdRetryInterval)
+
+			continue
+		}
+
+		if config.beVerbose {
+			fmt.Printf("Config changed in etcd:\n%s\n", changedText)
+		}
+
+		if err := Reconfigure(); err != nil {
+			fmt.Println("WARNING: Ignoring changed config from etcd:", err)
+		}
+	}
+}
+
+// waitEtcdConfigChange returns the new configuration text and its revision after the first change
+// of the config key. Also returns the revision of the last event (or the given revision if none) on
+// error.
+func waitEtcdConfigChange(revision string) (string, string, error) {
+	var startRevision int64
+
+	fmt.Sscan(revision, &startRevision)
+
+	resp, err := etcdPost(context.Background(), "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(config.etcdKey),
+			"start_revision": startRevision + 1,
+		},
+	})
+	if err != nil {
+		return "", revision, err
+	}
+
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+
+	for {
+		var watchResp struct {
+			Result struct {
+				Events []struct {
+					Type string       `json:"type"` // "PUT" is omitted as default value
+					Kv   etcdKeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}
+
+		if err := decoder.Decode(&watchResp); err != nil {
+			return "", revision, err
+		}
+
+		for _, event := range watchResp.Result.Events {
+			if event.Kv.ModRevision != "" {
+				revision = event.Kv.ModRevision
+			}
+
+			if event.Type == "DELETE" {
+				fmt.Println("WARNING: Config key was deleted from etcd, keeping current config:", config.etcdKey)
+				continue
+			}
+
+			return string(event.Kv.Value), revision, nil
+		}
+	}
+}
+
+// Reconfigure checks the current configuration through a "--checkconfig" run of the executable and,
+// if the check succeeds, restarts the proxy after active requests completed
+func Reconfigure() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	checkCmd := exec.Command(executable, append([]string{"--checkconfig"}, os.Args[1:]...)...)
+
+	if checkOutput, err := CombinedOutputOfChild(checkCmd); err != nil {
+		return fmt.Errorf("Config check failed: %w\n%s", err, checkOutput)
+	}
+
+	fmt.Println("Restarting with changed config...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), ReconfigureDrainTimeout)
+	defer cancel()
+
+	proxyState.server.Shutdown(ctx)
+
+	StopJSONLog() // the restarted proxy continues with the original stdout
+
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
+
+// MergeEtcdArguments parses the configuration from etcd as command line arguments. Options on the
+// actual command line get applied afterwards to override them. Returns the servers from etcd, which
+// are used if the command line has no servers.
+func MergeEtcdArguments() (etcdServers []string) {
+	text, revision, err := LoadEtcdConfig()
+	if err != nil {
+		fmt.Println("ERROR: Loading config from etcd failed:", err)
+		os.Exit(1)
+	}
+
+	proxyState.etcdRevision = revision
+
+	etcdArgs := ParseConfigText(text)
+
+	flag.CommandLine.Parse(etcdArgs) // exits on error
+
+	etcdServers = flag.Args()
+
+	RecordEtcdOptions(etcdArgs)
+
+	flag.CommandLine.Parse(os.Args[1:])
+
+	return etcdServers
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigText(t *testing.T) {
+	text := `# fleet config
+http://s1:9000
+
+--maxconns 8
+--sse true
+-cachesize=1024
+--verbose
+http://s2:9000,weight=2
+--apikeyheader  X-Tenant-Key
+--instance=edge 1
+`
+
+	want := []string{"--maxconns=8", "--sse=true", "-cachesize=1024", "--verbose",
+		"--apikeyheader=X-Tenant-Key", "--instance=edge 1", "http://s1:9000", "http://s2:9000,weight=2"}
+
+	if got := ParseConfigText(text); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseConfigText() = %q; want %q", got, want)
+	}
+}
+
+func TestWaitEtcdConfigChangeRevision(t *testing.T) {
+	var startRevisions []int64
+
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var watchReq struct {
+			CreateRequest struct {
+				StartRevision int64 `json:"start_revision"`
+			} `json:"create_request"`
+		}
+
+		json.NewDecoder(r.Body).Decode(&watchReq)
+
+		startRevisions = append(startRevisions, watchReq.CreateRequest.StartRevision)
+
+		// the stream ends after a deletion of the key
+		w.Write([]byte(`{"result":{"events":[{"type":"DELETE","kv":{"mod_revision":"7"}}]}}`))
+	}))
+	defer etcd.Close()
+
+	savedConfig := config
+	defer func() { config = savedConfig }()
+
+	config.etcdURL = etcd.URL
+
+	_, revision, err := waitEtcdConfigChange("5")
+	if err == nil || revision != "7" {
+		t.Fatalf("waitEtcdConfigChange() = %q, %v; want revision 7 of deletion and error", revision, err)
+	}
+
+	waitEtcdConfigChange(revision)
+
+	if want := []int64{6, 8}; !reflect.DeepEqual(startRevisions, want) {
+		t.Errorf("start revisions = %v; want %v", startRevisions, want)
+	}
+}
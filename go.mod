@@ -2,4 +2,6 @@ module github.com/breuner/proxperfect
 
 go 1.18
 
-require golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f 
+require golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f
+
+require github.com/expr-lang/expr v1.17.8
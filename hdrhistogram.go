@@ -0,0 +1,423 @@
+// HdrHistogram-compatible latency histograms (https://hdrhistogram.github.io/HdrHistogram/), which
+// can be exported as interval log (".hlog") and percentile distribution (".hgrm") for analysis
+// tools like HistogramLogAnalyzer or the HdrHistogram plotter.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	HdrLowestValue       = 1                  // microseconds
+	HdrHighestValue      = 3600 * 1000 * 1000 // 1 hour in microseconds; higher values get clamped
+	HdrSignificantDigits = 3
+	HdrValueUnitRatio    = 1000 // exported values are in milliseconds
+)
+
+// cookies of the V2 encoding (with LEB128 counts) and its zlib-compressed variant
+const (
+	hdrEncodingCookie           = 0x1c849303 | 0x10
+	hdrCompressedEncodingCookie = 0x1c849304 | 0x10
+)
+
+// HdrHistogram records values in microseconds with the layout of the reference implementation, so
+// that the encoded histogram can be decoded by HdrHistogram libraries. Not thread-safe.
+type HdrHistogram struct {
+	counts     []int64
+	totalCount int64
+	maxValue   int64
+	startTime  time.Time // start of recording
+
+	unitMagnitude               uint
+	subBucketHalfCountMagnitude uint
+	subBucketHalfCount          int64
+	subBucketCount              int64
+	subBucketMask               int64
+	bucketCount                 int
+	leadingZeroCountBase        int
+}
+
+func NewHdrHistogram() *HdrHistogram {
+	// sub-buckets of a bucket resolve values with HdrSignificantDigits
+	var largestValueWithSingleUnitResolution = 2 * math.Pow10(HdrSignificantDigits)
+	var subBucketCountMagnitude = uint(math.Ceil(math.Log2(largestValueWithSingleUnitResolution)))
+
+	histogram := &HdrHistogram{
+		startTime:                   time.Now(),
+		unitMagnitude:               uint(math.Floor(math.Log2(HdrLowestValue))),
+		subBucketHalfCountMagnitude: subBucketCountMagnitude - 1,
+		subBucketHalfCount:          int64(1) << (subBucketCountMagnitude - 1),
+		subBucketCount:              int64(1) << subBucketCountMagnitude,
+	}
+
+	histogram.subBucketMask = (histogram.subBucketCount - 1) << histogram.unitMagnitude
+	histogram.leadingZeroCountBase = 64 - int(histogram.unitMagnitude) - int(histogram.subBucketHalfCountMagnitude) - 1
+
+	// each bucket covers twice the value range of the previous bucket
+	var smallestUntrackableValue = histogram.subBucketCount << histogram.unitMagnitude
+
+	for histogram.bucketCount = 1; smallestUntrackableValue <= HdrHighestValue; histogram.bucketCount++ {
+		smallestUntrackableValue <<= 1
+	}
+
+	histogram.counts = make([]int64, (histogram.bucketCount+1)*int(histogram.subBucketHalfCount))
+
+	return histogram
+}
+
+// Record adds a latency to the histogram
+func (histogram *HdrHistogram) Record(latency time.Duration) {
+	var value = latency.Microseconds()
+
+	if value < 0 {
+		value = 0
+	} else if value > HdrHighestValue {
+		value = HdrHighestValue
+	}
+
+	histogram.counts[histogram.countsIndex(value)]++
+	histogram.totalCount++
+
+	if value > histogram.maxValue {
+		histogram.maxValue = value
+	}
+}
+
+// Add adds the counts of another histogram to this histogram
+func (histogram *HdrHistogram) Add(other *HdrHistogram) {
+	for i, count := range other.counts {
+		histogram.counts[i] += count
+	}
+
+	histogram.totalCount += other.totalCount
+
+	if other.maxValue > histogram.maxValue {
+		histogram.maxValue = other.maxValue
+	}
+
+	if other.startTime.Before(histogram.startTime) {
+		histogram.startTime = other.startTime
+	}
+}
+
+// Copy returns a copy of the histogram
+func (histogram *HdrHistogram) Copy() *HdrHistogram {
+	histogramCopy := *histogram
+	histogramCopy.counts = append([]int64(nil), histogram.counts...)
+
+	return &histogramCopy
+}
+
+func (histogram *HdrHistogram) bucketIndex(value int64) int {
+	return histogram.leadingZeroCountBase - bits.LeadingZeros64(uint64(value|histogram.subBucketMask))
+}
+
+func (histogram *HdrHistogram) countsIndex(value int64) int {
+	var bucketIdx = histogram.bucketIndex(value)
+	var subBucketIdx = value >> (uint(bucketIdx) + histogram.unitMagnitude)
+
+	return (bucketIdx+1)<<histogram.subBucketHalfCountMagnitude + int(subBucketIdx-histogram.subBucketHalfCount)
+}
+
+// valueFromIndex returns the lowest value of the equivalence range of a counts index
+func (histogram *HdrHistogram) valueFromIndex(index int) int64 {
+	var bucketIdx = index>>histogram.subBucketHalfCountMagnitude - 1
+	var subBucketIdx = int64(index)&(histogram.subBucketHalfCount-1) + histogram.subBucketHalfCount
+
+	if bucketIdx < 0 {
+		subBucketIdx -= histogram.subBucketHalfCount
+		bucketIdx = 0
+	}
+
+	return subBucketIdx << (uint(bucketIdx) + histogram.unitMagnitude)
+}
+
+// sizeOfEquivalentRange returns the size of the range of values that are counted as the same value
+func (histogram *HdrHistogram) sizeOfEquivalentRange(value int64) int64 {
+	var bucketIdx = histogram.bucketIndex(value)
+	var subBucketIdx = value >> (uint(bucketIdx) + histogram.unitMagnitude)
+
+	if subBucketIdx >= histogram.subBucketCount {
+		bucketIdx++
+	}
+
+	return int64(1) << (histogram.unitMagnitude + uint(bucketIdx))
+}
+
+func (histogram *HdrHistogram) highestEquivalentValue(index int) int64 {
+	var value = histogram.valueFromIndex(index)
+
+	return value + histogram.sizeOfEquivalentRange(value) - 1
+}
+
+// ValueAtPercentile returns the latency at the given percentile (0-100) or 0 if the histogram is
+// empty
+func (histogram *HdrHistogram) ValueAtPercentile(percentile float64) time.Duration {
+	if histogram.totalCount == 0 {
+		return 0
+	}
+
+	var countAtPercentile = int64(math.Ceil(percentile / 100 * float64(histogram.totalCount)))
+	if countAtPercentile < 1 {
+		countAtPercentile = 1
+	}
+
+	var cumulativeCount int64
+
+	for index, count := range histogram.counts {
+		cumulativeCount += count
+
+		if cumulativeCount >= countAtPercentile {
+			return time.Duration(histogram.highestEquivalentValue(index)) * time.Microsecond
+		}
+	}
+
+	return time.Duration(histogram.maxValue) * time.Microsecond
+}
+
+// Encode returns the histogram in the compressed V2 encoding of HdrHistogram
+func (histogram *HdrHistogram) Encode() []byte {
+	var relevantLength int
+
+	if histogram.totalCount > 0 {
+		relevantLength = histogram.countsIndex(histogram.maxValue) + 1
+	}
+
+	// counts as ZigZag LEB128, with runs of zeros as negative number of zeros
+	var payload bytes.Buffer
+	var varintBuf [binary.MaxVarintLen64]byte
+
+	for i := 0; i < relevantLength; {
+		var count = histogram.counts[i]
+		i++
+
+		if count == 0 {
+			var numZeros int64 = 1
+
+			for i < relevantLength && histogram.counts[i] == 0 {
+				numZeros++
+				i++
+			}
+
+			if numZeros > 1 {
+				count = -numZeros
+			}
+		}
+
+		payload.Write(varintBuf[:binary.PutVarint(varintBuf[:], count)])
+	}
+
+	var encoded bytes.Buffer
+
+	binary.Write(&encoded, binary.BigEndian, []int32{hdrEncodingCookie, int32(payload.Len()),
+		0, HdrSignificantDigits}) // 0 is the normalizing index offset
+	binary.Write(&encoded, binary.BigEndian, []int64{HdrLowestValue, HdrHighestValue})
+	binary.Write(&encoded, binary.BigEndian, float64(1)) // integer to double conversion ratio
+	encoded.Write(payload.Bytes())
+
+	var compressed bytes.Buffer
+
+	zlibWriter := zlib.NewWriter(&compressed)
+	zlibWriter.Write(encoded.Bytes())
+	zlibWriter.Close()
+
+	var result bytes.Buffer
+
+	binary.Write(&result, binary.BigEndian, []int32{hdrCompressedEncodingCookie, int32(compressed.Len())})
+	result.Write(compressed.Bytes())
+
+	return result.Bytes()
+}
+
+// WritePercentileDistribution writes the percentile distribution in the format of the reference
+// implementation (".hgrm") with values in milliseconds
+func (histogram *HdrHistogram) WritePercentileDistribution(writer io.Writer) {
+	const ticksPerHalfDistance = 5
+
+	fmt.Fprintf(writer, "%12s %14s %10s %14s\n\n", "Value", "Percentile", "TotalCount", "1/(1-Percentile)")
+
+	var sum, sumOfSquares float64
+	var cumulativeCount int64
+	var index int
+
+	for percentile := 0.0; histogram.totalCount > 0; {
+		var countAtPercentile = int64(math.Ceil(percentile / 100 * float64(histogram.totalCount)))
+		if countAtPercentile < 1 {
+			countAtPercentile = 1
+		}
+
+		for cumulativeCount < countAtPercentile {
+			cumulativeCount += histogram.counts[index]
+			index++
+		}
+
+		var value = float64(histogram.highestEquivalentValue(index-1)) / HdrValueUnitRatio
+
+		if cumulativeCount == histogram.totalCount {
+			fmt.Fprintf(writer, "%12.3f %2.12f %10d\n", value, 1.0, cumulativeCount)
+			break
+		}
+
+		fmt.Fprintf(writer, "%12.3f %2.12f %10d %14.2f\n", value, percentile/100, cumulativeCount,
+			1/(1-percentile/100))
+
+		// ticks get denser with each halving of the distance to 100%
+		var numTicks = ticksPerHalfDistance * math.Pow(2, math.Floor(math.Log2(100/(100-percentile)))+1)
+
+		percentile += 100 / numTicks
+	}
+
+	for i, count := range histogram.counts {
+		if count != 0 {
+			value := histogram.valueFromIndex(i)
+			medianValue := float64(value+histogram.sizeOfEquivalentRange(value)/2) / HdrValueUnitRatio
+
+			sum += medianValue * float64(count)
+			sumOfSquares += medianValue * medianValue * float64(count)
+		}
+	}
+
+	var mean, stdDeviation float64
+
+	if histogram.totalCount > 0 {
+		mean = sum / float64(histogram.totalCount)
+		stdDeviation = math.Sqrt(math.Max(0, sumOfSquares/float64(histogram.totalCount)-mean*mean))
+	}
+
+	var maxValue float64
+	if histogram.totalCount > 0 {
+		maxValue = float64(histogram.highestEquivalentValue(histogram.countsIndex(histogram.maxValue))) / HdrValueUnitRatio
+	}
+
+	fmt.Fprintf(writer, "#[Mean    = %12.3f, StdDeviation   = %12.3f]\n", mean, stdDeviation)
+	fmt.Fprintf(writer, "#[Max     = %12.3f, Total count    = %12d]\n", maxValue, histogram.totalCount)
+	fmt.Fprintf(writer, "#[Buckets = %12d, SubBuckets     = %12d]\n", histogram.bucketCount, histogram.subBucketCount)
+}
+
+// hdrLogWriter writes histograms in the HdrHistogram interval log format (version 1.3)
+type hdrLogWriter struct {
+	writer    io.Writer
+	startTime time.Time
+}
+
+func NewHdrLogWriter(writer io.Writer, startTime time.Time) *hdrLogWriter {
+	logWriter := &hdrLogWriter{writer: writer, startTime: startTime}
+
+	fmt.Fprintf(writer, "#[Logged with %s %s]\n", ProgName, ProgVersion)
+	fmt.Fprintf(writer, "#[Histogram log format version 1.3]\n")
+	fmt.Fprintf(writer, "#[StartTime: %.3f (seconds since epoch), %s]\n",
+		float64(startTime.UnixNano())/1e9, startTime.Format(time.UnixDate))
+	fmt.Fprintf(writer, "#[Values in microseconds; tags are server indices]\n")
+
+	for i, backend := range proxyState.backends {
+		fmt.Fprintf(writer, "#[Tag server%d: %s]\n", i, backend.serverStr)
+	}
+
+	fmt.Fprintf(writer, "\"StartTimestamp\",\"Interval_Length\",\"Interval_Max\",\"Interval_Compressed_Histogram\"\n")
+
+	return logWriter
+}
+
+// WriteInterval writes the histogram of the time from its start time to endTime
+func (logWriter *hdrLogWriter) WriteInterval(tag string, histogram *HdrHistogram, endTime time.Time) error {
+	var maxValue float64
+	if histogram.totalCount > 0 {
+		maxValue = float64(histogram.highestEquivalentValue(histogram.countsIndex(histogram.maxValue))) / HdrValueUnitRatio
+	}
+
+	_, err := fmt.Fprintf(logWriter.writer, "Tag=%s,%.3f,%.3f,%.3f,%s\n", tag,
+		histogram.startTime.Sub(logWriter.startTime).Seconds(), endTime.Sub(histogram.startTime).Seconds(),
+		maxValue, base64.StdEncoding.EncodeToString(histogram.Encode()))
+
+	return err
+}
+
+// StartHdrLog creates config.hdrLogFile and starts to periodically write the interval histograms
+// of all servers
+func StartHdrLog() {
+	file, err := os.Create(config.hdrLogFile)
+	if err != nil {
+		fmt.Println("ERROR: Creating latency log file failed:", err)
+		os.Exit(1)
+	}
+
+	logWriter := NewHdrLogWriter(file, time.Now())
+
+	// the first interval starts with the log
+	for _, backend := range proxyState.backends {
+		backend.latencyHistogram.SwapHdrInterval()
+	}
+
+	go func() {
+		for range time.Tick(config.hdrLogInterval) {
+			var endTime = time.Now()
+
+			for i, backend := range proxyState.backends {
+				intervalHistogram := backend.latencyHistogram.SwapHdrInterval()
+
+				if err := logWriter.WriteInterval("server"+strconv.Itoa(i), intervalHistogram, endTime); err != nil {
+					fmt.Println("ERROR: Writing latency log file failed:", err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// HdrHistogramHandler is the admin interface handler for the latency histograms since startup of
+// a single server (query parameter "server" with server index) or all servers combined. The
+// format is the percentile distribution (default) or the interval log ("format=hlog").
+func HdrHistogramHandler(w http.ResponseWriter, r *http.Request) {
+	var firstIdx, lastIdx = 0, len(proxyState.backends) - 1
+
+	if serverParam := r.URL.Query().Get("server"); serverParam != "" {
+		backendIdx, err := strconv.Atoi(serverParam)
+		if err != nil || backendIdx < 0 || backendIdx >= len(proxyState.backends) {
+			http.Error(w, "Invalid server index: "+serverParam, http.StatusBadRequest)
+			return
+		}
+
+		firstIdx, lastIdx = backendIdx, backendIdx
+	}
+
+	var histograms []*HdrHistogram
+
+	for i := firstIdx; i <= lastIdx; i++ {
+		histograms = append(histograms, proxyState.backends[i].latencyHistogram.CopyHdrTotal())
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "hgrm":
+		var combined = histograms[0]
+
+		for _, histogram := range histograms[1:] {
+			combined.Add(histogram)
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		combined.WritePercentileDistribution(w)
+	case "hlog":
+		var endTime = time.Now()
+
+		w.Header().Set("Content-Type", "text/plain")
+		logWriter := NewHdrLogWriter(w, histograms[0].startTime)
+
+		for i, histogram := range histograms {
+			logWriter.WriteInterval("server"+strconv.Itoa(firstIdx+i), histogram, endTime)
+		}
+	default:
+		http.Error(w, "Unknown format: "+r.URL.Query().Get("format"), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,202 @@
+// Preservation of the spelling and values of request headers toward servers that validate
+// signatures over the exact header bytes.
+//
+// Go canonicalizes the names of received headers (e.g. "x-amz-date" becomes "X-Amz-Date"), but
+// writes headers toward servers in the spelling of their map key. So headers can be sent in a
+// different spelling by re-keying them after all modifications, right before the transport. The
+// order of headers can't be preserved, because Go writes them sorted by name. (Signature schemes
+// sort headers themselves anyway.)
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RawHeadersSigned is the special name for "--rawheaders" to preserve the headers that are
+// covered by the AWS signature of a request
+const RawHeadersSigned = "signed"
+
+// transportHeaders are inspected or written by http.Transport only under their canonical name,
+// so renaming them would lead to duplicate headers or changed behavior (e.g. transparent gzip)
+var transportHeaders = []string{
+	"Accept-Encoding",
+	"Content-Length",
+	"Expect",
+	"Host",
+	"Range",
+	"Trailer",
+	"Transfer-Encoding",
+	"User-Agent",
+}
+
+// ParseRawHeaderNames returns the names of "--rawheaders" mapped by their canonical name and
+// whether signed headers are to be preserved
+func ParseRawHeaderNames(names []string) (rawNames map[string]string, preserveSigned bool, err error) {
+	rawNames = make(map[string]string)
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+
+		if name == RawHeadersSigned {
+			preserveSigned = true
+			continue
+		}
+
+		var canonicalName = http.CanonicalHeaderKey(name)
+
+		if name == "" || strings.ContainsAny(name, " :") || isTransportHeader(canonicalName) ||
+			isHopByHopHeader(canonicalName) {
+			return nil, false, fmt.Errorf("Header name can't be preserved: \"%s\"", name)
+		}
+
+		rawNames[canonicalName] = name
+	}
+
+	return rawNames, preserveSigned, nil
+}
+
+// SignedHeaderNames returns the lowercase names of the headers that are covered by the AWS
+// signature (v4 or v2) of a request, or nil if the request is not signed
+func SignedHeaderNames(r *http.Request) []string {
+	var query url.Values
+
+	var authHeader = r.Header.Get("Authorization")
+
+	// signature v4: "AWS4-HMAC-SHA256 Credential=..., SignedHeaders=host;x-amz-date, Signature=..."
+	if strings.HasPrefix(authHeader, "AWS4-") {
+		for _, field := range strings.Split(authHeader, ",") {
+			field = strings.TrimSpace(field)
+
+			if spaceIndex := strings.IndexByte(field, ' '); spaceIndex != -1 {
+				field = strings.TrimSpace(field[spaceIndex+1:]) // first field has algorithm prefix
+			}
+
+			if strings.HasPrefix(field, "SignedHeaders=") {
+				return strings.Split(strings.TrimPrefix(field, "SignedHeaders="), ";")
+			}
+		}
+
+		return nil
+	}
+
+	if authHeader == "" {
+		query = r.URL.Query()
+
+		// presigned URL with signature v4
+		if signedHeaders := query.Get("X-Amz-SignedHeaders"); signedHeaders != "" {
+			return strings.Split(signedHeaders, ";")
+		}
+	}
+
+	// signature v2 in header ("AWS KEY:SIGNATURE") or presigned URL covers fixed headers and
+	// all "x-amz-*" headers
+	if strings.HasPrefix(authHeader, "AWS ") || (query != nil && query.Get("Signature") != "") {
+		var names = []string{"content-md5", "content-type", "date"}
+
+		for name := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-") {
+				names = append(names, strings.ToLower(name))
+			}
+		}
+
+		return names
+	}
+
+	return nil
+}
+
+// SignedHeaderValues returns the values of the signed headers of a request as received from the
+// client, keyed by lowercase name; nil if the request is not signed
+func SignedHeaderValues(r *http.Request) http.Header {
+	var names = SignedHeaderNames(r)
+	if names == nil {
+		return nil
+	}
+
+	var signedHeader = make(http.Header, len(names))
+
+	for _, name := range names {
+		var canonicalName = http.CanonicalHeaderKey(name)
+
+		// host and length are not in the header map; hop-by-hop headers apply only to the client
+		// connection
+		if canonicalName == "Host" || canonicalName == "Content-Length" || isHopByHopHeader(canonicalName) {
+			continue
+		}
+
+		if values, exists := r.Header[canonicalName]; exists {
+			signedHeader[strings.ToLower(name)] = append([]string(nil), values...)
+		}
+	}
+
+	return signedHeader
+}
+
+// PreserveRawHeaders re-keys the header to the spelling given by "--rawheaders" and restores the
+// signed headers to the values of the client request, in case they were modified by the proxy
+func PreserveRawHeaders(header http.Header, signedHeader http.Header) {
+	for name, values := range signedHeader {
+		var canonicalName = http.CanonicalHeaderKey(name)
+
+		var spelling = name // the spelling that was signed by the client
+		if rawName, exists := config.rawHeaderNames[canonicalName]; exists {
+			spelling = rawName
+		} else if isTransportHeader(canonicalName) {
+			spelling = canonicalName
+		}
+
+		delete(header, canonicalName)
+		header[spelling] = values
+	}
+
+	for canonicalName, rawName := range config.rawHeaderNames {
+		if values, exists := header[canonicalName]; exists && rawName != canonicalName {
+			delete(header, canonicalName)
+			header[rawName] = values
+		}
+	}
+}
+
+// rawHeaderTransport is a http.RoundTripper that preserves raw headers of requests, as the last
+// step before they get sent to the server
+type rawHeaderTransport struct {
+	http.RoundTripper
+}
+
+func (transport *rawHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var signedHeader http.Header
+
+	if state, isProxied := req.Context().Value(requestStateKey{}).(*RequestState); isProxied {
+		signedHeader = state.signedHeader
+	}
+
+	outReq := req.Clone(req.Context()) // a RoundTripper must not modify the request
+
+	PreserveRawHeaders(outReq.Header, signedHeader)
+
+	return transport.RoundTripper.RoundTrip(outReq)
+}
+
+func isTransportHeader(canonicalName string) bool {
+	for _, headerName := range transportHeaders {
+		if canonicalName == headerName {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isHopByHopHeader(canonicalName string) bool {
+	for _, headerName := range hopByHopHeaders {
+		if canonicalName == headerName {
+			return true
+		}
+	}
+
+	return false
+}
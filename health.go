@@ -0,0 +1,203 @@
+// Passive health scoring of servers based on the classes of failed requests. Fast failures like
+// refused or reset connections mean that the server is down, so they lower the score much more
+// than timeouts, which often only mean that a server is slow but alive. Servers with a score of 0
+// get ejected from the weighted schedule for "--ejecttime". Optionally, an ejected server only gets
+// back into the schedule after it passed active checks for a stabilization period, so that servers
+// that are flapping between up and down don't get full traffic on each up.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MaxHealthScore is the score of a healthy server. A server gets ejected when its score drops to 0.
+const MaxHealthScore = 100
+
+// HealthScoreSuccess is the score increase for each response that a server sent
+const HealthScoreSuccess = 10
+
+// ProbationHealthScore is the score of a server when it gets back into the schedule after an
+// ejection, so that a single fast failure ejects it again
+const ProbationHealthScore = MaxHealthScore / 2
+
+// FailbackCheckInterval is the interval of the active checks of an ejected server during the
+// stabilization period of "--failbackdelay" and "--failbackchecks"
+const FailbackCheckInterval = time.Second
+
+// healthPenalties are the score decreases per error class. Fast failures eject a server after two
+// attempts, while a server needs to time out more often than it responds to get ejected.
+var healthPenalties = [NumErrorClasses]int{
+	ErrorClassDNS:            25,
+	ErrorClassConnectRefused: 50,
+	ErrorClassConnectTimeout: 10,
+	ErrorClassConnect:        50,
+	ErrorClassTLS:            25,
+	ErrorClassReset:          50,
+	ErrorClassHeaderTimeout:  10,
+	ErrorClassBodyTimeout:    10,
+	ErrorClassCanceled:       0,
+	ErrorClassOther:          25,
+}
+
+// BackendHealth is the health score of a server
+type BackendHealth struct {
+	mutex        sync.Mutex
+	score        int
+	isEjected    bool
+	isRecovering bool // ejection time is over, but server is still checked before reinstating
+	numEjections uint64
+}
+
+// HealthStats is the JSON representation of the health of a server
+type HealthStats struct {
+	Score      int    `json:"score"`
+	Ejected    bool   `json:"ejected"`
+	Ejections  uint64 `json:"ejections"`
+	Recovering bool   `json:"recovering,omitempty"` // in stabilization period before reinstating
+}
+
+func NewBackendHealth() *BackendHealth {
+	return &BackendHealth{score: MaxHealthScore}
+}
+
+// RecordSuccess raises the score of the server after it sent a response
+func (backend *Backend) RecordSuccess() {
+	health := backend.health
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if !health.isEjected && health.score < MaxHealthScore {
+		health.score += HealthScoreSuccess
+
+		if health.score > MaxHealthScore {
+			health.score = MaxHealthScore
+		}
+	}
+}
+
+// RecordFailure lowers the score of the server by the penalty of the error class and ejects the
+// server from the schedule if the score dropped to 0
+func (backend *Backend) RecordFailure(class ErrorClass) {
+	health := backend.health
+
+	health.mutex.Lock()
+
+	if health.isEjected || healthPenalties[class] == 0 {
+		health.mutex.Unlock()
+		return
+	}
+
+	health.score -= healthPenalties[class]
+
+	if health.score > 0 {
+		health.mutex.Unlock()
+		return
+	}
+
+	health.score = 0
+	health.isEjected = true
+	health.numEjections++
+
+	health.mutex.Unlock()
+
+	fmt.Printf("Ejecting server from schedule. Server: %s; Last error class: %s; Duration: %v\n",
+		backend.serverStr, class, config.ejectTime)
+
+	UpdateSchedule()
+
+	time.AfterFunc(config.ejectTime, backend.failback)
+}
+
+// failback reinstates an ejected server after its ejection time. With a configured stabilization
+// period or number of checks, the server gets checked actively until it was healthy for the whole
+// period and passed the number of consecutive checks. Each failed check restarts the period.
+func (backend *Backend) failback() {
+	if config.failbackDelay == 0 && config.failbackChecks == 0 {
+		backend.reinstate()
+		return
+	}
+
+	health := backend.health
+
+	health.mutex.Lock()
+	health.isRecovering = true
+	health.mutex.Unlock()
+
+	fmt.Printf("Checking ejected server before reinstating. Server: %s; Stabilization: %v; Checks: %d\n",
+		backend.serverStr, config.failbackDelay, config.failbackChecks)
+
+	var stableSince time.Time // zero while server is unhealthy
+	var numHealthyChecks int
+
+	for !backend.IsRemoved() {
+		if err := CheckBackend(backend); err != nil {
+			if !stableSince.IsZero() && config.beVerbose {
+				fmt.Printf("Check of ejected server failed, restarting stabilization period. Server: %s; Error: %v\n",
+					backend.serverStr, err)
+			}
+
+			stableSince = time.Time{}
+			numHealthyChecks = 0
+		} else {
+			if stableSince.IsZero() {
+				stableSince = time.Now()
+			}
+
+			numHealthyChecks++
+
+			if numHealthyChecks >= config.failbackChecks && time.Since(stableSince) >= config.failbackDelay {
+				break
+			}
+		}
+
+		time.Sleep(FailbackCheckInterval)
+	}
+
+	backend.reinstate()
+}
+
+// reinstate puts an ejected server back into the schedule on probation
+func (backend *Backend) reinstate() {
+	health := backend.health
+
+	health.mutex.Lock()
+	health.score = ProbationHealthScore
+	health.isEjected = false
+	health.isRecovering = false
+	health.mutex.Unlock()
+
+	fmt.Printf("Reinstating server in schedule. Server: %s\n", backend.serverStr)
+
+	UpdateSchedule()
+}
+
+// IsEjected returns true if the server is currently ejected from the schedule
+func (backend *Backend) IsEjected() bool {
+	if backend.health == nil {
+		return false
+	}
+
+	backend.health.mutex.Lock()
+	defer backend.health.mutex.Unlock()
+
+	return backend.health.isEjected
+}
+
+// HealthStats returns the current health of the server; nil if health scoring is disabled
+func (backend *Backend) HealthStats() *HealthStats {
+	health := backend.health
+
+	if health == nil {
+		return nil
+	}
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	return &HealthStats{Score: health.score, Ejected: health.isEjected, Ejections: health.numEjections,
+		Recovering: health.isRecovering}
+}
@@ -0,0 +1,81 @@
+// Handling of host and port of server URLs and dial addresses, including IPv6 literals with zones
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// NormalizeServerURL escapes the zone separator of an IPv6 literal host (e.g.
+// "http://[fe80::1%eth0]:8080"), which has to be "%25" in URLs, but is commonly given unescaped
+func NormalizeServerURL(urlStr string) string {
+	schemeEnd := strings.Index(urlStr, "://[")
+	if schemeEnd < 0 {
+		return urlStr
+	}
+
+	hostStart := schemeEnd + len("://[")
+
+	hostLen := strings.Index(urlStr[hostStart:], "]")
+	if hostLen < 0 {
+		return urlStr
+	}
+
+	host := urlStr[hostStart : hostStart+hostLen]
+
+	zoneIdx := strings.Index(host, "%")
+	if zoneIdx < 0 || strings.HasPrefix(host[zoneIdx:], "%25") {
+		return urlStr
+	}
+
+	return urlStr[:hostStart] + host[:zoneIdx] + "%25" + host[zoneIdx+1:] + urlStr[hostStart+hostLen:]
+}
+
+// CheckURLHost returns an error if the host of the URL looks like an IPv6 literal, but is invalid
+func CheckURLHost(targetURL *url.URL) error {
+	host := targetURL.Hostname()
+
+	if !strings.Contains(host, ":") {
+		return nil
+	}
+
+	ip, _, _ := strings.Cut(host, "%") // zone is not part of the IP
+
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("Invalid IPv6 address in server URL: %s", host)
+	}
+
+	return nil
+}
+
+// NormalizeDialAddr returns "host:port" for the given dial address, which may be a host name, an
+// IPv4 address or a (bracketed) IPv6 address with optional zone and optional port. The port of the
+// target URL is used if the dial address has no port.
+func NormalizeDialAddr(dialAddr string, targetURL *url.URL) string {
+	if _, _, err := net.SplitHostPort(dialAddr); err == nil {
+		return dialAddr
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(dialAddr, "["), "]")
+
+	_, port, _ := net.SplitHostPort(targetHostPort(targetURL))
+
+	return net.JoinHostPort(host, port)
+}
+
+// targetHostPort returns "host:port" of the URL with the default port of the scheme if the URL has
+// no port
+func targetHostPort(targetURL *url.URL) string {
+	if targetURL.Port() != "" {
+		return net.JoinHostPort(targetURL.Hostname(), targetURL.Port())
+	}
+
+	if targetURL.Scheme == "https" {
+		return net.JoinHostPort(targetURL.Hostname(), "443")
+	}
+
+	return net.JoinHostPort(targetURL.Hostname(), "80")
+}
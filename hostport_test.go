@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeServerURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"http://10.0.0.1:8080", "http://10.0.0.1:8080"},
+		{"http://[::1]:8080/bucket", "http://[::1]:8080/bucket"},
+		{"http://[fe80::1%eth0]:8080", "http://[fe80::1%25eth0]:8080"},
+		{"http://[fe80::1%25eth0]:8080", "http://[fe80::1%25eth0]:8080"},
+		{"https://[fe80::1%en0]/path%20x", "https://[fe80::1%25en0]/path%20x"},
+		{"http://host/%41", "http://host/%41"},
+	}
+
+	for _, test := range tests {
+		if got := NormalizeServerURL(test.in); got != test.want {
+			t.Errorf("NormalizeServerURL(%q) = %q; want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeDialAddr(t *testing.T) {
+	tests := []struct {
+		dialAddr string
+		url      string
+		want     string
+	}{
+		{"10.0.0.1", "http://s3.local", "10.0.0.1:80"},
+		{"10.0.0.1", "https://s3.local", "10.0.0.1:443"},
+		{"10.0.0.1", "http://s3.local:9000", "10.0.0.1:9000"},
+		{"10.0.0.1:7000", "http://s3.local:9000", "10.0.0.1:7000"},
+		{"::1", "http://s3.local:9000", "[::1]:9000"},
+		{"[::1]", "http://s3.local:9000", "[::1]:9000"},
+		{"[::1]:7000", "http://s3.local:9000", "[::1]:7000"},
+		{"fe80::1%eth0", "http://s3.local", "[fe80::1%eth0]:80"},
+		{"[fe80::1%eth0]:7000", "http://s3.local", "[fe80::1%eth0]:7000"},
+	}
+
+	for _, test := range tests {
+		targetURL, _ := url.Parse(test.url)
+
+		if got := NormalizeDialAddr(test.dialAddr, targetURL); got != test.want {
+			t.Errorf("NormalizeDialAddr(%q, %q) = %q; want %q", test.dialAddr, test.url, got, test.want)
+		}
+	}
+}
+
+func TestTargetHostPort(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://s3.local", "s3.local:80"},
+		{"https://s3.local", "s3.local:443"},
+		{"http://[::1]", "[::1]:80"},
+		{"https://[::1]:9000", "[::1]:9000"},
+		{"http://[fe80::1%25eth0]:8080", "[fe80::1%eth0]:8080"},
+	}
+
+	for _, test := range tests {
+		targetURL, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatalf("url.Parse(%q): %v", test.url, err)
+		}
+
+		if got := targetHostPort(targetURL); got != test.want {
+			t.Errorf("targetHostPort(%q) = %q; want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestNewBackendIPv6(t *testing.T) {
+	tests := []struct {
+		serverStr    string
+		wantHost     string // host of the forwarded request URL
+		wantDialAddr string
+	}{
+		{"http://[::1]:8080", "[::1]:8080", ""},
+		{"http://[fe80::1%eth0]:8080", "[fe80::1%eth0]:8080", ""},
+		{"http://[fe80::1%25eth0]", "[fe80::1%eth0]", ""},
+		{"https://s3.local,dial=fe80::2%eth1", "s3.local", "[fe80::2%eth1]:443"},
+	}
+
+	for _, test := range tests {
+		backend, err := NewBackend(test.serverStr)
+		if err != nil {
+			t.Errorf("NewBackend(%q): %v", test.serverStr, err)
+			continue
+		}
+
+		if backend.dialAddr != test.wantDialAddr {
+			t.Errorf("NewBackend(%q): dial address = %q; want %q", test.serverStr, backend.dialAddr, test.wantDialAddr)
+		}
+
+		outReq := httptest.NewRequest(http.MethodGet, "/obj", nil)
+		backend.proxy.Director(outReq)
+
+		if outReq.URL.Host != test.wantHost {
+			t.Errorf("NewBackend(%q): forwarded host = %q; want %q", test.serverStr, outReq.URL.Host, test.wantHost)
+		}
+	}
+
+	for _, serverStr := range []string{"http://[::g]:8080", "http://[fe80::1%eth0"} {
+		if _, err := NewBackend(serverStr); err == nil {
+			t.Errorf("NewBackend(%q): expected error", serverStr)
+		}
+	}
+}
+
+func TestProxyToIPv6Server(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available:", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "path="+r.URL.Path)
+	}))
+	server.Listener = listener
+	server.Start()
+
+	defer server.Close()
+
+	backend, err := NewBackend(server.URL)
+	if err != nil {
+		t.Fatalf("NewBackend(%q): %v", server.URL, err)
+	}
+
+	recorder := httptest.NewRecorder()
+	backend.proxy.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/obj", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", recorder.Code, http.StatusOK)
+	}
+
+	if want := "path=/obj"; recorder.Body.String() != want {
+		t.Errorf("body = %q; want %q", recorder.Body.String(), want)
+	}
+}
@@ -0,0 +1,193 @@
+// Duplicate suppression for retried non-idempotent requests with the same "Idempotency-Key" header
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MaxIdempotentResponseSize is the max body size of responses that get stored for replay.
+// Requests with larger responses get forwarded again when retried.
+const MaxIdempotentResponseSize = 1024 * 1024
+
+type idempotentResponse struct {
+	method     string // method and path of the original request to detect key reuse
+	path       string
+	isComplete bool // false while the original request is in progress
+	expiry     time.Time
+	statusCode int
+	header     http.Header
+	body       []byte
+	trailer    http.Header
+}
+
+var idempotencyState = struct {
+	mutex     sync.Mutex
+	responses map[string]*idempotentResponse // key is API key and idempotency key
+}{responses: make(map[string]*idempotentResponse)}
+
+// isIdempotencyMethod returns true for methods which are not idempotent in HTTP semantics and thus
+// get duplicate suppression
+func isIdempotencyMethod(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+}
+
+// ServeIdempotentRequest replays the stored response if the request is a retry of an earlier
+// request with the same idempotency key. Otherwise the request gets passed to next and its
+// response gets stored for config.idempotencyWindow.
+func ServeIdempotentRequest(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	var idempotencyKey = r.Header.Get("Idempotency-Key")
+
+	if idempotencyKey == "" || !isIdempotencyMethod(r.Method) {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	// keys of different tenants must not collide
+	var stateKey = idempotencyKey
+	if proxyState.tenants != nil {
+		stateKey = RequestTenantName(r) + "\x00" + idempotencyKey
+	}
+
+	idempotencyState.mutex.Lock()
+
+	stored, exists := idempotencyState.responses[stateKey]
+	if exists && stored.isComplete && time.Now().After(stored.expiry) {
+		delete(idempotencyState.responses, stateKey)
+		exists = false
+	}
+
+	// copy under lock, because the original request completes concurrently
+	var storedCopy idempotentResponse
+
+	if exists {
+		storedCopy = *stored
+	} else {
+		stored = &idempotentResponse{method: r.Method, path: r.URL.Path}
+		idempotencyState.responses[stateKey] = stored
+	}
+
+	idempotencyState.mutex.Unlock()
+
+	if exists {
+		switch {
+		case storedCopy.method != r.Method || storedCopy.path != r.URL.Path:
+			HTTPError(w, r, http.StatusUnprocessableEntity, "Idempotency key was used for a different request")
+		case !storedCopy.isComplete:
+			HTTPError(w, r, http.StatusConflict, "Request with same idempotency key is in progress")
+		default:
+			for key, values := range storedCopy.header {
+				w.Header()[key] = values
+			}
+
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(storedCopy.statusCode)
+			w.Write(storedCopy.body)
+
+			WriteResponseTrailers(w, storedCopy.trailer)
+		}
+
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK,
+		maxBodySize: MaxIdempotentResponseSize}
+
+	// deferred to also release the key if the proxy panics to abort the response
+	defer func() {
+		idempotencyState.mutex.Lock()
+
+		// server errors and oversized responses don't get replayed, so that retries can succeed
+		if recorder.isTruncated || recorder.statusCode >= 500 || r.Context().Err() != nil || !recorder.isDone {
+			delete(idempotencyState.responses, stateKey)
+		} else {
+			stored.isComplete = true
+			stored.expiry = time.Now().Add(config.idempotencyWindow)
+			stored.statusCode = recorder.statusCode
+			stored.header = recorder.header
+			stored.body = recorder.body.Bytes()
+			stored.trailer = recorder.Trailer()
+		}
+
+		idempotencyState.mutex.Unlock()
+	}()
+
+	next.ServeHTTP(recorder, r)
+
+	recorder.isDone = true
+}
+
+// PurgeIdempotentResponses periodically removes expired responses
+func PurgeIdempotentResponses() {
+	for range time.Tick(config.idempotencyWindow) {
+		var now = time.Now()
+
+		idempotencyState.mutex.Lock()
+
+		for stateKey, stored := range idempotencyState.responses {
+			if stored.isComplete && now.After(stored.expiry) {
+				delete(idempotencyState.responses, stateKey)
+			}
+		}
+
+		idempotencyState.mutex.Unlock()
+	}
+}
+
+// responseRecorder passes a response through to the wrapped writer and keeps a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode    int
+	header        http.Header // copy at the time of WriteHeader
+	body          bytes.Buffer
+	maxBodySize   int  // larger bodies don't get copied
+	isTruncated   bool // body exceeded maxBodySize
+	isDone        bool // handler returned normally
+	isHeaderWrite bool
+}
+
+func (recorder *responseRecorder) WriteHeader(statusCode int) {
+	if !recorder.isHeaderWrite {
+		recorder.isHeaderWrite = true
+		recorder.statusCode = statusCode
+		recorder.header = recorder.ResponseWriter.Header().Clone()
+	}
+
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *responseRecorder) Write(buf []byte) (int, error) {
+	if !recorder.isHeaderWrite {
+		recorder.WriteHeader(http.StatusOK)
+	}
+
+	if !recorder.isTruncated {
+		if recorder.body.Len()+len(buf) > recorder.maxBodySize {
+			recorder.isTruncated = true
+			recorder.body = bytes.Buffer{}
+		} else {
+			recorder.body.Write(buf)
+		}
+	}
+
+	return recorder.ResponseWriter.Write(buf)
+}
+
+func (recorder *responseRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Trailer returns the trailer values of the response after the handler returned
+func (recorder *responseRecorder) Trailer() http.Header {
+	return ResponseTrailers(recorder.ResponseWriter.Header())
+}
+
+// Unwrap allows http.ResponseController to access the wrapped writer
+func (recorder *responseRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
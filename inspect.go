@@ -0,0 +1,203 @@
+// Side-calls to an external inspection service (e.g. a policy engine or malware scanner), which
+// allows, denies or annotates each request before it gets proxied.
+//
+// The side-call is a POST request to "--inspecturl" with the headers of the client request and
+// these additional headers:
+//   X-ProxPerfect-Inspect-Method, X-ProxPerfect-Inspect-URI, X-ProxPerfect-Inspect-Host,
+//   X-ProxPerfect-Inspect-Client-IP: method, URI, host and client IP of the client request
+//   X-ProxPerfect-Inspect-Preview-Complete: "true" if the body of the side-call is the complete
+//   request body, "false" if it is only the first "--inspectpreview" bytes
+// The response status decides about the request:
+//   2xx: Allow. Response headers "X-ProxPerfect-Inspect-Set-NAME: VALUE" set header NAME of the
+//   request toward the server, e.g. to annotate it with a classification.
+//   3xx/4xx: Deny. The client gets the status and body of the inspection response.
+//   5xx or no response: Inspection failed. The request gets rejected with 503, unless
+//   "--inspectfailopen" is set.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Headers of side-calls to the inspection service
+const (
+	InspectHeaderPrefix          = "X-ProxPerfect-Inspect-"
+	InspectHeaderMethod          = InspectHeaderPrefix + "Method"
+	InspectHeaderURI             = InspectHeaderPrefix + "URI"
+	InspectHeaderHost            = InspectHeaderPrefix + "Host"
+	InspectHeaderClientIP        = InspectHeaderPrefix + "Client-IP"
+	InspectHeaderPreviewComplete = InspectHeaderPrefix + "Preview-Complete"
+	InspectHeaderSetPrefix       = InspectHeaderPrefix + "Set-" // in responses
+)
+
+// MaxInspectDenyBodySize is the max size of the body of a deny response of the inspection service
+// that gets relayed to the client
+const MaxInspectDenyBodySize = 64 * 1024
+
+// InspectionStats are the stats of side-calls to the inspection service
+type InspectionStats struct {
+	NumAllowed uint64 `json:"allowed"` // 64-bit atomics first for alignment on 32-bit archs
+	NumDenied  uint64 `json:"denied"`
+	NumFailed  uint64 `json:"failed"` // including failed side-calls that were allowed by fail-open
+}
+
+var inspectionStats InspectionStats
+
+// inspectClient sends the side-calls, with its own connection pool
+var inspectClient = &http.Client{
+	Transport: http.DefaultTransport.(*http.Transport).Clone(),
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse // a redirect is a deny response
+	},
+}
+
+// GetInspectionStats returns the current values of the inspection counters
+func GetInspectionStats() InspectionStats {
+	return InspectionStats{
+		NumAllowed: atomic.LoadUint64(&inspectionStats.NumAllowed),
+		NumDenied:  atomic.LoadUint64(&inspectionStats.NumDenied),
+		NumFailed:  atomic.LoadUint64(&inspectionStats.NumFailed),
+	}
+}
+
+// previewBody is a request body of which the preview was already read
+type previewBody struct {
+	io.Reader
+	io.Closer
+}
+
+// ReadBodyPreview reads up to the given number of bytes of the request body and replaces the body
+// with one that starts with the preview again. isComplete is true if the preview is the whole body.
+func ReadBodyPreview(r *http.Request, previewSize int) (preview []byte, isComplete bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	if previewSize == 0 {
+		return nil, r.ContentLength == 0, nil
+	}
+
+	buf := make([]byte, previewSize+1) // one more byte to detect whether the body is complete
+
+	numRead, err := io.ReadFull(r.Body, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+
+	preview = buf[:numRead]
+	isComplete = numRead <= previewSize
+
+	if !isComplete {
+		preview = buf[:previewSize]
+	}
+
+	r.Body = &previewBody{Reader: io.MultiReader(bytes.NewReader(buf[:numRead]), r.Body), Closer: r.Body}
+
+	return preview, isComplete, nil
+}
+
+// InspectRequest sends the side-call for the request to the inspection service and applies the
+// annotations of an allow response to the request. Returns false if the request was denied and the
+// response to the client was sent.
+func InspectRequest(w http.ResponseWriter, r *http.Request) bool {
+	preview, isComplete, err := ReadBodyPreview(r, config.inspectPreviewSize)
+	if err != nil {
+		HTTPError(w, r, http.StatusBadRequest, "Reading request body failed")
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.inspectTimeout)
+	defer cancel()
+
+	inspectReq, err := http.NewRequestWithContext(ctx, http.MethodPost, config.inspectURL,
+		bytes.NewReader(preview))
+	if err != nil {
+		return failInspection(w, r, err)
+	}
+
+	inspectReq.Header = r.Header.Clone()
+	StripHopByHopHeaders(inspectReq.Header)
+	inspectReq.Header.Del("Content-Length") // of the original body; preview has its own length
+
+	inspectReq.Header.Set(InspectHeaderMethod, r.Method)
+	inspectReq.Header.Set(InspectHeaderURI, r.URL.RequestURI())
+	inspectReq.Header.Set(InspectHeaderHost, r.Host)
+	inspectReq.Header.Set(InspectHeaderClientIP, ClientIP(r))
+	inspectReq.Header.Set(InspectHeaderPreviewComplete, strconv.FormatBool(isComplete))
+
+	resp, err := inspectClient.Do(inspectReq)
+	if err != nil {
+		return failInspection(w, r, err)
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		atomic.AddUint64(&inspectionStats.NumAllowed, 1)
+
+		for headerName, values := range resp.Header { // canonical names
+			if len(headerName) > len(InspectHeaderSetPrefix) &&
+				strings.EqualFold(headerName[:len(InspectHeaderSetPrefix)], InspectHeaderSetPrefix) {
+				r.Header[http.CanonicalHeaderKey(headerName[len(InspectHeaderSetPrefix):])] = values
+			}
+		}
+
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // allows conn reuse for small bodies
+
+		return true
+	case resp.StatusCode < 500:
+		atomic.AddUint64(&inspectionStats.NumDenied, 1)
+
+		if config.beVerbose {
+			fmt.Printf("Request denied by inspection. Status: %d; Request: %s %s (Client: %s)\n", resp.StatusCode, r.Method, r.URL.String(), ClientIP(r))
+		}
+
+		for _, headerName := range []string{"Content-Type", "Location", "Retry-After", "Www-Authenticate"} {
+			if value := resp.Header.Get(headerName); value != "" {
+				w.Header().Set(headerName, value)
+			}
+		}
+
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, io.LimitReader(resp.Body, MaxInspectDenyBodySize))
+
+		return false
+	default:
+		return failInspection(w, r, fmt.Errorf("Inspection service returned status %d", resp.StatusCode))
+	}
+}
+
+// failInspection handles a failed side-call according to "--inspectfailopen"
+func failInspection(w http.ResponseWriter, r *http.Request, err error) bool {
+	atomic.AddUint64(&inspectionStats.NumFailed, 1)
+
+	fmt.Printf("Request inspection failed. Request: %s %s (Client: %s); Fail open: %v; Error: %v\n", r.Method, r.URL.String(), ClientIP(r), config.inspectFailOpen, err)
+
+	if config.inspectFailOpen {
+		return true
+	}
+
+	HTTPError(w, r, http.StatusServiceUnavailable, "Request inspection failed")
+
+	return false
+}
+
+// inspectMiddleware sends each request to the inspection service before it gets proxied
+func inspectMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !InspectRequest(w, r) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,1166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBackend is a simulated server with configurable latency and error behavior, which counts the
+// requests it gets and records the max number of concurrent requests
+type testBackend struct {
+	// first for alignment on 32-bit archs
+	numRequests uint64
+	numInFlight int64
+	maxInFlight int64
+
+	*httptest.Server
+	name       string
+	latency    time.Duration
+	errorEvery uint64 // every nth request gets status 500; 0 for no errors
+}
+
+func newTestBackend(t testing.TB, name string, latency time.Duration, errorEvery uint64) *testBackend {
+	backend := &testBackend{name: name, latency: latency, errorEvery: errorEvery}
+
+	backend.Server = httptest.NewServer(http.HandlerFunc(backend.ServeHTTP))
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func (backend *testBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var requestNum = atomic.AddUint64(&backend.numRequests, 1)
+	var numInFlight = atomic.AddInt64(&backend.numInFlight, 1)
+	defer atomic.AddInt64(&backend.numInFlight, -1)
+
+	for {
+		maxInFlight := atomic.LoadInt64(&backend.maxInFlight)
+		if numInFlight <= maxInFlight ||
+			atomic.CompareAndSwapInt64(&backend.maxInFlight, maxInFlight, numInFlight) {
+			break
+		}
+	}
+
+	io.Copy(io.Discard, r.Body)
+
+	if backend.latency != 0 {
+		select {
+		case <-time.After(backend.latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if backend.errorEvery != 0 && requestNum%backend.errorEvery == 0 {
+		http.Error(w, "simulated error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "%s %s", backend.name, r.URL.Path)
+}
+
+func (backend *testBackend) NumRequests() uint64 {
+	return atomic.LoadUint64(&backend.numRequests)
+}
+
+func (backend *testBackend) MaxInFlight() int64 {
+	return atomic.LoadInt64(&backend.maxInFlight)
+}
+
+// startTestProxy starts the proxy with the given config in front of the given servers, with the
+// same handler and client connection handling as main()
+func startTestProxy(t testing.TB, testConfig Config, serverStrs ...string) *httptest.Server {
+	savedConfig, savedState := config, proxyState
+
+	t.Cleanup(func() {
+		config, proxyState = savedConfig, savedState
+	})
+
+	config = testConfig
+	config.balancerName = DefaultBalancerName
+	config.isMixedRedirect = len(config.redirectRules) != 0 || config.redirectSize > 0
+	proxyState = ProxyState{}
+
+	for _, serverStr := range serverStrs {
+		AddBackend(serverStr)
+	}
+
+	if config.apiKeysFile != "" {
+		tenants, err := LoadTenants(config.apiKeysFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxyState.tenants = tenants
+	}
+
+	if config.routeScriptFile != "" {
+		routeScript, err := LoadRouteScript(config.routeScriptFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxyState.routeScript = routeScript
+	}
+
+	UpdateSchedule()
+
+	var handler http.Handler = ProxyRequestHandler()
+	if config.redirectCode != 0 && !config.isMixedRedirect {
+		handler = http.HandlerFunc(RedirectHandler)
+	}
+
+	// like main, e.g. for background requests of the cache
+	savedServeMux := http.DefaultServeMux
+	http.DefaultServeMux = http.NewServeMux()
+	http.DefaultServeMux.Handle("/", handler)
+
+	t.Cleanup(func() {
+		http.DefaultServeMux = savedServeMux
+	})
+
+	proxy := httptest.NewUnstartedServer(CountClientConnReuse(handler))
+	proxy.Config.ConnContext = ClientConnContext
+	proxy.Listener = &clientConnListener{Listener: proxy.Listener}
+	proxy.Start()
+
+	t.Cleanup(proxy.Close)
+
+	return proxy
+}
+
+// testGet sends a GET request through the proxy and returns status and body. The client doesn't
+// follow redirects.
+func testGet(t *testing.T, client *http.Client, url string) (int, string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Error(err)
+		return 0, ""
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func newTestClient(t testing.TB) *http.Client {
+	transport := &http.Transport{MaxIdleConnsPerHost: 100}
+	t.Cleanup(transport.CloseIdleConnections)
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// runConcurrent calls fn numRequests times, spread across numWorkers goroutines
+func runConcurrent(numWorkers, numRequests int, fn func(requestIdx int)) {
+	var nextIdx int64 = -1
+	var waitGroup sync.WaitGroup
+
+	for worker := 0; worker < numWorkers; worker++ {
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+
+			for {
+				requestIdx := int(atomic.AddInt64(&nextIdx, 1))
+				if requestIdx >= numRequests {
+					return
+				}
+
+				fn(requestIdx)
+			}
+		}()
+	}
+
+	waitGroup.Wait()
+}
+
+func TestIntegrationBalancing(t *testing.T) {
+	backends := []*testBackend{
+		newTestBackend(t, "a", 0, 0),
+		newTestBackend(t, "b", 0, 0),
+		newTestBackend(t, "c", 0, 0),
+	}
+
+	proxy := startTestProxy(t, Config{}, backends[0].URL+",weight=2", backends[1].URL,
+		backends[2].URL)
+	client := newTestClient(t)
+
+	const numRequests = 400
+
+	runConcurrent(16, numRequests, func(requestIdx int) {
+		path := fmt.Sprintf("/obj%d", requestIdx)
+
+		status, body := testGet(t, client, proxy.URL+path)
+		if status != http.StatusOK || !strings.HasSuffix(body, " "+path) {
+			t.Errorf("GET %s = %d %q; want 200 from a server for this path", path, status, body)
+		}
+	})
+
+	// weighted round robin: exact shares, independent of concurrency
+	wantRequests := []uint64{numRequests / 2, numRequests / 4, numRequests / 4}
+
+	for i, backend := range backends {
+		if got := backend.NumRequests(); got != wantRequests[i] {
+			t.Errorf("requests of server %s = %d; want %d", backend.name, got, wantRequests[i])
+		}
+	}
+}
+
+func TestIntegrationConnLimit(t *testing.T) {
+	backend := newTestBackend(t, "a", 20*time.Millisecond, 0)
+
+	proxy := startTestProxy(t, Config{numConnsPerServer: 2}, backend.URL)
+	client := newTestClient(t)
+
+	runConcurrent(10, 40, func(requestIdx int) {
+		if status, body := testGet(t, client, proxy.URL+"/obj"); status != http.StatusOK {
+			t.Errorf("GET = %d %q; want 200", status, body)
+		}
+	})
+
+	if got := backend.MaxInFlight(); got > 2 {
+		t.Errorf("max concurrent requests of server = %d; want <= 2", got)
+	}
+
+	if got := backend.NumRequests(); got != 40 {
+		t.Errorf("requests of server = %d; want 40", got)
+	}
+}
+
+func TestIntegrationShedQueue(t *testing.T) {
+	backend := newTestBackend(t, "a", 50*time.Millisecond, 0)
+
+	proxy := startTestProxy(t, Config{numConnsPerServer: 1, shedQueueLen: 2}, backend.URL)
+	client := newTestClient(t)
+
+	var numOK, numShed int64
+
+	runConcurrent(20, 20, func(requestIdx int) {
+		switch status, body := testGet(t, client, proxy.URL+"/obj"); status {
+		case http.StatusOK:
+			atomic.AddInt64(&numOK, 1)
+		case http.StatusServiceUnavailable:
+			atomic.AddInt64(&numShed, 1)
+		default:
+			t.Errorf("GET = %d %q; want 200 or 503", status, body)
+		}
+	})
+
+	if numShed == 0 || numOK == 0 {
+		t.Errorf("served: %d; shed: %d; want both with full queue", numOK, numShed)
+	}
+
+	if got := backend.MaxInFlight(); got > 1 {
+		t.Errorf("max concurrent requests of server = %d; want 1", got)
+	}
+}
+
+func TestIntegrationClientConnLimit(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 0)
+
+	proxy := startTestProxy(t, Config{maxClientConns: 2}, backend.URL)
+
+	var idleConns []net.Conn
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		idleConns = append(idleConns, conn)
+	}
+
+	// rejected connections get the 503 response before the request was read
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if status := testRawGet(t, proxy); status == http.StatusServiceUnavailable {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("GET beyond client connection limit = %d; want 503", status)
+		}
+
+		time.Sleep(10 * time.Millisecond) // until the idle connections got accepted
+	}
+
+	idleConns[0].Close()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if status := testRawGet(t, proxy); status == http.StatusOK {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("GET after closed client connection = %d; want 200", status)
+		}
+
+		time.Sleep(10 * time.Millisecond) // until the closed connection got released
+	}
+}
+
+// testRawGet sends a GET request on a new connection and returns the status
+func testRawGet(t *testing.T, proxy *httptest.Server) int {
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	io.WriteString(conn, "GET /obj HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestIntegrationServerErrors(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 5)
+
+	proxy := startTestProxy(t, Config{printReport: true}, backend.URL)
+	client := newTestClient(t)
+
+	var numErrors int64
+
+	runConcurrent(8, 100, func(requestIdx int) {
+		switch status, body := testGet(t, client, proxy.URL+"/obj"); status {
+		case http.StatusOK:
+		case http.StatusInternalServerError:
+			atomic.AddInt64(&numErrors, 1)
+		default:
+			t.Errorf("GET = %d %q; want 200 or 500 of server", status, body)
+		}
+	})
+
+	if numErrors != 20 {
+		t.Errorf("errors = %d; want 20", numErrors)
+	}
+
+	// server errors get passed through to the client and counted for the report
+	if reports := BuildServerReports(); reports[0].Errors != 20 || reports[0].Requests != 100 {
+		t.Errorf("report errors = %d of %d requests; want 20 of 100", reports[0].Errors,
+			reports[0].Requests)
+	}
+}
+
+// The proxy doesn't retry failed requests itself, but a server that is down gets ejected, so that
+// client retries go to the healthy servers
+func TestIntegrationEjection(t *testing.T) {
+	healthyBackend := newTestBackend(t, "healthy", 0, 0)
+	downBackend := newTestBackend(t, "down", 0, 0)
+
+	downURL := downBackend.URL
+	downBackend.Close() // connections get refused
+
+	proxy := startTestProxy(t, Config{ejectTime: time.Minute}, healthyBackend.URL, downURL)
+	client := newTestClient(t)
+
+	var numFailed int
+
+	for i := 0; i < 20; i++ {
+		status, body := testGet(t, client, proxy.URL+"/obj")
+
+		switch {
+		case status == http.StatusBadGateway:
+			numFailed++
+		case status != http.StatusOK || !strings.HasPrefix(body, "healthy "):
+			t.Errorf("GET = %d %q; want 200 from healthy server or 502", status, body)
+		}
+	}
+
+	// refused connections eject a server after two failures
+	if numFailed != 2 {
+		t.Errorf("failed requests = %d; want 2", numFailed)
+	}
+
+	if health := proxyState.backends[1].HealthStats(); !health.Ejected {
+		t.Errorf("health of down server = %+v; want ejected", health)
+	}
+
+	if got := healthyBackend.NumRequests(); got != 18 {
+		t.Errorf("requests of healthy server = %d; want 18", got)
+	}
+}
+
+func TestIntegrationServerHintsEjection(t *testing.T) {
+	healthyBackend := newTestBackend(t, "healthy", 0, 0)
+	downBackend := newTestBackend(t, "down", 0, 0)
+
+	downURL := downBackend.URL
+	downBackend.Close() // connections get refused
+
+	proxy := startTestProxy(t, Config{ejectTime: time.Minute, serverHints: ServerHintsHeader},
+		healthyBackend.URL, downURL)
+	client := newTestClient(t)
+
+	// refused connections eject a server after two failures
+	for i := 0; i < 4; i++ {
+		testGet(t, client, proxy.URL+"/obj")
+	}
+
+	resp, err := client.Get(proxy.URL + "/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if got := resp.Header.Get("X-ProxPerfect-Servers"); got != healthyBackend.URL {
+		t.Errorf("server hints after ejection = %q; want %q", got, healthyBackend.URL)
+	}
+}
+
+func TestIntegrationRouteScriptEjection(t *testing.T) {
+	healthyBackend := newTestBackend(t, "healthy", 0, 0)
+	downBackend := newTestBackend(t, "down", 0, 0)
+
+	downURL := downBackend.URL
+	downBackend.Close() // connections get refused
+
+	scriptPath := filepath.Join(t.TempDir(), "route.expr")
+
+	if err := os.WriteFile(scriptPath, []byte(`path == "/unknown" ? "nope" : 1`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := startTestProxy(t, Config{ejectTime: time.Minute, routeScriptFile: scriptPath},
+		healthyBackend.URL, downURL)
+	client := newTestClient(t)
+
+	// refused connections eject the routed server after two failures
+	for i := 0; i < 2; i++ {
+		if status, body := testGet(t, client, proxy.URL+"/obj"); status != http.StatusBadGateway {
+			t.Errorf("GET before ejection = %d %q; want 502", status, body)
+		}
+	}
+
+	if status, body := testGet(t, client, proxy.URL+"/obj"); status != http.StatusOK ||
+		!strings.HasPrefix(body, "healthy ") {
+		t.Errorf("GET after ejection = %d %q; want 200 from healthy server", status, body)
+	}
+
+	// script errors are not for clients
+	if status, body := testGet(t, client, proxy.URL+"/unknown"); status != http.StatusInternalServerError ||
+		strings.Contains(body, "nope") {
+		t.Errorf("GET with script error = %d %q; want 500 without details", status, body)
+	}
+}
+
+func TestIntegrationStartupCheckDrop(t *testing.T) {
+	healthyBackend := newTestBackend(t, "healthy", 0, 0)
+	downBackend := newTestBackend(t, "down", 0, 0)
+
+	downURL := downBackend.URL
+	downBackend.Close() // connections get refused
+
+	startTestProxy(t, Config{startupCheck: StartupCheckDrop,
+		proxyStrings: []string{healthyBackend.URL, downURL}}, healthyBackend.URL, downURL)
+
+	CheckBackends()
+
+	if len(proxyState.backends) != 1 || !reflect.DeepEqual(config.proxyStrings, []string{healthyBackend.URL}) {
+		t.Errorf("servers after startup check = %d, %q; want only %s", len(proxyState.backends),
+			config.proxyStrings, healthyBackend.URL)
+	}
+}
+
+func TestIntegrationDrainCanonicalIP(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 0)
+
+	proxy := startTestProxy(t, Config{}, backend.URL)
+	client := newTestClient(t)
+
+	// IPv4-mapped and non-canonical spellings of the IP of the test client
+	for _, tc := range []struct {
+		method     string
+		clientIP   string
+		wantStatus int
+	}{
+		{http.MethodPost, "::ffff:127.0.0.1", http.StatusServiceUnavailable},
+		{http.MethodDelete, "0:0:0:0:0:ffff:7f00:1", http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		DrainHandler(recorder, httptest.NewRequest(tc.method, "/drain?client="+url.QueryEscape(tc.clientIP), nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("drain %s %s = %d %q", tc.method, tc.clientIP, recorder.Code, recorder.Body.String())
+		}
+
+		if status, body := testGet(t, client, proxy.URL+"/obj"); status != tc.wantStatus {
+			t.Errorf("GET after drain %s %s = %d %q; want %d", tc.method, tc.clientIP, status, body,
+				tc.wantStatus)
+		}
+	}
+}
+
+func TestIntegrationIdempotentRetry(t *testing.T) {
+	backend := newTestBackend(t, "a", 100*time.Millisecond, 0)
+
+	proxy := startTestProxy(t, Config{idempotencyWindow: time.Minute}, backend.URL)
+	client := newTestClient(t)
+
+	putWithKey := func() (int, string) {
+		req, err := http.NewRequest(http.MethodPut, proxy.URL+"/obj", strings.NewReader("data"))
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+
+		req.Header.Set("Idempotency-Key", "retry-"+backend.URL) // stored responses are global
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		return resp.StatusCode, string(body)
+	}
+
+	var originalDone = make(chan struct{})
+
+	go func() {
+		defer close(originalDone)
+
+		if status, body := putWithKey(); status != http.StatusOK || body != "a /obj" {
+			t.Errorf("original PUT = %d %q; want 200 %q", status, body, "a /obj")
+		}
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); backend.NumRequests() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("original request didn't reach the server")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// retries while the original request is in progress get rejected
+	runConcurrent(4, 4, func(requestIdx int) {
+		if status, _ := putWithKey(); status != http.StatusConflict {
+			t.Errorf("PUT during original request = %d; want %d", status, http.StatusConflict)
+		}
+	})
+
+	<-originalDone
+
+	// retries after the original request get the stored response
+	runConcurrent(4, 8, func(requestIdx int) {
+		if status, body := putWithKey(); status != http.StatusOK || body != "a /obj" {
+			t.Errorf("PUT after original request = %d %q; want replayed 200 %q", status, body, "a /obj")
+		}
+	})
+
+	if got := backend.NumRequests(); got != 1 {
+		t.Errorf("requests of server = %d; want 1", got)
+	}
+}
+
+// writeTestAPIKeys writes an API keys file with tenants "a" and "b" with keys "key-a" and "key-b"
+func writeTestAPIKeys(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "apikeys")
+
+	if err := os.WriteFile(path, []byte("a key-a\nb key-b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestIntegrationIdempotencyTenants(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 0)
+
+	proxy := startTestProxy(t, Config{idempotencyWindow: time.Minute, apiKeyHeader: "X-Api-Key",
+		apiKeysFile: writeTestAPIKeys(t)}, backend.URL)
+	client := newTestClient(t)
+
+	for _, apiKey := range []string{"key-a", "key-b", "key-a"} {
+		req, err := http.NewRequest(http.MethodPut, proxy.URL+"/obj", strings.NewReader("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("X-Api-Key", apiKey)
+		req.Header.Set("Idempotency-Key", "tenants-"+backend.URL)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("PUT of %s = %d; want 200", apiKey, resp.StatusCode)
+		}
+	}
+
+	// the same idempotency key of another tenant is a different request
+	if got := backend.NumRequests(); got != 2 {
+		t.Errorf("requests of server = %d; want 2", got)
+	}
+}
+
+func TestIntegrationCacheTenants(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 0)
+
+	cacheRoutes, err := ParseCacheRoutes("/*=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := startTestProxy(t, Config{cacheSize: 1024 * 1024, cacheRoutes: cacheRoutes,
+		apiKeyHeader: "X-Api-Key", apiKeysFile: writeTestAPIKeys(t)}, backend.URL)
+	client := newTestClient(t)
+
+	for _, apiKey := range []string{"key-a", "key-b", "key-a", "key-b"} {
+		req, err := http.NewRequest(http.MethodGet, proxy.URL+"/private", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("X-Api-Key", apiKey)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET of %s = %d; want 200", apiKey, resp.StatusCode)
+		}
+	}
+
+	// one cached response per tenant
+	if got := backend.NumRequests(); got != 2 {
+		t.Errorf("requests of server = %d; want 2", got)
+	}
+}
+
+func TestIntegrationCacheRefreshTenants(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 0)
+
+	cacheRoutes, err := ParseCacheRoutes("/*=50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := startTestProxy(t, Config{cacheSize: 1024 * 1024, cacheRoutes: cacheRoutes,
+		staleRevalidate: time.Hour, apiKeyHeader: "X-Api-Key", apiKeysFile: writeTestAPIKeys(t)},
+		backend.URL)
+	client := newTestClient(t)
+
+	getCacheStatus := func() string {
+		req, err := http.NewRequest(http.MethodGet, proxy.URL+"/private", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("X-Api-Key", "key-a")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET = %d; want 200", resp.StatusCode)
+		}
+
+		return resp.Header.Get(CacheHeader)
+	}
+
+	getCacheStatus()
+
+	time.Sleep(100 * time.Millisecond) // expired
+
+	if got := getCacheStatus(); got != CacheStatusStale {
+		t.Fatalf("cache status of expired response = %q; want %q", got, CacheStatusStale)
+	}
+
+	// the background refresh replaces the stale response of the tenant
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if got := getCacheStatus(); got == CacheStatusHit {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("cache status after refresh = %q; want %q", got, CacheStatusHit)
+		}
+	}
+
+	if got := backend.NumRequests(); got != 2 {
+		t.Errorf("requests of server = %d; want 2", got)
+	}
+}
+
+func TestIntegrationCacheWarmTenants(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 0)
+
+	cacheRoutes, err := ParseCacheRoutes("/*=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := startTestProxy(t, Config{cacheSize: 1024 * 1024, cacheRoutes: cacheRoutes,
+		apiKeyHeader: "X-Api-Key", apiKeysFile: writeTestAPIKeys(t)}, backend.URL)
+	client := newTestClient(t)
+
+	host := strings.TrimPrefix(proxy.URL, "http://")
+
+	for _, tc := range []struct {
+		query      string
+		wantStatus int
+	}{
+		{"", http.StatusBadRequest},
+		{"&tenant=c", http.StatusBadRequest},
+		{"&tenant=a", http.StatusOK},
+	} {
+		warmReq := httptest.NewRequest(http.MethodPost, "/cachewarm?encoding=gzip&host="+host+tc.query,
+			strings.NewReader("/warm\n"))
+		recorder := httptest.NewRecorder()
+
+		CacheWarmHandler(recorder, warmReq)
+
+		if recorder.Code != tc.wantStatus || (tc.wantStatus == http.StatusOK &&
+			!strings.Contains(recorder.Body.String(), `"cached": 1`)) {
+			t.Errorf("cache warm-up%s = %d %q; want %d", tc.query, recorder.Code, recorder.Body.String(),
+				tc.wantStatus)
+		}
+	}
+
+	for apiKey, wantCacheStatus := range map[string]string{"key-a": CacheStatusHit, "key-b": CacheStatusMiss} {
+		req, err := http.NewRequest(http.MethodGet, proxy.URL+"/warm", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("X-Api-Key", apiKey)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if got := resp.Header.Get(CacheHeader); resp.StatusCode != http.StatusOK || got != wantCacheStatus {
+			t.Errorf("GET of %s after warm-up = %d %q; want 200 %q", apiKey, resp.StatusCode, got,
+				wantCacheStatus)
+		}
+	}
+}
+
+func TestIntegrationRedirect(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 0)
+
+	proxy := startTestProxy(t, Config{redirectCode: http.StatusTemporaryRedirect},
+		backend.URL+"/base/")
+	client := newTestClient(t)
+
+	resp, err := client.Get(proxy.URL + "/obj?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if want := backend.URL + "/base/obj?x=1"; resp.StatusCode != http.StatusTemporaryRedirect ||
+		resp.Header.Get("Location") != want {
+		t.Errorf("GET = %d to %q; want %d to %q", resp.StatusCode, resp.Header.Get("Location"),
+			http.StatusTemporaryRedirect, want)
+	}
+
+	if got := backend.NumRequests(); got != 0 {
+		t.Errorf("requests of server = %d; want 0", got)
+	}
+}
+
+func TestIntegrationMixedRedirect(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 0)
+
+	rules, err := ParseRedirectRules("GET:/data/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := startTestProxy(t, Config{redirectCode: http.StatusTemporaryRedirect, redirectRules: rules},
+		backend.URL)
+	client := newTestClient(t)
+
+	runConcurrent(8, 100, func(requestIdx int) {
+		if requestIdx%2 == 0 {
+			if status, body := testGet(t, client, proxy.URL+"/other"); status != http.StatusOK ||
+				body != "a /other" {
+				t.Errorf("GET /other = %d %q; want proxied response", status, body)
+			}
+
+			return
+		}
+
+		// the redirect leads directly to the server
+		status, _ := testGet(t, client, proxy.URL+"/data/x")
+		if status != http.StatusTemporaryRedirect {
+			t.Errorf("GET /data/x = %d; want %d", status, http.StatusTemporaryRedirect)
+		}
+
+		if status, body := testGet(t, &http.Client{Transport: client.Transport},
+			proxy.URL+"/data/x"); status != http.StatusOK || body != "a /data/x" {
+			t.Errorf("GET /data/x with redirect = %d %q; want direct response of server", status, body)
+		}
+	})
+
+	if got := backend.NumRequests(); got != 100 {
+		t.Errorf("requests of server = %d; want 100", got)
+	}
+}
+
+func TestIntegrationGracefulShutdown(t *testing.T) {
+	backend := newTestBackend(t, "a", 200*time.Millisecond, 0)
+
+	proxy := startTestProxy(t, Config{}, backend.URL)
+	client := newTestClient(t)
+
+	const numRequests = 10
+
+	var waitGroup sync.WaitGroup
+
+	for i := 0; i < numRequests; i++ {
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+
+			if status, body := testGet(t, client, proxy.URL+"/obj"); status != http.StatusOK ||
+				body != "a /obj" {
+				t.Errorf("GET during shutdown = %d %q; want complete response", status, body)
+			}
+		}()
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); backend.NumRequests() < numRequests; {
+		if time.Now().After(deadline) {
+			t.Fatalf("requests of server = %d; want %d", backend.NumRequests(), numRequests)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// same as restart by Reconfigure(): active requests complete, no new connections
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := proxy.Config.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+
+	waitGroup.Wait()
+
+	if _, err := client.Get(proxy.URL + "/obj"); err == nil {
+		t.Errorf("GET after shutdown succeeded; want connection error")
+	}
+}
+
+func TestIntegrationShapePartialUpdate(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 0)
+
+	startTestProxy(t, Config{}, backend.URL)
+
+	for _, tc := range []struct {
+		method      string
+		query       string
+		wantDelay   time.Duration
+		wantPercent uint32
+	}{
+		{http.MethodPost, "?delay=100ms", 100 * time.Millisecond, FullSharePercent},
+		{http.MethodPost, "?share=50", 100 * time.Millisecond, 50},  // keeps the delay
+		{http.MethodPost, "?delay=10ms", 10 * time.Millisecond, 50}, // keeps the share
+		{http.MethodDelete, "", 0, FullSharePercent},
+	} {
+		recorder := httptest.NewRecorder()
+		ShapeHandler(recorder, httptest.NewRequest(tc.method, "/shape"+tc.query, nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("shape %s %s = %d %q", tc.method, tc.query, recorder.Code, recorder.Body.String())
+		}
+
+		shapedBackend := proxyState.backends[0]
+
+		if shapedBackend.ShapeDelay() != tc.wantDelay || shapedBackend.SharePercent() != tc.wantPercent {
+			t.Errorf("shaping after %s %s = %v, %d%%; want %v, %d%%", tc.method, tc.query,
+				shapedBackend.ShapeDelay(), shapedBackend.SharePercent(), tc.wantDelay, tc.wantPercent)
+		}
+	}
+}
+
+// Concurrent traffic to servers with latency and errors while the schedule gets changed through
+// the admin interface
+func TestIntegrationConcurrentScheduleChanges(t *testing.T) {
+	backends := []*testBackend{
+		newTestBackend(t, "a", time.Millisecond, 0),
+		newTestBackend(t, "b", 2*time.Millisecond, 7),
+		newTestBackend(t, "c", 0, 0),
+	}
+
+	proxy := startTestProxy(t, Config{numConnsPerServer: 4}, backends[0].URL,
+		backends[1].URL, backends[2].URL)
+	client := newTestClient(t)
+
+	var stopChan = make(chan struct{})
+	var adminDone = make(chan struct{})
+
+	go func() {
+		defer close(adminDone)
+
+		for share := 0; ; share = (share + 10) % 110 {
+			select {
+			case <-stopChan:
+				return
+			default:
+			}
+
+			recorder := httptest.NewRecorder()
+			ShapeHandler(recorder, httptest.NewRequest(http.MethodPost,
+				fmt.Sprintf("/shape?server=1&share=%d", share), nil))
+
+			if recorder.Code != http.StatusOK {
+				t.Errorf("shape = %d %q", recorder.Code, recorder.Body.String())
+				return
+			}
+
+			StatsHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	var numErrors int64
+
+	runConcurrent(16, 1000, func(requestIdx int) {
+		switch status, body := testGet(t, client, proxy.URL+"/obj"); status {
+		case http.StatusOK:
+		case http.StatusInternalServerError:
+			atomic.AddInt64(&numErrors, 1)
+		default:
+			t.Errorf("GET = %d %q; want 200 or 500 of server", status, body)
+		}
+	})
+
+	close(stopChan)
+	<-adminDone
+
+	var numServed uint64
+
+	for _, backend := range backends {
+		numServed += backend.NumRequests()
+
+		if got := backend.MaxInFlight(); got > 4 {
+			t.Errorf("max concurrent requests of server %s = %d; want <= 4", backend.name, got)
+		}
+	}
+
+	if numServed != 1000 {
+		t.Errorf("requests of all servers = %d; want 1000", numServed)
+	}
+
+	if want := int64(backends[1].NumRequests() / 7); numErrors != want {
+		t.Errorf("errors = %d; want %d", numErrors, want)
+	}
+}
+
+// newTruncatingServer returns a server that closes the connection after the response headers and
+// part of the body
+func newTruncatingServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("truncated"))
+		w.(http.Flusher).Flush()
+
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestIntegrationQuorumTruncatedBody(t *testing.T) {
+	goodBackend := newTestBackend(t, "good", 0, 0)
+	spareBackend := newTestBackend(t, "spare", 0, 0)
+
+	truncatingServer := newTruncatingServer(t)
+
+	proxy := startTestProxy(t, Config{quorumSize: 2}, goodBackend.URL, truncatingServer.URL,
+		spareBackend.URL+",weight=0")
+	client := newTestClient(t)
+
+	for i := 0; i < 10; i++ {
+		status, body := testGet(t, client, proxy.URL+"/obj")
+
+		if (status != http.StatusOK || body != "good /obj") && status != http.StatusBadGateway {
+			t.Errorf("GET = %d %q; want 200 from good server or 502 from truncating server", status, body)
+		}
+	}
+
+	if got := goodBackend.NumRequests(); got != 10 {
+		t.Errorf("requests of good server = %d; want 10", got)
+	}
+
+	if got := spareBackend.NumRequests(); got != 0 {
+		t.Errorf("requests of server with weight 0 = %d; want 0", got)
+	}
+}
+
+func TestIntegrationQuorumPools(t *testing.T) {
+	backends := []*testBackend{newTestBackend(t, "a", 0, 0), newTestBackend(t, "b", 0, 0),
+		newTestBackend(t, "cold", 0, 0)}
+
+	headerRoutes, err := ParseHeaderRoutes("X-Storage-Class:GLACIER=cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := startTestProxy(t, Config{quorumSize: 2, headerRoutes: headerRoutes}, backends[0].URL,
+		backends[1].URL, backends[2].URL+",pool=cold")
+	client := newTestClient(t)
+
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/obj", nil)
+		req.Header.Set("X-Storage-Class", "GLACIER")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+	}
+
+	// the quorum of the cold pool only has its single server
+	if got := backends[0].NumRequests() + backends[1].NumRequests(); got != 0 {
+		t.Errorf("requests of default pool for cold pool = %d; want 0", got)
+	}
+
+	for i := 0; i < 10; i++ {
+		if status, body := testGet(t, client, proxy.URL+"/obj"); status != http.StatusOK {
+			t.Errorf("GET = %d %q; want 200", status, body)
+		}
+	}
+
+	if got := backends[2].NumRequests(); got != 10 {
+		t.Errorf("requests of cold pool = %d; want 10 of its own requests", got)
+	}
+
+	// each quorum read goes to both servers of the default pool
+	for _, backend := range backends[:2] {
+		if got := backend.NumRequests(); got != 10 {
+			t.Errorf("requests of server %s = %d; want 10", backend.name, got)
+		}
+	}
+}
+
+func TestIntegrationInFlightAfterAbort(t *testing.T) {
+	truncatingServer := newTruncatingServer(t)
+
+	proxy := startTestProxy(t, Config{}, truncatingServer.URL)
+	client := newTestClient(t)
+
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(proxy.URL + "/obj")
+		if err != nil {
+			continue
+		}
+
+		if _, err := io.ReadAll(resp.Body); err == nil {
+			t.Error("GET of truncated response succeeded; want error")
+		}
+
+		resp.Body.Close()
+	}
+
+	// the proxy aborts the client connection before it completes the request
+	backend := proxyState.backends[0]
+
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&backend.numInFlight) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("requests in flight = %d; want 0", atomic.LoadInt64(&backend.numInFlight))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	backend.latencyHistogram.mutex.Lock()
+	numSamples := backend.latencyHistogram.count
+	backend.latencyHistogram.mutex.Unlock()
+
+	if numSamples != 5 {
+		t.Errorf("latency samples = %d; want 5", numSamples)
+	}
+}
+
+func TestIntegrationProbeFailedConnection(t *testing.T) {
+	backend := newTestBackend(t, "a", 0, 0)
+
+	startTestProxy(t, Config{}, backend.URL)
+
+	// the first dial fails, so that one probe request never gets a connection
+	transport := proxyState.backends[0].transport
+	dialContext := transport.DialContext
+
+	var numDials int32
+
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&numDials, 1) == 1 {
+			return nil, fmt.Errorf("simulated dial error")
+		}
+
+		return dialContext(ctx, network, addr)
+	}
+
+	startTime := time.Now()
+
+	numSuccessful, _ := ProbeServerConnections(proxyState.backends[0], 3)
+
+	// the transport retries the failed dial for one of the requests, so 2 or 3 succeed
+	if numSuccessful < 2 {
+		t.Errorf("successful probes = %d; want at least 2", numSuccessful)
+	}
+
+	if duration := time.Since(startTime); duration >= PrewarmBarrierTimeout {
+		t.Errorf("probe duration = %v; want less than %v", duration, PrewarmBarrierTimeout)
+	}
+}
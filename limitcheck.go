@@ -0,0 +1,134 @@
+// Consistency check of the connection limits and the open files limit at startup. Limits that
+// don't fit together get reported with concrete recommendations, e.g. if the connections toward
+// all servers plus the client connections can exceed the open files limit.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// LimitCheckHeadroom is the number of open files that the check reserves for files other than
+// client and server connections, e.g. listeners, the admin interface, DNS lookups and log files
+const LimitCheckHeadroom = 64
+
+// CheckLimits prints a warning with a recommendation for each inconsistency of "--maxconns",
+// "--maxclientconns", "--prewarm", "--quorum" and the open files limit, based on the servers after
+// expansion of servers file and SRV records
+func CheckLimits() {
+	var numBackends = uint64(len(proxyState.backends))
+	var openFilesLimit = GetOpenFilesLimit()
+
+	if numBackends == 0 || openFilesLimit.Cur <= LimitCheckHeadroom {
+		return
+	}
+
+	var connsPerServer = uint64(config.numConnsPerServer) // max concurrent connections per server
+	if config.numPrewarmConns > config.numConnsPerServer && config.numConnsPerServer != 0 {
+		fmt.Printf("WARNING: Pre-warmed connections exceed the connection limit per server, so that "+
+			"some of them can never be used concurrently. Recommendation: \"--prewarm %d\". "+
+			"(Prewarm: %d; Max connections per server: %d)\n",
+			config.numConnsPerServer, config.numPrewarmConns, config.numConnsPerServer)
+
+		connsPerServer = uint64(config.numPrewarmConns)
+	}
+
+	var numQuorum = uint64(1) // server connections per client request
+	if config.quorumSize > 1 {
+		numQuorum = uint64(config.quorumSize)
+	}
+
+	// connections toward servers
+	var numServerConns uint64
+
+	switch {
+	case config.numConnsPerServer != 0:
+		numServerConns = connsPerServer * numBackends
+	case config.maxClientConns != 0:
+		numServerConns = uint64(config.maxClientConns)*numQuorum + uint64(config.numPrewarmConns)*numBackends
+	default:
+		recommendedConns := (openFilesLimit.Cur - LimitCheckHeadroom) / (2 * numBackends)
+
+		fmt.Printf("WARNING: Neither server connections nor client connections are limited, so the "+
+			"open files limit can get exhausted. Recommendation: \"--maxconns %d\" or "+
+			"\"--maxclientconns\". (Servers: %d; Open files limit: %d)\n",
+			recommendedConns, numBackends, openFilesLimit.Cur)
+
+		return
+	}
+
+	// client connections; one per request toward a server if unlimited
+	var numClientConns = uint64(config.maxClientConns)
+	if numClientConns == 0 {
+		numClientConns = numServerConns / numQuorum
+	}
+
+	var numOtherFiles = LimitCheckHeadroom + uint64(config.numAcceptLoops)
+	var numRequiredFiles = numServerConns + numClientConns + numOtherFiles
+
+	if numRequiredFiles > openFilesLimit.Cur {
+		var recommendation string
+		var numAvailableFiles uint64 // for connections
+
+		if openFilesLimit.Cur > numOtherFiles {
+			numAvailableFiles = openFilesLimit.Cur - numOtherFiles
+		}
+
+		var recommendedConns uint64 // per server
+
+		if config.maxClientConns == 0 {
+			// client connections shrink with the server connections
+			recommendedConns = numAvailableFiles * numQuorum / (numBackends * (numQuorum + 1))
+		} else if numAvailableFiles > numClientConns {
+			recommendedConns = (numAvailableFiles - numClientConns) / numBackends
+		}
+
+		switch {
+		case numRequiredFiles <= openFilesLimit.Max:
+			recommendation = fmt.Sprintf("\"--fdlimit %d\"", numRequiredFiles)
+		case config.numConnsPerServer != 0 && recommendedConns > 0:
+			recommendation = fmt.Sprintf("\"--maxconns %d\" or a higher hard limit of open files",
+				recommendedConns)
+		case config.maxClientConns != 0 && numAvailableFiles > numServerConns:
+			recommendation = fmt.Sprintf("\"--maxclientconns %d\" or a higher hard limit of open files",
+				numAvailableFiles-numServerConns)
+		default:
+			recommendation = "a higher hard limit of open files"
+		}
+
+		fmt.Printf("WARNING: Server and client connections can exceed the open files limit. "+
+			"Recommendation: %s. (Server connections: %d; Client connections: %d; Other files: %d; "+
+			"Open files limit: %d; Max: %d)\n", recommendation, numServerConns, numClientConns,
+			numOtherFiles, openFilesLimit.Cur, openFilesLimit.Max)
+	}
+
+	// clients beyond the capacity of a pool wait for a connection slot, or get shed
+	if config.numConnsPerServer != 0 && config.maxClientConns != 0 {
+		var pools = PoolBackends()
+		var poolNames []string
+
+		for poolName := range pools {
+			poolNames = append(poolNames, poolName)
+		}
+
+		sort.Strings(poolNames)
+
+		for _, poolName := range poolNames {
+			var numPoolBackends = uint64(len(pools[poolName]))
+			var numPoolRequests = numPoolBackends * uint64(config.numConnsPerServer) / numQuorum
+
+			if uint64(config.maxClientConns) <= numPoolRequests {
+				continue
+			}
+
+			fmt.Printf("WARNING: Client connections can exceed the concurrent requests that the "+
+				"servers of pool %s can take, so that requests wait for connection slots. "+
+				"Recommendation: \"--maxconns %d\" or \"--maxclientconns %d\". (Servers: %d; "+
+				"Max connections per server: %d; Quorum: %d; Max client connections: %d)\n",
+				poolName, (uint64(config.maxClientConns)*numQuorum+numPoolBackends-1)/numPoolBackends,
+				numPoolRequests, numPoolBackends, config.numConnsPerServer, numQuorum,
+				config.maxClientConns)
+		}
+	}
+}
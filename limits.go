@@ -0,0 +1,22 @@
+// Limits for the size of client request headers and URLs
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// LimitURLLength rejects requests with a URL longer than config.maxURLLen before they are handled
+// by next
+func LimitURLLength(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > config.maxURLLen {
+			HTTPError(w, r, http.StatusRequestURITooLong,
+				"URL length "+strconv.Itoa(len(r.RequestURI))+" exceeds limit of "+strconv.Itoa(config.maxURLLen))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
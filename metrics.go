@@ -0,0 +1,420 @@
+// Metrics endpoint of the admin interface in Prometheus text format and OpenMetrics format, the
+// latter with trace ID exemplars for latency histograms
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are the upper bounds of the latency histogram buckets in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Exemplar links an observation of a histogram bucket to the trace of the request
+type Exemplar struct {
+	traceID   string
+	value     float64
+	timestamp time.Time
+}
+
+// LatencyHistogram is a thread-safe histogram of request latencies with the most recent exemplar
+// of each bucket
+type LatencyHistogram struct {
+	mutex        sync.Mutex
+	bucketCounts []uint64   // one more than latencyBuckets for "+Inf"
+	exemplars    []Exemplar // same index as bucketCounts; empty traceID if no exemplar
+	sum          float64
+	count        uint64
+	hdrTotal     *HdrHistogram // since startup; nil if HDR histograms disabled
+	hdrInterval  *HdrHistogram // since last interval of HDR log; nil if HDR log disabled
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	histogram := &LatencyHistogram{
+		bucketCounts: make([]uint64, len(latencyBuckets)+1),
+		exemplars:    make([]Exemplar, len(latencyBuckets)+1),
+	}
+
+	// for export on demand through the admin interface, as periodic log or as report on exit
+	if config.adminPort != 0 || config.hdrLogFile != "" || config.printReport {
+		histogram.hdrTotal = NewHdrHistogram()
+	}
+
+	if config.hdrLogFile != "" {
+		histogram.hdrInterval = NewHdrHistogram()
+	}
+
+	return histogram
+}
+
+// Observe adds a latency to the histogram. traceID is optional and may be empty.
+func (histogram *LatencyHistogram) Observe(latency time.Duration, traceID string) {
+	var seconds = latency.Seconds()
+	var bucketIdx = len(latencyBuckets)
+
+	for i, upperBound := range latencyBuckets {
+		if seconds <= upperBound {
+			bucketIdx = i
+			break
+		}
+	}
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	histogram.bucketCounts[bucketIdx]++
+	histogram.sum += seconds
+	histogram.count++
+
+	if histogram.hdrTotal != nil {
+		histogram.hdrTotal.Record(latency)
+	}
+
+	if histogram.hdrInterval != nil {
+		histogram.hdrInterval.Record(latency)
+	}
+
+	if traceID != "" {
+		histogram.exemplars[bucketIdx] = Exemplar{traceID: traceID, value: seconds, timestamp: time.Now()}
+	}
+}
+
+// CopyHdrTotal returns a copy of the HDR histogram since startup
+func (histogram *LatencyHistogram) CopyHdrTotal() *HdrHistogram {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	return histogram.hdrTotal.Copy()
+}
+
+// SwapHdrInterval returns the HDR histogram of the current interval and starts a new interval
+func (histogram *LatencyHistogram) SwapHdrInterval() *HdrHistogram {
+	var newInterval = NewHdrHistogram() // outside of lock
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	var interval = histogram.hdrInterval
+	histogram.hdrInterval = newInterval
+
+	return interval
+}
+
+// TraceID returns the trace ID from the W3C "traceparent" header of the request or an empty string
+// if the request has no valid traceparent header
+func TraceID(header http.Header) string {
+	// format: "VERSION-TRACEID-PARENTID-FLAGS", e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	fields := strings.Split(header.Get("traceparent"), "-")
+
+	if len(fields) < 4 || len(fields[1]) != 32 || fields[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+
+	if _, err := hex.DecodeString(fields[1]); err != nil {
+		return ""
+	}
+
+	return fields[1]
+}
+
+// AddTraceParent adds a new W3C "traceparent" header to the request if it doesn't have a valid one
+func AddTraceParent(header http.Header) {
+	if TraceID(header) != "" {
+		return
+	}
+
+	var ids [24]byte // 16 bytes trace ID, 8 bytes parent ID
+
+	if _, err := rand.Read(ids[:]); err != nil {
+		return
+	}
+
+	header.Set("traceparent", "00-"+hex.EncodeToString(ids[:16])+"-"+hex.EncodeToString(ids[16:])+"-01")
+}
+
+// metricsWriter writes metrics in Prometheus text format or in OpenMetrics format
+type metricsWriter struct {
+	writer        io.Writer
+	isOpenMetrics bool
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// header writes the HELP and TYPE lines of a metric. name is without "_total" suffix for counters.
+func (metrics *metricsWriter) header(name string, metricType string, help string) {
+	if metricType == "counter" && !metrics.isOpenMetrics {
+		name += "_total" // Prometheus text format uses the full sample name
+	}
+
+	fmt.Fprintf(metrics.writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// sample writes a single sample. labels are alternating names and values.
+func (metrics *metricsWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprint(metrics.writer, name)
+
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			fmt.Fprint(metrics.writer, "{")
+		} else {
+			fmt.Fprint(metrics.writer, ",")
+		}
+
+		fmt.Fprintf(metrics.writer, `%s="%s"`, labels[i], escapeLabelValue(labels[i+1]))
+
+		if i+2 >= len(labels) {
+			fmt.Fprint(metrics.writer, "}")
+		}
+	}
+
+	fmt.Fprintf(metrics.writer, " %s\n", formatFloat(value))
+}
+
+// histogram writes the samples of a latency histogram, including exemplars in OpenMetrics format
+func (metrics *metricsWriter) histogram(name string, histogram *LatencyHistogram, labels ...string) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	var cumulativeCount uint64
+
+	for i, bucketCount := range histogram.bucketCounts {
+		var upperBound = math.Inf(1)
+		if i < len(latencyBuckets) {
+			upperBound = latencyBuckets[i]
+		}
+
+		cumulativeCount += bucketCount
+
+		fmt.Fprintf(metrics.writer, "%s_bucket{", name)
+
+		for j := 0; j+1 < len(labels); j += 2 {
+			fmt.Fprintf(metrics.writer, `%s="%s",`, labels[j], escapeLabelValue(labels[j+1]))
+		}
+
+		fmt.Fprintf(metrics.writer, `le="%s"} %d`, formatFloat(upperBound), cumulativeCount)
+
+		if exemplar := histogram.exemplars[i]; metrics.isOpenMetrics && exemplar.traceID != "" {
+			fmt.Fprintf(metrics.writer, ` # {trace_id="%s"} %s %.3f`, exemplar.traceID, formatFloat(exemplar.value),
+				float64(exemplar.timestamp.UnixNano())/1e9)
+		}
+
+		fmt.Fprintln(metrics.writer)
+	}
+
+	metrics.sample(name+"_sum", histogram.sum, labels...)
+	metrics.sample(name+"_count", float64(histogram.count), labels...)
+}
+
+// sizeHistogram writes the samples of a body size histogram
+func (metrics *metricsWriter) sizeHistogram(name string, histogram *SizeHistogram, labels ...string) {
+	var cumulativeCount uint64
+
+	for i := range histogram.bucketCounts {
+		cumulativeCount += atomic.LoadUint64(&histogram.bucketCounts[i])
+
+		metrics.sample(name+"_bucket", float64(cumulativeCount), append(labels, "le", sizeBucketLabel(i))...)
+	}
+
+	metrics.sample(name+"_sum", float64(atomic.LoadUint64(&histogram.sum)), labels...)
+	metrics.sample(name+"_count", float64(atomic.LoadUint64(&histogram.count)), labels...)
+}
+
+// MetricsHandler serves the metrics in OpenMetrics format if the client accepts it (as Prometheus
+// does when exemplar storage is enabled) or in Prometheus text format otherwise
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics := metricsWriter{
+		writer:        w,
+		isOpenMetrics: strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text"),
+	}
+
+	if metrics.isOpenMetrics {
+		w.Header().Set("Content-Type", OpenMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", PrometheusContentType)
+	}
+
+	metrics.header("proxperfect_requests", "counter", "Number of received client requests.")
+	metrics.sample("proxperfect_requests_total", float64(atomic.LoadUint64(&proxyState.requestNum)))
+
+	scheduleStats := GetScheduleStats()
+
+	metrics.header("proxperfect_schedule_servers", "gauge", "Number of servers available for selection by the balancer of all servers.")
+	metrics.sample("proxperfect_schedule_servers", float64(scheduleStats.Servers))
+
+	metrics.header("proxperfect_schedule_updates", "counter", "Number of balancer updates due to weight changes, ejections etc.")
+	metrics.sample("proxperfect_schedule_updates_total", float64(scheduleStats.Updates))
+
+	metrics.header("proxperfect_quorum_divergences", "counter", "Number of quorum reads with divergent server responses.")
+	metrics.sample("proxperfect_quorum_divergences_total", float64(atomic.LoadUint64(&proxyState.quorumDivergences)))
+
+	metrics.header("proxperfect_checksum_mismatches", "counter", "Number of request or response bodies with checksum mismatch.")
+	metrics.sample("proxperfect_checksum_mismatches_total", float64(atomic.LoadUint64(&proxyState.checksumMismatches)))
+
+	clientConns := GetClientConnStats()
+
+	metrics.header("proxperfect_client_connections", "gauge", "Number of currently open client connections.")
+	metrics.sample("proxperfect_client_connections", float64(clientConns.NumCurrent))
+
+	metrics.header("proxperfect_client_connections_accepted", "counter", "Number of accepted client connections by transport.")
+	metrics.sample("proxperfect_client_connections_accepted_total", float64(clientConns.NumTotalPlain), "transport", "plain")
+	metrics.sample("proxperfect_client_connections_accepted_total", float64(clientConns.NumTotalTLS), "transport", "tls")
+
+	metrics.header("proxperfect_client_connections_rejected", "counter", "Number of client connections rejected by the connection limit.")
+	metrics.sample("proxperfect_client_connections_rejected_total", float64(clientConns.NumRejected))
+
+	metrics.header("proxperfect_client_requests", "counter", "Number of client requests by whether they were the first request of a connection (new) or arrived over a kept-alive connection (reused).")
+	metrics.sample("proxperfect_client_requests_total", float64(clientConns.NumReqsNew), "connection", "new")
+	metrics.sample("proxperfect_client_requests_total", float64(clientConns.NumReqsReused), "connection", "reused")
+
+	metrics.header("proxperfect_client_cancellations", "counter", "Number of requests canceled by the client (disconnect or deadline) by phase.")
+	metrics.sample("proxperfect_client_cancellations_total", float64(atomic.LoadUint64(&proxyState.queuedCancels)), "phase", "queued")
+	metrics.sample("proxperfect_client_cancellations_total", float64(atomic.LoadUint64(&proxyState.upstreamCancels)), "phase", "upstream")
+
+	if config.inspectURL != "" {
+		inspections := GetInspectionStats()
+
+		metrics.header("proxperfect_inspections", "counter", "Number of side-calls to the inspection service by result.")
+		metrics.sample("proxperfect_inspections_total", float64(inspections.NumAllowed), "result", "allowed")
+		metrics.sample("proxperfect_inspections_total", float64(inspections.NumDenied), "result", "denied")
+		metrics.sample("proxperfect_inspections_total", float64(inspections.NumFailed), "result", "failed")
+	}
+
+	if config.cacheSize > 0 {
+		cacheStats := GetCacheStats()
+
+		metrics.header("proxperfect_cache_requests", "counter", "Number of GET and HEAD requests by cache result.")
+		metrics.sample("proxperfect_cache_requests_total", float64(cacheStats.Hits), "result", "hit")
+		metrics.sample("proxperfect_cache_requests_total", float64(cacheStats.Misses), "result", "miss")
+		metrics.sample("proxperfect_cache_requests_total", float64(cacheStats.Bypasses), "result", "bypass")
+		metrics.sample("proxperfect_cache_requests_total", float64(cacheStats.StaleHits), "result", "stale")
+		metrics.sample("proxperfect_cache_requests_total", float64(cacheStats.StaleErrs), "result", "staleiferror")
+
+		metrics.header("proxperfect_cache_refreshes", "counter", "Number of background requests to refresh stale cached responses.")
+		metrics.sample("proxperfect_cache_refreshes_total", float64(cacheStats.Refreshes))
+
+		metrics.header("proxperfect_cache_evictions", "counter", "Number of cached responses evicted to make room for new ones.")
+		metrics.sample("proxperfect_cache_evictions_total", float64(cacheStats.Evictions))
+
+		metrics.header("proxperfect_cache_entries", "gauge", "Number of cached responses.")
+		metrics.sample("proxperfect_cache_entries", float64(cacheStats.NumEntries))
+
+		metrics.header("proxperfect_cache_size_bytes", "gauge", "Memory size of cached responses.")
+		metrics.sample("proxperfect_cache_size_bytes", float64(cacheStats.Size))
+	}
+
+	metrics.header("proxperfect_server_requests", "counter", "Number of requests forwarded to a server.")
+	for _, backend := range proxyState.backends {
+		metrics.sample("proxperfect_server_requests_total", float64(atomic.LoadUint64(&backend.numRequests)), "server", backend.serverStr)
+	}
+
+	metrics.header("proxperfect_server_weight", "gauge", "Current share of requests of a server relative to other servers.")
+	for _, backend := range proxyState.backends {
+		metrics.sample("proxperfect_server_weight", float64(backend.Weight()), "server", backend.serverStr)
+	}
+
+	metrics.header("proxperfect_server_errors", "counter", "Number of failed requests toward a server by error class.")
+	for _, backend := range proxyState.backends {
+		for class := ErrorClass(0); class < NumErrorClasses; class++ {
+			metrics.sample("proxperfect_server_errors_total", float64(atomic.LoadUint64(&backend.errorCounts[class])),
+				"server", backend.serverStr, "class", class.String())
+		}
+	}
+
+	if config.ejectTime != 0 {
+		metrics.header("proxperfect_server_health_score", "gauge", "Passive health score of a server based on failed requests. The server gets ejected at 0.")
+		for _, backend := range proxyState.backends {
+			metrics.sample("proxperfect_server_health_score", float64(backend.HealthStats().Score), "server", backend.serverStr)
+		}
+
+		metrics.header("proxperfect_server_ejected", "gauge", "1 if a server is currently ejected from the schedule, 0 otherwise.")
+		for _, backend := range proxyState.backends {
+			var ejected float64
+
+			if backend.IsEjected() {
+				ejected = 1
+			}
+
+			metrics.sample("proxperfect_server_ejected", ejected, "server", backend.serverStr)
+		}
+
+		metrics.header("proxperfect_server_ejections", "counter", "Number of ejections of a server from the schedule.")
+		for _, backend := range proxyState.backends {
+			metrics.sample("proxperfect_server_ejections_total", float64(backend.HealthStats().Ejections), "server", backend.serverStr)
+		}
+	}
+
+	if config.adaptiveConns {
+		metrics.header("proxperfect_server_conn_limit", "gauge", "Current adaptive connection limit of a server.")
+		for _, backend := range proxyState.backends {
+			metrics.sample("proxperfect_server_conn_limit", float64(backend.connLimiter.Limit()), "server", backend.serverStr)
+		}
+	}
+
+	metrics.header("proxperfect_server_request_duration_seconds", "histogram", "Time from forwarding a request to a server until the response was fully sent to the client.")
+	for _, backend := range proxyState.backends {
+		metrics.histogram("proxperfect_server_request_duration_seconds", backend.latencyHistogram, "server", backend.serverStr)
+	}
+
+	metrics.header("proxperfect_server_request_size_bytes", "histogram", "Body size of requests forwarded to a server.")
+	for _, backend := range proxyState.backends {
+		metrics.sizeHistogram("proxperfect_server_request_size_bytes", backend.requestSizes, "server", backend.serverStr)
+	}
+
+	metrics.header("proxperfect_server_response_size_bytes", "histogram", "Body size of responses of a server sent to the client.")
+	for _, backend := range proxyState.backends {
+		metrics.sizeHistogram("proxperfect_server_response_size_bytes", backend.responseSizes, "server", backend.serverStr)
+	}
+
+	if proxyState.statsRoutes != nil {
+		metrics.header("proxperfect_route_request_size_bytes", "histogram", "Body size of requests by route.")
+		for _, route := range proxyState.statsRoutes {
+			metrics.sizeHistogram("proxperfect_route_request_size_bytes", route.requestSizes, "route", route.name)
+		}
+
+		metrics.header("proxperfect_route_response_size_bytes", "histogram", "Body size of responses by route.")
+		for _, route := range proxyState.statsRoutes {
+			metrics.sizeHistogram("proxperfect_route_response_size_bytes", route.responseSizes, "route", route.name)
+		}
+	}
+
+	if len(proxyState.tenants) != 0 {
+		metrics.header("proxperfect_tenant_requests", "counter", "Number of requests of a tenant.")
+		for _, tenant := range proxyState.tenants {
+			metrics.sample("proxperfect_tenant_requests_total", float64(tenant.Stats().NumRequests), "tenant", tenant.name)
+		}
+
+		metrics.header("proxperfect_tenant_rejected_requests", "counter", "Number of rejected requests of a tenant.")
+		for _, tenant := range proxyState.tenants {
+			metrics.sample("proxperfect_tenant_rejected_requests_total", float64(tenant.Stats().NumRejected), "tenant", tenant.name)
+		}
+	}
+
+	metrics.writeProcessMetrics()
+
+	if metrics.isOpenMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
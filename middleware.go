@@ -0,0 +1,434 @@
+// Request handling as a chain of middleware stages, from admission checks to the final proxy stage
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware is a stage of the request handling chain. The handler returned by Wrap does the work of
+// this stage and then calls next, or it responds directly without calling next (e.g. to reject a
+// request). The RequestState of the current request is available through GetRequestState().
+type Middleware interface {
+	Name() string // used for verbose output
+	Wrap(next http.Handler) http.Handler
+}
+
+type middlewareFunc struct {
+	name string
+	wrap func(next http.Handler) http.Handler
+}
+
+// NewMiddleware creates a named Middleware from a plain wrapping function
+func NewMiddleware(name string, wrap func(next http.Handler) http.Handler) Middleware {
+	return &middlewareFunc{name: name, wrap: wrap}
+}
+
+func (middleware *middlewareFunc) Name() string {
+	return middleware.name
+}
+
+func (middleware *middlewareFunc) Wrap(next http.Handler) http.Handler {
+	return middleware.wrap(next)
+}
+
+// extensionMiddlewares are user-provided stages, which run after the built-in admission and routing
+// stages and before the request waits for a server connection slot
+var extensionMiddlewares []Middleware
+
+// RegisterMiddleware adds a user-provided stage to the chain. It has to be called before the chain
+// gets built at startup, typically from an init() function in a separate source file.
+func RegisterMiddleware(middleware Middleware) {
+	extensionMiddlewares = append(extensionMiddlewares, middleware)
+}
+
+// RequestState is the per-request state that is shared between the middleware stages
+type RequestState struct {
+	requestNum uint64
+	backendIdx uint32 // index in proxyState.backends
+	backend    *Backend
+	startTime  time.Time // when the proxy received the request
+
+	balancer BalancerStrategy // strategy that picked the server; nil if the server was set otherwise
+	tenant   *Tenant          // admitted tenant of the API key; nil without "--apikeys"
+
+	isEventStream bool        // client requested server-sent events in SSE mode
+	signedHeader  http.Header // signed headers as received from the client; nil if not preserved
+
+	forwardedTo atomic.Value // *Backend; set when the request gets sent to the server, for state dumps
+}
+
+type requestStateKey struct{}
+
+// GetRequestState returns the state of a request that passes through the middleware chain
+func GetRequestState(r *http.Request) *RequestState {
+	return r.Context().Value(requestStateKey{}).(*RequestState)
+}
+
+// SetBackend changes the server to which the request gets sent
+func (state *RequestState) SetBackend(backendIdx uint32) {
+	state.backendIdx = backendIdx
+	state.backend = proxyState.backends[backendIdx]
+	state.balancer = nil
+}
+
+// SetPickedBackend changes the server to which the request gets sent to the one that the given
+// balancer picked, so that the balancer gets notified of the outcome
+func (state *RequestState) SetPickedBackend(balancer BalancerStrategy, backendIdx uint32) {
+	state.SetBackend(backendIdx)
+	state.balancer = balancer
+}
+
+// BuildMiddlewareChain returns the handler for proxied requests, consisting of the stages that are
+// enabled by the config
+func BuildMiddlewareChain() http.Handler {
+	var middlewares []Middleware
+
+	middlewares = append(middlewares, NewMiddleware("drain", drainMiddleware))
+
+	if config.sseMode {
+		middlewares = append(middlewares, NewMiddleware("sse", sseMiddleware))
+	}
+
+	if config.clientDeadline {
+		middlewares = append(middlewares, NewMiddleware("deadline", deadlineMiddleware))
+	}
+
+	if proxyState.tenants != nil {
+		middlewares = append(middlewares, NewMiddleware("tenants", tenantMiddleware))
+	}
+
+	if config.inspectURL != "" {
+		middlewares = append(middlewares, NewMiddleware("inspect", inspectMiddleware))
+	}
+
+	if config.idempotencyWindow != 0 {
+		middlewares = append(middlewares, NewMiddleware("idempotency", idempotencyMiddleware))
+	}
+
+	if config.cacheSize > 0 {
+		middlewares = append(middlewares, NewMiddleware("cache", cacheMiddleware))
+	}
+
+	if HasPools() {
+		middlewares = append(middlewares, NewMiddleware("pools", poolMiddleware))
+	}
+
+	if config.compatMode {
+		middlewares = append(middlewares, NewMiddleware("compat", compatMiddleware))
+	}
+
+	if proxyState.shardMap != nil {
+		middlewares = append(middlewares, NewMiddleware("shards", shardMiddleware))
+	}
+
+	if proxyState.routeScript != nil {
+		middlewares = append(middlewares, NewMiddleware("routescript", routeScriptMiddleware))
+	}
+
+	if config.affinityWindow != 0 {
+		middlewares = append(middlewares, NewMiddleware("affinity", affinityMiddleware))
+	}
+
+	if config.isMixedRedirect {
+		middlewares = append(middlewares, NewMiddleware("redirect", redirectMiddleware))
+	}
+
+	if config.addTraceParent {
+		middlewares = append(middlewares, NewMiddleware("traceparent", traceParentMiddleware))
+	}
+
+	if len(config.checksumAlgos) != 0 {
+		middlewares = append(middlewares, NewMiddleware("checksums", checksumMiddleware))
+	}
+
+	if config.requestFilterCmd != "" {
+		middlewares = append(middlewares, NewMiddleware("requestfilter", requestFilterMiddleware))
+	}
+
+	middlewares = append(middlewares, extensionMiddlewares...)
+
+	if config.quorumSize > 1 {
+		middlewares = append(middlewares, NewMiddleware("quorum", quorumMiddleware))
+	}
+
+	middlewares = append(middlewares, NewMiddleware("connlimit", connLimitMiddleware))
+
+	if config.beVerbose {
+		middlewares = append(middlewares, NewMiddleware("log", logMiddleware))
+	}
+
+	var handler http.Handler = http.HandlerFunc(ServeBackend)
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i].Wrap(handler)
+	}
+
+	if config.beVerbose {
+		fmt.Print("Request handling chain:")
+
+		for _, middleware := range middlewares {
+			fmt.Print(" " + middleware.Name() + " ->")
+		}
+
+		fmt.Println(" proxy")
+	}
+
+	return handler
+}
+
+func drainMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if RejectDrainedRequest(w, r) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sseMiddleware detects requests for server-sent events, which get no compression from the server,
+// because that could delay events
+func sseMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsEventStreamRequest(r) {
+			GetRequestState(r).isEventStream = true
+
+			r.Header.Set("Accept-Encoding", "identity")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deadlineMiddleware applies the timeout from the client request headers to the request context
+func deadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if timeout, ok := ClientTimeout(r.Header); ok && !GetRequestState(r).isEventStream {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			r = r.WithContext(ctx)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantMiddleware checks API key, rate limit and concurrency limit of the tenant
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// background requests of the cache were admitted as the request that they were made for
+		if tenant, isRefresh := CacheRefreshTenant(r); isRefresh {
+			GetRequestState(r).tenant = tenant
+
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		tenant, w := AdmitTenantRequest(w, r)
+		if tenant == nil {
+			return
+		}
+
+		defer tenant.ReleaseRequest()
+
+		GetRequestState(r).tenant = tenant
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeIdempotentRequest(w, r, next)
+	})
+}
+
+// shardMiddleware sends requests to the server that is responsible for the hash range of the path.
+// Sharding is strict: Other servers don't have the objects of the range, so requests still go to the
+// responsible server while it is ejected or no longer in its SRV record, and fail there.
+func shardMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		GetRequestState(r).SetBackend(ShardBackend(r.URL.Path))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func routeScriptMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var state = GetRequestState(r)
+
+		routedIdx, isRouted, err := RouteRequest(r, state.requestNum)
+		if err != nil {
+			// details of the script are not for clients
+			fmt.Printf("Routing script failed. Request: %s %s (Client: %s); Error: %v\n", r.Method,
+				r.URL.String(), ClientIP(r), err)
+			HTTPError(w, r, http.StatusInternalServerError, "Routing failed")
+
+			return
+		}
+
+		if isRouted {
+			state.SetBackend(routedIdx)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectMiddleware redirects matching requests and requests for large objects to the selected
+// server instead of proxying them
+func redirectMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var state = GetRequestState(r)
+
+		if MatchRedirectRules(r) || (config.redirectSize > 0 && ExceedsRedirectSize(r, state.backend)) {
+			RedirectRequest(w, r, state.backend, state.requestNum)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func traceParentMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddTraceParent(r.Header)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func checksumMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = NewChecksumVerifier(r.Body, r.Header, "Request: "+r.Method+" "+r.URL.String())
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requestFilterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !FilterRequestBody(w, r) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// quorumMiddleware handles GET requests by QuorumRead() instead of the rest of the chain
+func quorumMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var state = GetRequestState(r)
+
+		// quorum reads buffer the whole response
+		if r.Method != http.MethodGet || state.isEventStream {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		QuorumRead(w, r, state.backendIdx, state.requestNum)
+	})
+}
+
+// connLimitMiddleware limits concurrent connections for the selected server
+// (note: release is deferred, because the proxy panics on errors during body copy)
+func connLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var backend = GetRequestState(r).backend
+
+		if backend.connLimiter != nil {
+			var priority = ClassifyPriority(r)
+
+			if config.shedQueueLen != 0 && backend.connLimiter.NumWaiting() >= ShedQueueLen(priority) {
+				HTTPError(w, r, http.StatusServiceUnavailable, "Server queue full")
+				return
+			}
+
+			if err := backend.connLimiter.Acquire(r.Context(), priority); err != nil {
+				AbortCanceledRequest(w, r, err)
+				return
+			}
+
+			defer backend.connLimiter.Release()
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func logMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var state = GetRequestState(r)
+
+		fmt.Printf("[%s START #%d]: %s %s (Client: %s)\n", state.backend.serverStr, state.requestNum, r.Method, r.URL.String(), ClientIP(r))
+
+		next.ServeHTTP(w, r)
+
+		fmt.Printf("[%s END   #%d]: %s %s\n", state.backend.serverStr, state.requestNum, r.Method, r.URL.String())
+	})
+}
+
+// ServeBackend is the final stage of the chain, which proxies the request to the selected server
+func ServeBackend(w http.ResponseWriter, r *http.Request) {
+	var state = GetRequestState(r)
+	var backend = state.backend
+
+	AddTagHeaders(r, state.backendIdx, state.requestNum)
+
+	if config.connTrace {
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), backend.NewClientTrace(state.requestNum)))
+	}
+
+	atomic.AddUint64(&backend.numRequests, 1)
+
+	var requestBytes, responseBytes uint64
+
+	r.Body = &countingReader{ReadCloser: r.Body, numBytes: &requestBytes}
+	countingWriter := &countingResponseWriter{ResponseWriter: w, numBytes: &responseBytes}
+	w = countingWriter
+
+	PrepareRequestTrailers(r)
+
+	if backend.adaptiveConns != nil {
+		r = WithAdaptiveConnsSample(r)
+	}
+
+	atomic.AddInt64(&backend.numInFlight, 1)
+	state.forwardedTo.Store(backend)
+
+	startTime := time.Now()
+
+	// deferred, because the proxy panics to abort the response if the client disconnects or the
+	// response body of the server is truncated
+	defer func() {
+		atomic.AddInt64(&backend.numInFlight, -1)
+
+		duration := time.Since(startTime)
+
+		if state.balancer != nil {
+			state.balancer.Completed(state.backendIdx, duration)
+		}
+
+		backend.latencyHistogram.Observe(duration, TraceID(r.Header))
+
+		ObserveBodySizes(backend, r, atomic.LoadUint64(&requestBytes), atomic.LoadUint64(&responseBytes))
+		backend.CountResponseStatus(countingWriter.statusCode)
+	}()
+
+	// artificial latency counts for the server, as if the server was slow
+	if backend.WaitShapeDelay(r.Context()) {
+		backend.proxy.ServeHTTP(w, r)
+	} else {
+		w.WriteHeader(CanceledRequestStatus(r.Context().Err()))
+	}
+}
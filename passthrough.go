@@ -0,0 +1,241 @@
+// TLS passthrough mode: Client connections get forwarded as raw TCP streams without TLS termination,
+// for servers that terminate TLS themselves with their own certificates. The server gets selected by
+// the balancer through the SNI hostname of the TLS ClientHello, which gets peeked and replayed.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PassthroughHelloTimeout is the max time for a client to send the TLS ClientHello
+const PassthroughHelloTimeout = 10 * time.Second
+
+// passthroughAcceptRetryDelay is the delay after temporary accept errors, e.g. too many open files
+const passthroughAcceptRetryDelay = 50 * time.Millisecond
+
+// errClientHelloPeeked stops the TLS handshake after the ClientHello was read
+var errClientHelloPeeked = errors.New("ClientHello peeked")
+
+// SNIRoute sends passthrough connections with a matching SNI hostname to a pool
+type SNIRoute struct {
+	pattern string // lowercase; a leading "*." matches any subdomain
+	pool    string
+}
+
+// ParseSNIRoutes parses a comma-separated list of routes in the format "HOSTNAME=POOL", e.g.
+// "s3.example.com=s3,*.web.example.com=web"
+func ParseSNIRoutes(routesStr string) ([]SNIRoute, error) {
+	var routes []SNIRoute
+
+	for _, routeStr := range strings.Split(routesStr, ",") {
+		pattern, pool, hasPool := strings.Cut(routeStr, "=")
+
+		if !hasPool || pattern == "" || pool == "" {
+			return nil, fmt.Errorf("Invalid SNI route: %s", routeStr)
+		}
+
+		routes = append(routes, SNIRoute{pattern: strings.ToLower(pattern), pool: pool})
+	}
+
+	return routes, nil
+}
+
+// MatchSNIRoutes returns the pool of the first SNI route that matches the hostname, or
+// DefaultPoolName if no route matches
+func MatchSNIRoutes(serverName string) string {
+	serverName = strings.ToLower(serverName)
+
+	for _, route := range config.sniRoutes {
+		if route.pattern == serverName ||
+			(strings.HasPrefix(route.pattern, "*.") && strings.HasSuffix(serverName, route.pattern[1:])) {
+			return route.pool
+		}
+	}
+
+	return DefaultPoolName
+}
+
+// CheckSNIRoutes returns an error if an SNI route refers to a pool without servers
+func CheckSNIRoutes() error {
+	pools := PoolBackends()
+
+	for _, route := range config.sniRoutes {
+		if len(pools[route.pool]) == 0 {
+			return fmt.Errorf("SNI route refers to pool without servers: %s", route.pool)
+		}
+	}
+
+	return nil
+}
+
+// helloPeekConn is the client connection for the TLS handshake that reads the ClientHello. Reads
+// get recorded for the replay to the server, writes get discarded, so that the client gets no
+// handshake response (e.g. an alert) from the proxy.
+type helloPeekConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (conn *helloPeekConn) Read(buf []byte) (int, error) {
+	return conn.reader.Read(buf)
+}
+
+func (conn *helloPeekConn) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+// PeekClientHello reads the TLS ClientHello from the client connection. Returns the SNI hostname
+// (empty if the client sent none) and all bytes that were read from the connection.
+func PeekClientHello(conn net.Conn) (serverName string, helloBytes []byte, err error) {
+	var recordedBytes bytes.Buffer
+	var isHelloPeeked bool
+
+	peekConn := &helloPeekConn{Conn: conn, reader: io.TeeReader(conn, &recordedBytes)}
+
+	err = tls.Server(peekConn, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			isHelloPeeked = true
+
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+
+	if !isHelloPeeked {
+		return "", nil, fmt.Errorf("Reading TLS ClientHello failed: %w", err)
+	}
+
+	return serverName, recordedBytes.Bytes(), nil
+}
+
+// ServePassthrough runs the accept loop of a listener for client connections in TLS passthrough mode
+func ServePassthrough(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(passthroughAcceptRetryDelay)
+				continue
+			}
+
+			log.Fatal(err)
+		}
+
+		go ServePassthroughConn(conn)
+	}
+}
+
+// ServePassthroughConn forwards a client connection to the server that the balancer picks for its
+// SNI hostname
+func ServePassthroughConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(PassthroughHelloTimeout))
+
+	serverName, helloBytes, err := PeekClientHello(conn)
+	if err != nil {
+		if config.beVerbose {
+			fmt.Printf("Closing client connection. Remote: %s; Error: %v\n", conn.RemoteAddr(), err)
+		}
+
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	atomic.AddUint64(&proxyState.requestNum, 1)
+
+	// balancers only get the SNI hostname and client address, as there is no HTTP request
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: serverName},
+		Host:       serverName,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+
+	balancer, backendIdx, isAvailable := SelectPoolBackend(MatchSNIRoutes(serverName), r)
+	if !isAvailable {
+		balancer, backendIdx, isAvailable = SelectBackend(r)
+	}
+
+	if !isAvailable {
+		fmt.Printf("Closing client connection. Remote: %s; SNI: %s; Reason: %s\n", conn.RemoteAddr(), serverName, NoServersMessage)
+		return
+	}
+
+	backend := proxyState.backends[backendIdx]
+
+	var addr = backend.dialAddr
+
+	if addr == "" {
+		addr = targetHostPort(backend.targetURL)
+	}
+
+	atomic.AddUint64(&backend.numRequests, 1)
+	atomic.AddInt64(&backend.numInFlight, 1)
+	defer atomic.AddInt64(&backend.numInFlight, -1)
+
+	startTime := time.Now()
+
+	dialer := &net.Dialer{Timeout: DialTimeout, KeepAlive: config.tcpKeepAlive}
+
+	serverConn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		class := ClassifyUpstreamError(err, false)
+
+		backend.CountError(class)
+		balancer.Failed(backendIdx, class)
+		balancer.Completed(backendIdx, time.Since(startTime))
+
+		fmt.Printf("Passthrough error. Server: %s; Class: %s; SNI: %s; Error: %v\n", backend.serverStr, class, serverName, err)
+
+		return
+	}
+
+	defer serverConn.Close()
+
+	if config.beVerbose {
+		fmt.Printf("Passthrough connection. Client: %s; SNI: %s; Server: %s\n", conn.RemoteAddr(), serverName, backend.serverStr)
+	}
+
+	if _, err := serverConn.Write(helloBytes); err == nil {
+		PipeConns(conn, serverConn)
+	}
+
+	balancer.Completed(backendIdx, time.Since(startTime))
+}
+
+// PipeConns copies data between the client and server connection in both directions until the
+// server closes its side, or the client closed its side and the server finished sending
+func PipeConns(clientConn net.Conn, serverConn net.Conn) {
+	var clientDone = make(chan struct{})
+
+	go func() {
+		io.Copy(serverConn, clientConn)
+
+		if tcpConn, ok := serverConn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite() // let the server finish sending
+		}
+
+		close(clientDone)
+	}()
+
+	io.Copy(clientConn, serverConn)
+
+	clientConn.Close() // unblocks the copy from the client, if the client hasn't closed yet
+
+	<-clientDone
+}
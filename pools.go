@@ -0,0 +1,107 @@
+// Pools of servers for tiered backends behind one endpoint. Servers join a pool through their
+// "pool" option, requests get routed to a pool by their header values (e.g. the storage class).
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultPoolName is the pool of servers without "pool" option and of requests that match no
+// header route
+const DefaultPoolName = "default"
+
+// HeaderRoute sends requests with a matching header value to a pool
+type HeaderRoute struct {
+	header string // canonical form
+	value  string // "*" matches any non-empty value
+	pool   string
+}
+
+// ParseHeaderRoutes parses a comma-separated list of routes in the format "HEADER:VALUE=POOL",
+// e.g. "X-Amz-Storage-Class:GLACIER=cold,X-Tenant-Id:*=tenants"
+func ParseHeaderRoutes(routesStr string) ([]HeaderRoute, error) {
+	var routes []HeaderRoute
+
+	for _, routeStr := range strings.Split(routesStr, ",") {
+		match, pool, hasPool := strings.Cut(routeStr, "=")
+		header, value, hasValue := strings.Cut(match, ":")
+
+		if !hasPool || !hasValue || header == "" || value == "" || pool == "" {
+			return nil, fmt.Errorf("Invalid header route: %s", routeStr)
+		}
+
+		routes = append(routes, HeaderRoute{
+			header: http.CanonicalHeaderKey(header),
+			value:  value,
+			pool:   pool,
+		})
+	}
+
+	return routes, nil
+}
+
+// MatchHeaderRoutes returns the pool of the first header route that matches the request, or
+// DefaultPoolName if no route matches
+func MatchHeaderRoutes(r *http.Request) string {
+	for _, route := range config.headerRoutes {
+		value := r.Header.Get(route.header)
+
+		if value != "" && (route.value == "*" || route.value == value) {
+			return route.pool
+		}
+	}
+
+	return DefaultPoolName
+}
+
+// HasPools returns true if any server has a "pool" option
+func HasPools() bool {
+	for _, backend := range proxyState.backends {
+		if backend.pool != DefaultPoolName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PoolBackends returns the indices of the servers of each pool, mapped by pool name
+func PoolBackends() map[string][]uint32 {
+	pools := make(map[string][]uint32)
+
+	for i, backend := range proxyState.backends {
+		pools[backend.pool] = append(pools[backend.pool], uint32(i))
+	}
+
+	return pools
+}
+
+// CheckHeaderRoutes returns an error if a header route refers to a pool without servers
+func CheckHeaderRoutes() error {
+	pools := PoolBackends()
+
+	for _, route := range config.headerRoutes {
+		if len(pools[route.pool]) == 0 {
+			return fmt.Errorf("Header route refers to pool without servers: %s", route.pool)
+		}
+	}
+
+	return nil
+}
+
+// poolMiddleware selects the server from the pool of the request. Requests for the default pool
+// keep the server from the schedule of all servers if no server is in the default pool.
+func poolMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var state = GetRequestState(r)
+
+		if balancer, backendIdx, exists := SelectPoolBackend(MatchHeaderRoutes(r), r); exists {
+			state.SetPickedBackend(balancer, backendIdx)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,143 @@
+// Printout of the effective configuration after merging defaults, etcd config, servers file and
+// command line, including computed values, so that deployments are auditable
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Sources of option values in the effective config
+const (
+	ConfigSourceDefault     = "default"
+	ConfigSourceEtcd        = "etcd"
+	ConfigSourceCommandLine = "command line"
+)
+
+// etcdOptionValues are the values of the options that were set by the config from etcd, mapped by
+// option name
+var etcdOptionValues = make(map[string]string)
+
+// ConfigOption is the value of a command line option in the effective config
+type ConfigOption struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// ConfigServer is a server in the effective config, after expansion of templates and SRV records
+type ConfigServer struct {
+	Index      int    `json:"index"`
+	Server     string `json:"server"`
+	Address    string `json:"address"`
+	DialAddr   string `json:"dialAddr,omitempty"`
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	Pool       string `json:"pool"`
+	Weight     uint32 `json:"weight"`
+	SRVName    string `json:"srvName,omitempty"`
+}
+
+// EffectiveConfig is the structured form of the effective config
+type EffectiveConfig struct {
+	Version      string         `json:"version"`
+	Options      []ConfigOption `json:"options"` // sorted by name
+	Servers      []ConfigServer `json:"servers"`
+	GOMAXPROCS   int            `json:"gomaxprocs"`
+	CPUs         []int          `json:"cpus,omitempty"`
+	FDLimit      uint64         `json:"fdLimit"`        // after "auto" computation and capping at max; 0 if unchanged
+	OpenFiles    uint64         `json:"openFilesLimit"` // current soft limit, after "--fdlimit"
+	MaxOpenFiles uint64         `json:"maxOpenFilesLimit"`
+}
+
+// RecordEtcdOptions remembers the options that were set by the given arguments from etcd; called
+// after the arguments from etcd were parsed and before the actual command line gets parsed again
+func RecordEtcdOptions(etcdArgs []string) {
+	for _, arg := range etcdArgs {
+		if !strings.HasPrefix(arg, "-") {
+			continue // option value or server
+		}
+
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+
+		if option := flag.Lookup(name); option != nil {
+			etcdOptionValues[name] = option.Value.String()
+		}
+	}
+}
+
+// GetEffectiveConfig returns the effective config of the initialized proxy
+func GetEffectiveConfig() EffectiveConfig {
+	var isSet = make(map[string]bool)
+
+	flag.Visit(func(option *flag.Flag) {
+		isSet[option.Name] = true
+	})
+
+	rlimit := GetOpenFilesLimit()
+
+	effectiveConfig := EffectiveConfig{
+		Version:      ProgVersion,
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		CPUs:         config.cpus,
+		FDLimit:      config.fdLimit,
+		OpenFiles:    uint64(rlimit.Cur),
+		MaxOpenFiles: uint64(rlimit.Max),
+	}
+
+	flag.VisitAll(func(option *flag.Flag) { // in lexicographical order
+		var source = ConfigSourceDefault
+
+		if etcdValue, isEtcdOption := etcdOptionValues[option.Name]; isEtcdOption &&
+			etcdValue == option.Value.String() {
+			source = ConfigSourceEtcd
+		} else if isSet[option.Name] {
+			source = ConfigSourceCommandLine
+		}
+
+		effectiveConfig.Options = append(effectiveConfig.Options, ConfigOption{
+			Name:   option.Name,
+			Value:  option.Value.String(),
+			Source: source,
+		})
+	})
+
+	for i, backend := range proxyState.backends {
+		effectiveConfig.Servers = append(effectiveConfig.Servers, ConfigServer{
+			Index:      i,
+			Server:     backend.serverStr,
+			Address:    targetHostPort(backend.targetURL),
+			DialAddr:   backend.dialAddr,
+			PathPrefix: backend.pathPrefix,
+			Pool:       backend.pool,
+			Weight:     backend.Weight(),
+			SRVName:    backend.srvName,
+		})
+	}
+
+	return effectiveConfig
+}
+
+// WriteEffectiveConfig writes the effective config in JSON format
+func WriteEffectiveConfig(writer io.Writer) {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(GetEffectiveConfig())
+}
+
+// PrintStartupBanner prints version and main settings at startup, and the full effective config in
+// verbose mode
+func PrintStartupBanner() {
+	fmt.Printf("%s v%s; PID: %d; Port: %d; Servers: %d; GOMAXPROCS: %d\n", ProgName, ProgVersion,
+		os.Getpid(), config.listenPort, len(proxyState.backends), runtime.GOMAXPROCS(0))
+
+	if config.beVerbose {
+		fmt.Println("Effective config:")
+		WriteEffectiveConfig(os.Stdout)
+	}
+}
@@ -0,0 +1,254 @@
+// Request priority classes for preferred handling of e.g. management and health check traffic
+// under overload
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	NumPriorities // not a priority, only used for array sizes
+)
+
+var priorityNames = [NumPriorities]string{"low", "normal", "high"}
+
+func (priority Priority) String() string {
+	return priorityNames[priority]
+}
+
+// PriorityRule assigns a priority to requests that match the rule
+type PriorityRule struct {
+	priority Priority
+	kind     string // "path", "method" or "header"
+	pattern  string // path pattern or method
+	header   string // header name for kind "header"
+}
+
+// ParsePriorityRules parses a comma-separated list of rules in the format "LEVEL:KIND=PATTERN", e.g.
+// "high:path=/health*,high:method=OPTIONS,low:header=X-Batch:true"
+func ParsePriorityRules(rulesStr string) ([]PriorityRule, error) {
+	var rules []PriorityRule
+
+	for _, ruleStr := range strings.Split(rulesStr, ",") {
+		levelStr, matchStr, _ := strings.Cut(ruleStr, ":")
+		kind, pattern, hasPattern := strings.Cut(matchStr, "=")
+
+		rule := PriorityRule{priority: -1, kind: kind, pattern: pattern}
+
+		for priority := Priority(0); priority < NumPriorities; priority++ {
+			if levelStr == priority.String() {
+				rule.priority = priority
+			}
+		}
+
+		if rule.priority < 0 || !hasPattern {
+			return nil, fmt.Errorf("Invalid priority rule: %s", ruleStr)
+		}
+
+		switch kind {
+		case "path":
+		case "method":
+			rule.pattern = strings.ToUpper(pattern)
+		case "header":
+			rule.header, rule.pattern, _ = strings.Cut(pattern, ":")
+		default:
+			return nil, fmt.Errorf("Invalid priority rule type: %s", ruleStr)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (rule *PriorityRule) Matches(r *http.Request) bool {
+	switch rule.kind {
+	case "path":
+		return MatchPathPattern(rule.pattern, r.URL.Path)
+	case "method":
+		return r.Method == rule.pattern
+	case "header":
+		values, exists := r.Header[http.CanonicalHeaderKey(rule.header)]
+		if rule.pattern == "" {
+			return exists
+		}
+
+		for _, value := range values {
+			if value == rule.pattern {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ClassifyPriority returns the priority of the first matching rule or PriorityNormal if no rule
+// matches
+func ClassifyPriority(r *http.Request) Priority {
+	for i := range config.priorityRules {
+		if config.priorityRules[i].Matches(r) {
+			return config.priorityRules[i].priority
+		}
+	}
+
+	return PriorityNormal
+}
+
+// ShedQueueLen returns the number of waiting requests from which requests of the given priority
+// get rejected instead of queued. Low priority requests get shed first, high priority requests
+// only at much longer queues.
+func ShedQueueLen(priority Priority) int {
+	switch priority {
+	case PriorityLow:
+		return (config.shedQueueLen + 1) / 2
+	case PriorityHigh:
+		return config.shedQueueLen * 4
+	}
+
+	return config.shedQueueLen
+}
+
+// PriorityLimiter limits the number of concurrent requests like a semaphore, but serves waiting
+// requests in order of their priority. Requests of the same priority are served first come, first
+// served.
+type PriorityLimiter struct {
+	mutex     sync.Mutex
+	limit     int
+	numActive int
+	waiters   [NumPriorities]list.List // elements are of type "chan struct{}"
+}
+
+func NewPriorityLimiter(limit int) *PriorityLimiter {
+	return &PriorityLimiter{limit: limit}
+}
+
+// numWaitingUnlocked returns the total number of waiting requests; caller must hold the mutex
+func (limiter *PriorityLimiter) numWaitingUnlocked() int {
+	var numWaiting int
+
+	for priority := range limiter.waiters {
+		numWaiting += limiter.waiters[priority].Len()
+	}
+
+	return numWaiting
+}
+
+// NumWaiting returns the total number of requests that are waiting for a slot
+func (limiter *PriorityLimiter) NumWaiting() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	return limiter.numWaitingUnlocked()
+}
+
+// Usage returns the number of requests that currently hold a slot and the number of waiting requests
+// per priority
+func (limiter *PriorityLimiter) Usage() (numActive int, numWaiting [NumPriorities]int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	for priority := range limiter.waiters {
+		numWaiting[priority] = limiter.waiters[priority].Len()
+	}
+
+	return limiter.numActive, numWaiting
+}
+
+// Acquire waits for a free slot. Returns an error if ctx is done before a slot was acquired.
+func (limiter *PriorityLimiter) Acquire(ctx context.Context, priority Priority) error {
+	limiter.mutex.Lock()
+
+	if limiter.numActive < limiter.limit && limiter.numWaitingUnlocked() == 0 {
+		limiter.numActive++
+		limiter.mutex.Unlock()
+
+		return nil
+	}
+
+	readyChan := make(chan struct{})
+	waiterElem := limiter.waiters[priority].PushBack(readyChan)
+
+	limiter.mutex.Unlock()
+
+	select {
+	case <-readyChan:
+		return nil
+	case <-ctx.Done():
+		limiter.mutex.Lock()
+
+		select {
+		case <-readyChan:
+			// slot was handed over concurrently, so give it to the next waiter
+			limiter.mutex.Unlock()
+			limiter.Release()
+		default:
+			limiter.waiters[priority].Remove(waiterElem)
+			limiter.mutex.Unlock()
+		}
+
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot from Acquire() and hands it over to the waiter with the highest priority,
+// unless the limit was lowered below the number of active requests
+func (limiter *PriorityLimiter) Release() {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.numActive <= limiter.limit && limiter.handOverUnlocked() {
+		return // slot handed over, so numActive stays unchanged
+	}
+
+	limiter.numActive--
+}
+
+// handOverUnlocked wakes up the waiter with the highest priority and returns false if there is no
+// waiter; caller must hold the mutex
+func (limiter *PriorityLimiter) handOverUnlocked() bool {
+	for priority := NumPriorities - 1; priority >= 0; priority-- {
+		if waiterElem := limiter.waiters[priority].Front(); waiterElem != nil {
+			limiter.waiters[priority].Remove(waiterElem)
+			close(waiterElem.Value.(chan struct{}))
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// Limit returns the current max number of concurrent requests
+func (limiter *PriorityLimiter) Limit() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	return limiter.limit
+}
+
+// SetLimit changes the max number of concurrent requests. Waiting requests get the new slots of a
+// higher limit immediately. With a lower limit, active requests continue and released slots don't
+// get handed over until the number of active requests is below the new limit.
+func (limiter *PriorityLimiter) SetLimit(limit int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.limit = limit
+
+	for limiter.numActive < limiter.limit && limiter.handOverUnlocked() {
+		limiter.numActive++
+	}
+}
@@ -0,0 +1,85 @@
+// Health of the proxy process itself: runtime metrics and open file descriptors vs. rlimit
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const OpenFilesCheckInterval = 10 * time.Second
+const OpenFilesWarnRatio = 0.9  // warn when open files reach this share of the limit...
+const OpenFilesRearmRatio = 0.8 // ...and warn again after dropping below this share
+
+var isOpenFilesNearLimit int32 // atomic; 1 if open files reached OpenFilesWarnRatio of limit
+
+// NumOpenFiles returns the number of open file descriptors of this process or -1 if unknown
+func NumOpenFiles() int {
+	dirEntries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+
+	return len(dirEntries) - 1 // the directory itself is open while reading
+}
+
+// WatchOpenFiles periodically compares the number of open files to the open files limit and
+// prints a warning when the number approaches the limit
+func WatchOpenFiles() {
+	if NumOpenFiles() < 0 {
+		return // no way to count open files on this platform
+	}
+
+	for range time.Tick(OpenFilesCheckInterval) {
+		numOpenFiles := NumOpenFiles()
+		rlimit := GetOpenFilesLimit()
+
+		if rlimit.Cur == 0 {
+			continue
+		}
+
+		usageRatio := float64(numOpenFiles) / float64(rlimit.Cur)
+
+		if usageRatio >= OpenFilesWarnRatio && atomic.CompareAndSwapInt32(&isOpenFilesNearLimit, 0, 1) {
+			fmt.Printf("WARNING: Number of open files is approaching the limit. Consider increasing \"--fdlimit\". (Open: %d; Limit: %d)\n", numOpenFiles, rlimit.Cur)
+		} else if usageRatio < OpenFilesRearmRatio {
+			atomic.StoreInt32(&isOpenFilesNearLimit, 0)
+		}
+	}
+}
+
+// writeProcessMetrics adds the metrics of the proxy process itself to the metrics endpoint
+func (metrics *metricsWriter) writeProcessMetrics() {
+	var memStats runtime.MemStats
+
+	runtime.ReadMemStats(&memStats)
+
+	metrics.header("proxperfect_process_goroutines", "gauge", "Number of goroutines.")
+	metrics.sample("proxperfect_process_goroutines", float64(runtime.NumGoroutine()))
+
+	metrics.header("proxperfect_process_heap_bytes", "gauge", "Bytes of allocated heap objects.")
+	metrics.sample("proxperfect_process_heap_bytes", float64(memStats.HeapAlloc))
+
+	metrics.header("proxperfect_process_heap_sys_bytes", "gauge", "Bytes of heap memory obtained from the OS.")
+	metrics.sample("proxperfect_process_heap_sys_bytes", float64(memStats.HeapSys))
+
+	metrics.header("proxperfect_process_gc_cycles", "counter", "Number of completed GC cycles.")
+	metrics.sample("proxperfect_process_gc_cycles_total", float64(memStats.NumGC))
+
+	metrics.header("proxperfect_process_gc_pause_seconds", "counter", "Cumulative time of GC stop-the-world pauses.")
+	metrics.sample("proxperfect_process_gc_pause_seconds_total", float64(memStats.PauseTotalNs)/1e9)
+
+	if numOpenFiles := NumOpenFiles(); numOpenFiles >= 0 {
+		metrics.header("proxperfect_process_open_fds", "gauge", "Number of open file descriptors.")
+		metrics.sample("proxperfect_process_open_fds", float64(numOpenFiles))
+	}
+
+	metrics.header("proxperfect_process_max_fds", "gauge", "Limit of open file descriptors (as in 'ulimit -n').")
+	metrics.sample("proxperfect_process_max_fds", float64(GetOpenFilesLimit().Cur))
+
+	metrics.header("proxperfect_process_fds_near_limit", "gauge", "1 if the number of open file descriptors is approaching the limit, 0 otherwise.")
+	metrics.sample("proxperfect_process_fds_near_limit", float64(atomic.LoadInt32(&isOpenFilesNearLimit)))
+}
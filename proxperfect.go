@@ -3,77 +3,241 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"flag"
 	"fmt"
-	"golang.org/x/sync/semaphore"
+	"github.com/expr-lang/expr/vm"
+	"hash"
+	"hash/crc32"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 const ProgName = "ProxPerfect"
 const ProgVersion string = "1.0.1"
 
 type Config struct {
-	beVerbose         bool
-	showVersion       bool
-	listenPort        int
-	proxyStrings      []string
-	poolBufSize       int
-	numConnsPerServer int    // 0 disables this limit
-	redirectCode      int    // 0 disables redirect
-	fdLimit           uint64 // 0 disables attempt to change
+	beVerbose          bool
+	showVersion        bool
+	listenPort         int
+	proxyStrings       []string
+	poolBufSize        int
+	numConnsPerServer  int            // 0 disables this limit
+	redirectCode       int            // 0 disables redirect
+	redirectRules      []RedirectRule // empty redirects all requests if redirectCode is set
+	redirectSize       int64          // 0 disables redirect by object size
+	isMixedRedirect    bool           // redirect selected requests, proxy the others
+	serverHints        string         // empty disables response headers with available servers
+	maxClientConns     int            // 0 means unlimited
+	tlsCertFile        string         // empty disables TLS for client connections
+	tlsKeyFile         string
+	fdLimit            uint64   // 0 disables attempt to change
+	fdLimitAuto        bool     // compute fdLimit from config
+	quorumSize         int      // 0 disables quorum reads
+	checksumAlgos      []string // empty disables checksum verification
+	apiKeysFile        string   // empty disables tenant API keys
+	apiKeyHeader       string
+	adminPort          int      // 0 disables admin interface
+	tagHeaders         []string // empty disables tagging of requests toward servers
+	instanceName       string
+	numPrewarmConns    int           // 0 disables pre-warming of connections
+	tcpKeepAlive       time.Duration // negative disables TCP keep-alive toward servers
+	probeInterval      time.Duration // 0 disables probing of idle connections
+	headerTimeout      time.Duration // 0 disables timeout for response headers of servers
+	connTrace          bool
+	upstreamKeepAlive  bool
+	priorityRules      []PriorityRule
+	shedQueueLen       int // 0 disables shedding
+	addTraceParent     bool
+	statusRules        []StatusRule
+	requestFilterCmd   string        // empty disables filtering of request bodies
+	routeScriptFile    string        // empty disables routing script
+	numShards          int           // 0 disables even shard map
+	shardMapFile       string        // empty disables shard map file
+	printShardMap      bool          // print shard map and exit
+	clientDeadline     bool          // honor deadlines from client request headers
+	idempotencyWindow  time.Duration // 0 disables duplicate suppression by idempotency key
+	maxHeaderBytes     int           // max size of client request line and headers
+	maxURLLen          int           // 0 means unlimited
+	streamIdleTimeout  time.Duration // 0 disables idle timeout for streaming responses
+	upgradeIdleTimeout time.Duration // 0 disables idle timeout for upgraded connections
+	sseMode            bool          // special handling of server-sent event streams
+	dnsServer          string        // "host:port"; empty for system resolver
+	dnsRefreshInterval time.Duration // 0 disables refresh of SRV and TXT records
+	etcdURL            string        // empty disables config from etcd
+	etcdKey            string
+	checkConfig        bool   // check config and exit
+	printConfig        bool   // print effective config and exit
+	startupCheck       string // empty disables startup check of servers
+	requireAllBackends bool   // exit if any server is unreachable at startup
+	healthPath         string // empty for TCP connect check
+	serversFile        string // empty if servers are only given as arguments
+	responseFilterCmd  string // empty disables filtering of response bodies
+	realIPMode         string
+	trustedProxies     []*net.IPNet
+	rawHeaderNames     map[string]string // spelling of headers toward servers by canonical name
+	rawSignedHeaders   bool              // send signed headers as received from the client
+	gomaxprocs         int               // 0 for default of Go runtime
+	cpus               []int             // sorted; empty disables CPU pinning
+	numAcceptLoops     int               // number of listeners for client connections
+	hdrLogFile         string            // empty disables HDR histogram log
+	hdrLogInterval     time.Duration
+	statsRoutes        string        // empty disables size stats per route
+	ejectTime          time.Duration // 0 disables passive health scoring
+	affinityWindow     time.Duration // 0 disables read-your-writes affinity
+	affinityKey        string
+	balancerName       string
+	tlsPassthrough     bool          // forward client connections as raw TLS streams without termination
+	sniRoutes          []SNIRoute    // routes to pools by SNI hostname in passthrough mode
+	headerRoutes       []HeaderRoute // routes to pools by request header values
+	inspectURL         string        // empty disables side-calls to an inspection service
+	inspectPreviewSize int
+	inspectTimeout     time.Duration
+	inspectFailOpen    bool
+	cacheSize          int64        // 0 disables the response cache
+	cacheRoutes        []CacheRoute // TTL overrides and bypass rules by path
+	staleRevalidate    time.Duration
+	staleIfError       time.Duration
+	printReport        bool          // print comparative server report on exit
+	failbackDelay      time.Duration // 0 disables stabilization period before reinstating servers
+	failbackChecks     int           // 0 disables min number of checks before reinstating servers
+	compatMode         bool          // compatibility with HTTP/1.0 and ancient clients
+	compatPool         string        // pool for requests without "Host" header; empty for all servers
+	stripTrailers      bool          // remove trailers of requests and responses
+	containerMode      bool          // JSON log, port from environment, graceful shutdown on SIGTERM
+	errorTemplateDir   string        // dir of error page templates; empty for plain-text errors
+	adaptiveConns      bool          // adjust conn limit per server; numConnsPerServer is the max
 }
 
 var config Config
 
 type ProxyState struct {
-	proxies      []*httputil.ReverseProxy
-	connLimiters []*semaphore.Weighted // per-proxy limit
-	requestNum   uint32
+	quorumDivergences  uint64 // 64-bit atomics first for alignment on 32-bit archs
+	checksumMismatches uint64
+	queuedCancels      uint64 // client canceled while waiting for a connection slot
+	upstreamCancels    uint64 // client canceled while the request to the server was in progress
+	requestNum         uint64 // number of the last request
+	isShuttingDown     int32  // atomic; set on SIGTERM or SIGINT in container mode
+	backends           []*Backend
+	tenants            map[string]*Tenant // key is API key; empty if tenant API keys disabled
+	routeScript        *vm.Program        // nil if routing script disabled
+	shardMap           []ShardRange       // sorted by hash; nil if sharding disabled
+	statsRoutes        []*StatsRoute      // last route matches all paths; nil if route stats disabled
+	server             *http.Server       // server for client requests
+	etcdRevision       string             // revision of config in etcd; empty if config from etcd disabled
 }
 
 var proxyState ProxyState
 
-// proxyBufferPool is a httputil.BufferPool backed by a thread-safe sync.Pool
+// Backend is a HTTP server that requests get forwarded to
+type Backend struct {
+	errorCounts      [NumErrorClasses]uint64 // 64-bit atomics first for alignment on 32-bit archs
+	numRequests      uint64
+	numServerErrors  uint64 // responses with status 5xx, including failed requests
+	numInFlight      int64  // atomic; requests currently forwarded to the server
+	shapeDelay       int64  // atomic; artificial latency of requests in ns; 0 if disabled
+	serverStr        string // as given by user, including options
+	targetURL        *url.URL
+	dialAddr         string          // "host:port"; empty to dial the host of targetURL
+	pathPrefix       string          // prepended to request paths; empty or starts with "/"
+	transport        *http.Transport // not shared with other backends
+	proxy            *httputil.ReverseProxy
+	connLimiter      *PriorityLimiter   // nil if connection limit disabled
+	adaptiveConns    *AdaptiveConnLimit // nil if adaptive connection limit disabled
+	health           *BackendHealth     // nil if passive health scoring disabled
+	pool             string             // DefaultPoolName if no "pool" option
+	latencyHistogram *LatencyHistogram
+	requestSizes     *SizeHistogram
+	responseSizes    *SizeHistogram
+	srvName          string // SRV record through which the server was discovered; empty if static
+	weight           uint32 // atomic; share of requests relative to other servers
+	isRemoved        uint32 // atomic; 1 if the server is no longer in its SRV record
+	sharePercent     uint32 // atomic; share of requests relative to the weight; reducible for experiments
+}
+
+// Weight returns the current weight of the server in the schedule
+func (backend *Backend) Weight() uint32 {
+	return atomic.LoadUint32(&backend.weight)
+}
+
+// proxyBufferPool is a httputil.BufferPool backed by a thread-safe sync.Pool. The buffer size can be
+// changed at runtime, which replaces the sync.Pool, so that buffers of the old size get dropped.
 // note: sync.Pool is garbage-collected on mem pressure, so doesn't need upper bound of elems
 type proxyBufferPool struct {
+	generation atomic.Value // *bufferPoolGeneration
+}
+
+// bufferPoolGeneration is the sync.Pool for the current buffer size of a proxyBufferPool
+type bufferPoolGeneration struct {
 	pool        *sync.Pool
+	bufSize     int // 0 disables buffer pooling
 	bufAllocNum uint32
 }
 
-func NewProxyBufferPool() httputil.BufferPool {
-	return &proxyBufferPool{
-		pool:        new(sync.Pool),
-		bufAllocNum: 0,
-	}
+func NewProxyBufferPool(bufSize int) *proxyBufferPool {
+	bufPool := &proxyBufferPool{}
+
+	bufPool.SetBufSize(bufSize)
+
+	return bufPool
+}
+
+// SetBufSize replaces the pool by a pool with buffers of the given size. Buffers of the old pool
+// that are still in use get dropped when they are returned.
+func (bufPool *proxyBufferPool) SetBufSize(bufSize int) {
+	bufPool.generation.Store(&bufferPoolGeneration{
+		pool:    new(sync.Pool),
+		bufSize: bufSize,
+	})
 }
 
 func (bufPool *proxyBufferPool) Get() []byte {
-	buf := bufPool.pool.Get()
+	generation := bufPool.generation.Load().(*bufferPoolGeneration)
+
+	if generation.bufSize == 0 {
+		return nil // httputil.ReverseProxy allocates a temporary buffer
+	}
+
+	buf := generation.pool.Get()
 	if buf == nil {
-		if config.beVerbose {
-			var currentAllocNum = atomic.AddUint32(&bufPool.bufAllocNum, 1)
+		var currentAllocNum = atomic.AddUint32(&generation.bufAllocNum, 1)
 
-			fmt.Printf("Allocating proxy pool buf. Num: %d; Total alloc size: %d\n", currentAllocNum, uint32(config.poolBufSize)*currentAllocNum)
+		if config.beVerbose {
+			fmt.Printf("Allocating proxy pool buf. Num: %d; Total alloc size: %d\n", currentAllocNum, uint32(generation.bufSize)*currentAllocNum)
 		}
 
-		return make([]byte, config.poolBufSize)
+		return make([]byte, generation.bufSize)
 	}
 
 	return buf.([]byte)
 }
 
 func (bufPool *proxyBufferPool) Put(buf []byte) {
-	bufPool.pool.Put(buf)
+	generation := bufPool.generation.Load().(*bufferPoolGeneration)
+
+	if generation.bufSize == 0 || len(buf) != generation.bufSize {
+		return // pooling disabled or buffer of old pool
+	}
+
+	generation.pool.Put(buf)
 }
 
 func Usage() {
@@ -84,6 +248,23 @@ func Usage() {
 	fmt.Printf("Usage: ./%s [OPTIONS] HTTP_SERVERS...\n", exename)
 	fmt.Println()
 
+	fmt.Println("HTTP server format: URL[,OPTION=VALUE...]")
+	fmt.Println("  dial=ADDRESS[:PORT]  Connect to given address instead of the host of the URL.")
+	fmt.Println("                       (The URL host is still used for TLS server name verification.)")
+	fmt.Println("  weight=NUM           Share of requests relative to other servers. (Default: 1)")
+	fmt.Println("  prefix=PATH          Prepend given path to request paths, e.g. \"prefix=/shard3\" forwards")
+	fmt.Println("                       \"/bucket/obj\" as \"/shard3/bucket/obj\".")
+	fmt.Println("  pool=NAME            Pool of the server for \"--headerroutes\" and routing scripts.")
+	fmt.Println("                       (Default: \"" + DefaultPoolName + "\")")
+	fmt.Println()
+
+	fmt.Println("DNS SRV server discovery: srv+URL[,OPTION=VALUE...]")
+	fmt.Println("  The URL host is the name of a SRV record, e.g. \"srv+http://_s3._tcp.cluster.local\".")
+	fmt.Println("  Each server of the SRV record gets added with its weight. TXT records of the same name")
+	fmt.Println("  with format \"proxperfect HOST[:PORT] [weight=NUM] [drain]\" override weights or drain")
+	fmt.Println("  servers.")
+	fmt.Println()
+
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 	fmt.Println()
@@ -91,6 +272,8 @@ func Usage() {
 	fmt.Printf("Example:\n")
 	fmt.Printf("  Forward requests round-robin to servers 192.168.0.1 through 192.168.0.8:\n")
 	fmt.Printf("    $ ./%s http://192.168.0.{1..8}\n", exename)
+	fmt.Printf("  Forward requests round-robin to 10.0.0.1 and 10.0.0.2, both serving https://s3.cluster.local:\n")
+	fmt.Printf("    $ ./%s https://s3.cluster.local,dial=10.0.0.{1,2}\n", exename)
 }
 
 // parse command line args and init config struct
@@ -98,40 +281,485 @@ func ParseArguments() {
 	showVersionConfigPtr := flag.Bool("version", false, "Print version and exit.")
 	beVerboseConfigPtr := flag.Bool("verbose", false, "Print verbose output.")
 	listenPortConfigPtr := flag.Int("port", 8080, "Port to listen on for incoming connections.")
-	poolBufSizeConfigPtr := flag.Int("bufsize", 128*1024, "Size of each pooled buffer in bytes. [0 disables buffer pooling.]")
+	poolBufSizeConfigPtr := flag.Int("bufsize", 128*1024, "Size of each pooled buffer in bytes. Can be changed at runtime through the admin interface. [0 disables buffer pooling.]")
 	numConnsPerServer := flag.Int("maxconns", 10, "Max number of connections per server. [0 disables limit.]")
 	redirectCode := flag.Int("redirect", 0, "Redirect requests using given HTTP code instead of proxying. [0 disables redirect; 301 is temporary redirect.]")
-	fdLimit := flag.Uint64("fdlimit", 0, "Increase open file descriptor limit of process (as in 'ulimit -n').")
+	fdLimit := flag.String("fdlimit", "0", "Increase open file descriptor limit of process (as in 'ulimit -n'). \"auto\" computes the limit from number of servers and \"--maxconns\".")
+	checksumAlgos := flag.String("checksum", "", "Comma-separated list of checksum algorithms to verify proxied request and response bodies against \"Content-MD5\" and \"x-amz-checksum-crc32c\" headers, if present. Mismatches get logged. [Algorithms: md5, crc32c]")
+	apiKeysFile := flag.String("apikeys", "", "Path to file with tenant API keys to require from clients. Each line has the format \"NAME KEY [REQUESTS_PER_SEC [MAX_CONCURRENT_REQUESTS]]\". [0 for a limit means unlimited.]")
+	apiKeyHeader := flag.String("apikeyheader", "X-Api-Key", "Request header containing the tenant API key. The header is not forwarded to servers.")
+	adminPort := flag.Int("adminport", 0, "Port to listen on for admin interface requests: \"/stats\" (GET), \"/metrics\" (GET), \"/drain?client=IP|apikey=KEY[&message=TEXT]\" (GET, POST, DELETE), \"/shardmap\" (GET), \"/bufsize[?size=BYTES]\" (GET, POST), \"/hdrhistogram[?server=INDEX][&format=hgrm|hlog]\" (GET, latency percentile distribution or HdrHistogram log since startup), \"/dump\" (GET, dump of servers, active requests and goroutine stacks as on SIGQUIT), \"/closeidle[?server=INDEX|SERVER]\" (POST, close idle connections toward all or the given server), \"/cachewarm[?host=HOST][&encoding=ACCEPT_ENCODING][&concurrency=NUM][&tenant=NAME]\" (POST, preload the cache with the URLs in the request body, one per line; tenant of \"--apikeys\" required if set), \"/shape[?server=INDEX|SERVER][&delay=DURATION][&share=PERCENT]\" (GET, POST, DELETE, add artificial latency to requests of a server or reduce its share of requests for experiments), \"/report[?format=text|json]\" (GET, comparison of servers with throughput, latency percentiles and error rate since startup), \"/livez\" (GET, liveness check), \"/readyz\" (GET, readiness check, 503 while no server is available or during shutdown), \"/errortemplates\" (GET, POST, list or reload the error page templates of \"--errortemplates\"). [0 disables admin interface.]")
+	tagHeaders := flag.String("tagheaders", "", "Comma-separated list of headers to add to requests toward servers for correlation of server logs. [Tags: instance (X-ProxPerfect-Instance), server (X-ProxPerfect-Server), request (X-ProxPerfect-Request), client (X-ProxPerfect-Client), queuetime (X-ProxPerfect-Queue-Time-Ms: milliseconds since the proxy received the request, e.g. while waiting for a connection slot), timeout (X-ProxPerfect-Expected-Timeout-Ms: milliseconds until the deadline of the request from \"--clientdeadline\", so that servers can skip work for requests that are about to time out; omitted if the request has no deadline)]")
+	instanceName := flag.String("instance", "", "Name of this proxy instance for the \"instance\" tag header. (Default: hostname)")
+	numPrewarmConns := flag.Int("prewarm", 0, "Number of idle connections to establish to each server at startup, so that first requests don't have to wait for connection setup. [0 disables pre-warming.]")
+	tcpKeepAlive := flag.Duration("tcpkeepalive", 30*time.Second, "Interval of TCP keep-alive probes on connections toward servers. [Negative value disables TCP keep-alive.]")
+	probeInterval := flag.Duration("probeinterval", 0, "Interval for probing idle connections toward servers with HEAD requests to discard dead connections proactively. [0 disables probing.]")
+	headerTimeout := flag.Duration("headertimeout", 0, "Time to wait for response headers of servers after a request was sent. [0 disables timeout.]")
+	connTrace := flag.Bool("conntrace", false, "Log connection events (accept, dial, TLS handshake, reuse, close with reason) of client and server connections for debugging.")
+	upstreamKeepAlive := flag.Bool("upstreamkeepalive", true, "Keep connections toward servers alive for reuse, independent of \"Connection\" headers sent by clients. [false closes server connections after each request.]")
+	priorityRules := flag.String("priorityrules", "", "Comma-separated list of rules to classify requests into priorities. High priority requests get served first when waiting for a connection to a server. Format: \"LEVEL:KIND=PATTERN\", e.g. \"high:path=/health*,high:method=OPTIONS,low:header=X-Batch:true\". [Levels: low, normal, high; Kinds: path, method, header]")
+	shedQueueLen := flag.Int("shedqueue", 0, "Reject requests with 503 when the number of requests waiting for a connection to a server reaches this length. Low priority requests get rejected at half this length, high priority requests only at four times this length. [0 disables shedding.]")
+	addTraceParent := flag.Bool("traceparent", false, "Add a W3C \"traceparent\" header to requests that don't have one, so that server logs and metrics exemplars can be correlated by trace ID.")
+	statusRules := flag.String("statusmap", "", "Comma-separated list of rules to rewrite status codes of server responses. Format: \"[PATH_PATTERN:]FROM=TO\", e.g. \"404=204,/probe/*:503=502\". (A trailing \"*\" in the path pattern matches any suffix.)")
+	requestFilterCmd := flag.String("requestfilter", "", "Shell command to transform request bodies. The command reads the original body from stdin and writes the new body to stdout. Method, path, query and content type are available in environment variables \"PROXPERFECT_*\". (Starts a process per request.)")
+	responseFilterCmd := flag.String("responsefilter", "", "Shell command to transform response bodies, like \"--requestfilter\". The response status is available in environment variable \"PROXPERFECT_STATUS\".")
+	routeScriptFile := flag.String("routescript", "", "Path to file with an expression (https://expr-lang.org) to select the server for a request. Available variables: method, host, path, query, clientIP, requestNum, servers, Header(NAME). The expression returns the server index, the server string, the name of a server pool (see \"pool\" server option) or nil for default round-robin selection. Servers that are ejected or no longer in their SRV record fall back to the default selection.")
+	numShards := flag.Int("shards", 0, "Send requests to servers by hash of the path, with the hash space partitioned into given number of ranges of equal size that get assigned to the servers round-robin. Sharding is strict: Requests still go to the responsible server while it is ejected or no longer in its SRV record. [0 disables sharding, unless \"--shardmap\" is given.]")
+	shardMapFile := flag.String("shardmap", "", "Path to shard map file to send requests to servers by hash of the path. Each line has the format \"FIRST-LAST SERVER\" with a range of 32-bit FNV-1a hashes in hex (e.g. \"00000000-7fffffff\") and the server index or server string. The ranges need to cover the whole hash space. (\"--printshardmap\" prints a map in this format.)")
+	printShardMap := flag.Bool("printshardmap", false, "Print the shard map of \"--shards\" or \"--shardmap\" and exit.")
+	clientDeadline := flag.Bool("clientdeadline", false, "Honor request timeouts from clients through header \"X-Request-Timeout\" (seconds or duration like \"1.5s\") or \"grpc-timeout\". Requests which exceed their timeout get aborted with status 504.")
+	idempotencyWindow := flag.Duration("idempotency", 0, "Time to remember responses to POST/PUT/PATCH requests with an \"Idempotency-Key\" header. Retries with the same key within this time get the stored response instead of being forwarded again. (Example: \"10m\") [0 disables duplicate suppression.]")
+	maxHeaderBytes := flag.Int("maxheaderbytes", http.DefaultMaxHeaderBytes, "Max size of request line and headers of client requests in bytes. Larger requests get rejected with status 431.")
+	maxURLLen := flag.Int("maxurllen", 0, "Max length of client request URLs. Longer URLs get rejected with status 414. [0 means unlimited.]")
+	streamIdleTimeout := flag.Duration("streamidle", 0, "Close streaming responses (event streams and responses of unknown length) if the server sends no data for this time. (Example: \"5m\") [0 disables the timeout.]")
+	upgradeIdleTimeout := flag.Duration("upgradeidle", 0, "Close upgraded connections (e.g. WebSocket) if no data is transferred in either direction for this time. (Example: \"10m\") [0 disables the timeout.]")
+	sseMode := flag.Bool("sse", false, "Server-sent events friendly mode: Requests for event streams (\"Accept: text/event-stream\") bypass quorum reads, response filter and client deadlines and are sent without compression. Event stream responses are not buffered and use the \"--streamidle\" timeout (default: 1h).")
+	dnsServer := flag.String("dnsserver", "", "DNS server for SRV server discovery as \"HOST:PORT\". (Default: system resolver)")
+	dnsRefreshInterval := flag.Duration("dnsrefresh", 30*time.Second, "Interval to refresh server weights and drain flags from SRV and TXT records. [0 disables refresh.]")
+	etcdURL := flag.String("etcd", "", "URL of etcd server (e.g. \"http://10.0.0.1:2379\") to load the config from. The config text has one option with optional value (e.g. \"--maxconns 8\") or one server per line. Options on the command line override options from etcd. Changes in etcd get applied by a restart after active requests completed.")
+	etcdKey := flag.String("etcdkey", "/proxperfect/config", "Key of config in etcd.")
+	checkConfig := flag.Bool("checkconfig", false, "Check config, including servers and referenced files, and exit.")
+	printConfig := flag.Bool("printconfig", false, "Print the effective config in JSON format and exit. The config includes the value and source (default, etcd, command line) of each option, the servers after expansion of servers file and SRV records, and computed values like the open files limit.")
+	startupCheck := flag.String("startupcheck", "", "Check reachability of servers at startup. "+
+		"[Values: "+StartupCheckWarn+" (print warning for unreachable servers), "+
+		StartupCheckDrop+" (remove unreachable servers)]")
+	requireAllBackends := flag.Bool("requireall", false, "Check reachability of servers at startup and refuse to start if any server is unreachable.")
+	healthPath := flag.String("healthpath", "", "Path for GET requests to check servers. Servers are considered unreachable if the request fails or returns a 5xx status. (Default: TCP connect check)")
+	serversFile := flag.String("serversfile", "", "Path to file with additional servers. Each line has a server template, in which \"[FIRST-LAST]\" expands to the numbers of the range (zero-padded if FIRST is, e.g. \"[01-16]\") and \"{A,B,...}\" expands to the alternatives. Lines starting with \"!\" have a template of servers to exclude.")
+	redirectRules := flag.String("redirectpaths", "", "Comma-separated list of requests to redirect, while other requests get proxied. Format: \"[METHOD:]PATH_PATTERN\", where a pattern ending with \"*\" matches all paths with this prefix. (Example: \"GET:/data/*\") Redirect code is given by \"--redirect\" (default: 307).")
+	redirectSize := flag.Int64("redirectsize", 0, "Redirect GET requests for objects larger than this size in bytes, while smaller objects get proxied. The size is queried by a HEAD request to the server. Redirect code is given by \"--redirect\" (default: 307). [0 disables redirect by size.]")
+	serverHints := flag.String("serverhints", "", "Advertise the available servers in responses, so that capable clients can connect to them directly. "+
+		"[Values: "+ServerHintsAltSvc+" (standard \"Alt-Svc\" header), "+
+		ServerHintsHeader+" (\"X-ProxPerfect-Servers\" header with comma-separated server URLs)]")
+	maxClientConns := flag.Int("maxclientconns", 0, "Max number of concurrent client connections. Further connections get rejected with status 503. [0 means unlimited.]")
+	tlsCertFile := flag.String("tlscert", "", "Path to certificate file (PEM) to serve clients over TLS. Requires \"--tlskey\".")
+	tlsKeyFile := flag.String("tlskey", "", "Path to private key file (PEM) for \"--tlscert\".")
+	realIPMode := flag.String("realip", RealIPModeRemoteAddr, "How to determine the real client IP address for logging, tag headers etc. [Modes: "+
+		RealIPModeRemoteAddr+" (address of TCP connection), "+
+		RealIPModeXFF+" (X-Forwarded-For header), "+
+		RealIPModeCloudflare+" (CF-Connecting-IP header), "+
+		RealIPModeProxyProtocol+" (PROXY protocol v1/v2 header of TCP connection)]")
+	trustedProxies := flag.String("trustedproxies", "", "Comma-separated list of CIDRs (e.g. \"10.0.0.0/8\") of proxies that are trusted to provide the real client IP address. Required for header-based \"--realip\" modes.")
+	rawHeaders := flag.String("rawheaders", "", "Comma-separated list of header names to send to servers in exactly the given spelling instead of Go's canonical form, for servers that validate signatures over exact header bytes. (Example: \"x-amz-date,x-amz-content-sha256\") The special name \""+RawHeadersSigned+"\" sends the headers covered by the AWS signature (v2/v4) of a request in their signed spelling and unmodified by the proxy. (Applies to HTTP/1.1; the order of headers is not preserved.)")
+	gomaxprocs := flag.Int("gomaxprocs", 0, "Max number of CPUs executing Go code simultaneously (as in GOMAXPROCS). (Default: number of CPUs of \"--cpus\" or of the host)")
+	cpuList := flag.String("cpus", "", "Pin the process to given list of CPUs (as in taskset), e.g. \"0-7,16-23\", or to the CPUs of a NUMA node, e.g. \"node0\". (Linux only)")
+	numAcceptLoops := flag.Int("acceptloops", 1, "Number of accept loops for client connections. Multiple accept loops have separate sockets for the port (SO_REUSEPORT), so that the kernel distributes new connections among them. (Linux only)")
+	hdrLogFile := flag.String("hdrlog", "", "Path to file for periodic latency histograms of each server in HdrHistogram interval log format (\".hlog\") for tools like HistogramLogAnalyzer. Values are in microseconds, the tag of a histogram is the server index.")
+	hdrLogInterval := flag.Duration("hdrinterval", 10*time.Second, "Interval of histograms in \"--hdrlog\".")
+	statsRoutes := flag.String("statsroutes", "", "Comma-separated list of routes for request and response size stats in the admin interface in addition to the stats per server. Format: \"[NAME=]PATH_PATTERN\", e.g. \"data=/data/*,meta=/meta/*\". Requests that match no route count for route \""+OtherStatsRouteName+"\". (A trailing \"*\" in the path pattern matches any suffix.)")
+	ejectTime := flag.Duration("ejecttime", 0, "Time to remove a server from the weighted schedule when its health score dropped to 0 through failed requests. Refused and reset connections lower the score much more than timeouts, so that servers which are down get ejected quickly, while slow servers get more tolerance. Responses raise the score. [0 disables health scoring.]")
+	failbackDelay := flag.Duration("failbackdelay", 0, "Stabilization period before an ejected server gets back into the schedule after \"--ejecttime\". The server gets checked every second (see \"--healthpath\") and needs to pass all checks for this time, so that flapping servers don't get full traffic on each recovery. A failed check restarts the period. [0 reinstates servers after the ejection time without checks, unless \"--failbackchecks\" is given.]")
+	failbackChecks := flag.Int("failbackchecks", 0, "Number of consecutive successful checks of an ejected server before it gets back into the schedule, like \"--failbackdelay\". [0 disables the minimum number of checks.]")
+	compatMode := flag.Bool("compat", false, "Compatibility mode for HTTP/1.0 and ancient clients, e.g. very old benchmark tools and appliances: Responses to HTTP/1.0 clients without length get buffered (up to 16MiB) to send them with \"Content-Length\" instead of ending them by closing the connection, so that keep-alive works. Requests without \"Host\" header get routed to \"--compatpool\".")
+	compatPool := flag.String("compatpool", "", "Pool of servers (see \"pool\" server option) for requests without \"Host\" header in \"--compat\" mode. (Default: all servers)")
+	containerMode := flag.Bool("container", false, "Container mode, e.g. for Kubernetes and Docker Compose: Output gets logged to stdout as JSON lines (with level from \"ERROR:\" and \"WARNING:\" prefixes), the port is taken from the \"PORT\" environment variable unless \"--port\" is given, SIGTERM and SIGINT shut down gracefully (in-flight requests complete for up to "+ContainerDrainTimeout.String()+"), zombie processes get reaped when running as PID 1, and the admin interface with health endpoints \"/livez\" and \"/readyz\" listens on port "+strconv.Itoa(ContainerAdminPort)+" unless \"--adminport\" is given.")
+	adaptiveConns := flag.Bool("adaptiveconns", false, "Adjust the connection limit of each server automatically between 1 and \"--maxconns\", starting at "+strconv.Itoa(AdaptiveConnsInitial)+": The limit grows by about one per round trip while it is in use, and shrinks by "+strconv.Itoa(int(100-AdaptiveConnsBackoff*100))+"% when the server gets slower than "+strconv.FormatFloat(AdaptiveConnsLatencyTolerance, 'f', -1, 64)+"x its latency without load (the min latency of the last "+(2*AdaptiveConnsLatencyWindow).String()+"), when a request fails or when the server replies with 503 or 429. Latency is the time from the request being sent until the response headers were received.")
+	errorTemplateDir := flag.String("errortemplates", "", "Directory of Go templates for error responses instead of plain-text messages. File names: \"STATUS.EXT\" (e.g. \"503.html\"), \"CLASS.EXT\" (e.g. \"5xx.json\"), \""+ErrorTemplateMaintenance+".EXT\" (drained clients and no available servers) or \""+ErrorTemplateDefault+".EXT\", where EXT is \"html\", \"json\" or \"txt\" for the content type, selected by the \"Accept\" header of the request. Variables: {{.Status}}, {{.StatusText}}, {{.Message}}, {{.Method}}, {{.Host}}, {{.Path}}, {{.RequestURI}}, {{.ClientIP}}, {{.TraceID}}, {{.Instance}}, {{.Time}}; function \"json\" for JSON strings, e.g. {{json .Message}}. Reload through admin interface \"/errortemplates\" (POST).")
+	stripTrailers := flag.Bool("striptrailers", false, "Remove HTTP trailers (e.g. checksums of streaming servers, gRPC status) of requests and responses for clients or servers that can't handle them. (By default, trailers get forwarded in both directions.)")
+	affinityWindow := flag.Duration("affinity", 0, "Time to send reads (GET, HEAD) of a key to the server that handled the last write (PUT, POST, PATCH, DELETE) of the key, to avoid stale reads from eventually consistent servers. The time starts when the write completed. (Example: \"5s\") [0 disables read-your-writes affinity.]")
+	affinityKey := flag.String("affinitykey", AffinityKeyPath, "Key of reads and writes for \"--affinity\". [Keys: "+
+		AffinityKeyPath+" (request path), "+
+		AffinityKeyClient+" (client IP, so that all reads of a client go to the server of its last write)]")
+	headerRoutes := flag.String("headerroutes", "", "Comma-separated list of routes to server pools by request header values. Format: \"HEADER:VALUE=POOL\", e.g. \"x-amz-storage-class:GLACIER=cold\". The first matching route applies. A value of \"*\" matches any non-empty value. Requests that match no route go to pool \""+DefaultPoolName+"\", or to all servers if no server is in this pool. (See \"pool\" server option.)")
+	balancerName := flag.String("balancer", DefaultBalancerName, "Strategy to select the server for each request. Server weights apply to all strategies. [Strategies: "+strings.Join(BalancerNames(), ", ")+"] ("+DefaultBalancerName+": smooth weighted round-robin, random: weighted random, leastconns: fewest requests in flight relative to weight, fastest: lowest moving average of response times)")
+	tlsPassthrough := flag.Bool("passthrough", false, "Forward client connections as raw TLS streams (layer 4) without TLS termination, for servers that terminate TLS themselves with their own certificates. The server for each connection gets selected by the balancer according to the SNI hostname in the TLS ClientHello (see \"--sniroutes\"). HTTP-level features (e.g. redirects, tag headers, caching, middleware stages) don't apply. Cannot be combined with \"--tlscert\".")
+	sniRoutes := flag.String("sniroutes", "", "Comma-separated list of routes to server pools by SNI hostname for \"--passthrough\". Format: \"HOSTNAME=POOL\", e.g. \"s3.example.com=s3,*.web.example.com=web\". A leading \"*.\" matches any subdomain. Connections that match no route or have no SNI go to pool \""+DefaultPoolName+"\", or to all servers if no server is in this pool. (See \"pool\" server option.)")
+	inspectURL := flag.String("inspecturl", "", "URL of an external inspection service (e.g. a policy engine), which gets a side-call for each request before it gets proxied. The side-call is a POST request with the headers of the client request, its method, URI, host and client IP in \"X-ProxPerfect-Inspect-...\" headers, and the body preview of \"--inspectpreview\". A 2xx response allows the request and can set request headers through \"X-ProxPerfect-Inspect-Set-NAME\" response headers. A 3xx/4xx response denies the request and gets relayed to the client. A 5xx response or no response rejects the request with 503, unless \"--inspectfailopen\" is set.")
+	inspectPreviewSize := flag.Int("inspectpreview", 0, "Max number of bytes of the request body in the side-call to the inspection service. The body preview gets buffered in memory. [0 sends only the headers.]")
+	inspectTimeout := flag.Duration("inspecttimeout", time.Second, "Timeout of side-calls to the inspection service.")
+	inspectFailOpen := flag.Bool("inspectfailopen", false, "Allow requests when the side-call to the inspection service fails, instead of rejecting them.")
+	cacheSize := flag.Int64("cachesize", 0, "Memory size of the cache of GET responses in bytes. Responses get cached for the time of their \"Cache-Control\" header (s-maxage or max-age), unless \"--cacheroutes\" overrides this. Responses state \""+CacheHeader+": HIT|MISS|BYPASS\". (Example: \"268435456\" for 256MiB) [0 disables the cache.]")
+	cacheRoutes := flag.String("cacheroutes", "", "Comma-separated list of TTL overrides for cached responses by path pattern. Format: \"PATH_PATTERN=TTL|"+CacheRouteBypass+"\", e.g. \"/static/live/*="+CacheRouteBypass+",/static/*=1h\". The first matching route applies. A TTL caches all GET responses with status 200 for this time, regardless of their headers, also for requests with \"Authorization\" headers. \""+CacheRouteBypass+"\" sends requests to the servers without caching. (A trailing \"*\" in the path pattern matches any suffix.) Requires \"--cachesize\".")
+	staleRevalidate := flag.Duration("stalerevalidate", 0, "Time after the expiry of a cached response during which it still gets served, while a background request to a server refreshes it. Applies to responses without \"stale-while-revalidate\" directive in their \"Cache-Control\" header. [0 disables serving of stale responses while refreshing.]")
+	staleIfError := flag.Duration("staleiferror", 0, "Time after the expiry of a cached response during which it gets served if the server fails (status 5xx) or no server is available, to keep read-heavy workloads available. Applies to responses without \"stale-if-error\" directive in their \"Cache-Control\" header. [0 disables serving of stale responses on errors.]")
+	printReport := flag.Bool("report", false, "Print a comparison of the servers side by side on exit (SIGINT or SIGTERM), with requests, requests per second, MB/s of responses, p50/p95/p99 latency and error rate (status 5xx), to spot slow servers of a benchmark run. Servers with a p99 latency of more than twice the median of all servers get marked as \"SLOW\". (Also available through admin interface \"/report\".)")
+	quorumSize := flag.Int("quorum", 0, "Send each GET request to given number of servers, compare their responses (status, ETag, MD5 of body) and log divergence. Responses are buffered in memory. [0 disables quorum reads.]")
 
 	flag.Parse()
 
+	config.etcdURL = *etcdURL
+	config.etcdKey = *etcdKey
+
+	var etcdServers []string
+
+	if config.etcdURL != "" {
+		etcdServers = MergeEtcdArguments()
+	}
+
 	config.beVerbose = *beVerboseConfigPtr
 	config.showVersion = *showVersionConfigPtr
 	config.listenPort = *listenPortConfigPtr
 	config.poolBufSize = *poolBufSizeConfigPtr
 	config.proxyStrings = flag.Args()
+	config.checkConfig = *checkConfig
+	config.printConfig = *printConfig
+	config.startupCheck = *startupCheck
+	config.requireAllBackends = *requireAllBackends
+	config.healthPath = *healthPath
+	config.serversFile = *serversFile
 	config.numConnsPerServer = *numConnsPerServer
 	config.redirectCode = *redirectCode
-	config.fdLimit = *fdLimit
+	config.fdLimitAuto = (*fdLimit == "auto")
+	config.quorumSize = *quorumSize
+	config.apiKeysFile = *apiKeysFile
+	config.apiKeyHeader = *apiKeyHeader
+	config.adminPort = *adminPort
+	config.instanceName = *instanceName
+	config.numPrewarmConns = *numPrewarmConns
+	config.tcpKeepAlive = *tcpKeepAlive
+	config.probeInterval = *probeInterval
+	config.realIPMode = *realIPMode
+	config.headerTimeout = *headerTimeout
+	config.connTrace = *connTrace
+	config.upstreamKeepAlive = *upstreamKeepAlive
+	config.shedQueueLen = *shedQueueLen
+	config.addTraceParent = *addTraceParent
+	config.requestFilterCmd = *requestFilterCmd
+	config.routeScriptFile = *routeScriptFile
+	config.numShards = *numShards
+	config.shardMapFile = *shardMapFile
+	config.printShardMap = *printShardMap
+	config.clientDeadline = *clientDeadline
+	config.idempotencyWindow = *idempotencyWindow
+	config.maxHeaderBytes = *maxHeaderBytes
+	config.maxURLLen = *maxURLLen
+	config.streamIdleTimeout = *streamIdleTimeout
+	config.upgradeIdleTimeout = *upgradeIdleTimeout
+	config.sseMode = *sseMode
+	config.dnsServer = *dnsServer
+	config.dnsRefreshInterval = *dnsRefreshInterval
+	config.responseFilterCmd = *responseFilterCmd
+
+	if *tagHeaders != "" {
+		config.tagHeaders = strings.Split(*tagHeaders, ",")
+	}
+
+	config.gomaxprocs = *gomaxprocs
+	config.hdrLogFile = *hdrLogFile
+	config.hdrLogInterval = *hdrLogInterval
+	config.statsRoutes = *statsRoutes
+	config.ejectTime = *ejectTime
+	config.failbackDelay = *failbackDelay
+	config.failbackChecks = *failbackChecks
+	config.compatMode = *compatMode
+	config.compatPool = *compatPool
+	config.stripTrailers = *stripTrailers
+	config.containerMode = *containerMode
+	config.errorTemplateDir = *errorTemplateDir
+	config.adaptiveConns = *adaptiveConns
+	config.affinityWindow = *affinityWindow
+	config.affinityKey = *affinityKey
+	config.balancerName = *balancerName
+	config.tlsPassthrough = *tlsPassthrough
+	config.inspectURL = *inspectURL
+	config.inspectPreviewSize = *inspectPreviewSize
+	config.inspectTimeout = *inspectTimeout
+	config.inspectFailOpen = *inspectFailOpen
+	config.cacheSize = *cacheSize
+	config.staleRevalidate = *staleRevalidate
+	config.staleIfError = *staleIfError
+	config.printReport = *printReport
+
+	if config.cacheSize < 0 {
+		fmt.Println("ERROR: Cache size must not be negative.")
+		os.Exit(1)
+	}
+
+	if *cacheRoutes != "" {
+		var err error
+
+		config.cacheRoutes, err = ParseCacheRoutes(*cacheRoutes)
+		if err != nil {
+			fmt.Println("ERROR: Invalid cache routes:", err)
+			os.Exit(1)
+		}
+
+		if config.cacheSize <= 0 {
+			fmt.Println("ERROR: Cache routes require a cache size.")
+			os.Exit(1)
+		}
+	}
+
+	if config.compatPool != "" && !config.compatMode {
+		fmt.Println("ERROR: Compatibility pool requires \"--compat\".")
+		os.Exit(1)
+	}
+
+	if config.failbackDelay < 0 || config.failbackChecks < 0 {
+		fmt.Println("ERROR: Failback delay and number of failback checks must not be negative.")
+		os.Exit(1)
+	}
+
+	if (config.failbackDelay != 0 || config.failbackChecks != 0) && config.ejectTime == 0 {
+		fmt.Println("ERROR: Failback delay and failback checks require \"--ejecttime\".")
+		os.Exit(1)
+	}
+
+	if config.inspectPreviewSize < 0 || config.inspectTimeout <= 0 {
+		fmt.Println("ERROR: Inspection body preview size must not be negative and timeout must be positive.")
+		os.Exit(1)
+	}
+
+	if *sniRoutes != "" {
+		var err error
+
+		config.sniRoutes, err = ParseSNIRoutes(*sniRoutes)
+		if err != nil {
+			fmt.Println("ERROR: Invalid SNI routes:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *headerRoutes != "" {
+		var err error
+
+		config.headerRoutes, err = ParseHeaderRoutes(*headerRoutes)
+		if err != nil {
+			fmt.Println("ERROR: Invalid header routes:", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.affinityKey != AffinityKeyPath && config.affinityKey != AffinityKeyClient {
+		fmt.Println("ERROR: Unknown affinity key:", config.affinityKey)
+		os.Exit(1)
+	}
+
+	if _, exists := balancerStrategies[config.balancerName]; !exists {
+		fmt.Println("ERROR: Unknown balancer:", config.balancerName)
+		os.Exit(1)
+	}
+
+	if config.hdrLogFile != "" && config.hdrLogInterval <= 0 {
+		fmt.Println("ERROR: Interval of latency histogram log must be positive.")
+		os.Exit(1)
+	}
+
+	config.numAcceptLoops = *numAcceptLoops
+
+	if *cpuList != "" {
+		var err error
+
+		config.cpus, err = ParseCPUList(*cpuList)
+		if err != nil {
+			fmt.Println("ERROR: Invalid CPU list:", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.gomaxprocs < 0 || config.numAcceptLoops < 1 {
+		fmt.Println("ERROR: GOMAXPROCS must not be negative and number of accept loops must be positive.")
+		os.Exit(1)
+	}
+
+	if *rawHeaders != "" {
+		var err error
+
+		config.rawHeaderNames, config.rawSignedHeaders, err = ParseRawHeaderNames(strings.Split(*rawHeaders, ","))
+		if err != nil {
+			fmt.Println("ERROR: Invalid raw headers:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *checksumAlgos != "" {
+		config.checksumAlgos = strings.Split(*checksumAlgos, ",")
+	}
 
 	if config.showVersion {
 		fmt.Printf("%s v%s\n", ProgName, ProgVersion)
 		os.Exit(0)
 	}
 
+	if len(config.proxyStrings) == 0 {
+		config.proxyStrings = etcdServers
+	}
+
+	if config.serversFile != "" {
+		fileServers, err := LoadServersFile(config.serversFile)
+		if err != nil {
+			fmt.Println("ERROR: Loading servers file failed:", err)
+			os.Exit(1)
+		}
+
+		config.proxyStrings = append(config.proxyStrings, fileServers...)
+	}
+
 	if config.beVerbose {
-		fmt.Println("HTTP Servers:", flag.Args())
+		fmt.Println("HTTP Servers:", config.proxyStrings)
 	}
 
-	if len(flag.Args()) == 0 {
+	if len(config.proxyStrings) == 0 {
 		fmt.Println("ERROR: HTTP servers missing. Specify one or more server arguments.")
-		fmt.Println("       (Format: \"http://<host>:<port>\")")
+		fmt.Println("       (Format: \"http://<host>:<port>[,dial=<address>:<port>]\")")
 		fmt.Println()
 		Usage()
 
 		os.Exit(1)
 	}
 
+	if config.quorumSize > len(config.proxyStrings) {
+		fmt.Printf("ERROR: Quorum size exceeds number of given HTTP servers. (Quorum: %d; Servers: %d)\n", config.quorumSize, len(config.proxyStrings))
+		os.Exit(1)
+	}
+
+	if (config.quorumSize > 1) && (config.redirectCode != 0) && (*redirectRules == "") && (*redirectSize == 0) {
+		fmt.Println("ERROR: Quorum reads cannot be combined with redirect mode.")
+		os.Exit(1)
+	}
+
+	switch config.startupCheck {
+	case "", StartupCheckWarn, StartupCheckDrop:
+	default:
+		fmt.Println("ERROR: Unknown startup check mode:", config.startupCheck)
+		os.Exit(1)
+	}
+
+	if config.numShards < 0 || (config.numShards != 0 && config.shardMapFile != "") {
+		fmt.Println("ERROR: Number of shards must be positive and can't be combined with a shard map file.")
+		os.Exit(1)
+	}
+
+	if config.printShardMap && config.numShards == 0 && config.shardMapFile == "" {
+		fmt.Println("ERROR: Printing the shard map requires \"--shards\" or \"--shardmap\".")
+		os.Exit(1)
+	}
+
+	for _, algo := range config.checksumAlgos {
+		if _, exists := checksumHeaders[algo]; !exists {
+			fmt.Println("ERROR: Unknown checksum algorithm:", algo)
+			os.Exit(1)
+		}
+	}
+
+	for _, tag := range config.tagHeaders {
+		if _, exists := tagHeaderNames[tag]; !exists {
+			fmt.Println("ERROR: Unknown tag header:", tag)
+			os.Exit(1)
+		}
+	}
+
+	if *trustedProxies != "" {
+		var err error
+
+		config.trustedProxies, err = ParseTrustedProxies(*trustedProxies)
+		if err != nil {
+			fmt.Println("ERROR: Invalid trusted proxies:", err)
+			os.Exit(1)
+		}
+	}
+
+	switch config.realIPMode {
+	case RealIPModeRemoteAddr, RealIPModeProxyProtocol:
+	case RealIPModeXFF, RealIPModeCloudflare:
+		if len(config.trustedProxies) == 0 {
+			fmt.Println("ERROR: Trusted proxies are required for real IP mode:", config.realIPMode)
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("ERROR: Unknown real IP mode:", config.realIPMode)
+		os.Exit(1)
+	}
+
+	if *statusRules != "" {
+		var err error
+
+		config.statusRules, err = ParseStatusRules(*statusRules)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *redirectRules != "" {
+		var err error
+
+		config.redirectRules, err = ParseRedirectRules(*redirectRules)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+	}
+
+	config.redirectSize = *redirectSize
+	config.serverHints = *serverHints
+	config.maxClientConns = *maxClientConns
+	config.tlsCertFile = *tlsCertFile
+	config.tlsKeyFile = *tlsKeyFile
+	config.isMixedRedirect = len(config.redirectRules) != 0 || config.redirectSize > 0
+
+	switch config.serverHints {
+	case "", ServerHintsAltSvc, ServerHintsHeader:
+	default:
+		fmt.Println("ERROR: Unknown server hints mode:", config.serverHints)
+		os.Exit(1)
+	}
+
+	if config.isMixedRedirect && config.redirectCode == 0 {
+		config.redirectCode = http.StatusTemporaryRedirect
+	}
+
+	if config.tlsPassthrough && config.tlsCertFile != "" {
+		fmt.Println("ERROR: TLS passthrough cannot be combined with TLS termination through a certificate.")
+		os.Exit(1)
+	}
+
+	if config.tlsPassthrough && config.redirectCode != 0 {
+		fmt.Println("ERROR: TLS passthrough cannot be combined with redirect mode.")
+		os.Exit(1)
+	}
+
+	if (config.tlsCertFile == "") != (config.tlsKeyFile == "") {
+		fmt.Println("ERROR: TLS certificate and key file must be given together.")
+		os.Exit(1)
+	}
+
+	if config.tlsCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(config.tlsCertFile, config.tlsKeyFile); err != nil {
+			fmt.Println("ERROR: Loading TLS certificate failed:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *priorityRules != "" {
+		var err error
+
+		config.priorityRules, err = ParsePriorityRules(*priorityRules)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.adaptiveConns && config.numConnsPerServer == 0 {
+		fmt.Println("ERROR: Adaptive connection limit requires a max number of connections per server.")
+		os.Exit(1)
+	}
+
+	if config.containerMode {
+		ApplyContainerDefaults()
+	}
+
+	if config.errorTemplateDir != "" {
+		if err := LoadErrorTemplates(); err != nil {
+			fmt.Println("ERROR: Loading error templates failed:", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.instanceName == "" {
+		config.instanceName, _ = os.Hostname()
+	}
+
+	if config.fdLimitAuto {
+		config.fdLimit = ComputeOpenFilesLimit()
+	} else if fdLimitVal, err := strconv.ParseUint(*fdLimit, 10, 64); err == nil {
+		config.fdLimit = fdLimitVal
+	} else {
+		fmt.Println("ERROR: Invalid open files limit:", *fdLimit)
+		os.Exit(1)
+	}
+
 	if config.fdLimit != 0 {
 		SetOpenFilesLimit()
 	}
@@ -156,6 +784,39 @@ func GetOpenFilesLimit() syscall.Rlimit {
 	return rlimit
 }
 
+// ComputeOpenFilesLimit returns the number of file descriptors that the proxy needs for the given
+// number of servers and connections per server: one connection toward the server and one
+// connection from the client per proxied request, plus headroom for listeners and idle clients.
+// Returns the hard limit if the number of connections per server is unlimited.
+func ComputeOpenFilesLimit() uint64 {
+	const headroom = 1024
+
+	rlimit := GetOpenFilesLimit()
+
+	var numConnsPerServer = config.numConnsPerServer
+	if config.numPrewarmConns > numConnsPerServer {
+		numConnsPerServer = config.numPrewarmConns
+	}
+
+	if config.numConnsPerServer == 0 {
+		fmt.Printf("Open files limit: Connections per server are unlimited, using max limit. (Max: %d)\n", rlimit.Max)
+		return rlimit.Max
+	}
+
+	var numServers = uint64(len(config.proxyStrings))
+	var fdLimit = 2*uint64(numConnsPerServer)*numServers + headroom
+
+	if config.beVerbose {
+		fmt.Printf("Open files limit computed: 2 x %d conns x %d servers + %d headroom = %d\n", numConnsPerServer, numServers, headroom, fdLimit)
+	}
+
+	if fdLimit > rlimit.Max {
+		fmt.Printf("WARNING: Computed open files limit exceeds max limit. Consider raising the hard limit or lowering \"--maxconns\". (Computed: %d; Max: %d)\n", fdLimit, rlimit.Max)
+	}
+
+	return fdLimit
+}
+
 // set "ulimit -n"
 // this func will only increase the limit, not decrease
 func SetOpenFilesLimit() {
@@ -179,87 +840,704 @@ func SetOpenFilesLimit() {
 	}
 }
 
-// NewProxy takes target host and creates a reverse proxy
-func NewProxy(targetHost string) (*httputil.ReverseProxy, error) {
-	url, err := url.Parse(targetHost)
+// NewBackend takes the server string of the user and creates a backend with its own transport and
+// reverse proxy. The server string has the format "URL[,OPTION=VALUE...]".
+func NewBackend(serverStr string) (*Backend, error) {
+	serverOptions := strings.Split(serverStr, ",")
+
+	targetURL, err := url.Parse(NormalizeServerURL(serverOptions[0]))
 	if err != nil {
 		return nil, err
 	}
 
-	return httputil.NewSingleHostReverseProxy(url), nil
+	if err := CheckURLHost(targetURL); err != nil {
+		return nil, err
+	}
+
+	backend := &Backend{
+		serverStr:        serverStr,
+		targetURL:        targetURL,
+		latencyHistogram: NewLatencyHistogram(),
+		requestSizes:     NewSizeHistogram(),
+		responseSizes:    NewSizeHistogram(),
+		weight:           DefaultWeight,
+		sharePercent:     FullSharePercent,
+		pool:             DefaultPoolName,
+	}
+
+	for _, option := range serverOptions[1:] {
+		optionName, optionValue, _ := strings.Cut(option, "=")
+
+		switch optionName {
+		case "dial":
+			backend.dialAddr = NormalizeDialAddr(optionValue, targetURL)
+		case "weight":
+			weight, err := strconv.ParseUint(optionValue, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid server weight: \"%s\"; Server: %s", optionValue, serverStr)
+			}
+
+			backend.weight = uint32(weight)
+		case "prefix":
+			if !strings.HasPrefix(optionValue, "/") {
+				return nil, fmt.Errorf("Server path prefix must start with \"/\": \"%s\"; Server: %s", optionValue, serverStr)
+			}
+
+			backend.pathPrefix = strings.TrimRight(optionValue, "/")
+		case "pool":
+			if optionValue == "" {
+				return nil, fmt.Errorf("Server pool name must not be empty; Server: %s", serverStr)
+			}
+
+			backend.pool = optionValue
+		default:
+			return nil, fmt.Errorf("Unknown server option: \"%s\"; Server: %s", option, serverStr)
+		}
+	}
+
+	backend.transport = NewTransport(backend)
+	backend.proxy = &httputil.ReverseProxy{}
+	backend.proxy.Transport = backend.transport
+
+	if len(config.rawHeaderNames) != 0 || config.rawSignedHeaders {
+		backend.proxy.Transport = &rawHeaderTransport{backend.transport}
+	}
+
+	backend.proxy.ModifyResponse = backend.ModifyResponse
+
+	backend.proxy.Director = func(outReq *http.Request) {
+		outReq.URL = JoinURL(backend.targetURL, backend.pathPrefix, outReq.URL)
+
+		if _, exists := outReq.Header["User-Agent"]; !exists {
+			outReq.Header.Set("User-Agent", "") // no default user agent of the transport
+		}
+
+		LinkRequestTrailers(outReq)
+
+		if !isUpgrade(outReq.Header) {
+			StripHopByHopHeaders(outReq.Header)
+		}
+	}
+	backend.proxy.ErrorHandler = backend.ProxyErrorHandler
+
+	if config.adaptiveConns {
+		var initialLimit = AdaptiveConnsInitial
+		if initialLimit > config.numConnsPerServer {
+			initialLimit = config.numConnsPerServer
+		}
+
+		backend.connLimiter = NewPriorityLimiter(initialLimit)
+		backend.adaptiveConns = NewAdaptiveConnLimit(backend.connLimiter, serverStr,
+			config.numConnsPerServer)
+	} else if config.numConnsPerServer != 0 {
+		backend.connLimiter = NewPriorityLimiter(config.numConnsPerServer)
+	}
+
+	if config.ejectTime != 0 {
+		backend.health = NewBackendHealth()
+	}
+
+	return backend, nil
+}
+
+// AddPathPrefix prepends the path prefix of a server to the path of a request URL
+func AddPathPrefix(reqURL *url.URL, pathPrefix string) {
+	if reqURL.RawPath != "" {
+		reqURL.RawPath = joinPathSlash((&url.URL{Path: pathPrefix}).EscapedPath(), reqURL.RawPath)
+	}
+
+	reqURL.Path = joinPathSlash(pathPrefix, reqURL.Path)
+}
+
+// ModifyResponse is the httputil.ReverseProxy hook for responses of this backend
+func (backend *Backend) ModifyResponse(resp *http.Response) error {
+	// the body of an upgraded response is the server connection, which must stay writable
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if config.upgradeIdleTimeout != 0 {
+			conn, err := NewUpgradeIdleTimeoutConn(resp, backend.serverStr)
+			if err != nil {
+				return err
+			}
+
+			resp.Body = conn
+		}
+
+		return nil
+	}
+
+	if backend.health != nil {
+		backend.RecordSuccess()
+	}
+
+	backend.ObserveAdaptiveConns(resp.Request.Context(), IsOverloadStatus(resp.StatusCode))
+
+	StripHopByHopHeaders(resp.Header)
+
+	if config.stripTrailers {
+		StripResponseTrailers(resp)
+	}
+
+	if config.serverHints != "" {
+		AddServerHints(resp.Header)
+	}
+
+	if len(config.statusRules) != 0 {
+		RewriteStatus(resp)
+	}
+
+	var isEventStream = config.sseMode && IsEventStreamResponse(resp)
+
+	if isEventStream {
+		PrepareEventStreamResponse(resp, backend.serverStr)
+	} else if config.streamIdleTimeout != 0 && IsStreamingResponse(resp) {
+		resp.Body = NewStreamIdleTimeoutBody(resp, backend.serverStr)
+	}
+
+	// partial content doesn't match the checksum of the full object
+	if len(config.checksumAlgos) != 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body = NewChecksumVerifier(resp.Body, resp.Header,
+			"Response from "+backend.serverStr+": "+resp.Request.Method+" "+resp.Request.URL.RequestURI())
+	}
+
+	// the filter process would buffer the event stream
+	if config.responseFilterCmd != "" && !isEventStream {
+		if err := FilterResponseBody(resp); err != nil {
+			return err
+		}
+	}
+
+	resp.Body = &errorClassifyingReader{ReadCloser: resp.Body, backend: backend, ctx: resp.Request.Context()}
+
+	return nil
 }
 
 func InitProxyState() {
 	proxyState.requestNum = 0
 
-	for i, proxyStr := range flag.Args() {
+	if config.apiKeysFile != "" {
+		tenants, err := LoadTenants(config.apiKeysFile)
+		if err != nil {
+			panic(err)
+		}
+
 		if config.beVerbose {
-			fmt.Printf("Adding proxy. Index: %d; Server: %s\n", i, proxyStr)
+			fmt.Printf("Loaded tenant API keys. Number of tenants: %d\n", len(tenants))
+		}
+
+		proxyState.tenants = tenants
+	}
+
+	if config.routeScriptFile != "" {
+		routeScript, err := LoadRouteScript(config.routeScriptFile)
+		if err != nil {
+			panic(err)
+		}
+
+		proxyState.routeScript = routeScript
+	}
+
+	for _, proxyStr := range config.proxyStrings {
+		if !strings.HasPrefix(proxyStr, SRVServerPrefix) {
+			AddBackend(proxyStr)
+			continue
 		}
 
-		proxy, err := NewProxy(flag.Arg(i))
+		srvName, srvServerStrs, srvTargets, err := ExpandSRVServer(proxyStr)
 		if err != nil {
 			panic(err)
 		}
 
-		proxy.FlushInterval = -1 // negative value means "flush immediately"
+		for i, srvServerStr := range srvServerStrs {
+			backend := AddBackend(srvServerStr)
+			backend.srvName = srvName
+			backend.weight = srvTargetWeight(srvTargets[i])
+		}
+	}
+
+	if config.startupCheck != "" || config.requireAllBackends {
+		CheckBackends()
+	}
+
+	if config.statsRoutes != "" {
+		proxyState.statsRoutes = ParseStatsRoutes(config.statsRoutes)
+	}
+
+	// after the startup check, which might remove servers
+	if config.shardMapFile != "" {
+		shardMap, err := LoadShardMap(config.shardMapFile)
+		if err != nil {
+			panic(err)
+		}
+
+		proxyState.shardMap = shardMap
+	} else if config.numShards != 0 {
+		proxyState.shardMap = NewEvenShardMap(config.numShards, len(proxyState.backends))
+	}
+
+	if err := CheckHeaderRoutes(); err != nil {
+		panic(err)
+	}
+
+	if err := CheckSNIRoutes(); err != nil {
+		panic(err)
+	}
+
+	if err := CheckCompatPool(); err != nil {
+		panic(err)
+	}
+
+	if config.beVerbose && proxyState.shardMap != nil {
+		fmt.Printf("Shard map:\n%s", FormatShardMap(proxyState.shardMap))
+	}
+
+	UpdateSchedule()
+}
+
+// FindBackend returns the index of the server with the given index or server string, which may omit
+// the server options
+func FindBackend(serverStr string) (uint32, bool) {
+	if backendIdx, err := strconv.Atoi(serverStr); err == nil {
+		return uint32(backendIdx), backendIdx >= 0 && backendIdx < len(proxyState.backends)
+	}
+
+	for i, backend := range proxyState.backends {
+		if backend.serverStr == serverStr || strings.HasPrefix(backend.serverStr, serverStr+",") {
+			return uint32(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// AddBackend creates the backend for the given server string and appends it to the list of servers
+func AddBackend(proxyStr string) *Backend {
+	if config.beVerbose {
+		fmt.Printf("Adding proxy. Index: %d; Server: %s\n", len(proxyState.backends), proxyStr)
+	}
 
-		if config.poolBufSize > 0 {
-			proxy.BufferPool = NewProxyBufferPool()
+	backend, err := NewBackend(proxyStr)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.beVerbose {
+		fmt.Printf("  Address: %s\n", targetHostPort(backend.targetURL))
+
+		if backend.dialAddr != "" {
+			fmt.Printf("  Dial address: %s\n", backend.dialAddr)
 		}
 
-		proxyState.proxies = append(proxyState.proxies, proxy)
+		if backend.pathPrefix != "" {
+			fmt.Printf("  Path prefix: %s\n", backend.pathPrefix)
+		}
 
-		if config.numConnsPerServer != 0 {
-			var sem = semaphore.NewWeighted(int64(config.numConnsPerServer))
-			proxyState.connLimiters = append(proxyState.connLimiters, sem)
+		if backend.pool != DefaultPoolName {
+			fmt.Printf("  Pool: %s\n", backend.pool)
 		}
 	}
 
+	proxy := backend.proxy
+
+	proxy.FlushInterval = -1 // negative value means "flush immediately"
+
+	// also with pooling disabled, so that pooling can be enabled at runtime
+	proxy.BufferPool = NewProxyBufferPool(config.poolBufSize)
+
+	proxyState.backends = append(proxyState.backends, backend)
+
+	return backend
+}
+
+// checksumHeaders maps the supported checksum algorithms to the headers containing their expected
+// base64-encoded values
+var checksumHeaders = map[string]string{
+	"md5":    "Content-MD5",
+	"crc32c": "X-Amz-Checksum-Crc32c",
+}
+
+func newChecksumHash(algo string) hash.Hash {
+	if algo == "crc32c" {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+
+	return md5.New()
+}
+
+// checksumVerifier wraps a request or response body to compute checksums of the data that is read
+// through it and compares them to the expected values when EOF is reached
+type checksumVerifier struct {
+	body        io.ReadCloser
+	algos       []string
+	hashes      []hash.Hash
+	expectedSum [][]byte
+	description string // for log messages
+	isDone      bool
+}
+
+// NewChecksumVerifier returns the given body unchanged if the header contains no expected
+// checksum for any of the configured algorithms
+func NewChecksumVerifier(body io.ReadCloser, header http.Header, description string) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		return body
+	}
+
+	verifier := &checksumVerifier{body: body, description: description}
+
+	for _, algo := range config.checksumAlgos {
+		// note: multipart checksums ("<sum>-<numParts>") are not a checksum of the body
+		headerVal := header.Get(checksumHeaders[algo])
+		if headerVal == "" || strings.Contains(headerVal, "-") {
+			continue
+		}
+
+		expectedSum, err := base64.StdEncoding.DecodeString(headerVal)
+		if err != nil {
+			fmt.Printf("Ignoring invalid checksum header. %s: %s: %s\n", description, checksumHeaders[algo], headerVal)
+			continue
+		}
+
+		verifier.algos = append(verifier.algos, algo)
+		verifier.hashes = append(verifier.hashes, newChecksumHash(algo))
+		verifier.expectedSum = append(verifier.expectedSum, expectedSum)
+	}
+
+	if len(verifier.hashes) == 0 {
+		return body
+	}
+
+	return verifier
+}
+
+func (verifier *checksumVerifier) Read(buf []byte) (int, error) {
+	numRead, err := verifier.body.Read(buf)
+
+	for _, hasher := range verifier.hashes {
+		hasher.Write(buf[:numRead])
+	}
+
+	if err == io.EOF && !verifier.isDone {
+		verifier.isDone = true
+		verifier.verify()
+	}
+
+	return numRead, err
+}
+
+func (verifier *checksumVerifier) Close() error {
+	return verifier.body.Close()
+}
+
+func (verifier *checksumVerifier) verify() {
+	for i, hasher := range verifier.hashes {
+		computedSum := hasher.Sum(nil)
+
+		if !bytes.Equal(computedSum, verifier.expectedSum[i]) {
+			var mismatchNum = atomic.AddUint64(&proxyState.checksumMismatches, 1)
+
+			fmt.Printf("Checksum mismatch #%d: %s: Algorithm: %s; Expected: %s; Computed: %s\n", mismatchNum, verifier.description, verifier.algos[i],
+				base64.StdEncoding.EncodeToString(verifier.expectedSum[i]), base64.StdEncoding.EncodeToString(computedSum))
+		} else if config.beVerbose {
+			fmt.Printf("Checksum verified: %s: Algorithm: %s\n", verifier.description, verifier.algos[i])
+		}
+	}
+}
+
+// tagHeaderNames maps the supported tags to the headers that get added to requests toward servers
+var tagHeaderNames = map[string]string{
+	"instance":  "X-ProxPerfect-Instance",
+	"server":    "X-ProxPerfect-Server",
+	"request":   "X-ProxPerfect-Request",
+	"client":    "X-ProxPerfect-Client",
+	"queuetime": "X-ProxPerfect-Queue-Time-Ms",
+	"timeout":   "X-ProxPerfect-Expected-Timeout-Ms",
+}
+
+// AddTagHeaders adds the configured tag headers to a request that gets forwarded to given server
+func AddTagHeaders(r *http.Request, proxyIdx uint32, currentRequestNum uint64) {
+	for _, tag := range config.tagHeaders {
+		var value string
+
+		switch tag {
+		case "instance":
+			value = config.instanceName
+		case "server":
+			value = strconv.FormatUint(uint64(proxyIdx), 10)
+		case "request":
+			value = strconv.FormatUint(currentRequestNum, 10)
+		case "client":
+			value = ClientIP(r)
+		case "queuetime":
+			value = strconv.FormatInt(time.Since(GetRequestState(r).startTime).Milliseconds(), 10)
+		case "timeout":
+			deadline, hasDeadline := r.Context().Deadline()
+			if !hasDeadline {
+				r.Header.Del(tagHeaderNames[tag]) // don't pass through a value from the client
+				continue
+			}
+
+			remainingMillis := time.Until(deadline).Milliseconds()
+			if remainingMillis < 0 {
+				remainingMillis = 0
+			}
+
+			value = strconv.FormatInt(remainingMillis, 10)
+		}
+
+		// note: not using Header.Set(), because it would canonicalize to "X-Proxperfect-..."
+		r.Header.Del(tagHeaderNames[tag])
+		r.Header[tagHeaderNames[tag]] = []string{value}
+	}
 }
 
 // ProxyRequestHandler proxies the http request to server from given list
-func ProxyRequestHandler() func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var currentRequestNum = atomic.AddUint32(&proxyState.requestNum, 1)
-		var proxyIdx = currentRequestNum % uint32(len(proxyState.proxies))
-		var proxy = proxyState.proxies[proxyIdx]
-		var limiter *semaphore.Weighted
+func ProxyRequestHandler() http.Handler {
+	var chain = BuildMiddlewareChain()
 
-		// limit concurrent connections for this proxy
-		if config.numConnsPerServer != 0 {
-			limiter = proxyState.connLimiters[proxyIdx]
-			ctx := context.Background()
-			limiter.Acquire(ctx, 1)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var state = &RequestState{
+			requestNum: atomic.AddUint64(&proxyState.requestNum, 1),
+			startTime:  time.Now(),
 		}
 
-		if config.beVerbose {
-			fmt.Printf("[%s START #%d]: %s %s\n", config.proxyStrings[proxyIdx], currentRequestNum, r.Method, r.URL.String())
+		r = ResolveClientIP(r) // before selection, so that balancers can use the client IP
+
+		balancer, backendIdx, isAvailable := SelectBackend(r)
+		if !isAvailable {
+			if config.cacheSize > 0 && ServeStaleResponse(w, r) {
+				return
+			}
+
+			HTTPMaintenanceError(w, r, http.StatusServiceUnavailable, NoServersMessage)
+			return
 		}
 
-		proxy.ServeHTTP(w, r)
+		state.SetPickedBackend(balancer, backendIdx)
 
-		if config.beVerbose {
-			fmt.Printf("[%s END   #%d]: %s %s\n", config.proxyStrings[proxyIdx], currentRequestNum, r.Method, r.URL.String())
+		if config.rawSignedHeaders {
+			state.signedHeader = SignedHeaderValues(r) // before middlewares can modify headers
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), requestStateKey{}, state))
+
+		activeRequests.Store(state.requestNum, &ActiveRequest{request: r, state: state})
+		defer activeRequests.Delete(state.requestNum)
+
+		chain.ServeHTTP(w, r)
+	})
+}
+
+// quorumResponse is a http.ResponseWriter that buffers the full response of a single server in
+// quorum read mode, so that it can be compared to the responses of the other servers
+type quorumResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (resp *quorumResponse) Header() http.Header {
+	return resp.header
+}
+
+func (resp *quorumResponse) Write(buf []byte) (int, error) {
+	if resp.statusCode == 0 {
+		resp.statusCode = http.StatusOK
+	}
+
+	return resp.body.Write(buf)
+}
+
+func (resp *quorumResponse) WriteHeader(statusCode int) {
+	if resp.statusCode == 0 {
+		resp.statusCode = statusCode
+	}
+}
+
+// Flush is a no-op, as the response is buffered until all servers have replied
+func (resp *quorumResponse) Flush() {}
+
+// Fail replaces a partial response by status 502, e.g. after the response body of the server was
+// truncated
+func (resp *quorumResponse) Fail() {
+	resp.header = make(http.Header)
+	resp.statusCode = http.StatusBadGateway
+	resp.body.Reset()
+}
+
+// md5 returns the hex-encoded MD5 checksum of the buffered body
+func (resp *quorumResponse) md5() string {
+	sum := md5.Sum(resp.body.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// QuorumRead sends the GET request to config.quorumSize servers (starting at proxyIdx, followed by
+// the next servers of its pool), compares the responses and serves the response of the first
+// server. divergence between the responses gets logged and counted.
+func QuorumRead(w http.ResponseWriter, r *http.Request, proxyIdx uint32, currentRequestNum uint64) {
+	var backendIdxs = SelectQuorumBackends(proxyIdx)
+	var responses = make([]*quorumResponse, len(backendIdxs))
+	var waitGroup sync.WaitGroup
+
+	for i, currentIdx := range backendIdxs {
+		responses[i] = &quorumResponse{header: make(http.Header)}
+
+		waitGroup.Add(1)
+
+		go func(resp *quorumResponse, currentIdx uint32) {
+			defer waitGroup.Done()
+
+			// the proxy aborts with a panic if copying the response body fails, which would kill the
+			// process in this goroutine
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					if recovered != http.ErrAbortHandler {
+						panic(recovered)
+					}
+
+					resp.Fail()
+				}
+			}()
+
+			var backend = proxyState.backends[currentIdx]
+
+			// limit concurrent connections for this proxy
+			if backend.connLimiter != nil {
+				if err := backend.connLimiter.Acquire(r.Context(), ClassifyPriority(r)); err != nil {
+					atomic.AddUint64(&proxyState.queuedCancels, 1)
+					resp.WriteHeader(CanceledRequestStatus(err))
+					return
+				}
+
+				defer backend.connLimiter.Release()
+			}
+
+			if config.beVerbose {
+				fmt.Printf("[%s QUORUM #%d]: %s %s (Client: %s)\n", backend.serverStr, currentRequestNum, r.Method, r.URL.String(), ClientIP(r))
+			}
+
+			outReq := r.Clone(r.Context())
+			AddTagHeaders(outReq, currentIdx, currentRequestNum)
+
+			if config.connTrace {
+				outReq = outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), backend.NewClientTrace(currentRequestNum)))
+			}
+
+			if backend.adaptiveConns != nil {
+				outReq = WithAdaptiveConnsSample(outReq)
+			}
+
+			atomic.AddUint64(&backend.numRequests, 1)
+			atomic.AddInt64(&backend.numInFlight, 1)
+
+			startTime := time.Now()
+
+			// deferred like in ServeBackend(), but runs before the recovery of an abort, so that a
+			// truncated response still counts with its received size
+			defer func() {
+				atomic.AddInt64(&backend.numInFlight, -1)
+
+				backend.latencyHistogram.Observe(time.Since(startTime), TraceID(outReq.Header))
+				backend.CountResponseStatus(resp.statusCode)
+
+				ObserveBodySizes(backend, outReq, 0, uint64(resp.body.Len())) // quorum reads are GETs
+			}()
+
+			backend.proxy.ServeHTTP(resp, outReq)
+		}(responses[i], currentIdx)
+	}
+
+	waitGroup.Wait()
+
+	// compare responses to the response of the first server
+	var primary = responses[0]
+	var isDivergent = false
+
+	for _, resp := range responses[1:] {
+		if (resp.statusCode != primary.statusCode) ||
+			(resp.header.Get("ETag") != primary.header.Get("ETag")) ||
+			(resp.md5() != primary.md5()) {
+			isDivergent = true
+			break
 		}
+	}
+
+	if isDivergent {
+		var divergenceNum = atomic.AddUint64(&proxyState.quorumDivergences, 1)
+
+		fmt.Printf("Quorum divergence #%d: Request #%d: %s %s\n", divergenceNum, currentRequestNum, r.Method, r.URL.String())
 
-		if config.numConnsPerServer != 0 {
-			limiter.Release(1)
+		for i, resp := range responses {
+			var currentIdx = backendIdxs[i]
+
+			fmt.Printf("  %s: Status: %d; ETag: %s; Length: %d; MD5: %s\n", proxyState.backends[currentIdx].serverStr, resp.statusCode, resp.header.Get("ETag"), resp.body.Len(), resp.md5())
 		}
 	}
+
+	// serve response of first server
+	trailer := SplitResponseTrailers(primary.header)
+
+	for key, values := range primary.header {
+		w.Header()[key] = values
+	}
+
+	w.WriteHeader(primary.statusCode)
+	w.Write(primary.body.Bytes())
+
+	WriteResponseTrailers(w, trailer)
+}
+
+// HTTPError replies to the request with the given error code and message
+func HTTPError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	if config.beVerbose {
+		fmt.Printf("[ERROR %d]: %s %s (Client: %s): %s\n", code, r.Method, r.URL.String(), ClientIP(r), message)
+	}
+
+	if !WriteErrorPage(w, r, code, message, false) {
+		http.Error(w, message, code)
+	}
+}
+
+// MatchPathPattern returns true if the path equals the pattern or, if the pattern ends with "*", if
+// the path starts with the pattern
+func MatchPathPattern(pattern string, path string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(path, pattern[:len(pattern)-1])
+	}
+
+	return path == pattern
 }
 
 // RedirectHandler redirects incoming http request to server from given list
 func RedirectHandler(w http.ResponseWriter, r *http.Request) {
-	var currentRequestNum = atomic.AddUint32(&proxyState.requestNum, 1)
-	var proxyIdx = currentRequestNum % uint32(len(proxyState.proxies))
-	var serverStr = config.proxyStrings[proxyIdx] + r.URL.String()
+	var currentRequestNum = atomic.AddUint64(&proxyState.requestNum, 1)
 
-	if config.beVerbose {
-		fmt.Printf("[%s REDIRECT #%d]: %s %s\n", config.proxyStrings[proxyIdx], currentRequestNum, r.Method, r.URL.String())
+	r = ResolveClientIP(r)
+
+	var _, backendIdx, isAvailable = SelectBackend(r)
+	if !isAvailable {
+		HTTPMaintenanceError(w, r, http.StatusServiceUnavailable, NoServersMessage)
+		return
+	}
+
+	if proxyState.shardMap != nil {
+		backendIdx = ShardBackend(r.URL.Path)
 	}
 
-	http.Redirect(w, r, serverStr, config.redirectCode)
+	var backend = proxyState.backends[backendIdx]
+
+	if RejectDrainedRequest(w, r) {
+		return
+	}
+
+	if proxyState.tenants != nil {
+		tenant, _ := AdmitTenantRequest(w, r)
+		if tenant == nil {
+			return
+		}
+
+		defer tenant.ReleaseRequest()
+	}
+
+	RedirectRequest(w, r, backend, currentRequestNum)
 }
 
 func main() {
@@ -267,18 +1545,147 @@ func main() {
 
 	ParseArguments()
 
+	ApplyProcessTuning()
+
 	InitProxyState()
 
+	// not for output in machine-readable formats
+	if !config.printConfig && !config.printShardMap {
+		CheckLimits()
+	}
+
+	if config.checkConfig {
+		fmt.Println("Config OK.")
+		os.Exit(0)
+	}
+
+	if config.printShardMap {
+		fmt.Print(FormatShardMap(proxyState.shardMap))
+		os.Exit(0)
+	}
+
+	if config.printConfig {
+		WriteEffectiveConfig(os.Stdout)
+		os.Exit(0)
+	}
+
+	if config.containerMode {
+		if err := StartJSONLog(); err != nil {
+			log.Fatal(err)
+		}
+
+		go HandleContainerSignals()
+	}
+
+	PrintStartupBanner()
+
+	if config.numPrewarmConns > 0 {
+		PrewarmConnections()
+	}
+
+	if config.probeInterval > 0 {
+		go ProbeIdleConnections()
+	}
+
+	go WatchOpenFiles()
+
+	if config.hdrLogFile != "" {
+		StartHdrLog()
+	}
+
+	go DumpStateOnSignal()
+
+	if config.printReport && !config.containerMode { // container mode prints it on shutdown
+		go PrintReportOnExit()
+	}
+
+	if config.idempotencyWindow != 0 {
+		go PurgeIdempotentResponses()
+	}
+
+	if config.affinityWindow != 0 {
+		go PurgeAffinityEntries()
+	}
+
+	if config.cacheSize > 0 {
+		go PurgeExpiredCacheEntries()
+	}
+
+	if config.dnsRefreshInterval > 0 && HasSRVBackends() {
+		go RefreshDNSWeights()
+	}
+
 	// register http request handler
-	if config.redirectCode == 0 {
-		// handle requests through proxy
-		http.HandleFunc("/", ProxyRequestHandler())
+	if config.redirectCode == 0 || config.isMixedRedirect {
+		// handle requests through proxy (with redirect of selected requests)
+		http.Handle("/", ProxyRequestHandler())
 	} else {
 		// handle requests through redirector
 		http.HandleFunc("/", RedirectHandler)
 	}
 
+	if config.adminPort != 0 {
+		fmt.Printf("Admin interface listening on port %d...\n", config.adminPort)
+
+		go func() {
+			log.Fatal(http.ListenAndServe(":"+strconv.Itoa(config.adminPort), NewAdminServeMux()))
+		}()
+	}
+
+	listeners, err := ListenClientPort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for i := range listeners {
+		listeners[i] = &clientConnListener{Listener: listeners[i], isTLS: config.tlsCertFile != "" || config.tlsPassthrough}
+
+		if config.connTrace {
+			listeners[i] = &tracedListener{Listener: listeners[i]}
+		}
+
+		if config.realIPMode == RealIPModeProxyProtocol {
+			listeners[i] = &proxyProtocolListener{Listener: listeners[i]}
+		}
+	}
+
+	var handler http.Handler = CountClientConnReuse(http.DefaultServeMux)
+
+	if config.maxURLLen > 0 {
+		handler = LimitURLLength(handler)
+	}
+
+	proxyState.server = &http.Server{Handler: handler, MaxHeaderBytes: config.maxHeaderBytes,
+		ConnContext: ClientConnContext}
+
+	if config.etcdURL != "" {
+		go WatchEtcdConfig(proxyState.etcdRevision)
+	}
+
 	fmt.Printf("Listening on port %d...\n", config.listenPort)
 
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(config.listenPort), nil))
+	for _, listener := range listeners {
+		if config.tlsPassthrough {
+			go ServePassthrough(listener)
+		} else {
+			go ServeClients(listener)
+		}
+	}
+
+	select {} // until exit or restart by Reconfigure()
+}
+
+// ServeClients runs the accept loop of a listener for client connections
+func ServeClients(listener net.Listener) {
+	var err error
+
+	if config.tlsCertFile != "" {
+		err = proxyState.server.ServeTLS(listener, config.tlsCertFile, config.tlsKeyFile)
+	} else {
+		err = proxyState.server.Serve(listener)
+	}
+
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,296 @@
+// Resolution of the real client IP address for requests that arrive through other proxies or
+// load balancers
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ProxyProtocolHeaderTimeout = 10 * time.Second
+
+// supported values for config.realIPMode
+const (
+	RealIPModeRemoteAddr    = "remoteaddr"
+	RealIPModeXFF           = "xff"
+	RealIPModeCloudflare    = "cf"
+	RealIPModeProxyProtocol = "proxyprotocol"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type clientIPContextKey struct{}
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs and plain IP addresses
+func ParseTrustedProxies(trustedProxiesStr string) ([]*net.IPNet, error) {
+	var trustedNets []*net.IPNet
+
+	for _, cidrStr := range strings.Split(trustedProxiesStr, ",") {
+		if !strings.Contains(cidrStr, "/") {
+			if ip := net.ParseIP(cidrStr); ip != nil && ip.To4() != nil {
+				cidrStr += "/32"
+			} else {
+				cidrStr += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidrStr)
+		if err != nil {
+			return nil, err
+		}
+
+		trustedNets = append(trustedNets, ipNet)
+	}
+
+	return trustedNets, nil
+}
+
+// IsTrustedProxy returns true if the given IP is in the list of trusted proxies
+func IsTrustedProxy(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range config.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ResolveClientIP determines the real client IP of a request based on config.realIPMode and
+// stores it in the request context, so that all later users see the same value through ClientIP()
+func ResolveClientIP(r *http.Request) *http.Request {
+	clientIP := remoteAddrIP(r.RemoteAddr)
+
+	if IsTrustedProxy(clientIP) {
+		switch config.realIPMode {
+		case RealIPModeXFF:
+			clientIP = clientIPFromXFF(r.Header.Values("X-Forwarded-For"), clientIP)
+		case RealIPModeCloudflare:
+			if headerIP := strings.TrimSpace(r.Header.Get("CF-Connecting-IP")); net.ParseIP(headerIP) != nil {
+				clientIP = headerIP
+			}
+		}
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, clientIP))
+}
+
+// ClientIP returns the real client IP of a request as resolved by ResolveClientIP()
+func ClientIP(r *http.Request) string {
+	if clientIP, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return clientIP
+	}
+
+	return remoteAddrIP(r.RemoteAddr)
+}
+
+func remoteAddrIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+
+	return host
+}
+
+// clientIPFromXFF walks the X-Forwarded-For chain from right to left and returns the first IP that
+// is not a trusted proxy. If all IPs are trusted, the leftmost IP is returned.
+func clientIPFromXFF(headerValues []string, remoteIP string) string {
+	var forwardedIPs []string
+
+	for _, headerValue := range headerValues {
+		for _, ipStr := range strings.Split(headerValue, ",") {
+			forwardedIPs = append(forwardedIPs, strings.TrimSpace(ipStr))
+		}
+	}
+
+	clientIP := remoteIP
+
+	for i := len(forwardedIPs) - 1; i >= 0; i-- {
+		if net.ParseIP(forwardedIPs[i]) == nil {
+			break // can't trust anything left of a malformed entry
+		}
+
+		clientIP = forwardedIPs[i]
+
+		if !IsTrustedProxy(clientIP) {
+			break
+		}
+	}
+
+	return clientIP
+}
+
+// proxyProtocolListener wraps a listener to accept connections that start with a PROXY protocol
+// (v1 or v2) header, as sent by load balancers like HAProxy or AWS NLB
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (listener *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn parses the PROXY protocol header on first use, so that slow senders don't
+// block the accept loop of the listener
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	parseOnce  sync.Once
+	parseErr   error
+	remoteAddr net.Addr // nil if header contained no address (e.g. "PROXY UNKNOWN")
+}
+
+func (conn *proxyProtocolConn) parseHeader() {
+	conn.parseOnce.Do(func() {
+		if len(config.trustedProxies) != 0 && !IsTrustedProxy(remoteAddrIP(conn.Conn.RemoteAddr().String())) {
+			conn.parseErr = fmt.Errorf("PROXY protocol header from untrusted address: %s", conn.Conn.RemoteAddr())
+		} else {
+			conn.Conn.SetReadDeadline(time.Now().Add(ProxyProtocolHeaderTimeout))
+			conn.remoteAddr, conn.parseErr = ReadProxyProtocolHeader(conn.reader)
+			conn.Conn.SetReadDeadline(time.Time{})
+		}
+
+		if conn.parseErr != nil {
+			fmt.Printf("Closing client connection. Remote: %s; Error: %v\n", conn.Conn.RemoteAddr(), conn.parseErr)
+			conn.Conn.Close()
+		}
+	})
+}
+
+func (conn *proxyProtocolConn) Read(buf []byte) (int, error) {
+	if conn.parseHeader(); conn.parseErr != nil {
+		return 0, conn.parseErr
+	}
+
+	return conn.reader.Read(buf)
+}
+
+func (conn *proxyProtocolConn) RemoteAddr() net.Addr {
+	if conn.parseHeader(); conn.remoteAddr != nil {
+		return conn.remoteAddr
+	}
+
+	return conn.Conn.RemoteAddr()
+}
+
+// ReadProxyProtocolHeader reads a PROXY protocol v1 or v2 header and returns the source address
+func ReadProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyProtocolV2Header(reader)
+	}
+
+	return readProxyProtocolV1Header(reader)
+}
+
+// readProxyProtocolV1Header parses the human-readable format, e.g.
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyProtocolV1Header(reader *bufio.Reader) (net.Addr, error) {
+	const maxLineLen = 107 // as defined by the spec
+
+	var line []byte
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxLineLen {
+			return nil, errors.New("PROXY protocol v1 header too long")
+		}
+
+		nextByte, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, nextByte)
+	}
+
+	fields := strings.Fields(string(line))
+
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("Missing PROXY protocol header")
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY protocol v1 header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Invalid PROXY protocol v1 source address: %q", line)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2Header parses the binary format
+func readProxyProtocolV2Header(reader *bufio.Reader) (net.Addr, error) {
+	var header [16]byte // signature, version/command, family/protocol, address length
+
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version: %d", header[12]>>4)
+	}
+
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+
+	if _, err := io.ReadFull(reader, addrs); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command (e.g. health checks of the load balancer) has no client address
+	if header[12]&0x0F == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1: // AF_INET: src addr (4), dst addr (4), src port (2), dst port (2)
+		if len(addrs) < 12 {
+			return nil, errors.New("PROXY protocol v2 IPv4 address block too short")
+		}
+
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 2: // AF_INET6: src addr (16), dst addr (16), src port (2), dst port (2)
+		if len(addrs) < 36 {
+			return nil, errors.New("PROXY protocol v2 IPv6 address block too short")
+		}
+
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	}
+
+	return nil, nil // unsupported address family (e.g. unix sockets) has no usable client IP
+}
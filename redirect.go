@@ -0,0 +1,92 @@
+// Redirects of selected requests directly to the servers, while other requests get proxied
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RedirectRule selects requests to redirect by method and path
+type RedirectRule struct {
+	method      string // empty matches all methods
+	pathPattern string
+}
+
+// ParseRedirectRules parses a comma-separated list of rules in the format "[METHOD:]PATH_PATTERN",
+// e.g. "GET:/data/*,/bulk/*"
+func ParseRedirectRules(rulesStr string) ([]RedirectRule, error) {
+	var rules []RedirectRule
+
+	for _, ruleStr := range strings.Split(rulesStr, ",") {
+		var rule = RedirectRule{pathPattern: ruleStr}
+
+		if !strings.HasPrefix(ruleStr, "/") {
+			rule.method, rule.pathPattern, _ = strings.Cut(ruleStr, ":")
+		}
+
+		if rule.method != strings.ToUpper(rule.method) || !strings.HasPrefix(rule.pathPattern, "/") {
+			return nil, fmt.Errorf("Invalid redirect rule: %s", ruleStr)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// MatchRedirectRules returns true if the request matches any of config.redirectRules
+func MatchRedirectRules(r *http.Request) bool {
+	for _, rule := range config.redirectRules {
+		if (rule.method == "" || rule.method == r.Method) && MatchPathPattern(rule.pathPattern, r.URL.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExceedsRedirectSize sends a HEAD request for the requested object to the given server and returns
+// true if the object is larger than config.redirectSize. Returns false if the size is unknown.
+func ExceedsRedirectSize(r *http.Request, backend *Backend) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+		return false
+	}
+
+	headReq := r.Clone(r.Context())
+	headReq.Method = http.MethodHead
+	headReq.Body = http.NoBody
+	headReq.ContentLength = 0
+	headReq.RequestURI = ""
+
+	backend.proxy.Director(headReq) // same server URL and headers as the proxied request
+
+	resp, err := backend.transport.RoundTrip(headReq)
+	if err != nil {
+		if config.beVerbose {
+			fmt.Printf("Size probe failed. Server: %s; Request: %s; Error: %v\n", backend.serverStr, r.URL.String(), err)
+		}
+
+		return false
+	}
+
+	resp.Body.Close()
+
+	if config.beVerbose {
+		fmt.Printf("Size probe. Server: %s; Request: %s; Status: %d; Size: %d\n", backend.serverStr, r.URL.String(), resp.StatusCode, resp.ContentLength)
+	}
+
+	return resp.StatusCode == http.StatusOK && resp.ContentLength > config.redirectSize
+}
+
+// RedirectRequest redirects the client to the given server with config.redirectCode
+func RedirectRequest(w http.ResponseWriter, r *http.Request, backend *Backend, requestNum uint64) {
+	if config.beVerbose {
+		fmt.Printf("[%s REDIRECT #%d]: %s %s (Client: %s)\n", backend.serverStr, requestNum, r.Method, r.URL.String(), ClientIP(r))
+	}
+
+	var location = JoinURL(backend.targetURL, backend.pathPrefix, r.URL)
+
+	http.Redirect(w, r, location.String(), config.redirectCode)
+}
@@ -0,0 +1,165 @@
+// Comparative report of the servers side by side (throughput, latency percentiles, error rate), so
+// that slow nodes of the fan-out set are immediately visible after a benchmark run
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ReportSlowFactor is the factor of the p99 latency of a server over the median p99 latency of all
+// servers from which on the server gets marked as slow in the report
+const ReportSlowFactor = 2
+
+// ServerReport is the summary of the requests to a server since startup
+type ServerReport struct {
+	Server         string  `json:"server"`
+	Requests       uint64  `json:"requests"`
+	RequestsPerSec float64 `json:"requestsPerSec"`
+	MBPerSec       float64 `json:"mbPerSec"` // response bodies to clients
+	P50Ms          float64 `json:"p50Ms"`
+	P95Ms          float64 `json:"p95Ms"`
+	P99Ms          float64 `json:"p99Ms"`
+	Errors         uint64  `json:"errors"`    // responses with status 5xx, including failed requests
+	ErrorRate      float64 `json:"errorRate"` // errors relative to requests
+	IsSlow         bool    `json:"slow"`      // p99 latency is ReportSlowFactor over median of all servers
+}
+
+// CountResponseStatus counts the response status of a request to the server for the error rate of
+// the report
+func (backend *Backend) CountResponseStatus(statusCode int) {
+	if statusCode >= http.StatusInternalServerError {
+		atomic.AddUint64(&backend.numServerErrors, 1)
+	}
+}
+
+// BuildServerReports returns the reports of all servers, with rates since the start of recording
+func BuildServerReports() []ServerReport {
+	var reports []ServerReport
+	var now = time.Now()
+
+	for _, backend := range proxyState.backends {
+		histogram := backend.latencyHistogram.CopyHdrTotal()
+		seconds := now.Sub(histogram.startTime).Seconds()
+
+		report := ServerReport{
+			Server:   backend.serverStr,
+			Requests: atomic.LoadUint64(&backend.numRequests),
+			Errors:   atomic.LoadUint64(&backend.numServerErrors),
+			P50Ms:    durationMs(histogram.ValueAtPercentile(50)),
+			P95Ms:    durationMs(histogram.ValueAtPercentile(95)),
+			P99Ms:    durationMs(histogram.ValueAtPercentile(99)),
+		}
+
+		if seconds > 0 {
+			report.RequestsPerSec = float64(report.Requests) / seconds
+			report.MBPerSec = float64(backend.responseSizes.Stats().Sum) / (1024 * 1024) / seconds
+		}
+
+		if report.Requests > 0 {
+			report.ErrorRate = float64(report.Errors) / float64(report.Requests)
+		}
+
+		reports = append(reports, report)
+	}
+
+	// mark servers that are much slower than the typical server
+	var p99s []float64
+
+	for _, report := range reports {
+		if report.Requests > 0 {
+			p99s = append(p99s, report.P99Ms)
+		}
+	}
+
+	if len(p99s) > 1 {
+		sort.Float64s(p99s)
+		medianP99 := p99s[(len(p99s)-1)/2] // lower median, so that one of two servers can be slow
+
+		for i := range reports {
+			reports[i].IsSlow = reports[i].Requests > 0 && reports[i].P99Ms > ReportSlowFactor*medianP99
+		}
+	}
+
+	return reports
+}
+
+func durationMs(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+// WriteServerReport writes the reports of all servers as a table in text form
+func WriteServerReport(writer io.Writer) {
+	bufWriter := bufio.NewWriter(writer)
+	defer bufWriter.Flush()
+
+	var reports = BuildServerReports()
+	var serverWidth = len("Server")
+
+	for _, report := range reports {
+		if len(report.Server) > serverWidth {
+			serverWidth = len(report.Server)
+		}
+	}
+
+	fmt.Fprintf(bufWriter, "%-*s %10s %10s %10s %10s %10s %10s %8s\n", serverWidth, "Server",
+		"Requests", "Req/s", "MB/s", "p50[ms]", "p95[ms]", "p99[ms]", "Errors")
+
+	for _, report := range reports {
+		fmt.Fprintf(bufWriter, "%-*s %10d %10.1f %10.2f %10.2f %10.2f %10.2f %7.2f%%",
+			serverWidth, report.Server, report.Requests, report.RequestsPerSec, report.MBPerSec,
+			report.P50Ms, report.P95Ms, report.P99Ms, report.ErrorRate*100)
+
+		if report.IsSlow {
+			fmt.Fprint(bufWriter, "  SLOW")
+		}
+
+		fmt.Fprintln(bufWriter)
+	}
+}
+
+// PrintReportOnExit writes the server report to stdout on SIGINT or SIGTERM and exits
+func PrintReportOnExit() {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+
+	<-signalChan
+
+	fmt.Println("\n=== Server report")
+	WriteServerReport(os.Stdout)
+
+	os.Exit(0)
+}
+
+// ReportHandler is the admin handler that returns the server report as table (default) or in JSON
+// format ("format=json")
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		WriteServerReport(w)
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(BuildServerReports())
+	default:
+		http.Error(w, "Unknown format: "+r.URL.Query().Get("format"), http.StatusBadRequest)
+	}
+}
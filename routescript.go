@@ -0,0 +1,102 @@
+// Routing decisions by a user-provided expression (see https://expr-lang.org for the language)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"net/http"
+	"os"
+)
+
+// RouteEnv is the environment that routing scripts can access
+type RouteEnv struct {
+	Method     string   `expr:"method"`
+	Host       string   `expr:"host"`
+	Path       string   `expr:"path"`
+	Query      string   `expr:"query"`
+	ClientIP   string   `expr:"clientIP"`
+	RequestNum int      `expr:"requestNum"`
+	Servers    []string `expr:"servers"` // server strings in the order of the command line
+
+	header http.Header
+}
+
+// Header returns the first value of the given request header; available as "Header(NAME)"
+func (env RouteEnv) Header(name string) string {
+	return env.header.Get(name)
+}
+
+// LoadRouteScript compiles the routing expression from the given file. The expression returns the
+// index of the server, the server string, the name of a server pool or nil for default round-robin
+// selection.
+func LoadRouteScript(path string) (*vm.Program, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	program, err := expr.Compile(string(src), expr.Env(RouteEnv{}))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid routing script: %s; Error: %w", path, err)
+	}
+
+	return program, nil
+}
+
+// RouteRequest runs the routing script for the given request and returns the index of the selected
+// backend. ok is false for default round-robin selection, also if the script selected a server that
+// is ejected or was removed from its SRV record, because the request would fail on it.
+func RouteRequest(r *http.Request, requestNum uint64) (backendIdx uint32, ok bool, err error) {
+	env := RouteEnv{
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		ClientIP:   ClientIP(r),
+		RequestNum: int(requestNum),
+		Servers:    make([]string, len(proxyState.backends)),
+		header:     r.Header,
+	}
+
+	for i, backend := range proxyState.backends {
+		env.Servers[i] = backend.serverStr
+	}
+
+	result, err := expr.Run(proxyState.routeScript, env)
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch result := result.(type) {
+	case nil:
+		return 0, false, nil
+	case int:
+		if result < 0 || result >= len(proxyState.backends) {
+			return 0, false, fmt.Errorf("Routing script returned invalid server index: %d", result)
+		}
+
+		return uint32(result), isRoutable(uint32(result)), nil
+	case string:
+		if backendIdx, exists := FindBackend(result); exists {
+			return backendIdx, isRoutable(backendIdx), nil
+		}
+
+		if _, backendIdx, exists := SelectPoolBackend(result, r); exists {
+			return backendIdx, true, nil
+		}
+
+		return 0, false, errors.New("Routing script returned unknown server or pool: " + result)
+	default:
+		return 0, false, fmt.Errorf("Routing script returned invalid type: %T", result)
+	}
+}
+
+// isRoutable returns true if the server selected by the routing script can serve requests
+func isRoutable(backendIdx uint32) bool {
+	backend := proxyState.backends[backendIdx]
+
+	return !backend.IsEjected() && !backend.IsRemoved()
+}
@@ -0,0 +1,61 @@
+// Response headers which advertise the available servers, so that capable clients can connect to
+// them directly
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	ServerHintsAltSvc = "altsvc" // standard "Alt-Svc" header
+	ServerHintsHeader = "header" // "X-ProxPerfect-Servers" header with server URLs
+)
+
+// ServerHintsMaxAge is the time in seconds for which clients may use the advertised servers
+const ServerHintsMaxAge = 60
+
+// serverHints is the precomputed header value; updated on changes of server weights
+var serverHints atomic.Value // string
+
+// UpdateServerHints computes the header value from the servers of the balancer of all servers that
+// have an effective weight, so that ejected and removed servers don't get advertised
+func UpdateServerHints(servers []BalancerServer) {
+	var hints []string
+
+	for _, server := range servers {
+		if server.Weight == 0 {
+			continue
+		}
+
+		backend := proxyState.backends[server.BackendIdx]
+
+		if config.serverHints == ServerHintsAltSvc {
+			// the protocol of the server is unknown, so only HTTP/1.1 can be assumed
+			hints = append(hints, "http/1.1=\""+targetHostPort(backend.targetURL)+"\"; ma="+strconv.Itoa(ServerHintsMaxAge))
+		} else {
+			hintURL := url.URL{Scheme: backend.targetURL.Scheme, Host: backend.targetURL.Host}
+			hints = append(hints, hintURL.String()) // escapes zone of IPv6 literal
+		}
+	}
+
+	serverHints.Store(strings.Join(hints, ", "))
+}
+
+// AddServerHints adds the header with the available servers to the response
+func AddServerHints(header http.Header) {
+	hints, _ := serverHints.Load().(string)
+	if hints == "" {
+		return
+	}
+
+	if config.serverHints == ServerHintsAltSvc {
+		header.Set("Alt-Svc", hints)
+	} else {
+		header["X-ProxPerfect-Servers"] = []string{hints} // direct assignment to keep the casing
+	}
+}
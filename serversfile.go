@@ -0,0 +1,133 @@
+// Server lists from a file with templates, which expand numeric ranges and alternatives
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxTemplateExpansions limits the number of servers of a single template
+const MaxTemplateExpansions = 10000
+
+// templateRangeRegex matches numeric ranges like "[1-16]" or "[01-16]" (zero-padded), but not IPv6
+// literals like "[::1]"
+var templateRangeRegex = regexp.MustCompile(`\[(\d+)-(\d+)\]`)
+
+// templateAltRegex matches alternatives like "{a,b,c}"
+var templateAltRegex = regexp.MustCompile(`\{([^{}]*,[^{}]*)\}`)
+
+// ExpandServerTemplate returns all server strings of the given template in order of the template,
+// e.g. "http://10.0.0.[1-2]:{80,81}" expands to "http://10.0.0.1:80", "http://10.0.0.1:81",
+// "http://10.0.0.2:80" and "http://10.0.0.2:81".
+func ExpandServerTemplate(template string) ([]string, error) {
+	var alternatives []string
+	var matchLoc []int
+
+	rangeLoc := templateRangeRegex.FindStringSubmatchIndex(template)
+	altLoc := templateAltRegex.FindStringSubmatchIndex(template)
+
+	switch {
+	case rangeLoc == nil && altLoc == nil:
+		return []string{template}, nil
+	case altLoc == nil || (rangeLoc != nil && rangeLoc[0] < altLoc[0]):
+		matchLoc = rangeLoc
+
+		firstStr := template[rangeLoc[2]:rangeLoc[3]]
+		lastStr := template[rangeLoc[4]:rangeLoc[5]]
+
+		first, _ := strconv.ParseUint(firstStr, 10, 32)
+		last, _ := strconv.ParseUint(lastStr, 10, 32)
+
+		if first > last || last-first >= MaxTemplateExpansions {
+			return nil, fmt.Errorf("Invalid range in server template: %s", template)
+		}
+
+		var format = "%d"
+		if len(firstStr) > 1 && firstStr[0] == '0' {
+			format = "%0" + strconv.Itoa(len(firstStr)) + "d"
+		}
+
+		for num := first; num <= last; num++ {
+			alternatives = append(alternatives, fmt.Sprintf(format, num))
+		}
+	default:
+		matchLoc = altLoc
+		alternatives = strings.Split(template[altLoc[2]:altLoc[3]], ",")
+	}
+
+	var expanded []string
+
+	for _, alternative := range alternatives {
+		subExpanded, err := ExpandServerTemplate(template[:matchLoc[0]] + alternative + template[matchLoc[1]:])
+		if err != nil {
+			return nil, err
+		}
+
+		expanded = append(expanded, subExpanded...)
+
+		if len(expanded) > MaxTemplateExpansions {
+			return nil, fmt.Errorf("Server template expands to more than %d servers: %s", MaxTemplateExpansions, template)
+		}
+	}
+
+	return expanded, nil
+}
+
+// LoadServersFile returns the servers of the given file. Each line contains a server template.
+// Lines starting with "!" contain a template of servers to exclude. Empty lines and lines starting
+// with "#" are ignored.
+func LoadServersFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var servers []string
+	var excludedServers = make(map[string]bool)
+
+	scanner := bufio.NewScanner(file)
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		isExclude := strings.HasPrefix(line, "!")
+
+		expanded, err := ExpandServerTemplate(strings.TrimSpace(strings.TrimPrefix(line, "!")))
+		if err != nil {
+			return nil, fmt.Errorf("%w; File: %s; Line: %d", err, path, lineNum)
+		}
+
+		if isExclude {
+			for _, server := range expanded {
+				excludedServers[server] = true
+			}
+		} else {
+			servers = append(servers, expanded...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var includedServers []string
+
+	for _, server := range servers {
+		if !excludedServers[server] {
+			includedServers = append(includedServers, server)
+		}
+	}
+
+	return includedServers, nil
+}
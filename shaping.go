@@ -0,0 +1,202 @@
+// Artificial degradation of servers for experiments: Requests to a server can get a fixed added
+// latency, and its share of requests can get reduced, to study how client workloads respond to a
+// degraded node without actually degrading it. Changed at runtime through the admin interface.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FullSharePercent is the share of a server without reduction, i.e. requests according to its weight
+const FullSharePercent = 100
+
+// shapingMutex serializes changes, so that concurrent changes don't interleave their printouts and
+// schedule updates
+var shapingMutex sync.Mutex
+
+// ShapingStats are the current artificial degradation of a server
+type ShapingStats struct {
+	Server       string `json:"server"`
+	Delay        string `json:"delay"`        // added latency of each request, e.g. "100ms"
+	SharePercent uint32 `json:"sharePercent"` // of the requests according to the weight
+}
+
+// ShapeDelay returns the artificial latency of requests to the server
+func (backend *Backend) ShapeDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&backend.shapeDelay))
+}
+
+// SharePercent returns the share of requests of the server relative to its weight
+func (backend *Backend) SharePercent() uint32 {
+	return atomic.LoadUint32(&backend.sharePercent)
+}
+
+// IsShaped returns true if the server has artificial latency or reduced share
+func (backend *Backend) IsShaped() bool {
+	return backend.ShapeDelay() != 0 || backend.SharePercent() != FullSharePercent
+}
+
+// ApplyShareShaping scales the weights of the given servers by their share percentages if any of them
+// has a reduced share, so that a reduction also works for servers with small weights. Returns the
+// new total weight.
+func ApplyShareShaping(servers []BalancerServer) uint64 {
+	var isReduced bool
+	var totalWeight uint64
+
+	for _, server := range servers {
+		if proxyState.backends[server.BackendIdx].SharePercent() != FullSharePercent {
+			isReduced = true
+		}
+
+		totalWeight += uint64(server.Weight)
+	}
+
+	if !isReduced {
+		return totalWeight
+	}
+
+	totalWeight = 0
+
+	for i := range servers {
+		weight := uint64(servers[i].Weight) * uint64(proxyState.backends[servers[i].BackendIdx].SharePercent())
+		if weight > math.MaxUint32 {
+			weight = math.MaxUint32
+		}
+
+		servers[i].Weight = uint32(weight)
+		totalWeight += weight
+	}
+
+	return totalWeight
+}
+
+// WaitShapeDelay waits for the artificial latency of the server before a request gets forwarded.
+// Returns false if the request was canceled during the wait.
+func (backend *Backend) WaitShapeDelay(ctx context.Context) bool {
+	delay := backend.ShapeDelay()
+	if delay == 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// GetShapingStats returns the current shaping of the server
+func (backend *Backend) GetShapingStats() ShapingStats {
+	return ShapingStats{
+		Server:       backend.serverStr,
+		Delay:        backend.ShapeDelay().String(),
+		SharePercent: backend.SharePercent(),
+	}
+}
+
+// ShapeHandler is the admin interface handler to query (GET), change (POST) or reset (DELETE) the
+// artificial degradation of the server with the given index or server string in query parameter
+// "server", or of all servers. POST takes query parameters "delay" (added latency, e.g. "100ms")
+// and "share" (percentage of the requests according to the weight, e.g. "50"); parameters that are
+// not given keep their current value.
+func ShapeHandler(w http.ResponseWriter, r *http.Request) {
+	shapingMutex.Lock()
+	defer shapingMutex.Unlock()
+
+	var query = r.URL.Query()
+	var backends = proxyState.backends
+
+	if serverParam := query.Get("server"); serverParam != "" {
+		backendIdx, exists := FindBackend(serverParam)
+		if !exists {
+			http.Error(w, "Unknown server: "+serverParam, http.StatusBadRequest)
+			return
+		}
+
+		backends = backends[backendIdx : backendIdx+1]
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		var delay time.Duration
+		var sharePercent = uint64(FullSharePercent)
+
+		// DELETE resets both parameters, POST only changes the given parameters
+		var isDelaySet = r.Method == http.MethodDelete
+		var isShareSet = r.Method == http.MethodDelete
+
+		if r.Method == http.MethodPost {
+			var err error
+
+			if delayParam := query.Get("delay"); delayParam != "" {
+				delay, err = time.ParseDuration(delayParam)
+				if err != nil || delay < 0 {
+					http.Error(w, "Invalid delay: \""+delayParam+"\"", http.StatusBadRequest)
+					return
+				}
+
+				isDelaySet = true
+			}
+
+			if shareParam := query.Get("share"); shareParam != "" {
+				sharePercent, err = strconv.ParseUint(shareParam, 10, 32)
+				if err != nil || sharePercent > FullSharePercent {
+					http.Error(w, "Invalid share percentage: \""+shareParam+"\"", http.StatusBadRequest)
+					return
+				}
+
+				isShareSet = true
+			}
+		}
+
+		var isShareChanged bool
+
+		for _, backend := range backends {
+			if isDelaySet {
+				atomic.StoreInt64(&backend.shapeDelay, int64(delay))
+			}
+
+			if isShareSet &&
+				atomic.SwapUint32(&backend.sharePercent, uint32(sharePercent)) != uint32(sharePercent) {
+				isShareChanged = true
+			}
+
+			fmt.Printf("Changed shaping through admin interface. Server: %s; Delay: %v; Share: %d%%\n",
+				backend.serverStr, backend.ShapeDelay(), backend.SharePercent())
+		}
+
+		if isShareChanged {
+			UpdateSchedule()
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// reply with current state
+	var shaping []ShapingStats
+
+	for _, backend := range backends {
+		shaping = append(shaping, backend.GetShapingStats())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(shaping)
+}
@@ -0,0 +1,156 @@
+// Sharding of the object namespace by hash ranges: The 32-bit hash space of request paths is
+// partitioned into explicit ranges, each of which is mapped to a server. The shard map can be
+// printed, saved to a file and edited to move ranges between servers, so that the distribution is
+// reproducible and re-shardable.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ShardRange is a range of path hashes that is mapped to a server
+type ShardRange struct {
+	first      uint32
+	last       uint32 // inclusive
+	backendIdx uint32 // index in proxyState.backends
+}
+
+// ShardKeyHash returns the hash of an object path for the shard map (32-bit FNV-1a)
+func ShardKeyHash(path string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(path))
+
+	return hash.Sum32()
+}
+
+// NewEvenShardMap partitions the hash space into ranges of equal size, which get assigned to the
+// servers round-robin
+func NewEvenShardMap(numShards int, numBackends int) []ShardRange {
+	var shardMap = make([]ShardRange, numShards)
+	var rangeSize = (uint64(1) << 32) / uint64(numShards)
+
+	for i := range shardMap {
+		shardMap[i] = ShardRange{
+			first:      uint32(uint64(i) * rangeSize),
+			last:       uint32(uint64(i+1)*rangeSize - 1),
+			backendIdx: uint32(i % numBackends),
+		}
+	}
+
+	shardMap[numShards-1].last = ^uint32(0) // remainder of the division
+
+	return shardMap
+}
+
+// LoadShardMap reads a shard map file. Each line has the format "FIRST-LAST SERVER", where FIRST and
+// LAST are hex hash values and SERVER is the server index or server string. The ranges need to cover
+// the whole hash space without overlap. Text after "#" is a comment.
+func LoadShardMap(path string) ([]ShardRange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var shardMap []ShardRange
+
+	scanner := bufio.NewScanner(file)
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: Invalid number of fields", path, lineNum)
+		}
+
+		firstStr, lastStr, isRange := strings.Cut(fields[0], "-")
+
+		first, firstErr := strconv.ParseUint(firstStr, 16, 32)
+		last, lastErr := strconv.ParseUint(lastStr, 16, 32)
+
+		if !isRange || firstErr != nil || lastErr != nil || first > last {
+			return nil, fmt.Errorf("%s:%d: Invalid hash range: %s", path, lineNum, fields[0])
+		}
+
+		backendIdx, exists := FindBackend(fields[1])
+		if !exists {
+			return nil, fmt.Errorf("%s:%d: Unknown server: %s", path, lineNum, fields[1])
+		}
+
+		shardMap = append(shardMap, ShardRange{first: uint32(first), last: uint32(last), backendIdx: backendIdx})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(shardMap, func(i, j int) bool { return shardMap[i].first < shardMap[j].first })
+
+	// check full coverage of the hash space
+	var nextFirst uint64
+
+	for _, shard := range shardMap {
+		if uint64(shard.first) != nextFirst {
+			return nil, fmt.Errorf("%s: Hash ranges have gap or overlap at %08x", path, shard.first)
+		}
+
+		nextFirst = uint64(shard.last) + 1
+	}
+
+	if nextFirst != uint64(1)<<32 {
+		return nil, fmt.Errorf("%s: Hash ranges don't cover the hash space up to ffffffff", path)
+	}
+
+	return shardMap, nil
+}
+
+// FormatShardMap returns the shard map in the format of the shard map file
+func FormatShardMap(shardMap []ShardRange) string {
+	var builder strings.Builder
+
+	for _, shard := range shardMap {
+		fmt.Fprintf(&builder, "%08x-%08x %d # %s\n", shard.first, shard.last, shard.backendIdx,
+			proxyState.backends[shard.backendIdx].serverStr)
+	}
+
+	return builder.String()
+}
+
+// ShardBackend returns the index of the server that is responsible for the given object path
+func ShardBackend(path string) uint32 {
+	var hash = ShardKeyHash(path)
+	var shardMap = proxyState.shardMap
+
+	var i = sort.Search(len(shardMap), func(i int) bool { return shardMap[i].last >= hash })
+
+	return shardMap[i].backendIdx
+}
+
+// ShardMapHandler is the admin interface handler that prints the shard map
+func ShardMapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if proxyState.shardMap == nil {
+		http.Error(w, "Sharding disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, FormatShardMap(proxyState.shardMap))
+}
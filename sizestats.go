@@ -0,0 +1,134 @@
+// Distributions of request and response body sizes per server and per route, to understand the
+// composition of the workload that flows through the proxy
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// sizeBuckets are the upper bounds of the size histogram buckets in bytes. The first bucket counts
+// empty bodies.
+var sizeBuckets = []uint64{0, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20,
+	16 << 20, 64 << 20, 256 << 20, 1 << 30}
+
+// SizeHistogram is a lock-free histogram of body sizes
+type SizeHistogram struct {
+	bucketCounts []uint64 // atomic; one more than sizeBuckets for "+Inf"
+	sum          uint64   // atomic
+	count        uint64   // atomic
+}
+
+func NewSizeHistogram() *SizeHistogram {
+	return &SizeHistogram{bucketCounts: make([]uint64, len(sizeBuckets)+1)}
+}
+
+// Observe adds a body size to the histogram
+func (histogram *SizeHistogram) Observe(numBytes uint64) {
+	var bucketIdx = len(sizeBuckets)
+
+	for i, upperBound := range sizeBuckets {
+		if numBytes <= upperBound {
+			bucketIdx = i
+			break
+		}
+	}
+
+	atomic.AddUint64(&histogram.bucketCounts[bucketIdx], 1)
+	atomic.AddUint64(&histogram.sum, numBytes)
+	atomic.AddUint64(&histogram.count, 1)
+}
+
+// SizeHistogramStats is the JSON representation of a size histogram
+type SizeHistogramStats struct {
+	Count   uint64            `json:"count"`
+	Sum     uint64            `json:"sum"`
+	Buckets map[string]uint64 `json:"buckets"` // key is upper bound in bytes or "+Inf"; not cumulative
+}
+
+func (histogram *SizeHistogram) Stats() SizeHistogramStats {
+	stats := SizeHistogramStats{
+		Count:   atomic.LoadUint64(&histogram.count),
+		Sum:     atomic.LoadUint64(&histogram.sum),
+		Buckets: make(map[string]uint64),
+	}
+
+	for i := range histogram.bucketCounts {
+		stats.Buckets[sizeBucketLabel(i)] = atomic.LoadUint64(&histogram.bucketCounts[i])
+	}
+
+	return stats
+}
+
+func sizeBucketLabel(bucketIdx int) string {
+	if bucketIdx < len(sizeBuckets) {
+		return strconv.FormatUint(sizeBuckets[bucketIdx], 10)
+	}
+
+	return formatFloat(math.Inf(1))
+}
+
+// StatsRoute is a group of requests by path for size stats
+type StatsRoute struct {
+	name          string
+	pathPattern   string // a trailing "*" matches any suffix
+	requestSizes  *SizeHistogram
+	responseSizes *SizeHistogram
+}
+
+// OtherStatsRouteName is the route of requests that don't match any configured route
+const OtherStatsRouteName = "other"
+
+// ParseStatsRoutes parses a comma-separated list of "[NAME=]PATH_PATTERN" and appends the route for
+// all other requests
+func ParseStatsRoutes(routesStr string) []*StatsRoute {
+	var routes []*StatsRoute
+
+	for _, routeStr := range strings.Split(routesStr, ",") {
+		name, pathPattern, hasName := strings.Cut(routeStr, "=")
+		if !hasName {
+			pathPattern = name
+		}
+
+		routes = append(routes, NewStatsRoute(name, pathPattern))
+	}
+
+	return append(routes, NewStatsRoute(OtherStatsRouteName, "*"))
+}
+
+func NewStatsRoute(name string, pathPattern string) *StatsRoute {
+	return &StatsRoute{
+		name:          name,
+		pathPattern:   pathPattern,
+		requestSizes:  NewSizeHistogram(),
+		responseSizes: NewSizeHistogram(),
+	}
+}
+
+// MatchStatsRoute returns the first route that matches the path of the request
+func MatchStatsRoute(r *http.Request) *StatsRoute {
+	for _, route := range proxyState.statsRoutes {
+		if MatchPathPattern(route.pathPattern, r.URL.Path) {
+			return route
+		}
+	}
+
+	return nil // can't happen, the last route matches everything
+}
+
+// ObserveBodySizes adds the body sizes of a proxied request to the stats of the server and the route
+func ObserveBodySizes(backend *Backend, r *http.Request, requestBytes uint64, responseBytes uint64) {
+	backend.requestSizes.Observe(requestBytes)
+	backend.responseSizes.Observe(responseBytes)
+
+	if proxyState.statsRoutes != nil {
+		route := MatchStatsRoute(r)
+
+		route.requestSizes.Observe(requestBytes)
+		route.responseSizes.Observe(responseBytes)
+	}
+}
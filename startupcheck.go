@@ -0,0 +1,127 @@
+// Reachability check of the servers at startup
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// StartupCheckTimeout is the timeout for the check of each server
+const StartupCheckTimeout = 10 * time.Second
+
+const (
+	StartupCheckWarn = "warn" // print warning for unreachable servers
+	StartupCheckDrop = "drop" // remove unreachable servers from the list of servers
+)
+
+// CheckBackend connects to the server or, if config.healthPath is set, sends a GET request for the
+// health path, which must not fail with a server error status
+func CheckBackend(backend *Backend) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StartupCheckTimeout)
+	defer cancel()
+
+	if config.healthPath == "" {
+		conn, err := backend.transport.DialContext(ctx, "tcp", targetHostPort(backend.targetURL))
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	healthURL := *backend.targetURL
+	healthURL.Path = config.healthPath
+	healthURL.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := backend.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return errors.New("Health check failed with status: " + resp.Status)
+	}
+
+	return nil
+}
+
+// CheckBackends checks all servers concurrently. Unreachable servers get reported and, depending on
+// config, removed or cause exit.
+func CheckBackends() {
+	var checkErrors = make([]error, len(proxyState.backends))
+	var waitGroup sync.WaitGroup
+
+	for i, backend := range proxyState.backends {
+		waitGroup.Add(1)
+
+		go func(i int, backend *Backend) {
+			defer waitGroup.Done()
+
+			checkErrors[i] = CheckBackend(backend)
+		}(i, backend)
+	}
+
+	waitGroup.Wait()
+
+	var reachableBackends []*Backend
+
+	for i, backend := range proxyState.backends {
+		if checkErrors[i] == nil {
+			if config.beVerbose {
+				fmt.Println("Startup check succeeded. Server:", backend.serverStr)
+			}
+
+			reachableBackends = append(reachableBackends, backend)
+			continue
+		}
+
+		if config.requireAllBackends {
+			fmt.Printf("ERROR: Server unreachable: %s; Error: %v\n", backend.serverStr, checkErrors[i])
+			os.Exit(1)
+		}
+
+		fmt.Printf("WARNING: Server unreachable: %s; Error: %v\n", backend.serverStr, checkErrors[i])
+	}
+
+	if config.startupCheck != StartupCheckDrop || len(reachableBackends) == len(proxyState.backends) {
+		return
+	}
+
+	if len(reachableBackends) == 0 {
+		fmt.Println("ERROR: No reachable servers left.")
+		os.Exit(1)
+	}
+
+	if config.quorumSize > len(reachableBackends) {
+		fmt.Printf("ERROR: Quorum size exceeds number of reachable servers. (Quorum: %d; Servers: %d)\n", config.quorumSize, len(reachableBackends))
+		os.Exit(1)
+	}
+
+	fmt.Printf("Removed unreachable servers. Remaining servers: %d\n", len(reachableBackends))
+
+	proxyState.backends = reachableBackends
+
+	// for everything that is based on the given servers, e.g. "--printconfig" and "--fdlimit auto"
+	config.proxyStrings = make([]string, len(reachableBackends))
+
+	for i, backend := range reachableBackends {
+		config.proxyStrings[i] = backend.serverStr
+	}
+
+	if config.fdLimitAuto {
+		config.fdLimit = ComputeOpenFilesLimit()
+	}
+}
@@ -0,0 +1,123 @@
+// Dump of the proxy state to diagnose hangs in production: in-flight requests and connection slot
+// waiters per server, the list of active requests with their ages and the stacks of all
+// goroutines. The dump gets written to stdout on SIGQUIT or returned by the admin interface.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ActiveRequest is a client request that is currently being handled by the proxy
+type ActiveRequest struct {
+	request *http.Request
+	state   *RequestState
+}
+
+// activeRequests maps the request number to the *ActiveRequest of all requests in the middleware chain
+var activeRequests sync.Map
+
+// stateDumpMutex serializes state dumps, so that concurrent dumps to stdout don't interleave
+var stateDumpMutex sync.Mutex
+
+// WriteStateDump writes the current state of servers, active requests and goroutines in text form
+func WriteStateDump(writer io.Writer) {
+	stateDumpMutex.Lock()
+	defer stateDumpMutex.Unlock()
+
+	bufWriter := bufio.NewWriter(writer)
+	defer bufWriter.Flush()
+
+	now := time.Now()
+
+	fmt.Fprintf(bufWriter, "=== ProxPerfect state dump at %s\n", now.Format(time.RFC3339Nano))
+
+	fmt.Fprintf(bufWriter, "\n=== Servers\n")
+
+	for backendIdx, backend := range proxyState.backends {
+		fmt.Fprintf(bufWriter, "%d: %s: In flight: %d; Requests: %d", backendIdx, backend.serverStr,
+			atomic.LoadInt64(&backend.numInFlight), atomic.LoadUint64(&backend.numRequests))
+
+		if backend.connLimiter != nil {
+			numActive, numWaiting := backend.connLimiter.Usage()
+
+			fmt.Fprintf(bufWriter, "; Connection slots: %d/%d; Waiting:", numActive,
+				backend.connLimiter.Limit())
+
+			for priority := NumPriorities - 1; priority >= 0; priority-- {
+				fmt.Fprintf(bufWriter, " %s=%d", priorityNames[priority], numWaiting[priority])
+			}
+		}
+
+		fmt.Fprintln(bufWriter)
+	}
+
+	var requests []*ActiveRequest
+
+	activeRequests.Range(func(key, value interface{}) bool {
+		requests = append(requests, value.(*ActiveRequest))
+		return true
+	})
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].state.startTime.Before(requests[j].state.startTime) // oldest first
+	})
+
+	fmt.Fprintf(bufWriter, "\n=== Active requests: %d\n", len(requests))
+
+	for _, activeRequest := range requests {
+		var serverStr = "(not forwarded)"
+
+		if backend, isForwarded := activeRequest.state.forwardedTo.Load().(*Backend); isForwarded {
+			serverStr = backend.serverStr
+		}
+
+		fmt.Fprintf(bufWriter, "#%d: Age: %v; Client: %s; Server: %s; %s %s\n",
+			activeRequest.state.requestNum, now.Sub(activeRequest.state.startTime).Round(time.Millisecond),
+			ClientIP(activeRequest.request), serverStr, activeRequest.request.Method,
+			activeRequest.request.URL.RequestURI())
+	}
+
+	fmt.Fprintf(bufWriter, "\n=== Goroutines: %d\n", runtime.NumGoroutine())
+
+	if err := pprof.Lookup("goroutine").WriteTo(bufWriter, 2); err != nil {
+		fmt.Fprintln(bufWriter, "ERROR: Writing goroutine stacks failed:", err)
+	}
+
+	fmt.Fprintf(bufWriter, "=== End of state dump\n")
+}
+
+// DumpStateOnSignal writes a state dump to stdout on each SIGQUIT. This replaces the default
+// behavior of the Go runtime, which is to print the goroutine stacks and exit.
+func DumpStateOnSignal() {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGQUIT)
+
+	for range signalChan {
+		WriteStateDump(os.Stdout)
+	}
+}
+
+// DumpHandler is the admin handler that returns a state dump
+func DumpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	WriteStateDump(w)
+}
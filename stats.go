@@ -0,0 +1,196 @@
+// Stats endpoint of the admin interface and helpers for accounting of proxied traffic
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Stats is the JSON document served by the "/stats" endpoint
+type Stats struct {
+	NumRequests        uint64                 `json:"requests"`
+	QuorumDivergences  uint64                 `json:"quorumDivergences"`
+	ChecksumMismatches uint64                 `json:"checksumMismatches"`
+	QueuedCancels      uint64                 `json:"queuedCancels"`   // client gone while waiting for a connection slot
+	UpstreamCancels    uint64                 `json:"upstreamCancels"` // client gone during the server request
+	ClientConns        ClientConnStats        `json:"clientConns"`
+	Schedule           ScheduleStats          `json:"schedule"`
+	Inspections        *InspectionStats       `json:"inspections,omitempty"` // nil if inspection disabled
+	Cache              *CacheStats            `json:"cache,omitempty"`       // nil if cache disabled
+	Tenants            map[string]TenantStats `json:"tenants,omitempty"`
+	Servers            []ServerStats          `json:"servers"`
+	Routes             []RouteStats           `json:"routes,omitempty"`
+}
+
+// ServerStats are the stats of a single backend
+type ServerStats struct {
+	Server        string             `json:"server"`
+	Weight        uint32             `json:"weight"`
+	Pool          string             `json:"pool"`
+	Errors        map[string]uint64  `json:"errors"` // key is error class
+	RequestSizes  SizeHistogramStats `json:"requestSizes"`
+	ResponseSizes SizeHistogramStats `json:"responseSizes"`
+	Health        *HealthStats       `json:"health,omitempty"`  // nil if health scoring disabled
+	Shaping       *ShapingStats      `json:"shaping,omitempty"` // nil if not artificially degraded
+}
+
+// RouteStats are the stats of a route of "--statsroutes"
+type RouteStats struct {
+	Route         string             `json:"route"`
+	RequestSizes  SizeHistogramStats `json:"requestSizes"`
+	ResponseSizes SizeHistogramStats `json:"responseSizes"`
+}
+
+// StatsHandler serves the current stats in JSON format
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := Stats{
+		NumRequests:        atomic.LoadUint64(&proxyState.requestNum),
+		QuorumDivergences:  atomic.LoadUint64(&proxyState.quorumDivergences),
+		ChecksumMismatches: atomic.LoadUint64(&proxyState.checksumMismatches),
+		QueuedCancels:      atomic.LoadUint64(&proxyState.queuedCancels),
+		UpstreamCancels:    atomic.LoadUint64(&proxyState.upstreamCancels),
+		ClientConns:        GetClientConnStats(),
+		Schedule:           GetScheduleStats(),
+	}
+
+	if config.inspectURL != "" {
+		inspections := GetInspectionStats()
+		stats.Inspections = &inspections
+	}
+
+	if config.cacheSize > 0 {
+		cacheStats := GetCacheStats()
+		stats.Cache = &cacheStats
+	}
+
+	if len(proxyState.tenants) != 0 {
+		stats.Tenants = make(map[string]TenantStats)
+
+		for _, tenant := range proxyState.tenants {
+			stats.Tenants[tenant.name] = tenant.Stats()
+		}
+	}
+
+	for _, backend := range proxyState.backends {
+		serverStats := ServerStats{
+			Server:        backend.serverStr,
+			Weight:        backend.Weight(),
+			Pool:          backend.pool,
+			Errors:        backend.ErrorCounts(),
+			RequestSizes:  backend.requestSizes.Stats(),
+			ResponseSizes: backend.responseSizes.Stats(),
+			Health:        backend.HealthStats(),
+		}
+
+		if backend.IsShaped() {
+			shaping := backend.GetShapingStats()
+			serverStats.Shaping = &shaping
+		}
+
+		stats.Servers = append(stats.Servers, serverStats)
+	}
+
+	for _, route := range proxyState.statsRoutes {
+		stats.Routes = append(stats.Routes, RouteStats{
+			Route:         route.name,
+			RequestSizes:  route.requestSizes.Stats(),
+			ResponseSizes: route.responseSizes.Stats(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(stats)
+}
+
+// NewAdminServeMux returns the request router for the admin interface
+func NewAdminServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/stats", StatsHandler)
+	mux.HandleFunc("/metrics", MetricsHandler)
+	mux.HandleFunc("/drain", DrainHandler)
+	mux.HandleFunc("/shardmap", ShardMapHandler)
+	mux.HandleFunc("/bufsize", BufSizeHandler)
+	mux.HandleFunc("/hdrhistogram", HdrHistogramHandler)
+	mux.HandleFunc("/dump", DumpHandler)
+	mux.HandleFunc("/closeidle", CloseIdleHandler)
+	mux.HandleFunc("/cachewarm", CacheWarmHandler)
+	mux.HandleFunc("/shape", ShapeHandler)
+	mux.HandleFunc("/report", ReportHandler)
+	mux.HandleFunc("/livez", LiveHandler)
+	mux.HandleFunc("/readyz", ReadyHandler)
+	mux.HandleFunc("/errortemplates", ErrorTemplatesHandler)
+
+	return mux
+}
+
+// countingReader wraps a request body to count the number of read bytes
+type countingReader struct {
+	io.ReadCloser
+	numBytes *uint64
+}
+
+func (reader *countingReader) Read(buf []byte) (int, error) {
+	numRead, err := reader.ReadCloser.Read(buf)
+
+	atomic.AddUint64(reader.numBytes, uint64(numRead))
+
+	return numRead, err
+}
+
+// countingResponseWriter wraps a http.ResponseWriter to count the number of written body bytes.
+// Flushing and hijacking (for protocol upgrades) are passed through to the wrapped writer.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	numBytes   *uint64
+	statusCode int // 0 until headers are written
+}
+
+func (writer *countingResponseWriter) WriteHeader(statusCode int) {
+	if writer.statusCode == 0 && statusCode >= http.StatusOK {
+		writer.statusCode = statusCode
+	}
+
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (writer *countingResponseWriter) Write(buf []byte) (int, error) {
+	numWritten, err := writer.ResponseWriter.Write(buf)
+
+	if writer.statusCode == 0 {
+		writer.statusCode = http.StatusOK
+	}
+
+	atomic.AddUint64(writer.numBytes, uint64(numWritten))
+
+	return numWritten, err
+}
+
+func (writer *countingResponseWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (writer *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := writer.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Wrapped response writer does not support hijacking")
+	}
+
+	return hijacker.Hijack()
+}
+
+// Unwrap allows http.ResponseController to access the wrapped writer
+func (writer *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
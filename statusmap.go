@@ -0,0 +1,85 @@
+// Rewriting of server response status codes, e.g. as protocol-compatibility shim during migrations
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// StatusRule maps a server status code to a different client status code for matching paths
+type StatusRule struct {
+	pathPattern string // empty matches all paths
+	fromCode    int
+	toCode      int
+}
+
+// ParseStatusRules parses a comma-separated list of rules in the format "[PATH_PATTERN:]FROM=TO",
+// e.g. "404=204,/probe/*:503=502"
+func ParseStatusRules(rulesStr string) ([]StatusRule, error) {
+	var rules []StatusRule
+
+	for _, ruleStr := range strings.Split(rulesStr, ",") {
+		var rule StatusRule
+
+		codesStr := ruleStr
+
+		if colonIdx := strings.LastIndex(ruleStr, ":"); colonIdx >= 0 {
+			rule.pathPattern = ruleStr[:colonIdx]
+			codesStr = ruleStr[colonIdx+1:]
+		}
+
+		fromStr, toStr, _ := strings.Cut(codesStr, "=")
+
+		var errFrom, errTo error
+
+		rule.fromCode, errFrom = strconv.Atoi(fromStr)
+		rule.toCode, errTo = strconv.Atoi(toStr)
+
+		if errFrom != nil || errTo != nil ||
+			rule.fromCode < 100 || rule.fromCode > 599 || rule.toCode < 100 || rule.toCode > 599 {
+			return nil, fmt.Errorf("Invalid status rule: %s", ruleStr)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// statusAllowsBody returns false for status codes that must not have a response body
+func statusAllowsBody(statusCode int) bool {
+	return statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
+
+// RewriteStatus applies the first matching status rule to the server response
+func RewriteStatus(resp *http.Response) {
+	for _, rule := range config.statusRules {
+		if resp.StatusCode != rule.fromCode ||
+			(rule.pathPattern != "" && !MatchPathPattern(rule.pathPattern, resp.Request.URL.Path)) {
+			continue
+		}
+
+		if config.beVerbose {
+			fmt.Printf("Rewriting response status: %s %s: %d => %d\n", resp.Request.Method, resp.Request.URL.String(), rule.fromCode, rule.toCode)
+		}
+
+		resp.StatusCode = rule.toCode
+		resp.Status = strconv.Itoa(rule.toCode) + " " + http.StatusText(rule.toCode)
+
+		// writing a body would fail for the new status code
+		if !statusAllowsBody(rule.toCode) {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // allows conn reuse for small bodies
+			resp.Body.Close()
+
+			resp.Body = http.NoBody
+			resp.ContentLength = 0
+			resp.Header.Del("Content-Length")
+		}
+
+		return
+	}
+}
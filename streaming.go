@@ -0,0 +1,145 @@
+// Idle timeouts for long-lived streaming responses and upgraded connections (e.g. WebSocket)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errIdleTimeout is returned by reads after an idle timeout. It is a net.Error timeout, so that it
+// gets classified as body timeout.
+type errIdleTimeout struct{}
+
+func (errIdleTimeout) Error() string   { return "Idle timeout of streaming response" }
+func (errIdleTimeout) Timeout() bool   { return true }
+func (errIdleTimeout) Temporary() bool { return false }
+
+// DefaultSSEIdleTimeout is the idle timeout for event streams in SSE mode if no stream idle timeout
+// was configured explicitly
+const DefaultSSEIdleTimeout = time.Hour
+
+// IsEventStreamRequest returns true if the client accepts a server-sent events stream
+func IsEventStreamRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// IsEventStreamResponse returns true for a server-sent events stream
+func IsEventStreamResponse(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	return mediaType == "text/event-stream"
+}
+
+// PrepareEventStreamResponse disables buffering of the event stream in the proxy and in downstream
+// proxies and applies the idle timeout for streams
+func PrepareEventStreamResponse(resp *http.Response, serverStr string) {
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	if resp.Header.Get("X-Accel-Buffering") == "" {
+		resp.Header.Set("X-Accel-Buffering", "no") // nginx and similar proxies downstream
+	}
+
+	var idleTimeout = config.streamIdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultSSEIdleTimeout
+	}
+
+	resp.Body = newIdleTimeoutBody(resp.Body, idleTimeout,
+		"Event stream from "+serverStr+": "+resp.Request.URL.RequestURI())
+}
+
+// IsStreamingResponse returns true for event streams and other responses of unknown length, which
+// the server might keep open indefinitely
+func IsStreamingResponse(resp *http.Response) bool {
+	return IsEventStreamResponse(resp) || resp.ContentLength < 0
+}
+
+// idleTimeoutBody closes the wrapped body if no data was transferred for the given timeout
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout    time.Duration
+	timer      *time.Timer
+	isTimedOut int32 // atomic, set by timer
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, description string) *idleTimeoutBody {
+	idleBody := &idleTimeoutBody{ReadCloser: body, timeout: timeout}
+
+	idleBody.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&idleBody.isTimedOut, 1)
+
+		if config.beVerbose {
+			fmt.Printf("Idle timeout: %s\n", description)
+		}
+
+		idleBody.ReadCloser.Close()
+	})
+
+	return idleBody
+}
+
+func (idleBody *idleTimeoutBody) Read(buf []byte) (int, error) {
+	numRead, err := idleBody.ReadCloser.Read(buf)
+
+	if atomic.LoadInt32(&idleBody.isTimedOut) != 0 {
+		return numRead, errIdleTimeout{}
+	}
+
+	idleBody.timer.Reset(idleBody.timeout)
+
+	return numRead, err
+}
+
+func (idleBody *idleTimeoutBody) Close() error {
+	idleBody.timer.Stop()
+
+	return idleBody.ReadCloser.Close()
+}
+
+// idleTimeoutConn is the server connection of an upgraded response, which gets closed if no data
+// was transferred in either direction for the given timeout
+type idleTimeoutConn struct {
+	*idleTimeoutBody
+	writer io.Writer
+}
+
+func (idleConn *idleTimeoutConn) Write(buf []byte) (int, error) {
+	numWritten, err := idleConn.writer.Write(buf)
+
+	if atomic.LoadInt32(&idleConn.isTimedOut) != 0 {
+		return numWritten, errIdleTimeout{}
+	}
+
+	idleConn.timer.Reset(idleConn.timeout)
+
+	return numWritten, err
+}
+
+// NewStreamIdleTimeoutBody returns the response body wrapped for config.streamIdleTimeout
+func NewStreamIdleTimeoutBody(resp *http.Response, serverStr string) io.ReadCloser {
+	return newIdleTimeoutBody(resp.Body, config.streamIdleTimeout,
+		"Stream from "+serverStr+": "+resp.Request.Method+" "+resp.Request.URL.RequestURI())
+}
+
+// NewUpgradeIdleTimeoutConn returns the server connection of an upgraded response wrapped for
+// config.upgradeIdleTimeout
+func NewUpgradeIdleTimeoutConn(resp *http.Response, serverStr string) (io.ReadWriteCloser, error) {
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return nil, errors.New("Upgraded response body is not writable")
+	}
+
+	return &idleTimeoutConn{
+		idleTimeoutBody: newIdleTimeoutBody(conn, config.upgradeIdleTimeout,
+			"Upgraded connection to "+serverStr+": "+resp.Request.URL.RequestURI()),
+		writer: conn,
+	}, nil
+}
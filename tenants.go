@@ -0,0 +1,221 @@
+// Per-tenant API keys with individual rate limits, concurrency caps and usage accounting
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/sync/semaphore"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TenantStats is the usage accounting of a single tenant
+type TenantStats struct {
+	NumRequests    uint64 `json:"requests"` // 64-bit atomics first for alignment on 32-bit archs
+	NumRejected    uint64 `json:"rejected"`
+	NumBytesIn     uint64 `json:"bytesIn"`
+	NumBytesOut    uint64 `json:"bytesOut"`
+	NumActiveConns int64  `json:"activeConns"`
+}
+
+type Tenant struct {
+	stats       TenantStats         // first field for alignment of 64-bit atomics
+	name        string              // used for log messages and stats instead of the secret key
+	rateLimiter *TokenBucket        // nil if no rate limit
+	connLimiter *semaphore.Weighted // nil if no concurrency limit
+}
+
+// TokenBucket is a thread-safe rate limiter with a burst size of one second worth of requests
+type TokenBucket struct {
+	mutex      sync.Mutex
+	rate       float64 // tokens per second
+	tokens     float64
+	lastRefill time.Time
+}
+
+func NewTokenBucket(rate float64) *TokenBucket {
+	return &TokenBucket{
+		rate:       rate,
+		tokens:     rate,
+		lastRefill: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket and returns false if no token was available
+func (bucket *TokenBucket) Allow() bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	now := time.Now()
+
+	bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * bucket.rate
+	bucket.lastRefill = now
+
+	var burstSize = bucket.rate
+	if burstSize < 1 {
+		burstSize = 1
+	}
+
+	if bucket.tokens > burstSize {
+		bucket.tokens = burstSize
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// LoadTenants reads the API keys file. Each line has the format:
+// "NAME KEY [REQUESTS_PER_SEC [MAX_CONCURRENT_REQUESTS]]", where empty lines and lines starting
+// with "#" are ignored and a limit of 0 means unlimited.
+func LoadTenants(path string) (map[string]*Tenant, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tenants := make(map[string]*Tenant)
+	scanner := bufio.NewScanner(file)
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("%s:%d: Invalid number of fields", path, lineNum)
+		}
+
+		tenant := &Tenant{name: fields[0]}
+
+		if len(fields) > 2 {
+			rate, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil || rate < 0 {
+				return nil, fmt.Errorf("%s:%d: Invalid rate limit: %s", path, lineNum, fields[2])
+			}
+
+			if rate > 0 {
+				tenant.rateLimiter = NewTokenBucket(rate)
+			}
+		}
+
+		if len(fields) > 3 {
+			numConns, err := strconv.ParseUint(fields[3], 10, 31)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: Invalid concurrency limit: %s", path, lineNum, fields[3])
+			}
+
+			if numConns > 0 {
+				tenant.connLimiter = semaphore.NewWeighted(int64(numConns))
+			}
+		}
+
+		if _, exists := tenants[fields[1]]; exists {
+			return nil, fmt.Errorf("%s:%d: Duplicate API key for tenant: %s", path, lineNum, tenant.name)
+		}
+
+		tenants[fields[1]] = tenant
+	}
+
+	return tenants, scanner.Err()
+}
+
+// AdmitTenantRequest looks up the tenant of the request by its API key and enforces the tenant's
+// limits. On success, the request body and the returned response writer are wrapped for usage
+// accounting and the caller has to call ReleaseRequest() when done. On failure, an error response
+// has already been sent and nil is returned.
+func AdmitTenantRequest(w http.ResponseWriter, r *http.Request) (*Tenant, http.ResponseWriter) {
+	tenant, exists := proxyState.tenants[r.Header.Get(config.apiKeyHeader)]
+	if !exists {
+		HTTPError(w, r, http.StatusUnauthorized, "Missing or invalid API key")
+		return nil, w
+	}
+
+	// the key is a credential for the proxy, not for the servers
+	r.Header.Del(config.apiKeyHeader)
+
+	atomic.AddUint64(&tenant.stats.NumRequests, 1)
+
+	if tenant.rateLimiter != nil && !tenant.rateLimiter.Allow() {
+		atomic.AddUint64(&tenant.stats.NumRejected, 1)
+		HTTPError(w, r, http.StatusTooManyRequests, "Rate limit exceeded for tenant "+tenant.name)
+		return nil, w
+	}
+
+	if tenant.connLimiter != nil {
+		if err := tenant.connLimiter.Acquire(r.Context(), 1); err != nil {
+			AbortCanceledRequest(w, r, err)
+			return nil, w
+		}
+	}
+
+	atomic.AddInt64(&tenant.stats.NumActiveConns, 1)
+
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingReader{ReadCloser: r.Body, numBytes: &tenant.stats.NumBytesIn}
+	}
+
+	return tenant, &countingResponseWriter{ResponseWriter: w, numBytes: &tenant.stats.NumBytesOut}
+}
+
+// RequestTenantName returns the name of the tenant of the request, e.g. to keep state of different
+// tenants apart. That's the admitted tenant, because the API key header is no longer available after
+// admission, or the tenant of the API key for requests that were not admitted yet (e.g. for stale
+// responses while no server is available). Returns an empty string without "--apikeys" or valid API
+// key.
+func RequestTenantName(r *http.Request) string {
+	if state, hasState := r.Context().Value(requestStateKey{}).(*RequestState); hasState && state.tenant != nil {
+		return state.tenant.name
+	}
+
+	if tenant, exists := proxyState.tenants[r.Header.Get(config.apiKeyHeader)]; exists {
+		return tenant.name
+	}
+
+	return ""
+}
+
+// TenantByName returns the tenant with the given name, or nil if there is none
+func TenantByName(name string) *Tenant {
+	for _, tenant := range proxyState.tenants {
+		if tenant.name == name {
+			return tenant
+		}
+	}
+
+	return nil
+}
+
+// ReleaseRequest releases the tenant's concurrency slot of a request from AdmitTenantRequest()
+func (tenant *Tenant) ReleaseRequest() {
+	atomic.AddInt64(&tenant.stats.NumActiveConns, -1)
+
+	if tenant.connLimiter != nil {
+		tenant.connLimiter.Release(1)
+	}
+}
+
+// Stats returns the tenant's usage accounting. The counters are loaded one by one, so that they
+// can be from slightly different points in time while requests are active.
+func (tenant *Tenant) Stats() TenantStats {
+	return TenantStats{
+		NumRequests:    atomic.LoadUint64(&tenant.stats.NumRequests),
+		NumRejected:    atomic.LoadUint64(&tenant.stats.NumRejected),
+		NumBytesIn:     atomic.LoadUint64(&tenant.stats.NumBytesIn),
+		NumBytesOut:    atomic.LoadUint64(&tenant.stats.NumBytesOut),
+		NumActiveConns: atomic.LoadInt64(&tenant.stats.NumActiveConns),
+	}
+}
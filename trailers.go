@@ -0,0 +1,133 @@
+// Forwarding of HTTP trailers, e.g. checksums of streaming servers or gRPC status, in both
+// directions, including responses that the proxy buffers and replays. Optionally, trailers get
+// stripped for clients that can't handle them.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// requestTrailerBody copies the trailer values of a client request to the request toward the
+// server when the body is at EOF. The request toward the server has a copy of the trailer map of
+// the client request from before the trailer values arrived after the body.
+type requestTrailerBody struct {
+	io.ReadCloser
+	trailer    http.Header // of client request; values get filled in by net/http at EOF of body
+	outTrailer http.Header // of request toward server; nil until set by the director
+}
+
+func (body *requestTrailerBody) Read(buf []byte) (int, error) {
+	numRead, err := body.ReadCloser.Read(buf)
+
+	if err == io.EOF && body.outTrailer != nil {
+		for key, values := range body.trailer {
+			if _, isAnnounced := body.outTrailer[key]; isAnnounced {
+				body.outTrailer[key] = values
+			}
+		}
+	}
+
+	return numRead, err
+}
+
+// PrepareRequestTrailers prepares the forwarding of the trailers of a client request, which have to
+// be announced by the client through a "Trailer" header. If trailers are to be stripped, the
+// request gets no trailers and servers don't get told that the client accepts trailers.
+func PrepareRequestTrailers(r *http.Request) {
+	if config.stripTrailers {
+		r.Trailer = nil
+		r.Header.Del("Te")
+
+		return
+	}
+
+	if len(r.Trailer) != 0 {
+		r.Body = &requestTrailerBody{ReadCloser: r.Body, trailer: r.Trailer}
+	}
+}
+
+// LinkRequestTrailers connects the trailer of a request toward a server with the trailer of the
+// client request; called by the director
+func LinkRequestTrailers(outReq *http.Request) {
+	if trailerBody, isTrailerBody := outReq.Body.(*requestTrailerBody); isTrailerBody {
+		trailerBody.outTrailer = outReq.Trailer
+	}
+}
+
+// trailerStrippingBody drops the trailers of a server response, which the transport fills in when
+// the body is at EOF or gets closed
+type trailerStrippingBody struct {
+	io.ReadCloser
+	resp *http.Response
+}
+
+func (body *trailerStrippingBody) Close() error {
+	err := body.ReadCloser.Close()
+
+	body.resp.Trailer = nil
+
+	return err
+}
+
+// StripResponseTrailers removes the trailers of a server response, so that neither an announcement
+// nor the trailer values get forwarded to the client
+func StripResponseTrailers(resp *http.Response) {
+	resp.Trailer = nil
+	resp.Body = &trailerStrippingBody{ReadCloser: resp.Body, resp: resp}
+}
+
+// ResponseTrailers returns the trailer values that a handler set in the header after the body:
+// the keys announced by the "Trailer" header and the keys with http.TrailerPrefix (without the
+// prefix). nil if the response has no trailers.
+func ResponseTrailers(header http.Header) http.Header {
+	var trailer http.Header
+
+	for _, announcement := range header.Values("Trailer") {
+		for _, key := range strings.Split(announcement, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+
+			if values, exists := header[key]; exists && key != "" {
+				if trailer == nil {
+					trailer = make(http.Header)
+				}
+
+				trailer[key] = values
+			}
+		}
+	}
+
+	for key, values := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			if trailer == nil {
+				trailer = make(http.Header)
+			}
+
+			trailer[http.CanonicalHeaderKey(strings.TrimPrefix(key, http.TrailerPrefix))] = values
+		}
+	}
+
+	return trailer
+}
+
+// SplitResponseTrailers removes the trailer values from the header of a buffered response and
+// returns them, so that they can be sent as trailers of the replayed response
+func SplitResponseTrailers(header http.Header) http.Header {
+	trailer := ResponseTrailers(header)
+
+	for key := range trailer {
+		delete(header, key)
+		delete(header, http.TrailerPrefix+key)
+	}
+
+	return trailer
+}
+
+// WriteResponseTrailers sets the trailer values of a replayed response after its body was written
+func WriteResponseTrailers(w http.ResponseWriter, trailer http.Header) {
+	for key, values := range trailer {
+		w.Header()[http.TrailerPrefix+key] = values
+	}
+}
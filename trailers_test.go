@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// trailerTestServer is a server that reports the request trailer in a response header and sends
+// an announced and an unannounced response trailer
+func trailerTestServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+
+		w.Header().Set("X-Request-Trailer", r.Trailer.Get("X-Request-Checksum"))
+		w.Header().Set("Trailer", "X-Response-Checksum")
+		w.Header().Set("Cache-Control", "max-age=60")
+
+		io.WriteString(w, "body")
+
+		w.Header().Set("X-Response-Checksum", "resp-sum")
+		w.Header().Set(http.TrailerPrefix+"X-Unannounced", "late")
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// sendTrailerRequest sends a chunked request with a trailer through the proxy and returns the
+// response with fully read body
+func sendTrailerRequest(t *testing.T, proxy *httptest.Server, method string) (*http.Response, string) {
+	var body io.Reader
+
+	if method != http.MethodGet {
+		body = io.MultiReader(strings.NewReader("request body")) // unknown length, so sent chunked
+	}
+
+	req, err := http.NewRequest(method, proxy.URL+"/obj", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body != nil {
+		req.Trailer = http.Header{"X-Request-Checksum": {"req-sum"}}
+	}
+
+	var transport = &http.Transport{}
+	defer transport.CloseIdleConnections()
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(respBody)
+}
+
+func TestTrailersForwarded(t *testing.T) {
+	proxy := startTestProxy(t, Config{}, trailerTestServer(t).URL)
+
+	resp, body := sendTrailerRequest(t, proxy, http.MethodPut)
+
+	if body != "body" {
+		t.Errorf("body = %q; want %q", body, "body")
+	}
+
+	if got := resp.Header.Get("X-Request-Trailer"); got != "req-sum" {
+		t.Errorf("request trailer at server = %q; want %q", got, "req-sum")
+	}
+
+	if got := resp.Trailer.Get("X-Response-Checksum"); got != "resp-sum" {
+		t.Errorf("announced response trailer = %q; want %q", got, "resp-sum")
+	}
+
+	if got := resp.Trailer.Get("X-Unannounced"); got != "late" {
+		t.Errorf("unannounced response trailer = %q; want %q", got, "late")
+	}
+}
+
+func TestTrailersStripped(t *testing.T) {
+	proxy := startTestProxy(t, Config{stripTrailers: true}, trailerTestServer(t).URL)
+
+	resp, body := sendTrailerRequest(t, proxy, http.MethodPut)
+
+	if body != "body" {
+		t.Errorf("body = %q; want %q", body, "body")
+	}
+
+	if got := resp.Header.Get("X-Request-Trailer"); got != "" {
+		t.Errorf("request trailer at server = %q; want none", got)
+	}
+
+	if len(resp.Trailer) != 0 {
+		t.Errorf("response trailers = %v; want none", resp.Trailer)
+	}
+
+	if got := resp.Header.Get("Trailer"); got != "" {
+		t.Errorf("response trailer announcement = %q; want none", got)
+	}
+}
+
+func TestTrailersOfCachedResponse(t *testing.T) {
+	proxy := startTestProxy(t, Config{cacheSize: 1 << 20}, trailerTestServer(t).URL)
+
+	for _, wantStatus := range []string{CacheStatusMiss, CacheStatusHit} {
+		resp, body := sendTrailerRequest(t, proxy, http.MethodGet)
+
+		if got := resp.Header.Get(CacheHeader); got != wantStatus {
+			t.Errorf("cache status = %q; want %q", got, wantStatus)
+		}
+
+		if body != "body" {
+			t.Errorf("%s: body = %q; want %q", wantStatus, body, "body")
+		}
+
+		if got := resp.Trailer.Get("X-Response-Checksum"); got != "resp-sum" {
+			t.Errorf("%s: announced response trailer = %q; want %q", wantStatus, got, "resp-sum")
+		}
+
+		if got := resp.Trailer.Get("X-Unannounced"); got != "late" {
+			t.Errorf("%s: unannounced response trailer = %q; want %q", wantStatus, got, "late")
+		}
+	}
+}
+
+func TestTrailersOfQuorumResponse(t *testing.T) {
+	proxy := startTestProxy(t, Config{quorumSize: 2}, trailerTestServer(t).URL,
+		trailerTestServer(t).URL)
+
+	resp, body := sendTrailerRequest(t, proxy, http.MethodGet)
+
+	if body != "body" {
+		t.Errorf("body = %q; want %q", body, "body")
+	}
+
+	if got := resp.Header.Get("X-Response-Checksum"); got != "" {
+		t.Errorf("trailer sent as header: %q", got)
+	}
+
+	if got := resp.Trailer.Get("X-Response-Checksum"); got != "resp-sum" {
+		t.Errorf("announced response trailer = %q; want %q", got, "resp-sum")
+	}
+
+	if got := resp.Trailer.Get("X-Unannounced"); got != "late" {
+		t.Errorf("unannounced response trailer = %q; want %q", got, "late")
+	}
+}
+
+func TestTrailersForHTTP10Client(t *testing.T) {
+	proxy := startTestProxy(t, Config{compatMode: true}, trailerTestServer(t).URL)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	io.WriteString(conn, "GET /obj HTTP/1.0\r\nHost: test\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	if string(body) != "body" {
+		t.Errorf("body = %q; want %q", body, "body")
+	}
+
+	if resp.ContentLength != int64(len("body")) {
+		t.Errorf("content length = %d; want %d", resp.ContentLength, len("body"))
+	}
+
+	// HTTP/1.0 has no trailers, so they get sent as headers of the buffered response
+	if got := resp.Header.Get("X-Response-Checksum"); got != "resp-sum" {
+		t.Errorf("announced response trailer as header = %q; want %q", got, "resp-sum")
+	}
+
+	if got := resp.Header.Get("X-Unannounced"); got != "late" {
+		t.Errorf("unannounced response trailer as header = %q; want %q", got, "late")
+	}
+
+	if got := resp.Header.Get("Trailer"); got != "" {
+		t.Errorf("response trailer announcement = %q; want none", got)
+	}
+}
+
+func TestResponseTrailers(t *testing.T) {
+	header := http.Header{
+		"Trailer":                     {"x-sum, X-Other"},
+		"X-Sum":                       {"1"},
+		"Content-Type":                {"text/plain"},
+		http.TrailerPrefix + "X-Late": {"2"},
+	}
+
+	trailer := SplitResponseTrailers(header)
+
+	if len(trailer) != 2 || trailer.Get("X-Sum") != "1" || trailer.Get("X-Late") != "2" {
+		t.Errorf("trailer = %v; want X-Sum and X-Late", trailer)
+	}
+
+	if len(header) != 2 || header.Get("Content-Type") == "" || header.Get("Trailer") == "" {
+		t.Errorf("header = %v; want Trailer and Content-Type", header)
+	}
+
+	if trailer := ResponseTrailers(http.Header{"Content-Type": {"text/plain"}}); trailer != nil {
+		t.Errorf("trailer of response without trailers = %v; want nil", trailer)
+	}
+}
@@ -0,0 +1,111 @@
+// Tuning of the proxy process for dedicated hosts: GOMAXPROCS, CPU pinning and the number of accept
+// loops for client connections
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseCPUList parses a list of CPUs in the format of taskset and sysfs, e.g. "0-3,8,10-11".
+// "nodeN" (e.g. "node1") is the list of CPUs of the given NUMA node.
+func ParseCPUList(cpuList string) ([]int, error) {
+	if strings.HasPrefix(cpuList, "node") {
+		if _, err := strconv.ParseUint(strings.TrimPrefix(cpuList, "node"), 10, 16); err != nil {
+			return nil, fmt.Errorf("Invalid NUMA node: \"%s\"", cpuList)
+		}
+
+		nodeCPUList, err := os.ReadFile("/sys/devices/system/node/" + cpuList + "/cpulist")
+		if err != nil {
+			return nil, err
+		}
+
+		cpuList = strings.TrimSpace(string(nodeCPUList))
+	}
+
+	var cpus []int
+
+	for _, cpuRange := range strings.Split(cpuList, ",") {
+		firstStr, lastStr, isRange := strings.Cut(cpuRange, "-")
+		if !isRange {
+			lastStr = firstStr
+		}
+
+		first, firstErr := strconv.ParseUint(firstStr, 10, 16)
+		last, lastErr := strconv.ParseUint(lastStr, 10, 16)
+
+		if firstErr != nil || lastErr != nil || first > last {
+			return nil, fmt.Errorf("Invalid CPU range: \"%s\"", cpuRange)
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, int(cpu))
+		}
+	}
+
+	sort.Ints(cpus)
+
+	return cpus, nil
+}
+
+// ApplyProcessTuning pins the process to config.cpus and sets GOMAXPROCS. Without explicit
+// config.gomaxprocs, GOMAXPROCS is the number of pinned CPUs, because the Go runtime derives the
+// default from the CPUs that were available at process start.
+func ApplyProcessTuning() {
+	if len(config.cpus) != 0 {
+		if err := SetCPUAffinity(config.cpus); err != nil {
+			fmt.Println("ERROR: Pinning to CPUs failed:", err)
+			os.Exit(1)
+		}
+
+		if config.gomaxprocs == 0 {
+			runtime.GOMAXPROCS(len(config.cpus))
+		}
+	}
+
+	if config.gomaxprocs != 0 {
+		runtime.GOMAXPROCS(config.gomaxprocs)
+	}
+
+	if config.beVerbose {
+		fmt.Printf("GOMAXPROCS: %d; Pinned CPUs: %v\n", runtime.GOMAXPROCS(0), config.cpus)
+	}
+}
+
+// ListenClientPort opens config.numAcceptLoops listeners for client connections. Multiple listeners
+// share the port through SO_REUSEPORT, so that the kernel distributes new connections among their
+// accept loops.
+func ListenClientPort() ([]net.Listener, error) {
+	var addr = ":" + strconv.Itoa(config.listenPort)
+
+	if config.numAcceptLoops == 1 {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return []net.Listener{listener}, nil
+	}
+
+	listenConfig := net.ListenConfig{Control: reusePortControl}
+
+	var listeners []net.Listener
+
+	for i := 0; i < config.numAcceptLoops; i++ {
+		listener, err := listenConfig.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// soReusePort is the value of SO_REUSEPORT on Linux, which is missing in package syscall
+func soReusePort() int {
+	if strings.HasPrefix(runtime.GOARCH, "mips") {
+		return 0x200
+	}
+
+	return 0xf
+}
+
+// SetCPUAffinity pins all threads of the process to the given CPUs. New threads of the Go runtime
+// inherit the affinity of the thread that creates them.
+func SetCPUAffinity(cpus []int) error {
+	// the kernel cpu_set_t consists of words of native size
+	const bitsPerWord = 8 * int(unsafe.Sizeof(uintptr(0)))
+
+	var mask = make([]uintptr, cpus[len(cpus)-1]/bitsPerWord+1) // cpus are sorted
+
+	for _, cpu := range cpus {
+		mask[cpu/bitsPerWord] |= 1 << uint(cpu%bitsPerWord)
+	}
+
+	threadEntries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+
+	for _, threadEntry := range threadEntries {
+		threadID, err := strconv.Atoi(threadEntry.Name())
+		if err != nil {
+			continue
+		}
+
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(threadID),
+			uintptr(len(mask)*bitsPerWord/8), uintptr(unsafe.Pointer(&mask[0])))
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
+
+// reusePortControl is a net.ListenConfig hook that sets SO_REUSEPORT on a listening socket
+func reusePortControl(network string, address string, rawConn syscall.RawConn) error {
+	var sockErr error
+
+	err := rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort(), 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func SetCPUAffinity(cpus []int) error {
+	return errors.New("CPU pinning is only supported on Linux")
+}
+
+func reusePortControl(network string, address string, rawConn syscall.RawConn) error {
+	return errors.New("Multiple accept loops are only supported on Linux")
+}
@@ -0,0 +1,256 @@
+// Connection handling toward the HTTP servers
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const PrewarmTimeout = 10 * time.Second
+
+// PrewarmBarrierTimeout is the max time that pre-warming and probe requests hold their connection
+// to wait for the connections of the other requests, leaving time to complete within PrewarmTimeout
+const PrewarmBarrierTimeout = PrewarmTimeout / 2
+
+const DialTimeout = 30 * time.Second
+
+// NewTransport returns the transport for requests toward the given backend, based on the settings
+// of http.DefaultTransport. Each backend gets its own transport, so that connection pools and
+// settings of backends are independent of each other.
+func NewTransport(backend *Backend) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{
+		Timeout:   DialTimeout,
+		KeepAlive: config.tcpKeepAlive,
+	}
+
+	transport.ResponseHeaderTimeout = config.headerTimeout
+	transport.DisableKeepAlives = !config.upstreamKeepAlive
+
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if backend.dialAddr != "" {
+			addr = backend.dialAddr
+		}
+
+		conn, err := dialer.DialContext(ctx, network, addr)
+
+		if config.connTrace && err == nil {
+			tracedConn := NewTracedConn(conn, "Server: "+backend.serverStr+"; Remote: "+conn.RemoteAddr().String())
+
+			fmt.Printf("[CONN #%d] Dial. %s; Local: %s\n", tracedConn.connID, tracedConn.description, conn.LocalAddr())
+
+			return tracedConn, nil
+		}
+
+		return conn, err
+	}
+
+	// keep as many idle connections as can be used concurrently, so that connections don't need
+	// to be closed and re-established between bursts of requests. (defaults to 2 otherwise.)
+	var maxIdleConns = config.numConnsPerServer
+
+	if config.numPrewarmConns > maxIdleConns {
+		maxIdleConns = config.numPrewarmConns
+	}
+
+	if maxIdleConns > transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConnsPerHost = maxIdleConns
+	}
+
+	if transport.MaxIdleConnsPerHost > transport.MaxIdleConns {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+
+	return transport
+}
+
+// hopByHopHeaders are the headers that only apply to a single connection and thus must not be
+// forwarded (RFC 7230, section 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// StripHopByHopHeaders removes the standard hop-by-hop headers and the headers that are named in
+// the "Connection" header, so that e.g. "Connection: close" of a client doesn't affect the reuse of
+// connections toward servers and vice versa. Protocol upgrades are handled by httputil.ReverseProxy
+// based on these headers, so they must not be stripped for upgrade requests/responses.
+func StripHopByHopHeaders(header http.Header) {
+	for _, connectionValue := range header.Values("Connection") {
+		for _, headerName := range strings.Split(connectionValue, ",") {
+			if headerName = strings.TrimSpace(headerName); headerName != "" {
+				header.Del(headerName)
+			}
+		}
+	}
+
+	for _, headerName := range hopByHopHeaders {
+		header.Del(headerName)
+	}
+}
+
+// isUpgrade returns true if the header requests/confirms a protocol upgrade (e.g. WebSocket)
+func isUpgrade(header http.Header) bool {
+	for _, connectionValue := range header.Values("Connection") {
+		for _, token := range strings.Split(connectionValue, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// PrewarmConnections establishes config.numPrewarmConns idle connections (including TLS handshake)
+// to each server, so that the first requests of clients don't have to wait for connection setup.
+func PrewarmConnections() {
+	var waitGroup sync.WaitGroup
+
+	for _, backend := range proxyState.backends {
+		waitGroup.Add(1)
+
+		go func(backend *Backend) {
+			defer waitGroup.Done()
+
+			numConns, _ := ProbeServerConnections(backend, config.numPrewarmConns)
+
+			if numConns < config.numPrewarmConns {
+				fmt.Printf("WARNING: Pre-warming connections incomplete. Server: %s; Established: %d; Requested: %d\n", backend.serverStr, numConns, config.numPrewarmConns)
+			} else if config.beVerbose {
+				fmt.Printf("Pre-warmed connections. Server: %s; Established: %d\n", backend.serverStr, numConns)
+			}
+		}(backend)
+	}
+
+	waitGroup.Wait()
+}
+
+// ProbeIdleConnections periodically sends HEAD requests to all servers over idle connections.
+// Dead idle connections get discarded and replaced by the transport. If a server is not reachable
+// at all, its idle connections get closed, so that no client request is sent over a stale one.
+func ProbeIdleConnections() {
+	var numConns = config.numPrewarmConns
+	if numConns < 1 {
+		numConns = 1
+	}
+
+	for range time.Tick(config.probeInterval) {
+		for _, backend := range proxyState.backends {
+			numSuccessful, numReused := ProbeServerConnections(backend, numConns)
+
+			if config.beVerbose {
+				fmt.Printf("Probed idle connections. Server: %s; Successful: %d/%d; Reused: %d\n", backend.serverStr, numSuccessful, numConns, numReused)
+			}
+
+			if numSuccessful == 0 {
+				fmt.Printf("Probing idle connections failed, closing idle connections. Server: %s\n", backend.serverStr)
+				backend.transport.CloseIdleConnections()
+			}
+		}
+	}
+}
+
+// ProbeServerConnections sends numConns concurrent HEAD requests to the given server and returns
+// the number of successful requests and the number of requests that were sent over an idle
+// connection. Each request holds its connection until all requests have got a connection or failed
+// (at most for PrewarmBarrierTimeout), so that the transport can't reuse a connection of another
+// request and has to use separate connections.
+// The requests don't take slots of the connection limit of the server (see "--maxconns"), because
+// they must be able to replace dead idle connections while client requests use all slots. At most
+// "--prewarm" connections get added to the connections of client requests.
+func ProbeServerConnections(backend *Backend, numConns int) (int, int) {
+	var numArrived int32 // requests that got a connection or failed
+	var numReused int32
+	var numSuccessful int32
+	var allArrived = make(chan struct{})
+	var waitGroup sync.WaitGroup
+
+	ctx, cancel := context.WithTimeout(context.Background(), PrewarmTimeout)
+	defer cancel()
+
+	barrierCtx, cancelBarrier := context.WithTimeout(ctx, PrewarmBarrierTimeout)
+	defer cancelBarrier()
+
+	arrive := func() {
+		if atomic.AddInt32(&numArrived, 1) == int32(numConns) {
+			close(allArrived)
+		}
+	}
+
+	for i := 0; i < numConns; i++ {
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+
+			var hasArrived bool // the transport may retry on another connection
+
+			trace := &httptrace.ClientTrace{
+				GotConn: func(connInfo httptrace.GotConnInfo) {
+					if hasArrived {
+						return
+					}
+
+					hasArrived = true
+
+					if connInfo.WasIdle {
+						atomic.AddInt32(&numReused, 1)
+					}
+
+					arrive()
+
+					// the barrier has its own timeout, so that a hanging request doesn't let all
+					// other requests run into the request timeout
+					select {
+					case <-allArrived:
+					case <-barrierCtx.Done():
+					}
+				},
+			}
+
+			req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodHead, backend.targetURL.String(), nil)
+			if err != nil {
+				arrive()
+				return
+			}
+
+			resp, err := backend.transport.RoundTrip(req)
+			if err != nil {
+				if !hasArrived {
+					arrive() // failed before getting a connection, e.g. on dial
+				}
+
+				if config.beVerbose {
+					fmt.Printf("Connection probe failed. Server: %s; Error: %v\n", backend.serverStr, err)
+				}
+
+				return
+			}
+
+			resp.Body.Close() // returns the connection to the idle pool
+
+			atomic.AddInt32(&numSuccessful, 1)
+		}()
+	}
+
+	waitGroup.Wait()
+
+	return int(numSuccessful), int(numReused)
+}
@@ -0,0 +1,80 @@
+// Joining of server URLs and request URLs for proxied requests and redirects, so that the path
+// toward the server keeps the escaping of the client (e.g. encoded slashes of object keys) and gets
+// exactly one slash between the path of the server URL and the request path
+
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// JoinURLPath joins two URL paths with exactly one slash in between. An empty path b is treated as
+// the root path "/". Both the unescaped path and the escaped form get returned; rawPath is empty if
+// the default encoding of path is sufficient, matching url.URL.RawPath.
+func JoinURLPath(a, b *url.URL) (path, rawPath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return joinPathSlash(a.Path, b.Path), ""
+	}
+
+	// the slashes at the join point have to be determined from the escaped paths, because an
+	// encoded slash at the end of a is not a separator
+	rawPath = joinPathSlash(a.EscapedPath(), b.EscapedPath())
+
+	path, err := url.PathUnescape(rawPath)
+	if err != nil { // can't happen for escaped paths from url.URL
+		return joinPathSlash(a.Path, b.Path), ""
+	}
+
+	if rawPath == (&url.URL{Path: path}).EscapedPath() {
+		return path, ""
+	}
+
+	return path, rawPath
+}
+
+// joinPathSlash joins two paths with exactly one slash in between, but keeps multiple slashes
+// within the paths, because they can be part of object keys
+func joinPathSlash(a, b string) string {
+	aHasSlash := strings.HasSuffix(a, "/")
+	bHasSlash := strings.HasPrefix(b, "/")
+
+	switch {
+	case aHasSlash && bHasSlash:
+		return a + b[1:]
+	case aHasSlash || bHasSlash:
+		return a + b
+	}
+
+	return a + "/" + b
+}
+
+// JoinURL returns the URL of a request toward the server with the given URL: scheme and host of
+// the server URL, the path of the server URL joined with the path prefix and the request path, and
+// the query of the server URL (e.g. a static token) followed by the query of the request. Scheme,
+// host and user info of an absolute request URL get ignored.
+func JoinURL(targetURL *url.URL, pathPrefix string, reqURL *url.URL) *url.URL {
+	var prefixedURL = url.URL{Path: reqURL.Path, RawPath: reqURL.RawPath}
+
+	if pathPrefix != "" {
+		AddPathPrefix(&prefixedURL, pathPrefix)
+	}
+
+	var joinedURL = url.URL{
+		Scheme:     targetURL.Scheme,
+		Host:       targetURL.Host,
+		RawQuery:   reqURL.RawQuery,
+		ForceQuery: reqURL.ForceQuery,
+	}
+
+	joinedURL.Path, joinedURL.RawPath = JoinURLPath(targetURL, &prefixedURL)
+
+	switch {
+	case targetURL.RawQuery != "" && reqURL.RawQuery != "":
+		joinedURL.RawQuery = targetURL.RawQuery + "&" + reqURL.RawQuery
+	case targetURL.RawQuery != "":
+		joinedURL.RawQuery = targetURL.RawQuery
+	}
+
+	return &joinedURL
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestJoinURL(t *testing.T) {
+	tests := []struct {
+		target     string
+		pathPrefix string
+		request    string // request URI as sent by a client
+		want       string
+	}{
+		{"http://s3.local", "", "/bucket/obj", "http://s3.local/bucket/obj"},
+		{"http://s3.local/", "", "/bucket/obj", "http://s3.local/bucket/obj"},
+		{"http://s3.local/base", "", "/obj", "http://s3.local/base/obj"},
+		{"http://s3.local/base/", "", "/obj", "http://s3.local/base/obj"},
+		{"http://s3.local/base", "", "/", "http://s3.local/base/"},
+		{"http://s3.local/base", "/tenant", "/obj", "http://s3.local/base/tenant/obj"},
+		{"http://s3.local", "/tenant", "/", "http://s3.local/tenant/"},
+		{"http://s3.local", "", "/dir//obj", "http://s3.local/dir//obj"}, // part of object key
+		{"http://s3.local", "", "//obj", "http://s3.local//obj"},         // part of object key
+		{"http://s3.local", "", "/a%2Fb", "http://s3.local/a%2Fb"},       // encoded slash
+		{"http://s3.local/base", "/p", "/a%2Fb/c", "http://s3.local/base/p/a%2Fb/c"},
+		{"http://s3.local/a%2Fb", "", "/c", "http://s3.local/a%2Fb/c"},
+		{"http://s3.local/a%2Fb", "", "/c%2Fd", "http://s3.local/a%2Fb/c%2Fd"},
+		{"http://s3.local", "/sp ace", "/x%20y", "http://s3.local/sp%20ace/x%20y"},
+		{"http://s3.local", "", "/obj?uploads", "http://s3.local/obj?uploads"},
+		{"http://s3.local", "", "/obj?", "http://s3.local/obj?"},
+		{"http://s3.local", "", "?list-type=2", "http://s3.local/?list-type=2"}, // query-only
+		{"http://s3.local/base", "", "?list-type=2", "http://s3.local/base/?list-type=2"},
+		{"http://s3.local/?token=1", "", "/obj", "http://s3.local/obj?token=1"},
+		{"http://s3.local/?token=1", "", "/obj?a=b", "http://s3.local/obj?token=1&a=b"},
+		{"http://s3.local", "", "http://other:81/obj?a=b", "http://s3.local/obj?a=b"}, // absolute form
+		{"http://s3.local", "", "http://user:pw@other/obj", "http://s3.local/obj"},
+		{"http://s3.local", "", "http://other", "http://s3.local/"},
+		{"https://[fe80::1%25eth0]:9000/b", "", "/o", "https://[fe80::1%25eth0]:9000/b/o"},
+	}
+
+	for _, test := range tests {
+		targetURL, err := url.Parse(test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reqURL, err := url.ParseRequestURI(test.request)
+		if strings.HasPrefix(test.request, "?") { // query-only, e.g. from a HTTP/2 ":path"
+			reqURL, err = url.Parse(test.request)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := JoinURL(targetURL, test.pathPrefix, reqURL).String(); got != test.want {
+			t.Errorf("JoinURL(%q, %q, %q) = %q; want %q", test.target, test.pathPrefix, test.request,
+				got, test.want)
+		}
+	}
+}
+
+func TestJoinURLPath(t *testing.T) {
+	tests := []struct {
+		a, b              string // escaped paths
+		wantPath, wantRaw string
+	}{
+		{"", "", "/", ""},
+		{"", "/", "/", ""},
+		{"/", "", "/", ""},
+		{"/", "/", "/", ""},
+		{"/a", "", "/a/", ""},
+		{"/a", "b", "/a/b", ""},
+		{"/a/", "/b", "/a/b", ""},
+		{"/a//", "//b", "/a///b", ""},
+		{"/a%2F", "/b", "/a//b", "/a%2F/b"},
+		{"/a", "/b%2Fc", "/a/b/c", "/a/b%2Fc"},
+		{"/%41", "/b", "/A/b", "/%41/b"}, // escaping of client kept
+		{"/a", "/b c", "/a/b c", ""},
+	}
+
+	for _, test := range tests {
+		a := parseTestPath(t, test.a)
+		b := parseTestPath(t, test.b)
+
+		path, rawPath := JoinURLPath(a, b)
+
+		if path != test.wantPath || rawPath != test.wantRaw {
+			t.Errorf("JoinURLPath(%q, %q) = %q, %q; want %q, %q", test.a, test.b, path, rawPath,
+				test.wantPath, test.wantRaw)
+		}
+	}
+}
+
+func TestAddPathPrefix(t *testing.T) {
+	tests := []struct {
+		path string // escaped
+		want string
+	}{
+		{"/obj", "/p/obj"},
+		{"/", "/p/"},
+		{"", "/p/"},
+		{"/a%2Fb", "/p/a%2Fb"},
+	}
+
+	for _, test := range tests {
+		reqURL := parseTestPath(t, test.path)
+
+		AddPathPrefix(reqURL, "/p")
+
+		if got := reqURL.EscapedPath(); got != test.want {
+			t.Errorf("AddPathPrefix(%q) = %q; want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestRedirectLocation(t *testing.T) {
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+
+	config = Config{redirectCode: http.StatusTemporaryRedirect}
+
+	backend, err := NewBackend("http://s3.local:9000/base/?token=1,prefix=/tenant/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://proxy.local/a%2Fb?versionId=3", nil)
+
+	RedirectRequest(recorder, req, backend, 1)
+
+	want := "http://s3.local:9000/base/tenant/a%2Fb?token=1&versionId=3"
+
+	if got := recorder.Header().Get("Location"); got != want {
+		t.Errorf("Location = %q; want %q", got, want)
+	}
+
+	if recorder.Code != http.StatusTemporaryRedirect {
+		t.Errorf("status = %d; want %d", recorder.Code, http.StatusTemporaryRedirect)
+	}
+}
+
+// parseTestPath returns a URL with the given escaped path, like the URL of a received request
+func parseTestPath(t *testing.T, escapedPath string) *url.URL {
+	t.Helper()
+
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsedURL = &url.URL{Path: path}
+
+	if parsedURL.EscapedPath() != escapedPath {
+		parsedURL.RawPath = escapedPath
+	}
+
+	return parsedURL
+}
+
+// FuzzJoinURL checks that the joined URL is consistent for arbitrary server URL paths, path prefixes
+// and request URIs: the escaped path is a valid encoding of the path, the server URL path comes
+// first with exactly one added slash, the request path comes last, and the URL survives a
+// round trip through its string form, e.g. as "Location" of a redirect
+func FuzzJoinURL(f *testing.F) {
+	f.Add("/base", "/tenant", "/a%2Fb?x=1")
+	f.Add("", "", "?x=1")
+	f.Add("/", "", "//obj")
+	f.Add("/a%2F", "/sp ace", "/%41%zz")
+	f.Add("/base/", "", "http://other/obj#frag")
+	f.Add("/b?q=1", "", "/a*b")
+	f.Add("/%2F", "/0", "/a*b")
+
+	f.Fuzz(func(t *testing.T, targetPath, pathPrefix, request string) {
+		targetURL, err := url.Parse("http://s3.local" + targetPath)
+		if err != nil || targetURL.Host != "s3.local" || targetURL.Fragment != "" {
+			return
+		}
+
+		reqURL, err := url.ParseRequestURI(request)
+		if err != nil {
+			if reqURL, err = url.Parse(request); err != nil || !strings.HasPrefix(request, "?") {
+				return
+			}
+		}
+
+		if reqURL.Path == "*" { // asterisk form of "OPTIONS" request has no path to join
+			return
+		}
+
+		if !strings.HasPrefix(pathPrefix, "/") {
+			pathPrefix = ""
+		}
+
+		pathPrefix = strings.TrimRight(pathPrefix, "/") // like the server option
+
+		joinedURL := JoinURL(targetURL, pathPrefix, reqURL)
+
+		reparsedPath, err := url.PathUnescape(joinedURL.EscapedPath())
+		if err != nil || reparsedPath != joinedURL.Path {
+			t.Fatalf("escaped path %q doesn't match path %q", joinedURL.EscapedPath(), joinedURL.Path)
+		}
+
+		if !strings.HasPrefix(joinedURL.Path, "/") {
+			t.Fatalf("path %q is not absolute", joinedURL.Path)
+		}
+
+		// compared in escaped form, because encoded slashes of the parts are no separators
+		escapedPrefix := strings.TrimSuffix(targetURL.EscapedPath(), "/") +
+			(&url.URL{Path: pathPrefix}).EscapedPath() + "/"
+		if !strings.HasPrefix(joinedURL.EscapedPath(), escapedPrefix) {
+			t.Fatalf("path %q doesn't start with %q", joinedURL.EscapedPath(), escapedPrefix)
+		}
+
+		if !strings.HasSuffix(joinedURL.EscapedPath(), strings.TrimPrefix(reqURL.EscapedPath(), "/")) {
+			t.Fatalf("path %q doesn't end with request path %q", joinedURL.EscapedPath(),
+				reqURL.EscapedPath())
+		}
+
+		reparsedURL, err := url.Parse(joinedURL.String())
+		if err != nil {
+			t.Fatalf("joined URL %q doesn't parse: %v", joinedURL.String(), err)
+		}
+
+		if reparsedURL.Host != targetURL.Host || reparsedURL.Path != joinedURL.Path ||
+			reparsedURL.RawQuery != joinedURL.RawQuery {
+			t.Fatalf("joined URL %q changed in round trip: %q", joinedURL.String(), reparsedURL.String())
+		}
+
+		if reqURL.RawQuery != "" && !strings.HasSuffix(joinedURL.RawQuery, reqURL.RawQuery) {
+			t.Fatalf("query %q doesn't end with request query %q", joinedURL.RawQuery, reqURL.RawQuery)
+		}
+	})
+}
@@ -0,0 +1,230 @@
+// Weighted selection of servers through the balancing strategy of "--balancer"
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultWeight is the weight of servers without "weight" option
+const DefaultWeight = 1
+
+// MaxScheduleLen is the max number of slots of the weighted schedule. Weights get scaled down
+// proportionally if their sum is larger.
+const MaxScheduleLen = 1000
+
+var scheduleState = struct {
+	numUpdates    uint64       // atomic; first for alignment on 32-bit archs; number of balancer updates
+	numSelections uint64       // atomic; selections of the balancer of all servers
+	numAvailable  int32        // atomic; number of servers of the balancer of all servers
+	mutex         sync.Mutex   // serializes weight updates
+	balancer      atomic.Value // BalancerStrategy of all servers
+	poolBalancers atomic.Value // map[string]BalancerStrategy of balancers by pool name
+	quorumIdxs    atomic.Value // map[string][]uint32 of servers with weight by pool name
+}{}
+
+// NoServersMessage is the response message for requests while no server is available
+const NoServersMessage = "No servers available"
+
+// SelectBackend returns the balancer of all servers and the index of the server that it picked for
+// the request. Returns false if no server is available, because all servers were removed from their
+// SRV records.
+func SelectBackend(r *http.Request) (BalancerStrategy, uint32, bool) {
+	balancer := scheduleState.balancer.Load().(BalancerStrategy)
+
+	atomic.AddUint64(&scheduleState.numSelections, 1)
+
+	backendIdx, isAvailable := balancer.Pick(r)
+
+	return balancer, backendIdx, isAvailable
+}
+
+// SelectPoolBackend returns the balancer of the given pool and the index of the server that it
+// picked for the request. Returns false if the pool has no servers.
+func SelectPoolBackend(poolName string, r *http.Request) (BalancerStrategy, uint32, bool) {
+	balancer, exists := scheduleState.poolBalancers.Load().(map[string]BalancerStrategy)[poolName]
+	if !exists {
+		return nil, 0, false
+	}
+
+	backendIdx, isAvailable := balancer.Pick(r)
+
+	return balancer, backendIdx, isAvailable
+}
+
+// SelectQuorumBackends returns up to config.quorumSize servers for a quorum read, starting with the
+// given server and followed by the next servers of its pool. Servers that are ejected or have
+// weight 0 don't get selected, so the quorum can be smaller than configured.
+func SelectQuorumBackends(firstIdx uint32) []uint32 {
+	var poolName = proxyState.backends[firstIdx].pool
+	var quorumIdxs = scheduleState.quorumIdxs.Load().(map[string][]uint32)[poolName]
+	var selectedIdxs = []uint32{firstIdx}
+
+	// start after the given server, so that the other servers of the quorum rotate with it
+	var startPos = 0
+
+	for pos, backendIdx := range quorumIdxs {
+		if backendIdx >= firstIdx {
+			startPos = pos
+			break
+		}
+	}
+
+	for i := 0; i < len(quorumIdxs) && len(selectedIdxs) < config.quorumSize; i++ {
+		if backendIdx := quorumIdxs[(startPos+i)%len(quorumIdxs)]; backendIdx != firstIdx {
+			selectedIdxs = append(selectedIdxs, backendIdx)
+		}
+	}
+
+	return selectedIdxs
+}
+
+// ScheduleStats are the stats of the balancer of all servers
+type ScheduleStats struct {
+	Balancer   string `json:"balancer"`
+	Servers    int    `json:"servers"`    // servers available for selection
+	Selections uint64 `json:"selections"` // since startup
+	Updates    uint64 `json:"updates"`    // due to weight changes, ejections etc.
+}
+
+func GetScheduleStats() ScheduleStats {
+	return ScheduleStats{
+		Balancer:   config.balancerName,
+		Servers:    int(atomic.LoadInt32(&scheduleState.numAvailable)),
+		Selections: atomic.LoadUint64(&scheduleState.numSelections),
+		Updates:    atomic.LoadUint64(&scheduleState.numUpdates),
+	}
+}
+
+// SetBackendWeights updates the weights of the given servers and updates the balancers. A weight of
+// 0 removes the server from selection.
+func SetBackendWeights(weights map[*Backend]uint32) {
+	scheduleState.mutex.Lock()
+	defer scheduleState.mutex.Unlock()
+
+	for backend, weight := range weights {
+		atomic.StoreUint32(&backend.weight, weight)
+	}
+
+	var allBackendIdxs = make([]uint32, len(proxyState.backends))
+
+	for i := range allBackendIdxs {
+		allBackendIdxs[i] = uint32(i)
+	}
+
+	// balancers keep their instance across updates, so that e.g. the round-robin position continues
+	balancer, isInitialized := scheduleState.balancer.Load().(BalancerStrategy)
+	if !isInitialized {
+		balancer = NewBalancerStrategy(config.balancerName)
+	}
+
+	prevPoolBalancers, _ := scheduleState.poolBalancers.Load().(map[string]BalancerStrategy)
+
+	var servers = balancerServers(allBackendIdxs, "")
+	var poolBalancers = make(map[string]BalancerStrategy)
+	var poolQuorumIdxs = make(map[string][]uint32)
+
+	balancer.Update(servers)
+
+	if HasPools() {
+		for poolName, backendIdxs := range PoolBackends() {
+			poolBalancer, exists := prevPoolBalancers[poolName]
+			if !exists {
+				poolBalancer = NewBalancerStrategy(config.balancerName)
+			}
+
+			poolServers := balancerServers(backendIdxs, poolName)
+
+			poolBalancer.Update(poolServers)
+
+			poolBalancers[poolName] = poolBalancer
+			poolQuorumIdxs[poolName] = quorumBackendIdxs(poolServers)
+		}
+	} else {
+		poolBalancers[DefaultPoolName] = balancer // all servers are in the default pool
+		poolQuorumIdxs[DefaultPoolName] = quorumBackendIdxs(servers)
+	}
+
+	var prevNumAvailable = atomic.LoadInt32(&scheduleState.numAvailable)
+
+	if len(servers) == 0 && (!isInitialized || prevNumAvailable != 0) {
+		fmt.Printf("WARNING: No servers available. Requests get rejected with status %d until servers return.\n", http.StatusServiceUnavailable)
+	} else if len(servers) != 0 && isInitialized && prevNumAvailable == 0 {
+		fmt.Println("Servers available again.")
+	}
+
+	atomic.StoreInt32(&scheduleState.numAvailable, int32(len(servers)))
+
+	scheduleState.quorumIdxs.Store(poolQuorumIdxs)
+
+	scheduleState.balancer.Store(balancer)
+	scheduleState.poolBalancers.Store(poolBalancers)
+
+	atomic.AddUint64(&scheduleState.numUpdates, 1)
+
+	if config.serverHints != "" {
+		UpdateServerHints(servers)
+	}
+}
+
+// quorumBackendIdxs returns the indices of the given servers that have an effective weight
+func quorumBackendIdxs(servers []BalancerServer) []uint32 {
+	var backendIdxs []uint32
+
+	for _, server := range servers {
+		if server.Weight != 0 {
+			backendIdxs = append(backendIdxs, server.BackendIdx)
+		}
+	}
+
+	return backendIdxs
+}
+
+// UpdateSchedule updates the balancers with the current server weights
+func UpdateSchedule() {
+	SetBackendWeights(nil)
+}
+
+// balancerServers returns the given servers with their effective weights for a balancer. poolName
+// is only for log messages; empty for all servers. Ejected servers have weight 0. Servers that were
+// removed from their SRV record are not in the result, so the result is empty if all servers were
+// removed. Weights are scaled if servers have a reduced share. If all other servers have weight 0,
+// they get equal weights.
+func balancerServers(backendIdxs []uint32, poolName string) []BalancerServer {
+	var servers []BalancerServer
+
+	for _, backendIdx := range backendIdxs {
+		backend := proxyState.backends[backendIdx]
+
+		if backend.IsRemoved() {
+			continue
+		}
+
+		var server = BalancerServer{BackendIdx: backendIdx}
+
+		if !backend.IsEjected() {
+			server.Weight = backend.Weight()
+		}
+
+		servers = append(servers, server)
+	}
+
+	totalWeight := ApplyShareShaping(servers)
+
+	if len(servers) != 0 && totalWeight == 0 {
+		if poolName != "" {
+			fmt.Printf("WARNING: All servers of pool %s have weight 0. Falling back to equal weights.\n", poolName)
+		} else {
+			fmt.Println("WARNING: All servers have weight 0. Falling back to equal weights.")
+		}
+
+		for i := range servers {
+			servers[i].Weight = 1
+		}
+	}
+
+	return servers
+}